@@ -0,0 +1,292 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Reasons an attendance event can look spoofed
+const (
+	anomalyMockLocation       = "mock_location"
+	anomalyInvalidPosition    = "invalid_position"
+	anomalyImpossibleTravel   = "impossible_travel"
+	anomalyRepeatedPosition   = "repeated_position"
+	anomalyLowAccuracy        = "low_accuracy"
+	anomalyFarFromHomeAndWork = "far_from_home_and_work"
+
+	// Review outcomes
+	anomalyGenuine = "genuine"
+	anomalySpoofed = "spoofed"
+
+	// Repeated coordinates only count when given to at least this many
+	// decimal places; a real GPS fix never lands on the same spot twice
+	repeatedPositionDecimals = 5
+	// How far back to look for repeated coordinates
+	repeatedPositionWindow = 30 * 24 * time.Hour
+	// Travel is only checked against an earlier event within this window
+	travelWindow = 24 * time.Hour
+)
+
+// anomalyWeights is how much each reason adds to an event's score. The
+// score is capped at 100.
+var anomalyWeights = map[string]int{
+	anomalyMockLocation:       60,
+	anomalyInvalidPosition:    60,
+	anomalyImpossibleTravel:   50,
+	anomalyRepeatedPosition:   40,
+	anomalyFarFromHomeAndWork: 30,
+	anomalyLowAccuracy:        20,
+}
+
+// anomalyRules are the thresholds for the anomaly signals
+type anomalyRules struct {
+	ReviewScore  int
+	MaxSpeedKmh  int
+	MaxAccuracyM int
+	RepeatCount  int
+	FarKm        int
+}
+
+func loadAnomalyRules() anomalyRules {
+	return anomalyRules{
+		ReviewScore:  envInt("ANOMALY_REVIEW_SCORE", 50),
+		MaxSpeedKmh:  envInt("ANOMALY_MAX_SPEED_KMH", 200),
+		MaxAccuracyM: envInt("ANOMALY_MAX_ACCURACY_M", 150),
+		RepeatCount:  envInt("ANOMALY_REPEAT_COUNT", 2),
+		FarKm:        envInt("ANOMALY_FAR_KM", 25),
+	}
+}
+
+// scoreAnomalies looks for signs that an event's position was faked: a mock
+// location provider, impossible coordinates, travel faster than
+// ANOMALY_MAX_SPEED_KMH since the previous event, the exact same
+// coordinates as earlier events, a poor accuracy radius, and a position far
+// from both home and work. It runs inside the event's transaction so the
+// trainee's earlier events are settled.
+func scoreAnomalies(tx *sql.Tx, in attendanceInput, fence geofenceResult) (int, []models.AnomalyReason, error) {
+	reasons := []models.AnomalyReason{}
+	if in.Source == sourceAutoClose {
+		return 0, reasons, nil
+	}
+	rules := loadAnomalyRules()
+	add := func(code, detail string) {
+		reasons = append(reasons, models.AnomalyReason{Code: code, Detail: detail, Weight: anomalyWeights[code]})
+	}
+
+	if in.MockLocation {
+		add(anomalyMockLocation, "The device reported a mock location provider")
+	}
+	if in.AccuracyM != nil && rules.MaxAccuracyM > 0 && *in.AccuracyM > float64(rules.MaxAccuracyM) {
+		add(anomalyLowAccuracy, fmt.Sprintf("Reported accuracy was %.0f m, the limit is %d m", *in.AccuracyM, rules.MaxAccuracyM))
+	}
+
+	if in.Latitude != nil && in.Longitude != nil {
+		lat, long := *in.Latitude, *in.Longitude
+		switch {
+		case lat < -90 || lat > 90 || long < -180 || long > 180:
+			add(anomalyInvalidPosition, fmt.Sprintf("%f,%f is not a valid position", lat, long))
+		case lat == 0 && long == 0 && in.AccuracyM != nil:
+			// Older builds send 0,0 when they have no fix, but they never
+			// send an accuracy with it
+			add(anomalyInvalidPosition, "The device reported a fix at 0,0")
+		}
+	}
+	if !hasPosition(in.Latitude, in.Longitude) {
+		return anomalyScore(reasons), reasons, nil
+	}
+	lat, long := *in.Latitude, *in.Longitude
+
+	// The nearest earlier event with a position
+	var prevAt time.Time
+	var prevLat, prevLong float64
+	err := tx.QueryRow(
+		`SELECT occurred_at, latitude, longitude FROM attendance_events
+		WHERE student_id = $1 AND latitude IS NOT NULL AND longitude IS NOT NULL AND NOT (latitude = 0 AND longitude = 0)
+			AND occurred_at <= $2 AND occurred_at > $3
+		ORDER BY occurred_at DESC LIMIT 1`,
+		in.StudentID, in.OccurredAt, in.OccurredAt.Add(-travelWindow),
+	).Scan(&prevAt, &prevLat, &prevLong)
+	switch {
+	case err == nil:
+		meters := haversine(prevLat, prevLong, lat, long)
+		seconds := in.OccurredAt.Sub(prevAt).Seconds()
+		if seconds < 60 {
+			seconds = 60
+		}
+		kmh := float64(meters) / seconds * 3.6
+		if rules.MaxSpeedKmh > 0 && meters > 1000 && kmh > float64(rules.MaxSpeedKmh) {
+			add(anomalyImpossibleTravel, fmt.Sprintf("%.1f km from the event at %s, %.0f km/h",
+				float64(meters)/1000, prevAt.Format(time.RFC3339), kmh))
+		}
+	case !errors.Is(err, sql.ErrNoRows):
+		return 0, nil, fmt.Errorf("load previous position: %w", err)
+	}
+
+	if rules.RepeatCount > 0 && decimalPlaces(lat) >= repeatedPositionDecimals && decimalPlaces(long) >= repeatedPositionDecimals {
+		var repeats int
+		err := tx.QueryRow(
+			`SELECT COUNT(*) FROM attendance_events
+			WHERE student_id = $1 AND latitude = $2 AND longitude = $3 AND occurred_at > $4`,
+			in.StudentID, lat, long, in.OccurredAt.Add(-repeatedPositionWindow),
+		).Scan(&repeats)
+		if err != nil {
+			return 0, nil, fmt.Errorf("count repeated positions: %w", err)
+		}
+		if repeats >= rules.RepeatCount {
+			add(anomalyRepeatedPosition, fmt.Sprintf("Exactly %s,%s was already reported on %d earlier events",
+				strconv.FormatFloat(lat, 'f', -1, 64), strconv.FormatFloat(long, 'f', -1, 64), repeats))
+		}
+	}
+
+	// Only when both distances are known; either one alone is not suspicious
+	if rules.FarKm > 0 && fence.DistanceMeters != nil {
+		var homeLat, homeLong sql.NullFloat64
+		err := tx.QueryRow(`SELECT home_lat, home_long FROM student WHERE id = $1`, in.StudentID).Scan(&homeLat, &homeLong)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return 0, nil, fmt.Errorf("load home position: %w", err)
+		}
+		if homeLat.Valid && homeLong.Valid && hasPosition(&homeLat.Float64, &homeLong.Float64) {
+			home := haversine(lat, long, homeLat.Float64, homeLong.Float64)
+			limit := rules.FarKm * 1000
+			if home > limit && *fence.DistanceMeters > limit {
+				add(anomalyFarFromHomeAndWork, fmt.Sprintf("%.1f km from home and %.1f km from work",
+					float64(home)/1000, float64(*fence.DistanceMeters)/1000))
+			}
+		}
+	}
+	return anomalyScore(reasons), reasons, nil
+}
+
+func anomalyScore(reasons []models.AnomalyReason) int {
+	score := 0
+	for _, r := range reasons {
+		score += r.Weight
+	}
+	if score > 100 {
+		score = 100
+	}
+	return score
+}
+
+// decimalPlaces is how many decimals v needs when printed exactly
+func decimalPlaces(v float64) int {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+// GetAttendanceAnomalies lists events queued for review because they looked
+// spoofed, for the trainees the caller manages, newest first. ?pending=true
+// limits it to anomalies nobody has reviewed yet.
+func GetAttendanceAnomalies(w http.ResponseWriter, r *http.Request) {
+	var args []interface{}
+	pending := r.URL.Query().Get("pending") == "true"
+	args = append(args, pending)
+	scope, args := studentScope(principalFromContext(r.Context()), "s", args)
+	if v := r.URL.Query().Get("student_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid student_id", http.StatusBadRequest)
+			return
+		}
+		args = append(args, id)
+		scope += fmt.Sprintf(" AND a.student_id = $%d", len(args))
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT a.id, a.event_id, e.session_id, a.student_id, s.first_name, s.last_name, e.event_type, e.occurred_at,
+			e.latitude, e.longitude, e.accuracy_m, a.score, e.anomaly_reasons, a.created_at,
+			a.outcome, a.reviewed_by, a.reviewed_at, a.review_note
+		FROM attendance_anomalies a
+		JOIN attendance_events e ON e.id = a.event_id
+		JOIN student s ON s.id = a.student_id
+		WHERE (NOT $1 OR a.reviewed_at IS NULL) AND `+scope+`
+		ORDER BY a.created_at DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading attendance anomalies: %v", err)
+		http.Error(w, "Failed to load anomalies", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	anomalies := []models.AttendanceAnomaly{}
+	for rows.Next() {
+		var a models.AttendanceAnomaly
+		var reasons []byte
+		if err := rows.Scan(&a.ID, &a.EventID, &a.SessionID, &a.StudentID, &a.FirstName, &a.LastName, &a.EventType, &a.OccurredAt,
+			&a.Latitude, &a.Longitude, &a.AccuracyM, &a.Score, &reasons, &a.CreatedAt,
+			&a.Outcome, &a.ReviewedBy, &a.ReviewedAt, &a.ReviewNote); err != nil {
+			http.Error(w, "Failed to load anomalies", http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(reasons, &a.Reasons); err != nil {
+			log.Printf("Bad anomaly reasons on event %d: %v", a.EventID, err)
+		}
+		anomalies = append(anomalies, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(anomalies)
+}
+
+// ReviewAttendanceAnomaly records the calling staff member's verdict on a
+// queued event: genuine or spoofed, with an optional note. The event itself
+// is left as it is; a spoofed session is fixed through a correction.
+func ReviewAttendanceAnomaly(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid anomaly ID", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Outcome string `json:"outcome"`
+		Note    string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if body.Outcome != anomalyGenuine && body.Outcome != anomalySpoofed {
+		http.Error(w, "outcome must be genuine or spoofed", http.StatusBadRequest)
+		return
+	}
+
+	var studentID int
+	err = database.DB.QueryRow(`SELECT student_id FROM attendance_anomalies WHERE id = $1`, id).Scan(&studentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Anomaly not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load anomaly", http.StatusInternalServerError)
+		return
+	}
+	if !requireStudentAccess(w, r, studentID) {
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	_, err = database.DB.Exec(
+		`UPDATE attendance_anomalies SET outcome = $1, reviewed_by = $2, reviewed_at = NOW(), review_note = $3 WHERE id = $4`,
+		body.Outcome, p.StaffID, strings.TrimSpace(body.Note), id,
+	)
+	if err != nil {
+		log.Printf("Error reviewing anomaly %d: %v", id, err)
+		http.Error(w, "Failed to review anomaly", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
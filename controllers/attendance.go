@@ -1,145 +1,77 @@
 package controllers
 
 import (
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"server/database"
 	"server/models"
-	"strconv"
-	"time"
 )
 
+// PostAttendance records a check-in, check-out or break event for the
+// authenticated trainee and responds with the session it belongs to. Earlier
+// records are never deleted; each event is appended to the attendance log.
 func PostAttendance(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received attendance request")
 
-	StudentIDHeader := r.Header.Get("student-id")
-	if StudentIDHeader == "" {
-		log.Println("Missing student-id header")
-		http.Error(w, "Missing student-id header", http.StatusBadRequest)
-		return
-	}
-
-	studentID, err := strconv.Atoi(StudentIDHeader)
+	studentID, err := authenticatedStudentID(r)
 	if err != nil {
-		log.Printf("Invalid student-id header: %v", err)
-		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
+		log.Printf("Unauthenticated attendance request: %v", err)
+		http.Error(w, "Trainee session required", http.StatusUnauthorized)
 		return
 	}
 
 	log.Printf("Processing attendance for student ID: %d", studentID)
 
-	var requestData struct {
-		CheckIn   bool    `json:"check_in"`
-		Latitude  float64 `json:"check_in_lat"`
-		Longitude float64 `json:"check_in_long"`
-	}
-
+	var requestData models.AttendanceRequest
 	if err := json.NewDecoder(r.Body).Decode(&requestData); err != nil {
 		log.Printf("Failed to decode request body: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Request data: check_in=%v, lat=%f, long=%f",
-		requestData.CheckIn, requestData.Latitude, requestData.Longitude)
-
-	var attendance models.Attendance
-	if requestData.CheckIn {
-		// Delete any existing records for today first
-		now := time.Now().UTC()
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		endOfDay := startOfDay.Add(24 * time.Hour)
-
-		deleteQuery := `DELETE FROM attendance WHERE student_id = $1 AND check_in_date_time >= $2 AND check_in_date_time < $3`
-		log.Printf("Delete Query: %s", deleteQuery)
-		log.Printf("Delete Params: student_id=%d, start=%v, end=%v", studentID, startOfDay, endOfDay)
-		_, err := database.DB.Exec(deleteQuery, studentID, startOfDay, endOfDay)
-		if err != nil {
-			log.Printf("Failed to delete existing records: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		attendance.StudentID = studentID
-		attendance.CheckInLat = requestData.Latitude
-		attendance.CheckInLong = requestData.Longitude
-		attendance.CheckInDateTime = time.Now()
-
-		log.Println("Creating new check-in record")
-		query := `INSERT INTO attendance (student_id, check_in_lat, check_in_long, check_in_date_time) VALUES ($1, $2, $3, $4) RETURNING id, student_id, check_in_lat, check_in_long, check_in_date_time`
-		log.Printf("Insert Query: %s", query)
-		log.Printf("Insert Params: student_id=%d, lat=%f, long=%f, datetime=%v", attendance.StudentID, attendance.CheckInLat, attendance.CheckInLong, attendance.CheckInDateTime)
-		row := database.DB.QueryRow(query, attendance.StudentID, attendance.CheckInLat, attendance.CheckInLong, attendance.CheckInDateTime)
-		err = row.Scan(&attendance.ID, &attendance.StudentID, &attendance.CheckInLat, &attendance.CheckInLong, &attendance.CheckInDateTime)
-		if err != nil {
-			log.Printf("Database error on insert: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	// Older app builds only send check_in true/false
+	eventType := requestData.EventType
+	if eventType == "" {
+		eventType = eventCheckOut
+		if requestData.CheckIn {
+			eventType = eventCheckIn
 		}
-		log.Printf("Check-in record created: %+v", attendance)
-	} else {
-		now := time.Now().UTC()
-		startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
-		endOfDay := startOfDay.Add(24 * time.Hour)
-
-		// Try to find existing record for today
-		query := `SELECT id, student_id, check_in_lat, check_in_long, check_in_date_time, check_out_lat, check_out_long, check_out_date_time 
-                  FROM attendance 
-                  WHERE student_id = $1 AND check_in_date_time >= $2 AND check_in_date_time < $3 
-                  ORDER BY check_in_date_time DESC LIMIT 1`
-		log.Printf("Select Query: %s", query)
-		log.Printf("Select Params: student_id=%d, start=%v, end=%v", studentID, startOfDay, endOfDay)
-		row := database.DB.QueryRow(query, studentID, startOfDay, endOfDay)
-		err := row.Scan(&attendance.ID, &attendance.StudentID, &attendance.CheckInLat, &attendance.CheckInLong, &attendance.CheckInDateTime, &attendance.CheckOutLat, &attendance.CheckOutLong, &attendance.CheckOutDateTime)
-
-		if err == sql.ErrNoRows {
-			// No check-in record exists, create a new record with zero check-in values and actual checkout data
-			log.Println("No check-in record found, creating checkout record with zero check-in values")
-			attendance.StudentID = studentID
-			attendance.CheckInLat = 0
-			attendance.CheckInLong = 0
-			attendance.CheckInDateTime = time.Time{} // zero timestamp
-			attendance.CheckOutLat = sql.NullFloat64{Float64: requestData.Latitude, Valid: true}
-			attendance.CheckOutLong = sql.NullFloat64{Float64: requestData.Longitude, Valid: true}
-			attendance.CheckOutDateTime = sql.NullTime{Time: time.Now(), Valid: true}
-
-			insertQuery := `INSERT INTO attendance (student_id, check_in_lat, check_in_long, check_in_date_time, check_out_lat, check_out_long, check_out_date_time) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`
-			log.Printf("Insert Query: %s", insertQuery)
-			row := database.DB.QueryRow(insertQuery, attendance.StudentID, attendance.CheckInLat, attendance.CheckInLong, attendance.CheckInDateTime, attendance.CheckOutLat, attendance.CheckOutLong, attendance.CheckOutDateTime)
-			err := row.Scan(&attendance.ID)
-			if err != nil {
-				log.Printf("Database error on checkout insert: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Printf("Checkout record with zero check-in values created: %+v", attendance)
-		} else if err != nil {
-			log.Printf("Database error on select: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		} else {
-			// Update existing record with checkout data (preserve existing check-in data)
-			log.Printf("Found existing check-in record, updating with check-out data: %+v", attendance)
-
-			attendance.CheckOutLat = sql.NullFloat64{Float64: requestData.Latitude, Valid: true}
-			attendance.CheckOutLong = sql.NullFloat64{Float64: requestData.Longitude, Valid: true}
-			attendance.CheckOutDateTime = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+	if !validEventType(eventType) {
+		http.Error(w, "event_type must be check_in, check_out, break_start or break_end", http.StatusBadRequest)
+		return
+	}
+	if outOfRange(requestData.Latitude, requestData.Longitude) {
+		http.Error(w, "latitude must be between -90 and 90 and longitude between -180 and 180", http.StatusBadRequest)
+		return
+	}
 
-			log.Println("Updating existing record with check-out data")
-			updateQuery := `UPDATE attendance SET check_out_lat = $1, check_out_long = $2, check_out_date_time = $3 WHERE id = $4`
-			log.Printf("Update Query: %s", updateQuery)
-			log.Printf("Update Params: lat=%v, long=%v, datetime=%v, id=%d", attendance.CheckOutLat, attendance.CheckOutLong, attendance.CheckOutDateTime, attendance.ID)
-			_, err = database.DB.Exec(updateQuery, attendance.CheckOutLat, attendance.CheckOutLong, attendance.CheckOutDateTime, attendance.ID)
-			if err != nil {
-				log.Printf("Failed to save record: %v", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Printf("Check-out updated for record ID: %d", attendance.ID)
-		}
+	log.Printf("Request data: event=%s, has position=%t", eventType, hasPosition(requestData.Latitude, requestData.Longitude))
+
+	event, attendance, err := recordAttendanceEvent(database.DB, attendanceInput{
+		StudentID:    studentID,
+		EventType:    eventType,
+		Latitude:     requestData.Latitude,
+		Longitude:    requestData.Longitude,
+		DeviceID:     principalFromContext(r.Context()).DeviceID,
+		SiteToken:    requestData.SiteToken,
+		AccuracyM:    requestData.AccuracyM,
+		MockLocation: requestData.MockLocation,
+	})
+	if errors.Is(err, errAttendanceConflict) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if errors.Is(err, errOutsideGeofence) || errors.Is(err, errInvalidSiteToken) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		log.Printf("Failed to record attendance for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record attendance", http.StatusInternalServerError)
+		return
 	}
+	log.Printf("Recorded %s event %d on session %d", event.EventType, event.ID, attendance.ID)
 
 	log.Println("Successfully processed request, sending response")
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,400 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"server/models"
+)
+
+const (
+	eventCheckIn    = "check_in"
+	eventCheckOut   = "check_out"
+	eventBreakStart = "break_start"
+	eventBreakEnd   = "break_end"
+
+	// Where an event came from
+	sourceApp        = "app"
+	sourceAutoClose  = "auto_close"
+	sourceCorrection = "correction"
+	sourceSync       = "sync"
+
+	// Namespace for the per-trainee advisory lock that serialises events
+	attendanceLockNamespace = 7007
+)
+
+// errAttendanceConflict is returned when an event does not fit the trainee's
+// current state, such as a second check-in without a check-out
+var errAttendanceConflict = errors.New("attendance conflict")
+
+// errDuplicateEvent is returned when an event with the same idempotency key
+// was already recorded for the trainee
+var errDuplicateEvent = errors.New("event already recorded")
+
+// attendanceInput is a single event to append to the attendance log
+type attendanceInput struct {
+	StudentID  int
+	EventType  string
+	OccurredAt time.Time
+	Latitude   *float64
+	Longitude  *float64
+	DeviceID   int
+	Source     string
+	// SessionID targets a specific open session instead of the latest one.
+	// Only the auto-close job uses it, for sessions left open too long.
+	SessionID int
+	// Offline sync only
+	IdempotencyKey   string
+	DeviceOccurredAt *time.Time
+	ClockOffsetS     *int
+	// SiteToken is a scanned workplace code, checked by verifySiteToken
+	SiteToken string
+	// What the device reported about the fix, used by scoreAnomalies
+	AccuracyM    *float64
+	MockLocation bool
+}
+
+const sessionColumns = `id, student_id, check_in_date_time, check_in_lat, check_in_long,
+	check_out_date_time, check_out_lat, check_out_long, orphan_checkout, break_minutes, on_break_since,
+	check_in_geofence, check_in_distance_m, check_out_geofence, check_out_distance_m, flagged,
+	scheduled_check_in, scheduled_check_out, late_minutes, early_leave_minutes, auto_closed, corrected, paid_break_minutes,
+	check_in_verification, check_out_verification`
+
+func scanSession(row interface{ Scan(...interface{}) error }, a *models.Attendance) error {
+	err := row.Scan(&a.ID, &a.StudentID, &a.CheckInDateTime, &a.CheckInLat, &a.CheckInLong,
+		&a.CheckOutDateTime, &a.CheckOutLat, &a.CheckOutLong, &a.OrphanCheckout, &a.BreakMinutes, &a.OnBreakSince,
+		&a.CheckInGeofence, &a.CheckInDistanceM, &a.CheckOutGeofence, &a.CheckOutDistanceM, &a.Flagged,
+		&a.ScheduledCheckIn, &a.ScheduledCheckOut, &a.LateMinutes, &a.EarlyLeaveMinutes, &a.AutoClosed, &a.Corrected, &a.PaidBreakMinutes,
+		&a.CheckInVerification, &a.CheckOutVerification)
+	a.NetWorkedMinutes = netWorkedMinutes(a)
+	return err
+}
+
+func validEventType(t string) bool {
+	switch t {
+	case eventCheckIn, eventCheckOut, eventBreakStart, eventBreakEnd:
+		return true
+	}
+	return false
+}
+
+// maxSessionLength is how long after its check-in an open session can still be
+// checked out. Older open sessions are left for review rather than extended.
+func maxSessionLength() time.Duration {
+	return time.Duration(envInt("ATTENDANCE_MAX_SESSION_HOURS", 16)) * time.Hour
+}
+
+// recordAttendanceEvent appends an event to the log and folds it into the
+// trainee's sessions. Several sessions per day are allowed; a session that
+// was never checked out is left open for review once it is older than
+// maxSessionLength, and a check-out with nothing to close is stored as an
+// orphan checkout.
+func recordAttendanceEvent(db *sql.DB, in attendanceInput) (*models.AttendanceEvent, *models.Attendance, error) {
+	// A replay is recognised before anything else is checked, so it is
+	// reported as a duplicate even once its site code has expired or the
+	// geofence has moved. It is checked again under the lock below.
+	if in.IdempotencyKey != "" {
+		if exists, err := eventRecorded(db, in.StudentID, in.IdempotencyKey); err != nil {
+			return nil, nil, err
+		} else if exists {
+			return nil, nil, errDuplicateEvent
+		}
+	}
+	if !validEventType(in.EventType) {
+		return nil, nil, fmt.Errorf("%w: unknown event type %q", errAttendanceConflict, in.EventType)
+	}
+	if in.OccurredAt.IsZero() {
+		in.OccurredAt = time.Now()
+	}
+	if in.Source == "" {
+		in.Source = sourceApp
+	}
+
+	loc, err := studentLocation(db, in.StudentID, in.OccurredAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load timezone: %w", err)
+	}
+	startOfDay, endOfDay := dayBounds(in.OccurredAt, loc)
+	schedIn, schedOut, err := scheduledTimes(db, in.StudentID, in.OccurredAt, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	verification := verifyNone
+	if in.SiteToken != "" {
+		if verification, err = verifySiteToken(db, in.StudentID, in.SiteToken, in.OccurredAt, loc); err != nil {
+			return nil, nil, err
+		}
+	} else if in.Source != sourceAutoClose && hasPosition(in.Latitude, in.Longitude) {
+		verification = verifyGPS
+	}
+
+	// Server generated events have no position to check
+	fence := geofenceResult{Status: geofenceUnknown}
+	if in.Source != sourceAutoClose {
+		fence, err = evaluateGeofence(db, in.StudentID, localDate(in.OccurredAt, loc), in.Latitude, in.Longitude)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// A valid site code stands in for GPS when there is no fix or the fix
+	// is too rough to tell, as is common indoors. A precise fix outside the
+	// geofence still counts: a photo of a printed code works from anywhere.
+	if in.SiteToken != "" && !fence.clearlyOutside(in.AccuracyM) {
+		fence.Flagged = false
+	} else if fence.rejects() {
+		return nil, nil, fence.rejectionError()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, $2)`, attendanceLockNamespace, in.StudentID); err != nil {
+		return nil, nil, fmt.Errorf("lock attendance: %w", err)
+	}
+
+	if in.IdempotencyKey != "" {
+		if exists, err := eventRecorded(tx, in.StudentID, in.IdempotencyKey); err != nil {
+			return nil, nil, err
+		} else if exists {
+			return nil, nil, errDuplicateEvent
+		}
+	}
+
+	score, reasons, err := scoreAnomalies(tx, in, fence)
+	if err != nil {
+		return nil, nil, err
+	}
+	anomalous := score > 0 && score >= loadAnomalyRules().ReviewScore
+	flagged := fence.Flagged || anomalous
+
+	// The most recent session still waiting for a check-out, if it is recent
+	// enough to still be running
+	var open *models.Attendance
+	var s models.Attendance
+	err = scanSession(tx.QueryRow(
+		`SELECT `+sessionColumns+` FROM attendance
+		WHERE student_id = $1 AND check_out_date_time IS NULL AND check_in_date_time IS NOT NULL AND ($2 = 0 OR id = $2)
+		ORDER BY check_in_date_time DESC LIMIT 1 FOR UPDATE`, in.StudentID, in.SessionID,
+	), &s)
+	switch {
+	case err == nil:
+		if in.SessionID != 0 || in.OccurredAt.Sub(*s.CheckInDateTime) < maxSessionLength() {
+			open = &s
+		}
+	case errors.Is(err, sql.ErrNoRows) && in.SessionID != 0:
+		return nil, nil, fmt.Errorf("%w: session %d is not open", errAttendanceConflict, in.SessionID)
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, nil, fmt.Errorf("load open session: %w", err)
+	}
+
+	// Events synced late can arrive after a newer check-in
+	if open != nil && in.EventType != eventCheckIn && in.OccurredAt.Before(*open.CheckInDateTime) {
+		return nil, nil, fmt.Errorf("%w: event is earlier than the open session's check-in", errAttendanceConflict)
+	}
+	if open != nil && in.EventType == eventBreakEnd && open.OnBreakSince.Valid && in.OccurredAt.Before(open.OnBreakSince.Time) {
+		return nil, nil, fmt.Errorf("%w: break cannot end before it started", errAttendanceConflict)
+	}
+
+	var sessionID int
+	switch in.EventType {
+	case eventCheckIn:
+		if open != nil {
+			return nil, nil, fmt.Errorf("%w: already checked in", errAttendanceConflict)
+		}
+		// Turning up late clears an absence the job already recorded
+		if err := clearAbsence(tx, in.StudentID, in.OccurredAt, loc); err != nil {
+			return nil, nil, err
+		}
+		// Lateness only counts against the first session of the day
+		var late *int
+		var firstToday bool
+		err = tx.QueryRow(
+			`SELECT NOT EXISTS (SELECT 1 FROM attendance WHERE student_id = $1 AND check_in_date_time >= $2 AND check_in_date_time < $3)`,
+			in.StudentID, startOfDay, endOfDay,
+		).Scan(&firstToday)
+		if err != nil {
+			return nil, nil, fmt.Errorf("check earlier sessions: %w", err)
+		}
+		if firstToday && schedIn != nil {
+			m := minutesAfter(in.OccurredAt, *schedIn)
+			late = &m
+		}
+		err = tx.QueryRow(
+			`INSERT INTO attendance (student_id, check_in_date_time, check_in_lat, check_in_long, check_in_geofence, check_in_distance_m, flagged,
+				scheduled_check_in, scheduled_check_out, late_minutes, check_in_verification)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+			in.StudentID, in.OccurredAt, in.Latitude, in.Longitude, fence.Status, fence.DistanceMeters, flagged,
+			schedIn, schedOut, late, verification,
+		).Scan(&sessionID)
+	case eventCheckOut:
+		if open != nil {
+			sessionID = int(open.ID)
+			break
+		}
+		err = tx.QueryRow(
+			`INSERT INTO attendance (student_id, check_out_date_time, check_out_lat, check_out_long, check_out_geofence, check_out_distance_m, flagged,
+				scheduled_check_in, scheduled_check_out, early_leave_minutes, orphan_checkout, check_out_verification)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, true, $11) RETURNING id`,
+			in.StudentID, in.OccurredAt, in.Latitude, in.Longitude, fence.Status, fence.DistanceMeters, flagged,
+			schedIn, schedOut, earlyLeave(schedOut, in.OccurredAt), verification,
+		).Scan(&sessionID)
+	case eventBreakStart:
+		if open == nil {
+			return nil, nil, fmt.Errorf("%w: not checked in", errAttendanceConflict)
+		}
+		if open.OnBreakSince.Valid {
+			return nil, nil, fmt.Errorf("%w: break already started", errAttendanceConflict)
+		}
+		sessionID = int(open.ID)
+	case eventBreakEnd:
+		if open == nil || !open.OnBreakSince.Valid {
+			return nil, nil, fmt.Errorf("%w: no break in progress", errAttendanceConflict)
+		}
+		sessionID = int(open.ID)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("create session: %w", err)
+	}
+
+	event := models.AttendanceEvent{
+		StudentID:  in.StudentID,
+		SessionID:  &sessionID,
+		EventType:  in.EventType,
+		OccurredAt: in.OccurredAt,
+		Latitude:   in.Latitude,
+		Longitude:  in.Longitude,
+		Source:     in.Source,
+		// Stored with the event so later changes to the geofence do not
+		// rewrite history
+		GeofenceStatus:     fence.Status,
+		DistanceM:          fence.DistanceMeters,
+		Flagged:            flagged,
+		VerificationMethod: verification,
+		AccuracyM:          in.AccuracyM,
+		MockLocation:       in.MockLocation,
+		AnomalyScore:       score,
+		AnomalyReasons:     reasons,
+	}
+	if in.DeviceID > 0 {
+		event.DeviceID = &in.DeviceID
+	}
+	if in.IdempotencyKey != "" {
+		event.IdempotencyKey = &in.IdempotencyKey
+		event.DeviceOccurredAt = in.DeviceOccurredAt
+		event.ClockOffsetS = in.ClockOffsetS
+	}
+	reasonsJSON, err := json.Marshal(reasons)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO attendance_events (student_id, session_id, event_type, occurred_at, latitude, longitude, device_id, source, geofence_status, distance_m, flagged,
+			idempotency_key, device_occurred_at, clock_offset_s, verification_method, accuracy_m, mock_location, anomaly_score, anomaly_reasons)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19) RETURNING id, recorded_at`,
+		event.StudentID, sessionID, event.EventType, event.OccurredAt, event.Latitude, event.Longitude, event.DeviceID, event.Source,
+		event.GeofenceStatus, event.DistanceM, event.Flagged, event.IdempotencyKey, event.DeviceOccurredAt, event.ClockOffsetS,
+		event.VerificationMethod, event.AccuracyM, event.MockLocation, event.AnomalyScore, string(reasonsJSON),
+	).Scan(&event.ID, &event.RecordedAt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("append event: %w", err)
+	}
+	if anomalous {
+		_, err = tx.Exec(`INSERT INTO attendance_anomalies (event_id, student_id, score) VALUES ($1, $2, $3)`, event.ID, in.StudentID, score)
+		if err != nil {
+			return nil, nil, fmt.Errorf("queue anomaly: %w", err)
+		}
+	}
+
+	// Fold the event into the session projection
+	switch {
+	case in.EventType == eventCheckIn:
+		_, err = tx.Exec(`UPDATE attendance SET check_in_event_id = $1 WHERE id = $2`, event.ID, sessionID)
+	case in.EventType == eventCheckOut && open == nil:
+		_, err = tx.Exec(`UPDATE attendance SET check_out_event_id = $1 WHERE id = $2`, event.ID, sessionID)
+	case in.EventType == eventCheckOut:
+		// Checking out ends any break still running
+		var breakMinutes, paid int
+		breakMinutes, paid, err = endBreak(tx, open, event.ID, in.OccurredAt, in.Latitude, in.Longitude)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(
+			`UPDATE attendance SET check_out_date_time = $1, check_out_lat = $2, check_out_long = $3, check_out_event_id = $4,
+				break_minutes = break_minutes + $5, paid_break_minutes = paid_break_minutes + $6, on_break_since = NULL,
+				check_out_geofence = $7, check_out_distance_m = $8, flagged = flagged OR $9, early_leave_minutes = $10, auto_closed = $11,
+				check_out_verification = $12
+			WHERE id = $13`,
+			in.OccurredAt, in.Latitude, in.Longitude, event.ID, breakMinutes, paid,
+			fence.Status, fence.DistanceMeters, flagged, earlyLeave(open.ScheduledCheckOut, in.OccurredAt),
+			in.Source == sourceAutoClose, verification, sessionID,
+		)
+	case in.EventType == eventBreakStart:
+		if err = startBreak(tx, sessionID, in.StudentID, event.ID, in.OccurredAt, in.Latitude, in.Longitude); err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(`UPDATE attendance SET on_break_since = $1, flagged = flagged OR $2 WHERE id = $3`, in.OccurredAt, flagged, sessionID)
+	case in.EventType == eventBreakEnd:
+		var breakMinutes, paid int
+		breakMinutes, paid, err = endBreak(tx, open, event.ID, in.OccurredAt, in.Latitude, in.Longitude)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = tx.Exec(
+			`UPDATE attendance SET break_minutes = break_minutes + $1, paid_break_minutes = paid_break_minutes + $2, on_break_since = NULL,
+				flagged = flagged OR $3 WHERE id = $4`,
+			breakMinutes, paid, flagged, sessionID,
+		)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("update session: %w", err)
+	}
+
+	var session models.Attendance
+	if err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM attendance WHERE id = $1`, sessionID), &session); err != nil {
+		return nil, nil, fmt.Errorf("reload session: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return &event, &session, nil
+}
+
+// eventRecorded reports whether the trainee already has an event with the
+// idempotency key
+func eventRecorded(q queryRower, studentID int, key string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM attendance_events WHERE student_id = $1 AND idempotency_key = $2)`,
+		studentID, key,
+	).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("check idempotency key: %w", err)
+	}
+	return exists, nil
+}
+
+// earlyLeave is how many minutes before the scheduled end a check-out was,
+// or nil when there is no schedule
+func earlyLeave(scheduled *time.Time, checkOut time.Time) *int {
+	if scheduled == nil {
+		return nil
+	}
+	m := minutesAfter(*scheduled, checkOut)
+	return &m
+}
+
+// openBreakMinutes is the length of the session's running break at t
+func openBreakMinutes(s *models.Attendance, t time.Time) int {
+	if s == nil || !s.OnBreakSince.Valid || t.Before(s.OnBreakSince.Time) {
+		return 0
+	}
+	return int(math.Round(t.Sub(s.OnBreakSince.Time).Minutes()))
+}
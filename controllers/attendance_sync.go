@@ -0,0 +1,239 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	syncApplied   = "applied"
+	syncDuplicate = "duplicate"
+	syncConflict  = "conflict"
+	syncRejected  = "rejected"
+	// The server failed; the app should keep the event and retry
+	syncError = "error"
+
+	maxSyncBatch = 200
+)
+
+// clockSkewTolerance is how far the device clock may drift from the server's
+// before event times are corrected, and how far into the future an event may
+// be
+func clockSkewTolerance() time.Duration {
+	return time.Duration(envInt("SYNC_CLOCK_SKEW_SECONDS", 300)) * time.Second
+}
+
+// maxSyncAge is how old a queued event may be and still be accepted
+func maxSyncAge() time.Duration {
+	return time.Duration(envInt("SYNC_MAX_AGE_HOURS", 72)) * time.Hour
+}
+
+// deviceOwnedBy reports whether the device belongs to the trainee and was not
+// yet revoked at the given time
+func deviceOwnedBy(db *sql.DB, deviceID, studentID int, at time.Time) (bool, error) {
+	var ok bool
+	err := db.QueryRow(
+		`SELECT student_id = $2 AND (revoked_at IS NULL OR revoked_at > $3) FROM authorized_devices WHERE id = $1`,
+		deviceID, studentID, at,
+	).Scan(&ok)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// syncedEvents looks up which of the idempotency keys the trainee already
+// has events for, with the ids to report back
+func syncedEvents(db *sql.DB, studentID int, keys []string) (map[string]models.AttendanceSyncResult, error) {
+	rows, err := db.Query(
+		`SELECT idempotency_key, id, session_id FROM attendance_events WHERE student_id = $1 AND idempotency_key = ANY($2)`,
+		studentID, pq.Array(keys),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	synced := map[string]models.AttendanceSyncResult{}
+	for rows.Next() {
+		var key string
+		var eventID int
+		var sessionID sql.NullInt64
+		if err := rows.Scan(&key, &eventID, &sessionID); err != nil {
+			return nil, err
+		}
+		res := models.AttendanceSyncResult{EventID: &eventID}
+		if sessionID.Valid {
+			s := int(sessionID.Int64)
+			res.SessionID = &s
+		}
+		synced[key] = res
+	}
+	return synced, rows.Err()
+}
+
+// SyncAttendance records a batch of events the app queued while offline.
+// Events are applied oldest first using their device timestamps. Each one is
+// reported separately so the app can drop the ones that were applied or
+// already synced and keep the rest for review. Sending the same batch again
+// is safe.
+func SyncAttendance(w http.ResponseWriter, r *http.Request) {
+	studentID, err := authenticatedStudentID(r)
+	if err != nil {
+		http.Error(w, "Trainee session required", http.StatusUnauthorized)
+		return
+	}
+
+	var req models.AttendanceSyncRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		http.Error(w, "events is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) > maxSyncBatch {
+		http.Error(w, "Too many events in one batch, send at most 200", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// A device clock that is further off than the tolerance is corrected by
+	// the difference seen when the batch arrived
+	now := time.Now()
+	tolerance := clockSkewTolerance()
+	var offset time.Duration
+	if req.DeviceTime != nil {
+		if d := now.Sub(*req.DeviceTime); d > tolerance || d < -tolerance {
+			offset = d.Round(time.Second)
+		}
+	}
+	offsetSeconds := int(offset / time.Second)
+
+	keys := make([]string, len(req.Events))
+	for i, ev := range req.Events {
+		keys[i] = strings.TrimSpace(ev.IdempotencyKey)
+	}
+	// Events already applied are reported as duplicates before any other
+	// check, which may no longer pass now that they are older
+	synced, err := syncedEvents(database.DB, studentID, keys)
+	if err != nil {
+		log.Printf("Error loading synced events for student %d: %v", studentID, err)
+		http.Error(w, "Failed to sync attendance", http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]models.AttendanceSyncResult, len(req.Events))
+	order := make([]int, 0, len(req.Events))
+	seen := map[string]bool{}
+	for i, ev := range req.Events {
+		key := keys[i]
+		results[i] = models.AttendanceSyncResult{IdempotencyKey: key, Status: syncRejected}
+		occurred := ev.OccurredAt.Add(offset)
+		prior, applied := synced[key]
+		switch {
+		case key == "" || len(key) > 128:
+			results[i].Error = "idempotency_key is required and must be at most 128 characters"
+		case applied:
+			results[i].Status = syncDuplicate
+			results[i].EventID, results[i].SessionID = prior.EventID, prior.SessionID
+		case seen[key]:
+			results[i].Status = syncDuplicate
+			results[i].Error = "repeated within the batch"
+		case !validEventType(ev.EventType):
+			results[i].Error = "event_type must be check_in, check_out, break_start or break_end"
+		case outOfRange(ev.Latitude, ev.Longitude):
+			results[i].Error = "latitude must be between -90 and 90 and longitude between -180 and 180"
+		case ev.OccurredAt.IsZero():
+			results[i].Error = "occurred_at is required"
+		case occurred.After(now.Add(tolerance)):
+			results[i].Error = "occurred_at is in the future"
+		case now.Sub(occurred) > maxSyncAge():
+			results[i].Error = "occurred_at is too old to sync, submit a correction instead"
+		default:
+			order = append(order, i)
+		}
+		seen[key] = true
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return req.Events[order[a]].OccurredAt.Before(req.Events[order[b]].OccurredAt)
+	})
+
+	sessionDevice := principalFromContext(r.Context()).DeviceID
+	for _, i := range order {
+		ev := req.Events[i]
+		res := &results[i]
+		occurred := ev.OccurredAt.Add(offset)
+
+		deviceID := sessionDevice
+		if ev.DeviceID != nil && *ev.DeviceID != sessionDevice {
+			ok, err := deviceOwnedBy(database.DB, *ev.DeviceID, studentID, occurred)
+			if err != nil {
+				log.Printf("Error checking device %d for student %d: %v", *ev.DeviceID, studentID, err)
+				res.Status = syncError
+				res.Error = "could not check the device, try again"
+				continue
+			}
+			if !ok {
+				res.Error = "device_id is not one of your devices"
+				continue
+			}
+			deviceID = *ev.DeviceID
+		}
+
+		in := attendanceInput{
+			StudentID:      studentID,
+			EventType:      ev.EventType,
+			OccurredAt:     occurred,
+			Latitude:       ev.Latitude,
+			Longitude:      ev.Longitude,
+			DeviceID:       deviceID,
+			Source:         sourceSync,
+			IdempotencyKey: res.IdempotencyKey,
+			SiteToken:      ev.SiteToken,
+			AccuracyM:      ev.AccuracyM,
+			MockLocation:   ev.MockLocation,
+		}
+		if offset != 0 {
+			in.DeviceOccurredAt = &ev.OccurredAt
+			in.ClockOffsetS = &offsetSeconds
+		}
+		event, session, err := recordAttendanceEvent(database.DB, in)
+		switch {
+		case err == nil:
+			res.Status = syncApplied
+			res.EventID = &event.ID
+			sessionID := int(session.ID)
+			res.SessionID = &sessionID
+		case errors.Is(err, errDuplicateEvent):
+			// Applied by a concurrent request since the batch was checked
+			res.Status = syncDuplicate
+			if prior, err := syncedEvents(database.DB, studentID, []string{res.IdempotencyKey}); err == nil {
+				res.EventID, res.SessionID = prior[res.IdempotencyKey].EventID, prior[res.IdempotencyKey].SessionID
+			}
+		case errors.Is(err, errAttendanceConflict):
+			res.Status = syncConflict
+			res.Error = err.Error()
+		case errors.Is(err, errOutsideGeofence), errors.Is(err, errInvalidSiteToken):
+			res.Error = err.Error()
+		default:
+			log.Printf("Failed to sync event %q for student %d: %v", res.IdempotencyKey, studentID, err)
+			res.Status = syncError
+			res.Error = "could not record the event, try again"
+		}
+	}
+	log.Printf("Synced %d events for student %d (clock offset %ds)", len(req.Events), studentID, offsetSeconds)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.AttendanceSyncResponse{ClockOffsetSeconds: offsetSeconds, Results: results})
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+// traineeRequest is a request authenticated as trainee 7
+func traineeRequest(method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, &Principal{Role: roleTrainee, StudentID: 7}))
+}
+
+// useFakeDB points database.DB at a fake for the rest of the test and
+// returns how many statements have reached it
+func useFakeDB(t *testing.T, answer fakeQuery) *int {
+	queries := new(int)
+	db := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		*queries++
+		return answer(query, args)
+	})
+	saved := database.DB
+	database.DB = db
+	t.Cleanup(func() { database.DB = saved })
+	return queries
+}
+
+func TestPostAttendanceRejectsOutOfRangeCoordinates(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"latitude above 90", `{"event_type":"check_in","check_in_lat":90.5,"check_in_long":79.86}`, http.StatusBadRequest},
+		{"latitude below -90", `{"event_type":"check_in","check_in_lat":-91,"check_in_long":79.86}`, http.StatusBadRequest},
+		{"longitude above 180", `{"event_type":"check_out","check_in_lat":6.93,"check_in_long":180.01}`, http.StatusBadRequest},
+		{"longitude below -180", `{"event_type":"break_start","check_in_lat":6.93,"check_in_long":-200}`, http.StatusBadRequest},
+		{"latitude alone", `{"check_in":true,"check_in_lat":123}`, http.StatusBadRequest},
+		// Positions at the limits are valid and go on to be recorded, which
+		// fails here because the fake database is down
+		{"on the limits", `{"event_type":"check_in","check_in_lat":-90,"check_in_long":180}`, http.StatusInternalServerError},
+		{"no fix", `{"event_type":"check_in"}`, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := useFakeDB(t, func(string, []driver.Value) ([]string, [][]driver.Value, error) {
+				return nil, nil, errors.New("database unavailable")
+			})
+			w := httptest.NewRecorder()
+			PostAttendance(w, traineeRequest(http.MethodPost, "/attendance", tt.body))
+			if w.Code != tt.code {
+				t.Fatalf("status = %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.code)
+			}
+			if tt.code == http.StatusBadRequest && *queries != 0 {
+				t.Errorf("%d statements ran before the event was rejected", *queries)
+			}
+		})
+	}
+}
+
+func TestSyncAttendanceRejectsOutOfRangeCoordinates(t *testing.T) {
+	queries := useFakeDB(t, func(query string, _ []driver.Value) ([]string, [][]driver.Value, error) {
+		if !strings.Contains(query, "FROM attendance_events") {
+			t.Errorf("unexpected statement: %s", query)
+		}
+		return []string{"idempotency_key", "id", "session_id"}, nil, nil
+	})
+	at := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	body := `{"events":[
+		{"idempotency_key":"a","event_type":"check_in","occurred_at":"` + at + `","latitude":95,"longitude":79.86},
+		{"idempotency_key":"b","event_type":"check_out","occurred_at":"` + at + `","latitude":6.93,"longitude":-181}
+	]}`
+	w := httptest.NewRecorder()
+	SyncAttendance(w, traineeRequest(http.MethodPost, "/attendance/sync", body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d (%s), want 200", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	var resp models.AttendanceSyncResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 {
+		t.Fatalf("%d results, want 2", len(resp.Results))
+	}
+	for _, res := range resp.Results {
+		if res.Status != syncRejected || !strings.Contains(res.Error, "latitude must be between") {
+			t.Errorf("%s: %s %q, want rejected for its position", res.IdempotencyKey, res.Status, res.Error)
+		}
+	}
+	// Only the lookup of already synced events
+	if *queries != 1 {
+		t.Errorf("%d statements ran, want 1", *queries)
+	}
+}
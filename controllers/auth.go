@@ -1,18 +1,21 @@
 package controllers
 
 import (
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
 	"net/http"
 	"server/database"
 	"server/models"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -21,13 +24,20 @@ import (
 
 // AuthService handles authentication-related operations
 type AuthService struct {
-	db *sql.DB
+	db       *sql.DB
+	otp      *otpPolicy
+	attempts otpAttemptLog
 }
 
 // NewAuthService creates a new auth service
 func NewAuthService() *AuthService {
+	sessions = loadSessionConfig()
+	channels = loadDeliveryChannels()
+	staffLogins = loadOTPPolicy()
 	return &AuthService{
-		db: database.DB, // Use the sql.DB instance
+		db:       database.DB, // Use the sql.DB instance
+		otp:      staffLogins,
+		attempts: sqlAttemptLog{db: database.DB},
 	}
 }
 
@@ -47,6 +57,32 @@ func (s *AuthService) HandleGenerateOTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if ok, err := canAccessStudent(principalFromContext(r.Context()), studentID); err != nil {
+		log.Printf("Error checking access to student %d: %v", studentID, err)
+		http.Error(w, "Failed to generate OTP", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	}
+
+	// Staff choose whether the code is shown to them or sent to the trainee
+	req := models.OTPRequest{Delivery: deliveryDisplay}
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	switch req.Delivery {
+	case "":
+		req.Delivery = deliveryDisplay
+	case deliveryDisplay, deliverySMSTrainee, deliverySMSGuardian, deliveryEmailSupervisor:
+	default:
+		http.Error(w, "Unknown delivery option", http.StatusBadRequest)
+		return
+	}
+
 	resp, err := s.GenerateOTP(studentID)
 	if err != nil {
 		log.Printf("Error generating OTP: %v", err)
@@ -54,6 +90,28 @@ func (s *AuthService) HandleGenerateOTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	resp.Delivery = req.Delivery
+	if req.Delivery != deliveryDisplay {
+		sentTo, err := s.deliverOTP(r.Context(), resp, req.Delivery)
+		if err != nil {
+			log.Printf("Error delivering OTP for student %d via %s: %v", studentID, req.Delivery, err)
+			// An undelivered code must not stay redeemable
+			if _, err := s.db.Exec("UPDATE otps SET is_used = true WHERE student_id = $1 AND is_used = false", studentID); err != nil {
+				log.Printf("Error invalidating undelivered OTP for student %d: %v", studentID, err)
+				http.Error(w, "Failed to send OTP", http.StatusInternalServerError)
+				return
+			}
+			if errors.Is(err, errChannelNotConfigured) || errors.Is(err, errNoRecipient) {
+				http.Error(w, "Could not send OTP: "+err.Error(), http.StatusUnprocessableEntity)
+			} else {
+				http.Error(w, "Failed to send OTP", http.StatusBadGateway)
+			}
+			return
+		}
+		resp.OTPCode = ""
+		resp.SentTo = sentTo
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding response: %v", err)
@@ -70,8 +128,23 @@ func (s *AuthService) HandleValidateOTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	resp, err := s.ValidateOTP(OTPCodeHeader)
-	if err != nil {
+	// The body optionally describes the device being paired
+	var device models.DeviceEnrollment
+	if r.Body != nil {
+		if err := json.NewDecoder(r.Body).Decode(&device); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("Error decoding device details: %v", err)
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := s.ValidateOTP(OTPCodeHeader, s.otp.clientIP(r), device)
+	var locked *otpLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", retryAfterSeconds(locked.retryAfter))
+		http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		return
+	} else if err != nil {
 		log.Printf("Error validating OTP: %v", err)
 		http.Error(w, "Failed to validate OTP", http.StatusInternalServerError)
 		return
@@ -96,20 +169,121 @@ func (s *AuthService) HandleVerifyDeviceAuth(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	isAuthorized, err := s.VerifyDeviceAuth(req.StudentID, req.SecretCode)
+	if req.StudentID == 0 || req.SecretCode == "" {
+		http.Error(w, "student_id and secret_code are required", http.StatusBadRequest)
+		return
+	}
+
+	deviceID, err := s.VerifyDeviceAuth(req.StudentID, req.SecretCode)
 	if err != nil {
 		log.Printf("Error verifying device authorization: %v", err)
 		http.Error(w, "Failed to verify device authorization", http.StatusInternalServerError)
 		return
 	}
 
+	resp := models.DeviceAuthResponse{Authorized: deviceID > 0}
+	if resp.Authorized {
+		// A paired device can start a fresh session without a new OTP
+		resp.DeviceID = deviceID
+		resp.SessionTokens, _, err = issueSession(s.db, studentSubject(req.StudentID), deviceID)
+		if err != nil {
+			log.Printf("Error issuing session for device %d: %v", deviceID, err)
+			http.Error(w, "Failed to start session", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(map[string]bool{"authorized": isAuthorized}); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Printf("Error encoding response: %v", err)
 		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
 	}
 }
 
+var errNoRecipient = errors.New("no contact details on record")
+
+// deliverOTP sends a freshly generated code to the trainee, their guardian or
+// their supervisor and returns the masked recipient
+func (s *AuthService) deliverOTP(ctx context.Context, otp *models.OTPResponse, delivery string) (string, error) {
+	var channel, to string
+	var err error
+	switch delivery {
+	case deliverySMSTrainee:
+		channel = channelSMS
+		err = s.db.QueryRow("SELECT COALESCE(contact_number, '') FROM student WHERE id = $1", otp.StudentID).Scan(&to)
+	case deliverySMSGuardian:
+		channel = channelSMS
+		err = s.db.QueryRow("SELECT COALESCE(contact_number_guardian, '') FROM student WHERE id = $1", otp.StudentID).Scan(&to)
+	case deliveryEmailSupervisor:
+		channel = channelEmail
+		err = s.db.QueryRow(
+			"SELECT COALESCE(sup.email_address, '') FROM student s JOIN supervisor sup ON sup.supervisor_id = s.supervisor_id WHERE s.id = $1",
+			otp.StudentID,
+		).Scan(&to)
+		if errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("database error: %w", err)
+	}
+	if strings.TrimSpace(to) == "" {
+		return "", errNoRecipient
+	}
+
+	minutes := int(time.Until(otp.ExpiresAt).Round(time.Minute).Minutes())
+	err = sendMessage(ctx, channel, OutboundMessage{
+		To:      to,
+		Subject: "Sign-in code",
+		Body:    fmt.Sprintf("Your sign-in code is %s. It expires in %d minutes. Do not share it with anyone.", otp.OTPCode, minutes),
+	})
+	if err != nil {
+		return "", err
+	}
+	return maskRecipient(to), nil
+}
+
+// HandleRefreshToken exchanges a refresh token for a new token pair
+func (s *AuthService) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := refreshSession(s.db, req.RefreshToken)
+	if errors.Is(err, errInvalidToken) || errors.Is(err, errExpiredToken) {
+		unauthorized(w, "Invalid or expired refresh token")
+		return
+	} else if err != nil {
+		log.Printf("Error refreshing session: %v", err)
+		http.Error(w, "Failed to refresh session", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tokens); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	}
+}
+
+// HandleLogout revokes the given refresh token
+func (s *AuthService) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	var req models.RefreshTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := revokeRefreshToken(s.db, req.RefreshToken); err != nil {
+		log.Printf("Error revoking refresh token: %v", err)
+		http.Error(w, "Failed to log out", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // GenerateOTP creates a new OTP for a student
 func (s *AuthService) GenerateOTP(studentID int) (*models.OTPResponse, error) {
 	// Check if student exists
@@ -130,18 +304,32 @@ func (s *AuthService) GenerateOTP(studentID int) (*models.OTPResponse, error) {
 		return nil, fmt.Errorf("failed to invalidate existing OTPs: %w", err)
 	}
 
-	// Generate a random 4-digit OTP
-	otp, err := s.generateRandomOTP(4)
-	if err != nil {
-		log.Printf("Error generating random OTP: %v", err)
-		return nil, fmt.Errorf("failed to generate OTP: %w", err)
+	// Codes are looked up globally, so draw until the code does not clash
+	// with another student's active one
+	var otp string
+	for attempt := 0; ; attempt++ {
+		otp, err = s.generateRandomOTP(s.otp.length)
+		if err != nil {
+			log.Printf("Error generating random OTP: %v", err)
+			return nil, fmt.Errorf("failed to generate OTP: %w", err)
+		}
+		var clash bool
+		err = s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM otps WHERE otp_hash = $1 AND is_used = false AND expires_at > NOW())", s.otp.hash(otp)).Scan(&clash)
+		if err != nil {
+			return nil, fmt.Errorf("database error: %w", err)
+		}
+		if !clash {
+			break
+		}
+		if attempt == 10 {
+			return nil, errors.New("could not allocate a unique OTP, increase OTP_LENGTH")
+		}
 	}
 
-	// Set expiration time (30 minutes from now)
-	expiresAt := time.Now().Add(30 * time.Minute)
+	expiresAt := time.Now().Add(s.otp.ttl)
 
-	// Insert new OTP
-	_, err = s.db.Exec("INSERT INTO otps (student_id, otp_code, expires_at, is_used) VALUES ($1, $2, $3, $4)", studentID, otp, expiresAt, false)
+	// Insert new OTP. Only the keyed hash is stored.
+	_, err = s.db.Exec("INSERT INTO otps (student_id, otp_hash, expires_at, is_used) VALUES ($1, $2, $3, $4)", studentID, s.otp.hash(otp), expiresAt, false)
 	if err != nil {
 		log.Printf("Error storing new OTP: %v", err)
 		return nil, fmt.Errorf("failed to store OTP: %w", err)
@@ -154,75 +342,120 @@ func (s *AuthService) GenerateOTP(studentID int) (*models.OTPResponse, error) {
 	}, nil
 }
 
-// ValidateOTP checks if an OTP is valid and returns student_id and a new secret code
-func (s *AuthService) ValidateOTP(otpCode string) (*models.OTPValidationResponse, error) {
-	var otp models.OTP
-	log.Printf("Validating OTP: %s", otpCode) // Add debug log
-	err := s.db.QueryRow("SELECT student_id, is_used, expires_at FROM otps WHERE otp_code = $1", otpCode).Scan(&otp.StudentID, &otp.IsUsed, &otp.ExpiresAt)
-	if errors.Is(err, sql.ErrNoRows) {
-		log.Printf("OTP not found for code: %s", otpCode)
+// ValidateOTP checks if an OTP is valid and, if so, enrolls the device and
+// starts a session for the student it was issued to. Attempts are audited and
+// an *otpLockedError is returned while the caller is locked out.
+func (s *AuthService) ValidateOTP(otpCode, ip string, device models.DeviceEnrollment) (*models.OTPValidationResponse, error) {
+	if err := s.otp.checkLockout(s.attempts, ip); err != nil {
+		return nil, err
+	}
+
+	fail := func(studentID, otpID int, reason, message string) (*models.OTPValidationResponse, error) {
+		log.Printf("OTP validation from %s failed: %s", ip, reason)
+		recordOTPAttempt(s.attempts, otpAttempt{IP: ip, StudentID: studentID, OTPID: otpID, Reason: reason})
 		return &models.OTPValidationResponse{
 			Success: false,
-			Message: "Invalid OTP",
+			Message: message,
 		}, nil
+	}
+
+	if !s.otp.wellFormed(otpCode) {
+		return fail(0, 0, otpMalformed, "Invalid OTP")
+	}
+
+	var otp models.OTP
+	err := s.db.QueryRow("SELECT id, student_id, is_used, expires_at, created_at FROM otps WHERE otp_hash = $1 ORDER BY created_at DESC LIMIT 1", s.otp.hash(otpCode)).Scan(&otp.ID, &otp.StudentID, &otp.IsUsed, &otp.ExpiresAt, &otp.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fail(0, 0, otpNotFound, "Invalid OTP")
 	} else if err != nil {
-		log.Printf("Database error while fetching OTP for code %s: %v", otpCode, err)
+		log.Printf("Database error while fetching OTP: %v", err)
 		return nil, fmt.Errorf("database error: %w", err)
 	}
 
 	// Check if OTP is already used
 	if otp.IsUsed {
-		log.Printf("OTP already used for code: %s", otpCode) // Improved logging
-		return &models.OTPValidationResponse{
-			Success: false,
-			Message: "OTP has already been used",
-		}, nil
+		return fail(otp.StudentID, int(otp.ID), otpAlreadyUsed, "OTP has already been used")
 	}
 
 	// Check if OTP is expired
 	if time.Now().After(otp.ExpiresAt) {
-		log.Printf("OTP expired for code: %s", otpCode) // Improved logging
-		otp.IsUsed = true
-		_, err := s.db.Exec("UPDATE otps SET is_used = true WHERE otp_code = ?", otpCode)
+		_, err := s.db.Exec("UPDATE otps SET is_used = true WHERE id = $1", otp.ID)
 		if err != nil {
-			log.Printf("Error marking expired OTP as used for code %s: %v", otpCode, err) // Improved logging
+			log.Printf("Error marking expired OTP %d as used: %v", otp.ID, err)
 		}
-		return &models.OTPValidationResponse{
-			Success: false,
-			Message: "OTP has expired",
-		}, nil
+		return fail(otp.StudentID, int(otp.ID), otpExpired, "OTP has expired")
 	}
 
-	// Mark OTP as used
-	otp.IsUsed = true
-	_, err = s.db.Exec("UPDATE otps SET is_used = true WHERE otp_code = ?", otpCode)
+	// A code that was outstanding through a wave of guesses is retired
+	exposed, err := s.otp.codeExposed(s.attempts, otp.CreatedAt)
 	if err != nil {
-		log.Printf("Error marking OTP as used for code %s: %v", otpCode, err) // Improved logging
+		return nil, err
+	}
+	if exposed {
+		if _, err := s.db.Exec("UPDATE otps SET is_used = true WHERE id = $1", otp.ID); err != nil {
+			log.Printf("Error retiring exposed OTP %d: %v", otp.ID, err)
+		}
+		return fail(otp.StudentID, int(otp.ID), otpExposed, "OTP has expired, ask for a new one")
 	}
 
-	// Removed secret code generation and storage
+	// Mark OTP as used. The is_used guard makes sure two concurrent requests
+	// cannot both redeem the same code.
+	res, err := s.db.Exec("UPDATE otps SET is_used = true WHERE id = $1 AND is_used = false", otp.ID)
+	if err != nil {
+		log.Printf("Error marking OTP %d as used: %v", otp.ID, err)
+		return nil, fmt.Errorf("failed to redeem OTP: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fail(otp.StudentID, int(otp.ID), otpAlreadyUsed, "OTP has already been used")
+	}
+	recordOTPAttempt(s.attempts, otpAttempt{IP: ip, StudentID: otp.StudentID, OTPID: int(otp.ID), Success: true, Reason: otpRedeemed})
+
+	secretCode, err := s.generateSecretCode()
+	if err != nil {
+		log.Printf("Error generating secret code: %v", err)
+		return nil, fmt.Errorf("failed to generate secret code: %w", err)
+	}
+	deviceID, err := enrollDevice(s.db, otp.StudentID, secretCode, device)
+	if err != nil {
+		log.Printf("Error enrolling device for student ID %d: %v", otp.StudentID, err)
+		return nil, fmt.Errorf("failed to enroll device: %w", err)
+	}
+
+	tokens, _, err := issueSession(s.db, studentSubject(otp.StudentID), deviceID)
+	if err != nil {
+		log.Printf("Error issuing session for student ID %d: %v", otp.StudentID, err)
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
 
 	return &models.OTPValidationResponse{
-		Success:   true,
-		StudentID: otp.StudentID,
-		Message:   "Authentication successful",
+		Success:       true,
+		StudentID:     otp.StudentID,
+		SecretCode:    secretCode,
+		DeviceID:      deviceID,
+		Message:       "Authentication successful",
+		SessionTokens: tokens,
 	}, nil
 }
 
-// VerifyDeviceAuth verifies if a device is authorized using student_id and secret_code
-func (s *AuthService) VerifyDeviceAuth(studentID int, secretCode string) (bool, error) {
-	var authDevice models.AuthorizedDevice
-
-	// Check if the device exists
-	err := s.db.QueryRow("SELECT * FROM authorized_devices WHERE student_id = ? AND secret_code = ?", studentID, secretCode).Scan(&authDevice.ID, &authDevice.StudentID, &authDevice.SecretCode)
+// VerifyDeviceAuth checks a device secret against the student's active
+// devices. It returns the device ID, or 0 when the device is not authorized.
+func (s *AuthService) VerifyDeviceAuth(studentID int, secretCode string) (int, error) {
+	var deviceID int
+	err := s.db.QueryRow(
+		"SELECT id FROM authorized_devices WHERE student_id = $1 AND secret_hash = $2 AND revoked_at IS NULL",
+		studentID, hashToken(secretCode),
+	).Scan(&deviceID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return false, nil
+		return 0, nil
 	} else if err != nil {
 		log.Printf("Database error while verifying device authorization: %v", err)
-		return false, fmt.Errorf("database error: %w", err)
+		return 0, fmt.Errorf("database error: %w", err)
 	}
 
-	return true, nil
+	if _, err := s.db.Exec("UPDATE authorized_devices SET last_seen_at = NOW() WHERE id = $1", deviceID); err != nil {
+		log.Printf("Error updating last_seen_at for device %d: %v", deviceID, err)
+	}
+	return deviceID, nil
 }
 
 // RegisterRoutes registers the routes for AuthService
@@ -248,14 +481,21 @@ func (s *AuthService) RegisterRoutes(router *mux.Router) {
 	)
 
 	// Apply CORS middleware to AuthService routes
-	router.HandleFunc("/generate-otp", s.HandleGenerateOTP).Methods("POST")
+	router.Handle("/generate-otp", RequirePermission(PermIssueOTP)(http.HandlerFunc(s.HandleGenerateOTP))).Methods("POST")
 	router.HandleFunc("/validate-otp", s.HandleValidateOTP).Methods("POST")
 	router.HandleFunc("/verify-device-auth", s.HandleVerifyDeviceAuth).Methods("POST")
+	router.HandleFunc("/refresh-token", s.HandleRefreshToken).Methods("POST")
+	router.HandleFunc("/logout", s.HandleLogout).Methods("POST")
 	router.Use(corsMiddleware)
 }
 
-// Helper function to generate a random 4-digit OTP
+// Helper function to generate a random numeric OTP
 func (s *AuthService) generateRandomOTP(digits int) (string, error) {
+	return randomDigits(digits)
+}
+
+// randomDigits returns a crypto-random numeric code of the given length
+func randomDigits(digits int) (string, error) {
 	maxNum := big.NewInt(0).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
 	n, err := rand.Int(rand.Reader, maxNum)
 	if err != nil {
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"server/database"
+	"strings"
+)
+
+// Principal is the authenticated caller derived from a session token. Exactly
+// one of StudentID and StaffID is set.
+type Principal struct {
+	Subject      string
+	Role         string
+	StudentID    int
+	DeviceID     int
+	StaffID      int
+	SupervisorID *int
+	EmployerID   *int
+}
+
+type principalKey struct{}
+
+// principalFromContext returns the caller attached by Authenticate, if any
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authenticatedStudentID returns the trainee the request is authenticated as.
+// The identity always comes from the session token, never from a header.
+func authenticatedStudentID(r *http.Request) (int, error) {
+	p := principalFromContext(r.Context())
+	if p == nil || p.Role != roleTrainee {
+		return 0, errors.New("request is not authenticated as a trainee")
+	}
+	return p.StudentID, nil
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func unauthorized(w http.ResponseWriter, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+	http.Error(w, message, http.StatusUnauthorized)
+}
+
+// Authenticate verifies the bearer access token and attaches the caller's
+// Principal to the request context. Requests without a valid token are
+// rejected with 401.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := bearerToken(r)
+		if token == "" {
+			unauthorized(w, "Missing bearer token")
+			return
+		}
+		claims, err := sessions.parseAccessToken(token)
+		if err != nil {
+			log.Printf("Rejected access token: %v", err)
+			unauthorized(w, "Invalid or expired token")
+			return
+		}
+
+		if claims.DeviceID > 0 {
+			active, err := deviceIsActive(database.DB, claims.DeviceID)
+			if err != nil {
+				log.Printf("Error checking device %d: %v", claims.DeviceID, err)
+				http.Error(w, "Failed to verify session", http.StatusInternalServerError)
+				return
+			}
+			if !active {
+				unauthorized(w, "Device has been revoked")
+				return
+			}
+		}
+
+		principal := &Principal{Subject: claims.Subject, Role: claims.Role, DeviceID: claims.DeviceID}
+		kind, id, err := parseSubject(claims.Subject)
+		if err != nil {
+			unauthorized(w, "Invalid or expired token")
+			return
+		}
+		switch kind {
+		case subjectStudent:
+			principal.StudentID = id
+		case subjectStaff:
+			// Reload the account so role changes and deactivation apply
+			// immediately rather than when the token expires
+			var active bool
+			err := database.DB.QueryRow(
+				`SELECT role, supervisor_id, employer_id, is_active FROM staff_accounts WHERE id = $1`, id,
+			).Scan(&principal.Role, &principal.SupervisorID, &principal.EmployerID, &active)
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && !active) {
+				unauthorized(w, "Account is disabled")
+				return
+			} else if err != nil {
+				log.Printf("Error loading staff account %d: %v", id, err)
+				http.Error(w, "Failed to verify session", http.StatusInternalServerError)
+				return
+			}
+			principal.StaffID = id
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey{}, principal)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireAuth lets any authenticated trainee or staff member through. Handlers
+// behind it decide what the caller may see, usually via resolveStudentID.
+func RequireAuth(next http.Handler) http.Handler {
+	return Authenticate(next)
+}
+
+// RequireStudent only lets requests authenticated as a trainee through
+func RequireStudent(next http.Handler) http.Handler {
+	return Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := principalFromContext(r.Context()); r.Method != http.MethodOptions && (p == nil || p.Role != roleTrainee) {
+			http.Error(w, "Trainee session required", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
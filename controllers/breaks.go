@@ -0,0 +1,325 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	jobBreakOverrun    = "break_overrun"
+	actionBreakOverrun = "break_overrun"
+
+	// Upper bound for either break rule, in minutes
+	maxBreakRuleMinutes = 480
+)
+
+// breakRules decide how a trainee's breaks are treated. A break longer than
+// MaxMinutes raises an alert (0 turns alerts off). The first PaidMinutes of
+// break in a session still count as working time; the rest is unpaid.
+type breakRules struct {
+	MaxMinutes  int
+	PaidMinutes int
+}
+
+// defaultBreakRules are used for employers that do not set their own
+func defaultBreakRules() breakRules {
+	return breakRules{
+		MaxMinutes:  envInt("BREAK_MAX_MINUTES", 60),
+		PaidMinutes: envInt("BREAK_PAID_MINUTES", 0),
+	}
+}
+
+// validateBreakSettings checks an employer's optional break rule overrides
+func validateBreakSettings(maxMinutes, paidMinutes *int) error {
+	if maxMinutes != nil && (*maxMinutes < 0 || *maxMinutes > maxBreakRuleMinutes) {
+		return errors.New("max_break_minutes must be between 0 and 480")
+	}
+	if paidMinutes != nil && (*paidMinutes < 0 || *paidMinutes > maxBreakRuleMinutes) {
+		return errors.New("paid_break_minutes must be between 0 and 480")
+	}
+	return nil
+}
+
+// loadBreakRules returns the break rules of the employer a trainee was
+// placed with on day (YYYY-MM-DD)
+func loadBreakRules(q querier, studentID int, day string) (breakRules, error) {
+	rules, err := breakRulesOn(q, []int{studentID}, []string{day})
+	if err != nil {
+		return breakRules{}, err
+	}
+	return rules[0], nil
+}
+
+// querier is the part of *sql.DB and *sql.Tx that runs queries
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// breakRulesOn returns the break rules for the trainee and date (YYYY-MM-DD)
+// at the same position in studentIDs and dates, in one query. The employer
+// is the one of the placement on that date, or the current one outside any
+// placement.
+func breakRulesOn(q querier, studentIDs []int, dates []string) ([]breakRules, error) {
+	all := make([]breakRules, len(studentIDs))
+	for i := range all {
+		all[i] = defaultBreakRules()
+	}
+	rows, err := q.Query(
+		`SELECT q.n, e.max_break_minutes, e.paid_break_minutes
+		FROM unnest($1::int[], $2::date[]) WITH ORDINALITY AS q(student_id, date, n)
+		JOIN student s ON s.id = q.student_id
+		`+placementAsOf("q.student_id", "q.date")+`
+		JOIN employer e ON e.id = `+placementEmployer,
+		pq.Array(studentIDs), pq.Array(dates),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load break rules: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n int
+		var maxMinutes, paidMinutes sql.NullInt64
+		if err := rows.Scan(&n, &maxMinutes, &paidMinutes); err != nil {
+			return nil, fmt.Errorf("load break rules: %w", err)
+		}
+		if maxMinutes.Valid {
+			all[n-1].MaxMinutes = int(maxMinutes.Int64)
+		}
+		if paidMinutes.Valid {
+			all[n-1].PaidMinutes = int(paidMinutes.Int64)
+		}
+	}
+	return all, rows.Err()
+}
+
+// netWorkedMinutes is a closed session's length less its unpaid breaks, or
+// nil while the session is open or has no check-in
+func netWorkedMinutes(a *models.Attendance) *int {
+	if a.CheckInDateTime == nil || !a.CheckOutDateTime.Valid {
+		return nil
+	}
+	net := minutesAfter(a.CheckOutDateTime.Time, *a.CheckInDateTime) - (a.BreakMinutes - a.PaidBreakMinutes)
+	if net < 0 {
+		net = 0
+	}
+	return &net
+}
+
+// startBreak records a break beginning in the session
+func startBreak(tx *sql.Tx, sessionID, studentID, eventID int, at time.Time, lat, long *float64) error {
+	_, err := tx.Exec(
+		`INSERT INTO attendance_breaks (session_id, student_id, started_at, start_lat, start_long, start_event_id)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		sessionID, studentID, at, lat, long, eventID,
+	)
+	if err != nil {
+		return fmt.Errorf("record break: %w", err)
+	}
+	return nil
+}
+
+// endBreak finishes the session's running break at t. It returns the
+// break's length and how much of it is paid, which the caller adds to the
+// session. Nothing happens when no break is running.
+func endBreak(tx *sql.Tx, s *models.Attendance, eventID int, at time.Time, lat, long *float64) (int, int, error) {
+	if s == nil || !s.OnBreakSince.Valid {
+		return 0, 0, nil
+	}
+	// The session belongs to the day of its check-in
+	started := s.OnBreakSince.Time
+	if s.CheckInDateTime != nil {
+		started = *s.CheckInDateTime
+	}
+	loc, err := studentLocation(database.DB, s.StudentID, started)
+	if err != nil {
+		return 0, 0, fmt.Errorf("load timezone: %w", err)
+	}
+	rules, err := loadBreakRules(tx, s.StudentID, localDate(started, loc))
+	if err != nil {
+		return 0, 0, err
+	}
+	minutes := openBreakMinutes(s, at)
+	paid := rules.PaidMinutes - s.PaidBreakMinutes
+	if paid < 0 {
+		paid = 0
+	}
+	if paid > minutes {
+		paid = minutes
+	}
+	_, err = tx.Exec(
+		`UPDATE attendance_breaks SET ended_at = $1, end_lat = $2, end_long = $3, end_event_id = $4,
+			minutes = $5, paid_minutes = $6, overrun = overrun OR $7
+		WHERE session_id = $8 AND ended_at IS NULL`,
+		at, lat, long, eventID, minutes, paid, rules.MaxMinutes > 0 && minutes > rules.MaxMinutes, s.ID,
+	)
+	if err != nil {
+		return 0, 0, fmt.Errorf("end break: %w", err)
+	}
+	return minutes, paid, nil
+}
+
+// flagBreakOverruns raises breaks that ran, or are still running, longer
+// than the employer allows. Each break is raised once, as a job action for
+// the trainee's supervisor to review.
+func flagBreakOverruns(db *sql.DB, now time.Time) (int, error) {
+	rows, err := db.Query(
+		`SELECT b.id, b.session_id, b.student_id, b.started_at, b.ended_at, b.minutes,
+			COALESCE(a.check_in_date_time::timestamptz, b.started_at)
+		FROM attendance_breaks b JOIN attendance a ON a.id = b.session_id
+		WHERE b.alerted_at IS NULL AND (b.ended_at IS NULL OR b.overrun)`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var breaks []models.AttendanceBreak
+	var sessionStarts []time.Time
+	for rows.Next() {
+		var b models.AttendanceBreak
+		var sessionStart time.Time
+		if err := rows.Scan(&b.ID, &b.SessionID, &b.StudentID, &b.StartedAt, &b.EndedAt, &b.Minutes, &sessionStart); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		breaks = append(breaks, b)
+		sessionStarts = append(sessionStarts, sessionStart)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	if len(breaks) == 0 {
+		return 0, nil
+	}
+
+	// Each break is held to the rules of the employer the trainee was with
+	// on the day its session started
+	ids := make([]int, len(breaks))
+	for i, b := range breaks {
+		ids[i] = b.StudentID
+	}
+	locs, err := studentTimezones(db, ids, now)
+	if err != nil {
+		return 0, err
+	}
+	dates := make([]string, len(breaks))
+	for i, b := range breaks {
+		loc := locs[b.StudentID]
+		if loc == nil {
+			loc = orgLocation
+		}
+		dates[i] = localDate(sessionStarts[i], loc)
+	}
+	allRules, err := breakRulesOn(db, ids, dates)
+	if err != nil {
+		return 0, err
+	}
+
+	raised := 0
+	for i, b := range breaks {
+		rules := allRules[i]
+		length := int(now.Sub(b.StartedAt).Minutes())
+		if b.Minutes != nil {
+			length = *b.Minutes
+		}
+		if rules.MaxMinutes == 0 || length <= rules.MaxMinutes {
+			continue
+		}
+		res, err := db.Exec(`UPDATE attendance_breaks SET overrun = true, alerted_at = $1 WHERE id = $2 AND alerted_at IS NULL`, now, b.ID)
+		if err != nil {
+			log.Printf("Background jobs: flag break %d: %v", b.ID, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		detail := fmt.Sprintf("Break started at %s has run %d minutes without returning, the limit is %d",
+			b.StartedAt.Format(time.RFC3339), length, rules.MaxMinutes)
+		if b.EndedAt != nil {
+			detail = fmt.Sprintf("Break from %s to %s lasted %d minutes, the limit is %d",
+				b.StartedAt.Format(time.RFC3339), b.EndedAt.Format(time.RFC3339), length, rules.MaxMinutes)
+		}
+		logJobAction(db, jobBreakOverrun, actionBreakOverrun, b.StudentID, &b.SessionID, nil, detail)
+		raised++
+	}
+	return raised, nil
+}
+
+// GetAttendanceBreaks lists breaks, newest first. Trainees see their own;
+// staff see the trainees they manage and can narrow it with student_id or
+// session_id. from and to are dates in the organisation's timezone and
+// overrun=true keeps only breaks that ran over.
+func GetAttendanceBreaks(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	scope, args := studentScope(principalFromContext(r.Context()), "s", nil)
+	conds := []string{scope}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	for param, column := range map[string]string{"student_id": "b.student_id", "session_id": "b.session_id"} {
+		if v := q.Get(param); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				http.Error(w, "Invalid "+param, http.StatusBadRequest)
+				return
+			}
+			conds = append(conds, column+" = "+arg(id))
+		}
+	}
+	from, to, err := dateRangeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from != "" {
+		d, _ := time.ParseInLocation(dateLayout, from, orgLocation)
+		conds = append(conds, "b.started_at >= "+arg(d.UTC()))
+	}
+	if to != "" {
+		d, _ := time.ParseInLocation(dateLayout, to, orgLocation)
+		conds = append(conds, "b.started_at < "+arg(d.AddDate(0, 0, 1).UTC()))
+	}
+	if q.Get("overrun") == "true" {
+		conds = append(conds, "b.overrun")
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT b.id, b.session_id, b.student_id, b.started_at, b.start_lat, b.start_long,
+			b.ended_at, b.end_lat, b.end_long, b.minutes, b.paid_minutes, b.overrun, b.alerted_at
+		FROM attendance_breaks b JOIN student s ON s.id = b.student_id
+		WHERE `+strings.Join(conds, " AND ")+` ORDER BY b.started_at DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading breaks: %v", err)
+		http.Error(w, "Failed to load breaks", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	breaks := []models.AttendanceBreak{}
+	for rows.Next() {
+		var b models.AttendanceBreak
+		err := rows.Scan(&b.ID, &b.SessionID, &b.StudentID, &b.StartedAt, &b.StartLat, &b.StartLong,
+			&b.EndedAt, &b.EndLat, &b.EndLong, &b.Minutes, &b.PaidMinutes, &b.Overrun, &b.AlertedAt)
+		if err != nil {
+			http.Error(w, "Failed to load breaks", http.StatusInternalServerError)
+			return
+		}
+		breaks = append(breaks, b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breaks)
+}
@@ -0,0 +1,496 @@
+package controllers
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+const (
+	excusedHoliday = "holiday"
+	excusedClosure = "closure"
+	excusedLeave   = "leave"
+
+	// Largest .ics file accepted by /holidays/import
+	maxCalendarUpload = 1 << 20
+)
+
+// excuse is why a trainee does not have to attend on a day
+type excuse struct {
+	kind, reason string
+}
+
+// excusedDays reports why each trainee does not have to attend on the date
+// (YYYY-MM-DD) at the same position in dates, keyed by student ID. Trainees
+// who do have to attend are left out. A holiday wins over a closure of the
+// employer they were placed with that day, which wins over approved leave.
+func excusedDays(db *sql.DB, studentIDs []int, dates []string) (map[int]excuse, error) {
+	rows, err := db.Query(
+		`SELECT q.student_id, x.kind, x.reason
+		FROM unnest($1::int[], $2::date[]) AS q(student_id, date)
+		JOIN student s ON s.id = q.student_id
+		`+placementAsOf("s.id", "q.date")+`
+		JOIN LATERAL (
+			SELECT 1 AS rank, 'holiday' AS kind, name AS reason FROM holidays WHERE date = q.date
+			UNION ALL
+			SELECT 2, 'closure', COALESCE(NULLIF(c.reason, ''), 'Workplace closed') FROM employer_closures c
+				WHERE c.employer_id = `+placementEmployer+` AND c.date = q.date
+			UNION ALL
+			SELECT 3, 'leave', l.leave_type FROM leave_requests l
+				WHERE l.student_id = q.student_id AND l.status = 'approved' AND q.date BETWEEN l.start_date AND l.end_date
+			ORDER BY rank LIMIT 1
+		) x ON TRUE`,
+		pq.Array(studentIDs), pq.Array(dates),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load calendar: %w", err)
+	}
+	defer rows.Close()
+	out := map[int]excuse{}
+	for rows.Next() {
+		var id int
+		var e excuse
+		if err := rows.Scan(&id, &e.kind, &e.reason); err != nil {
+			return nil, fmt.Errorf("load calendar: %w", err)
+		}
+		out[id] = e
+	}
+	return out, rows.Err()
+}
+
+// excuseAbsences clears absences already recorded for days that turn out to
+// be excused. where limits the absences (aliased a) and may use the bind
+// values in args.
+func excuseAbsences(db *sql.DB, kind, where string, args ...interface{}) {
+	args = append([]interface{}{kind}, args...)
+	if _, err := db.Exec(
+		`UPDATE absences a SET excused = $1, cleared_at = NOW() WHERE a.cleared_at IS NULL AND `+where, args...,
+	); err != nil {
+		log.Printf("Error excusing absences for %s: %v", kind, err)
+	}
+}
+
+// dateRangeFilter reads optional from and to query parameters (YYYY-MM-DD)
+func dateRangeFilter(r *http.Request) (string, string, error) {
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse(dateLayout, d); d != "" && err != nil {
+			return "", "", errors.New("from and to must be dates (YYYY-MM-DD)")
+		}
+	}
+	return from, to, nil
+}
+
+// GetHolidays lists the organisation's holidays, optionally between from and
+// to
+func GetHolidays(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRangeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := database.DB.Query(
+		`SELECT id, date, name, source FROM holidays
+		WHERE ($1 = '' OR date >= $1::date) AND ($2 = '' OR date <= $2::date) ORDER BY date`, from, to,
+	)
+	if err != nil {
+		log.Printf("Error loading holidays: %v", err)
+		http.Error(w, "Failed to load holidays", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	holidays := []models.Holiday{}
+	for rows.Next() {
+		var h models.Holiday
+		var date time.Time
+		if err := rows.Scan(&h.ID, &date, &h.Name, &h.Source); err != nil {
+			http.Error(w, "Failed to load holidays", http.StatusInternalServerError)
+			return
+		}
+		h.Date = date.Format(dateLayout)
+		holidays = append(holidays, h)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holidays)
+}
+
+// saveHoliday adds a holiday or renames the one already on that date
+func saveHoliday(db *sql.DB, h *models.Holiday, uid string) error {
+	err := db.QueryRow(
+		`INSERT INTO holidays (date, name, source, uid) VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (date) DO UPDATE SET name = EXCLUDED.name, source = EXCLUDED.source, uid = EXCLUDED.uid
+		RETURNING id`,
+		h.Date, h.Name, h.Source, uid,
+	).Scan(&h.ID)
+	if err != nil {
+		return err
+	}
+	excuseAbsences(db, excusedHoliday, "a.date = $2::date", h.Date)
+	return nil
+}
+
+// CreateHoliday adds a single holiday
+func CreateHoliday(w http.ResponseWriter, r *http.Request) {
+	var h models.Holiday
+	if err := json.NewDecoder(r.Body).Decode(&h); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	h.Name = strings.TrimSpace(h.Name)
+	if _, err := time.Parse(dateLayout, h.Date); err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if h.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	h.Source = "manual"
+	if err := saveHoliday(database.DB, &h, ""); err != nil {
+		log.Printf("Error saving holiday %s: %v", h.Date, err)
+		http.Error(w, "Failed to save holiday", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(h)
+}
+
+// DeleteHoliday removes a holiday. Absences already excused by it stay
+// cleared.
+func DeleteHoliday(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid holiday ID", http.StatusBadRequest)
+		return
+	}
+	res, err := database.DB.Exec(`DELETE FROM holidays WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, "Failed to delete holiday", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Holiday not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportHolidays loads all-day events from an iCalendar file as holidays. The
+// file is sent either as the request body (text/calendar) or as the "file"
+// field of a multipart form. Events that repeat (RRULE) are imported for
+// their first date only, and events longer than maxEventDays are refused.
+// Existing holidays on the same dates are renamed.
+func ImportHolidays(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxCalendarUpload)
+	var body io.Reader = r.Body
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Upload the calendar in a field named file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	events, err := parseICalendar(body)
+	if err != nil {
+		http.Error(w, "Invalid calendar: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	holidays := []models.Holiday{}
+	for _, ev := range events {
+		for _, date := range ev.dates {
+			h := models.Holiday{Date: date, Name: ev.summary, Source: "ics"}
+			if err := saveHoliday(database.DB, &h, ev.uid); err != nil {
+				log.Printf("Error importing holiday %s: %v", date, err)
+				http.Error(w, "Failed to save holidays", http.StatusInternalServerError)
+				return
+			}
+			holidays = append(holidays, h)
+		}
+	}
+	log.Printf("Imported %d holidays from %d calendar events", len(holidays), len(events))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(holidays)
+}
+
+// calendarEvent is an all-day VEVENT with the dates it covers
+type calendarEvent struct {
+	uid     string
+	summary string
+	dates   []string
+}
+
+// parseICalendar reads the VEVENTs of an RFC 5545 calendar. Timed events
+// cover the dates they touch in the organisation's timezone; DTEND is
+// exclusive.
+func parseICalendar(r io.Reader) ([]calendarEvent, error) {
+	// Unfold continuation lines first
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxCalendarUpload)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCALENDAR") {
+		return nil, errors.New("missing BEGIN:VCALENDAR")
+	}
+
+	var events []calendarEvent
+	var inEvent bool
+	var ev calendarEvent
+	var start, end string
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, _, _ := strings.Cut(strings.ToUpper(name), ";")
+		switch {
+		case prop == "BEGIN" && strings.EqualFold(value, "VEVENT"):
+			inEvent, ev, start, end = true, calendarEvent{}, "", ""
+		case prop == "END" && strings.EqualFold(value, "VEVENT"):
+			inEvent = false
+			dates, err := eventDates(start, end)
+			if err != nil {
+				return nil, fmt.Errorf("event %q: %w", ev.summary, err)
+			}
+			ev.dates = dates
+			if ev.summary == "" {
+				ev.summary = "Holiday"
+			}
+			events = append(events, ev)
+		case !inEvent:
+		case prop == "UID":
+			ev.uid = value
+		case prop == "SUMMARY":
+			ev.summary = unescapeICalText(value)
+		case prop == "DTSTART":
+			start = line
+		case prop == "DTEND":
+			end = line
+		}
+	}
+	return events, nil
+}
+
+// maxEventDays is the longest event imported as holidays
+const maxEventDays = 31
+
+// eventDates expands an event into the dates it covers. start and end are
+// the DTSTART and DTEND lines; end may be empty.
+func eventDates(start, end string) ([]string, error) {
+	if start == "" {
+		return nil, errors.New("missing DTSTART")
+	}
+	first, _, err := eventTime(start)
+	if err != nil {
+		return nil, errors.New("invalid DTSTART")
+	}
+	last := first
+	if end != "" {
+		e, allDay, err := eventTime(end)
+		if err != nil {
+			return nil, errors.New("invalid DTEND")
+		}
+		if allDay {
+			// All-day events end the day before DTEND
+			e = e.AddDate(0, 0, -1)
+		} else if e.After(first) {
+			// An event ending at midnight does not cover the next day
+			e = e.Add(-time.Nanosecond)
+		}
+		if e.After(last) {
+			last = e
+		}
+	}
+	firstDay := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, time.UTC)
+	lastDay := time.Date(last.Year(), last.Month(), last.Day(), 0, 0, 0, 0, time.UTC)
+	if lastDay.Sub(firstDay) >= maxEventDays*24*time.Hour {
+		return nil, fmt.Errorf("lasts more than %d days", maxEventDays)
+	}
+	var dates []string
+	for d := firstDay; !d.After(lastDay); d = d.AddDate(0, 0, 1) {
+		dates = append(dates, d.Format(dateLayout))
+	}
+	return dates, nil
+}
+
+// eventTime reads a DTSTART or DTEND line as a time in the organisation's
+// timezone. Dates are all-day; times are UTC with a trailing Z, in the zone
+// named by TZID, or otherwise already local.
+func eventTime(line string) (time.Time, bool, error) {
+	name, value, _ := strings.Cut(line, ":")
+	value = strings.TrimSpace(value)
+	if len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, orgLocation)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		return t.In(orgLocation), false, err
+	}
+	loc := orgLocation
+	for _, param := range strings.Split(name, ";")[1:] {
+		if key, tz, ok := strings.Cut(param, "="); ok && strings.EqualFold(key, "TZID") {
+			loc = locationFor(strings.Trim(tz, `"`))
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	return t.In(orgLocation), false, err
+}
+
+func unescapeICalText(s string) string {
+	return strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(strings.TrimSpace(s))
+}
+
+// employerAllowed reports whether the caller may manage an employer's
+// closures, sites and site codes. Employer contacts only manage their own workplace.
+func employerAllowed(p *Principal, employerID int) bool {
+	if p.Role != roleEmployer {
+		return true
+	}
+	return p.EmployerID != nil && *p.EmployerID == employerID
+}
+
+// GetEmployerClosures lists closure days, optionally for one employer
+// (?employer_id=) and between from and to
+func GetEmployerClosures(w http.ResponseWriter, r *http.Request) {
+	from, to, err := dateRangeFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	employerID := 0
+	if v := r.URL.Query().Get("employer_id"); v != "" {
+		if employerID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid employer_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if p := principalFromContext(r.Context()); p.Role == roleEmployer {
+		if p.EmployerID == nil {
+			employerID = -1
+		} else {
+			employerID = *p.EmployerID
+		}
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT id, employer_id, date, reason FROM employer_closures
+		WHERE ($1 = 0 OR employer_id = $1) AND ($2 = '' OR date >= $2::date) AND ($3 = '' OR date <= $3::date)
+		ORDER BY date, employer_id`, employerID, from, to,
+	)
+	if err != nil {
+		log.Printf("Error loading closures: %v", err)
+		http.Error(w, "Failed to load closures", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	closures := []models.EmployerClosure{}
+	for rows.Next() {
+		var c models.EmployerClosure
+		var date time.Time
+		if err := rows.Scan(&c.ID, &c.EmployerID, &date, &c.Reason); err != nil {
+			http.Error(w, "Failed to load closures", http.StatusInternalServerError)
+			return
+		}
+		c.Date = date.Format(dateLayout)
+		closures = append(closures, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(closures)
+}
+
+// CreateEmployerClosure marks a day an employer is closed
+func CreateEmployerClosure(w http.ResponseWriter, r *http.Request) {
+	var c models.EmployerClosure
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse(dateLayout, c.Date); err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	p := principalFromContext(r.Context())
+	if !employerAllowed(p, c.EmployerID) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return
+	}
+	c.Reason = strings.TrimSpace(c.Reason)
+
+	err := database.DB.QueryRow(
+		`INSERT INTO employer_closures (employer_id, date, reason, created_by)
+		SELECT id, $2, $3, $4 FROM employer WHERE id = $1
+		ON CONFLICT (employer_id, date) DO UPDATE SET reason = EXCLUDED.reason
+		RETURNING id`,
+		c.EmployerID, c.Date, c.Reason, p.StaffID,
+	).Scan(&c.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error saving closure for employer %d: %v", c.EmployerID, err)
+		http.Error(w, "Failed to save closure", http.StatusInternalServerError)
+		return
+	}
+	// Only trainees placed with the employer on that day are excused, as in
+	// excusedDays
+	excuseAbsences(database.DB, excusedClosure,
+		`a.date = $2::date AND a.student_id IN (
+			SELECT s.id FROM student s `+placementAsOf("s.id", "$2::date")+`
+			WHERE `+placementEmployer+` = $3
+		)`, c.Date, c.EmployerID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// DeleteEmployerClosure removes a closure day
+func DeleteEmployerClosure(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid closure ID", http.StatusBadRequest)
+		return
+	}
+	var employerID int
+	err = database.DB.QueryRow(`SELECT employer_id FROM employer_closures WHERE id = $1`, id).Scan(&employerID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !employerAllowed(principalFromContext(r.Context()), employerID)) {
+		http.Error(w, "Closure not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load closure", http.StatusInternalServerError)
+		return
+	}
+	if _, err := database.DB.Exec(`DELETE FROM employer_closures WHERE id = $1`, id); err != nil {
+		http.Error(w, "Failed to delete closure", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
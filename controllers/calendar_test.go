@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The organisation's timezone is the default, Asia/Colombo (UTC+05:30)
+func TestEventDates(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end string
+		want       []string
+		wantErr    bool
+	}{
+		{"single all-day", "DTSTART;VALUE=DATE:20261225", "DTEND;VALUE=DATE:20261226", []string{"2026-12-25"}, false},
+		{"no end", "DTSTART;VALUE=DATE:20261225", "", []string{"2026-12-25"}, false},
+		{"multi-day", "DTSTART;VALUE=DATE:20261230", "DTEND;VALUE=DATE:20270102", []string{"2026-12-30", "2026-12-31", "2027-01-01"}, false},
+		{"end before start", "DTSTART;VALUE=DATE:20261225", "DTEND;VALUE=DATE:20261220", []string{"2026-12-25"}, false},
+		// 20:00 UTC is 01:30 the next day in Colombo
+		{"UTC time", "DTSTART:20261224T200000Z", "DTEND:20261224T210000Z", []string{"2026-12-25"}, false},
+		{"TZID", "DTSTART;TZID=Europe/London:20261224T230000", "DTEND;TZID=Europe/London:20261224T233000", []string{"2026-12-25"}, false},
+		{"floating time", "DTSTART:20261224T230000", "DTEND:20261225T010000", []string{"2026-12-24", "2026-12-25"}, false},
+		{"ends at midnight", "DTSTART:20261224T090000", "DTEND:20261225T000000", []string{"2026-12-24"}, false},
+		{"32 days", "DTSTART;VALUE=DATE:20260101", "DTEND;VALUE=DATE:20260202", nil, true},
+		{"missing start", "", "DTEND;VALUE=DATE:20261226", nil, true},
+		{"bad start", "DTSTART;VALUE=DATE:2026122", "", nil, true},
+		{"bad end", "DTSTART;VALUE=DATE:20261225", "DTEND:tomorrow", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := eventDates(tt.start, tt.end)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	got, err := eventDates("DTSTART;VALUE=DATE:20260101", "DTEND;VALUE=DATE:20260201")
+	if err != nil || len(got) != maxEventDays || got[len(got)-1] != "2026-01-31" {
+		t.Errorf("a 31 day event: got %v, %v", got, err)
+	}
+}
+
+func TestParseICalendar(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"BEGIN:VEVENT",
+		"UID:xmas@example.com",
+		"SUMMARY:Christmas\\, Day",
+		"DTSTART;VALUE=DATE:20261225",
+		"DTEND;VALUE=DATE:20261226",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"UID:poya",
+		"SUMMARY:Full moon",
+		"  Poya",
+		"DTSTART:20261223T190000Z",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20261231",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+	events, err := parseICalendar(strings.NewReader(ics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []calendarEvent{
+		{uid: "xmas@example.com", summary: "Christmas, Day", dates: []string{"2026-12-25"}},
+		{uid: "poya", summary: "Full moon Poya", dates: []string{"2026-12-24"}},
+		{summary: "Holiday", dates: []string{"2026-12-31"}},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got %+v, want %+v", events, want)
+	}
+
+	for name, bad := range map[string]string{
+		"not a calendar": "BEGIN:VEVENT\r\nEND:VEVENT",
+		"empty":          "",
+		"too long":       "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nDTSTART;VALUE=DATE:20260101\r\nDTEND;VALUE=DATE:20260301\r\nEND:VEVENT\r\nEND:VCALENDAR",
+		"no start":       "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:x\r\nEND:VEVENT\r\nEND:VCALENDAR",
+	} {
+		if _, err := parseICalendar(strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -2,10 +2,25 @@ package controllers
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
 	"server/database"
 	"server/models"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// Dashboard attendance states for today
+const (
+	statusPresent    = "present"
+	statusOnBreak    = "on_break"
+	statusCheckedOut = "checked_out"
+	statusAutoClosed = "auto_closed"
+	statusAbsent     = "absent"
+	statusExpected   = "expected"
+	statusDayOff     = "day_off"
+	statusExcused    = "excused"
 )
 
 func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
@@ -17,7 +32,12 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
         e.name AS employer_name,
         a.check_in_date_time,
         a.check_out_date_time,
-        m.emotion
+        a.late_minutes,
+        a.early_leave_minutes,
+        COALESCE(a.auto_closed, false),
+        a.on_break_since,
+        m.emotion,
+        COALESCE(NULLIF(s.timezone, ''), NULLIF(e.timezone, ''), '') AS timezone
     FROM student s
     LEFT JOIN employer e ON s.employer_id = e.id
     LEFT JOIN (
@@ -37,11 +57,12 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
             FROM mood
             GROUP BY student_id
         ) m2 ON m1.student_id = m2.student_id AND m1.recorded_at = m2.latest_update
-    ) m ON s.id = m.student_id;
-    `
+    ) m ON s.id = m.student_id
+    WHERE `
 
+	scope, args := studentScope(principalFromContext(r.Context()), "s", nil)
 	var students []models.StudentCard
-	rows, err := database.DB.Query(query)
+	rows, err := database.DB.Query(query+scope, args...)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(models.ErrorResponse{Error: "Failed to execute query"})
@@ -49,10 +70,13 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 
+	now := time.Now()
+	locs := map[int]*time.Location{}
 	for rows.Next() {
 		var student models.StudentCard
 		var checkInDateTime, checkOutDateTime *time.Time
 		var emotion *string
+		var timezone string
 
 		err := rows.Scan(
 			&student.StudentID,
@@ -61,7 +85,12 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
 			&student.EmployerName,
 			&checkInDateTime,
 			&checkOutDateTime,
+			&student.LateMinutes,
+			&student.EarlyLeaveMinutes,
+			&student.AutoClosed,
+			&student.OnBreakSince,
 			&emotion,
+			&timezone,
 		)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -70,8 +99,11 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Handle NULL values
+		loc := locationFor(timezone)
 		if checkInDateTime != nil {
 			student.CheckInDateTime = *checkInDateTime
+			student.AttendanceDate = localDate(*checkInDateTime, loc)
+			student.CheckedInToday = student.AttendanceDate == localDate(now, loc)
 		}
 		if checkOutDateTime != nil {
 			student.CheckOutDateTime = *checkOutDateTime
@@ -81,8 +113,81 @@ func GetStudentDetails(w http.ResponseWriter, r *http.Request) {
 		}
 
 		students = append(students, student)
+		locs[int(student.StudentID)] = loc
+	}
+	rows.Close()
+
+	if err := setAttendanceStatuses(students, now, locs); err != nil {
+		log.Printf("Error working out attendance statuses: %v", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(students)
 }
+
+// setAttendanceStatuses fills in whether each trainee is due today and what
+// their attendance looks like so far. Schedules and absences are loaded for
+// all the cards at once.
+func setAttendanceStatuses(cards []models.StudentCard, now time.Time, locs map[int]*time.Location) error {
+	scheds, err := resolveSchedules(database.DB, now, locs)
+	if err != nil {
+		return err
+	}
+	var ids []int
+	var dates []string
+	for id, sched := range scheds {
+		ids = append(ids, id)
+		dates = append(dates, sched.Date)
+	}
+	absent := map[int]bool{}
+	rows, err := database.DB.Query(
+		`SELECT a.student_id FROM absences a
+		JOIN unnest($1::int[], $2::date[]) AS q(student_id, date) ON q.student_id = a.student_id AND q.date = a.date
+		WHERE a.cleared_at IS NULL`,
+		pq.Array(ids), pq.Array(dates),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return err
+		}
+		absent[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i := range cards {
+		card := &cards[i]
+		sched := scheds[int(card.StudentID)]
+		if sched == nil {
+			continue
+		}
+		card.ScheduledToday = sched.Scheduled
+
+		switch {
+		case card.CheckedInToday && card.CheckOutDateTime.IsZero() && card.OnBreakSince != nil:
+			card.Status = statusOnBreak
+		case card.CheckedInToday && card.CheckOutDateTime.IsZero():
+			card.Status = statusPresent
+		case card.CheckedInToday && card.AutoClosed:
+			card.Status = statusAutoClosed
+		case card.CheckedInToday:
+			card.Status = statusCheckedOut
+		case sched.Excused != "":
+			card.Status = statusExcused
+			card.ExcusedReason = sched.ExcusedReason
+		case !sched.Scheduled:
+			card.Status = statusDayOff
+		case absent[int(card.StudentID)]:
+			card.Status = statusAbsent
+		default:
+			card.Status = statusExpected
+		}
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+const (
+	commuteAtHome     = "at_home"
+	commuteTravelling = "travelling"
+	commuteArrived    = "arrived"
+	commuteOverdue    = "overdue"
+
+	// Who is told about a trainee's commute
+	commuteNotifyGuardian   = "guardian"
+	commuteNotifySupervisor = "supervisor"
+	commuteNotifyBoth       = "both"
+
+	jobCommute           = "commute_tracking"
+	actionCommuteOverdue = "commute_overdue"
+
+	// Upper bound for a trainee's expected travel time, in minutes
+	maxCommuteMinutes = 240
+)
+
+const commuteTripColumns = `id, student_id, trip_date, status, window_start, window_end, left_home_at, expected_minutes,
+	expected_by, arrived_at, overdue_alerted_at, last_ping_at, last_lat, last_long`
+
+func scanCommuteTrip(row interface{ Scan(...interface{}) error }, t *models.CommuteTrip) error {
+	var date time.Time
+	err := row.Scan(&t.ID, &t.StudentID, &date, &t.Status, &t.WindowStart, &t.WindowEnd, &t.LeftHomeAt, &t.ExpectedMinutes,
+		&t.ExpectedBy, &t.ArrivedAt, &t.OverdueAlertedAt, &t.LastPingAt, &t.LastLat, &t.LastLong)
+	if err != nil {
+		return err
+	}
+	t.Date = date.Format(dateLayout)
+	return nil
+}
+
+// loadCommuteSettings returns a trainee's commute tracking settings
+func loadCommuteSettings(q queryRower, studentID int) (models.CommuteSettings, error) {
+	var s models.CommuteSettings
+	err := q.QueryRow(
+		`SELECT commute_tracking, commute_notify, commute_minutes FROM student WHERE id = $1`, studentID,
+	).Scan(&s.Enabled, &s.Notify, &s.ExpectedMinutes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, errStudentNotAccessible
+	}
+	return s, err
+}
+
+// commuteWindow is when the app should send pings on the day of now: from
+// COMMUTE_WINDOW_MINUTES (default 180) before the scheduled start until the
+// trainee would be marked absent. ok is false on days without work.
+func commuteWindow(db *sql.DB, studentID int, now time.Time) (day string, start, end time.Time, ok bool, err error) {
+	loc, err := studentLocation(db, studentID, now)
+	if err != nil {
+		return "", start, end, false, fmt.Errorf("load timezone: %w", err)
+	}
+	schedIn, _, err := scheduledTimes(db, studentID, now, loc)
+	if err != nil || schedIn == nil {
+		return "", start, end, false, err
+	}
+	start = schedIn.Add(-time.Duration(envInt("COMMUTE_WINDOW_MINUTES", 180)) * time.Minute)
+	end = schedIn.Add(absenceGrace())
+	return localDate(*schedIn, loc), start, end, true, nil
+}
+
+// commutePlaces returns the trainee's home and their workplace on day,
+// either of which may be missing
+func commutePlaces(db *sql.DB, studentID int, day string) (home, work *LatLng, err error) {
+	var homeLat, homeLong sql.NullFloat64
+	err = db.QueryRow(`SELECT home_lat, home_long FROM student WHERE id = $1`, studentID).Scan(&homeLat, &homeLong)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load home: %w", err)
+	}
+	if homeLat.Valid && homeLong.Valid && hasPosition(&homeLat.Float64, &homeLong.Float64) {
+		home = &LatLng{Lat: homeLat.Float64, Lng: homeLong.Float64}
+	}
+	wp, _, err := loadWorkplace(db, studentID, day)
+	if err != nil {
+		return nil, nil, err
+	}
+	return home, wp.Position, nil
+}
+
+// expectedCommuteMinutes is how long the trip to work should take: the
+// trainee's own setting, else the route distance at COMMUTE_SPEED_KMH
+// (default 20), else COMMUTE_DEFAULT_MINUTES (default 45)
+func expectedCommuteMinutes(ctx context.Context, settings models.CommuteSettings, from, work *LatLng) int {
+	if settings.ExpectedMinutes != nil {
+		return *settings.ExpectedMinutes
+	}
+	fallback := envInt("COMMUTE_DEFAULT_MINUTES", 45)
+	speed := envInt("COMMUTE_SPEED_KMH", 20)
+	if from == nil || work == nil || speed <= 0 {
+		return fallback
+	}
+	measured, err := distances.Measure(ctx, *from, *work)
+	if err != nil {
+		log.Printf("Commute: measure route: %v", err)
+		return fallback
+	}
+	minutes := int(math.Ceil(float64(measured.Meters) / 1000 / float64(speed) * 60))
+	if minutes < 5 {
+		minutes = 5
+	}
+	return minutes
+}
+
+// notifyCommute tells the trainee's guardian by SMS and/or supervisor by
+// email, as the trainee's settings say. Failures are logged; a ping is never
+// refused because a message could not be sent.
+func notifyCommute(ctx context.Context, db *sql.DB, studentID int, notify, subject, body string) {
+	var guardian, supervisor string
+	err := db.QueryRow(
+		`SELECT COALESCE(s.contact_number_guardian, ''), COALESCE(sup.email_address, '')
+		FROM student s LEFT JOIN supervisor sup ON sup.supervisor_id = s.supervisor_id
+		WHERE s.id = $1`, studentID,
+	).Scan(&guardian, &supervisor)
+	if err != nil {
+		log.Printf("Commute: load contacts for student %d: %v", studentID, err)
+		return
+	}
+	send := func(channel, to string) {
+		if strings.TrimSpace(to) == "" {
+			log.Printf("Commute: student %d has no %s contact on record", studentID, channel)
+			return
+		}
+		if err := sendMessage(ctx, channel, OutboundMessage{To: to, Subject: subject, Body: body}); err != nil {
+			log.Printf("Commute: notify %s for student %d: %v", maskRecipient(to), studentID, err)
+		}
+	}
+	if notify == commuteNotifyGuardian || notify == commuteNotifyBoth {
+		send(channelSMS, guardian)
+	}
+	if notify == commuteNotifySupervisor || notify == commuteNotifyBoth {
+		send(channelEmail, supervisor)
+	}
+}
+
+// commuteMessage is a notification to send once the trip is saved
+type commuteMessage struct {
+	Subject string
+	Body    string
+}
+
+// PostCommutePing records the app's position while commute mode is on and
+// moves today's trip along. The first ping further than
+// COMMUTE_HOME_RADIUS_METERS (default 150) from home marks the departure;
+// a ping inside the workplace geofence marks the arrival. Both are sent to
+// the guardian or supervisor.
+func PostCommutePing(w http.ResponseWriter, r *http.Request) {
+	studentID, err := authenticatedStudentID(r)
+	if err != nil {
+		http.Error(w, "Trainee session required", http.StatusUnauthorized)
+		return
+	}
+	var ping models.CommutePing
+	if err := json.NewDecoder(r.Body).Decode(&ping); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !hasPosition(&ping.Latitude, &ping.Longitude) || math.Abs(ping.Latitude) > 90 || math.Abs(ping.Longitude) > 180 {
+		http.Error(w, "latitude and longitude must be a valid position", http.StatusBadRequest)
+		return
+	}
+
+	settings, err := loadCommuteSettings(database.DB, studentID)
+	if err != nil {
+		log.Printf("Error loading commute settings for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record ping", http.StatusInternalServerError)
+		return
+	}
+	if !settings.Enabled {
+		http.Error(w, "Commute tracking is turned off", http.StatusConflict)
+		return
+	}
+	now := time.Now()
+	day, start, end, ok, err := commuteWindow(database.DB, studentID, now)
+	if err != nil {
+		log.Printf("Error resolving commute window for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record ping", http.StatusInternalServerError)
+		return
+	}
+	if !ok || now.Before(start) || now.After(end) {
+		http.Error(w, "Outside today's travel window", http.StatusConflict)
+		return
+	}
+	home, work, err := commutePlaces(database.DB, studentID, day)
+	if err != nil {
+		log.Printf("Error recording commute ping for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record ping", http.StatusInternalServerError)
+		return
+	}
+	fence, err := evaluateGeofence(database.DB, studentID, day, &ping.Latitude, &ping.Longitude)
+	if err != nil {
+		log.Printf("Error recording commute ping for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record ping", http.StatusInternalServerError)
+		return
+	}
+
+	trip, messages, err := applyCommutePing(r.Context(), studentID, settings, day, start, end, ping, now, home, work, fence)
+	if err != nil {
+		log.Printf("Error recording commute ping for student %d: %v", studentID, err)
+		http.Error(w, "Failed to record ping", http.StatusInternalServerError)
+		return
+	}
+	for _, m := range messages {
+		notifyCommute(r.Context(), database.DB, studentID, settings.Notify, m.Subject, m.Body)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(trip)
+}
+
+// applyCommutePing stores a ping against today's trip and returns the trip
+// with any notifications the ping triggered
+func applyCommutePing(ctx context.Context, studentID int, settings models.CommuteSettings, day string, start, end time.Time,
+	ping models.CommutePing, now time.Time, home, work *LatLng, fence geofenceResult) (*models.CommuteTrip, []commuteMessage, error) {
+	here := LatLng{Lat: ping.Latitude, Lng: ping.Longitude}
+	leftHome := home == nil || haversine(home.Lat, home.Lng, here.Lat, here.Lng) > envInt("COMMUTE_HOME_RADIUS_METERS", 150)
+	// Without a home on record the first ping is the best guess at where
+	// the trip started
+	from := home
+	if from == nil {
+		from = &here
+	}
+	// The route is measured before the trip is locked, so a slow distance
+	// provider cannot hold up other pings for the same trip
+	var measured *int
+	if fence.Status != geofenceInside && leftHome {
+		var status string
+		err := database.DB.QueryRow(
+			`SELECT status FROM commute_trips WHERE student_id = $1 AND trip_date = $2`, studentID, day,
+		).Scan(&status)
+		if errors.Is(err, sql.ErrNoRows) || (err == nil && status == commuteAtHome) {
+			minutes := expectedCommuteMinutes(ctx, settings, from, work)
+			measured = &minutes
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("load trip: %w", err)
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO commute_trips (student_id, trip_date, window_start, window_end) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (student_id, trip_date) DO NOTHING`, studentID, day, start, end,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create trip: %w", err)
+	}
+	var trip models.CommuteTrip
+	err = scanCommuteTrip(tx.QueryRow(
+		`SELECT `+commuteTripColumns+` FROM commute_trips WHERE student_id = $1 AND trip_date = $2 FOR UPDATE`, studentID, day,
+	), &trip)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load trip: %w", err)
+	}
+	// Nothing left to track once the trainee is at work
+	if trip.Status == commuteArrived {
+		return &trip, nil, tx.Commit()
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO commute_pings (trip_id, student_id, recorded_at, latitude, longitude, accuracy_m) VALUES ($1, $2, $3, $4, $5, $6)`,
+		trip.ID, studentID, now, ping.Latitude, ping.Longitude, ping.AccuracyM,
+	)
+	if err != nil {
+		return nil, nil, fmt.Errorf("record ping: %w", err)
+	}
+
+	var messages []commuteMessage
+	name := studentName(tx, studentID)
+	clock := now.In(commuteLocation(database.DB, studentID, now)).Format("15:04")
+	switch {
+	case fence.Status == geofenceInside:
+		trip.Status = commuteArrived
+		trip.ArrivedAt = &now
+		messages = append(messages, commuteMessage{
+			Subject: name + " arrived at work",
+			Body:    fmt.Sprintf("%s arrived at work at %s.", name, clock),
+		})
+	case trip.Status == commuteAtHome:
+		if !leftHome {
+			break
+		}
+		// Trips never go back to at_home, so the route was measured above;
+		// the estimate without a route is only a guard
+		minutes := expectedCommuteMinutes(ctx, settings, nil, nil)
+		if measured != nil {
+			minutes = *measured
+		}
+		expectedBy := now.Add(time.Duration(minutes+envInt("COMMUTE_MARGIN_MINUTES", 20)) * time.Minute)
+		trip.Status = commuteTravelling
+		trip.LeftHomeAt = &now
+		trip.ExpectedMinutes = &minutes
+		trip.ExpectedBy = &expectedBy
+		messages = append(messages, commuteMessage{
+			Subject: name + " left home",
+			Body: fmt.Sprintf("%s left home at %s and should reach work in about %d minutes.",
+				name, clock, minutes),
+		})
+	}
+
+	err = scanCommuteTrip(tx.QueryRow(
+		`UPDATE commute_trips SET status = $1, left_home_at = $2, expected_minutes = $3, expected_by = $4, arrived_at = $5,
+			last_ping_at = $6, last_lat = $7, last_long = $8
+		WHERE id = $9 RETURNING `+commuteTripColumns,
+		trip.Status, trip.LeftHomeAt, trip.ExpectedMinutes, trip.ExpectedBy, trip.ArrivedAt,
+		now, ping.Latitude, ping.Longitude, trip.ID,
+	), &trip)
+	if err != nil {
+		return nil, nil, fmt.Errorf("update trip: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+	return &trip, messages, nil
+}
+
+// studentName is the trainee's first name for notifications, or "Your
+// trainee" when it cannot be loaded
+func studentName(q queryRower, studentID int) string {
+	var name string
+	if err := q.QueryRow(`SELECT COALESCE(first_name, '') FROM student WHERE id = $1`, studentID).Scan(&name); err != nil || name == "" {
+		return "Your trainee"
+	}
+	return name
+}
+
+// commuteLocation is the timezone notifications about time at show times in
+func commuteLocation(db *sql.DB, studentID int, at time.Time) *time.Location {
+	loc, err := studentLocation(db, studentID, at)
+	if err != nil {
+		return orgLocation
+	}
+	return loc
+}
+
+// flagOverdueCommutes settles trips still in progress. A trainee who has
+// checked in since leaving home has arrived; one who is past the expected
+// arrival time plus COMMUTE_MARGIN_MINUTES is raised once to the guardian or
+// supervisor and logged as a job action.
+func flagOverdueCommutes(db *sql.DB, now time.Time) (int, error) {
+	rows, err := db.Query(
+		`SELECT `+commuteTripColumns+` FROM commute_trips
+		WHERE status IN ('travelling', 'overdue') AND window_end > $1`, now.Add(-24*time.Hour),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var trips []models.CommuteTrip
+	for rows.Next() {
+		var t models.CommuteTrip
+		if err := scanCommuteTrip(rows, &t); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		trips = append(trips, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	raised := 0
+	for _, t := range trips {
+		settings, err := loadCommuteSettings(db, t.StudentID)
+		if err != nil {
+			log.Printf("Background jobs: commute %d: %v", t.ID, err)
+			continue
+		}
+		name := studentName(db, t.StudentID)
+
+		var checkedIn sql.NullTime
+		err = db.QueryRow(
+			`SELECT MIN(check_in_date_time) FROM attendance WHERE student_id = $1 AND check_in_date_time >= $2`,
+			t.StudentID, t.LeftHomeAt,
+		).Scan(&checkedIn)
+		if err != nil {
+			log.Printf("Background jobs: commute %d: %v", t.ID, err)
+			continue
+		}
+		if checkedIn.Valid {
+			res, err := db.Exec(
+				`UPDATE commute_trips SET status = 'arrived', arrived_at = $1 WHERE id = $2 AND status IN ('travelling', 'overdue')`,
+				checkedIn.Time, t.ID,
+			)
+			if err != nil {
+				log.Printf("Background jobs: commute %d: %v", t.ID, err)
+			} else if n, _ := res.RowsAffected(); n > 0 {
+				clock := checkedIn.Time.In(commuteLocation(db, t.StudentID, checkedIn.Time)).Format("15:04")
+				notifyCommute(context.Background(), db, t.StudentID, settings.Notify,
+					name+" arrived at work", fmt.Sprintf("%s checked in at work at %s.", name, clock))
+			}
+			continue
+		}
+
+		if t.Status != commuteTravelling || t.ExpectedBy == nil || now.Before(*t.ExpectedBy) {
+			continue
+		}
+		res, err := db.Exec(
+			`UPDATE commute_trips SET status = 'overdue', overdue_alerted_at = $1 WHERE id = $2 AND status = 'travelling'`, now, t.ID,
+		)
+		if err != nil {
+			log.Printf("Background jobs: commute %d: %v", t.ID, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		loc := commuteLocation(db, t.StudentID, now)
+		detail := fmt.Sprintf("%s left home at %s and has not reached work, expected by %s",
+			name, t.LeftHomeAt.In(loc).Format("15:04"), t.ExpectedBy.In(loc).Format("15:04"))
+		if t.LastPingAt != nil {
+			detail += fmt.Sprintf("; last position %.5f,%.5f at %s", *t.LastLat, *t.LastLong, t.LastPingAt.In(loc).Format("15:04"))
+		}
+		notifyCommute(context.Background(), db, t.StudentID, settings.Notify, name+" has not arrived at work", detail+".")
+		logJobAction(db, jobCommute, actionCommuteOverdue, t.StudentID, nil, nil, detail)
+		raised++
+	}
+	return raised, nil
+}
+
+// GetCommuteStatus returns the trainee's commute settings and today's trip.
+// today is null on days without work; before the first ping it shows the
+// travel window with status at_home.
+func GetCommuteStatus(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	var status models.CommuteStatus
+	if status.Settings, err = loadCommuteSettings(database.DB, studentID); err != nil {
+		log.Printf("Error loading commute settings for student %d: %v", studentID, err)
+		http.Error(w, "Failed to load commute", http.StatusInternalServerError)
+		return
+	}
+	day, start, end, ok, err := commuteWindow(database.DB, studentID, time.Now())
+	if err != nil {
+		log.Printf("Error resolving commute window for student %d: %v", studentID, err)
+		http.Error(w, "Failed to load commute", http.StatusInternalServerError)
+		return
+	}
+	if ok {
+		trip := models.CommuteTrip{StudentID: studentID, Date: day, Status: commuteAtHome, WindowStart: start, WindowEnd: end}
+		err := scanCommuteTrip(database.DB.QueryRow(
+			`SELECT `+commuteTripColumns+` FROM commute_trips WHERE student_id = $1 AND trip_date = $2`, studentID, day,
+		), &trip)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Error loading commute trip for student %d: %v", studentID, err)
+			http.Error(w, "Failed to load commute", http.StatusInternalServerError)
+			return
+		}
+		status.Today = &trip
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// UpdateCommuteSettings turns commute tracking on or off. Trainees change
+// their own; staff need PermManageTrainees.
+func UpdateCommuteSettings(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	if p.IsStaff() && !p.Can(PermManageTrainees) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return
+	}
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	var settings models.CommuteSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if settings.Notify == "" {
+		settings.Notify = commuteNotifyGuardian
+	}
+	switch settings.Notify {
+	case commuteNotifyGuardian, commuteNotifySupervisor, commuteNotifyBoth:
+	default:
+		http.Error(w, "notify must be guardian, supervisor or both", http.StatusBadRequest)
+		return
+	}
+	if m := settings.ExpectedMinutes; m != nil && (*m <= 0 || *m > maxCommuteMinutes) {
+		http.Error(w, "expected_minutes must be between 1 and 240", http.StatusBadRequest)
+		return
+	}
+
+	_, err = database.DB.Exec(
+		`UPDATE student SET commute_tracking = $1, commute_notify = $2, commute_minutes = $3 WHERE id = $4`,
+		settings.Enabled, settings.Notify, settings.ExpectedMinutes, studentID,
+	)
+	if err != nil {
+		log.Printf("Error updating commute settings for student %d: %v", studentID, err)
+		http.Error(w, "Failed to update commute settings", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
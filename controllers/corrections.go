@@ -0,0 +1,550 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	correctionMissingCheckIn  = "missing_check_in"
+	correctionMissingCheckOut = "missing_check_out"
+	correctionWrongTime       = "wrong_time"
+	correctionWrongLocation   = "wrong_location"
+)
+
+// States of requests that need a supervisor's decision, shared by
+// corrections and leave
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestRejected = "rejected"
+)
+
+// errInvalidCorrection is returned when a correction does not fit the session
+// it targets. At approval time it usually means the session changed since
+// the request was made.
+var errInvalidCorrection = errors.New("invalid correction")
+
+const correctionColumns = `id, student_id, session_id, kind, event_type, requested_time, requested_end_time,
+	latitude, longitude, reason, status, submitted_by_student, submitted_by_staff,
+	decided_by, decided_at, decision_note, created_at`
+
+func scanCorrection(row interface{ Scan(...interface{}) error }, c *models.AttendanceCorrection) error {
+	return row.Scan(&c.ID, &c.StudentID, &c.SessionID, &c.Kind, &c.EventType, &c.RequestedTime, &c.RequestedEndTime,
+		&c.Latitude, &c.Longitude, &c.Reason, &c.Status, &c.SubmittedByStudent, &c.SubmittedByStaff,
+		&c.DecidedBy, &c.DecidedAt, &c.DecisionNote, &c.CreatedAt)
+}
+
+// queryRower is satisfied by both *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// checkCorrection validates a correction against the current state of its
+// session and fills in the event type implied by the kind
+func checkCorrection(c *models.AttendanceCorrection, session *models.Attendance) error {
+	invalid := func(msg string) error { return fmt.Errorf("%w: %s", errInvalidCorrection, msg) }
+
+	switch c.Kind {
+	case correctionMissingCheckIn:
+		c.EventType = eventCheckIn
+	case correctionMissingCheckOut:
+		c.EventType = eventCheckOut
+	case correctionWrongTime, correctionWrongLocation:
+		if c.EventType != eventCheckIn && c.EventType != eventCheckOut {
+			return invalid("event_type must be check_in or check_out")
+		}
+	default:
+		return invalid("kind must be missing_check_in, missing_check_out, wrong_time or wrong_location")
+	}
+	if c.Kind == correctionWrongLocation {
+		if !hasPosition(c.Latitude, c.Longitude) {
+			return invalid("latitude and longitude are required")
+		}
+	} else if c.RequestedTime == nil {
+		return invalid("requested_time is required")
+	}
+	if c.RequestedTime != nil && c.RequestedTime.After(time.Now().Add(5*time.Minute)) {
+		return invalid("requested_time is in the future")
+	}
+	if c.RequestedEndTime != nil && (c.Kind != correctionMissingCheckIn || c.SessionID != nil) {
+		return invalid("requested_end_time is only allowed for a missing check-in without a session")
+	}
+
+	if session == nil {
+		if c.Kind != correctionMissingCheckIn {
+			return invalid("session_id is required")
+		}
+		if c.RequestedEndTime != nil && !c.RequestedEndTime.After(*c.RequestedTime) {
+			return invalid("requested_end_time must be after requested_time")
+		}
+		return nil
+	}
+
+	hasIn, hasOut := session.CheckInDateTime != nil, session.CheckOutDateTime.Valid
+	switch {
+	case c.Kind == correctionMissingCheckIn && hasIn:
+		return invalid("the session already has a check-in")
+	case c.Kind == correctionMissingCheckOut && hasOut:
+		return invalid("the session already has a check-out")
+	case c.Kind == correctionMissingCheckOut && !hasIn:
+		return invalid("the session has no check-in")
+	case (c.Kind == correctionWrongTime || c.Kind == correctionWrongLocation) && c.EventType == eventCheckIn && !hasIn:
+		return invalid("the session has no check-in to correct")
+	case (c.Kind == correctionWrongTime || c.Kind == correctionWrongLocation) && c.EventType == eventCheckOut && !hasOut:
+		return invalid("the session has no check-out to correct")
+	}
+
+	// The corrected session must still start before it ends
+	if c.RequestedTime != nil {
+		if c.EventType == eventCheckIn && hasOut && !c.RequestedTime.Before(session.CheckOutDateTime.Time) {
+			return invalid("the check-in would be after the check-out")
+		}
+		if c.EventType == eventCheckOut && hasIn && !c.RequestedTime.After(*session.CheckInDateTime) {
+			return invalid("the check-out would be before the check-in")
+		}
+	}
+	return nil
+}
+
+// loadCorrectionSession returns the trainee's session a correction targets
+func loadCorrectionSession(q queryRower, studentID int, sessionID *int, lock string) (*models.Attendance, error) {
+	if sessionID == nil {
+		return nil, nil
+	}
+	var s models.Attendance
+	err := scanSession(q.QueryRow(`SELECT `+sessionColumns+` FROM attendance WHERE id = $1 AND student_id = $2 `+lock, *sessionID, studentID), &s)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: session %d not found", errInvalidCorrection, *sessionID)
+	}
+	return &s, err
+}
+
+// CreateCorrection submits a correction request. Trainees submit for
+// themselves; staff pass the student-id header.
+func CreateCorrection(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	var c models.AttendanceCorrection
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	c.StudentID = studentID
+	c.Reason = strings.TrimSpace(c.Reason)
+	if c.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	session, err := loadCorrectionSession(database.DB, studentID, c.SessionID, "")
+	if err == nil {
+		err = checkCorrection(&c, session)
+	}
+	if errors.Is(err, errInvalidCorrection) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Error checking correction for student %d: %v", studentID, err)
+		http.Error(w, "Failed to submit correction", http.StatusInternalServerError)
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	var byStudent, byStaff *int
+	if p.Role == roleTrainee {
+		byStudent = &p.StudentID
+	} else {
+		byStaff = &p.StaffID
+	}
+	err = scanCorrection(database.DB.QueryRow(
+		`INSERT INTO attendance_corrections (student_id, session_id, kind, event_type, requested_time, requested_end_time,
+			latitude, longitude, reason, submitted_by_student, submitted_by_staff)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING `+correctionColumns,
+		c.StudentID, c.SessionID, c.Kind, c.EventType, c.RequestedTime, c.RequestedEndTime,
+		c.Latitude, c.Longitude, c.Reason, byStudent, byStaff,
+	), &c)
+	if err != nil {
+		log.Printf("Error saving correction for student %d: %v", studentID, err)
+		http.Error(w, "Failed to submit correction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+// GetCorrections lists correction requests, newest first. Trainees see their
+// own. Staff see the trainees they manage, or one trainee with the
+// student-id header. ?status= filters by pending, approved or rejected.
+func GetCorrections(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	status := r.URL.Query().Get("status")
+	args := []interface{}{status}
+	var scope string
+	if p.Role == roleTrainee || r.Header.Get("student-id") != "" {
+		studentID, err := resolveStudentID(r)
+		if err != nil {
+			writeResolveError(w, err)
+			return
+		}
+		args = append(args, studentID)
+		scope = "s.id = $2"
+	} else {
+		scope, args = studentScope(p, "s", args)
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT `+prefixColumns("c", correctionColumns)+` FROM attendance_corrections c
+		JOIN student s ON s.id = c.student_id
+		WHERE ($1 = '' OR c.status = $1) AND `+scope+`
+		ORDER BY c.created_at DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading corrections: %v", err)
+		http.Error(w, "Failed to load corrections", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	corrections := []models.AttendanceCorrection{}
+	for rows.Next() {
+		var c models.AttendanceCorrection
+		if err := scanCorrection(rows, &c); err != nil {
+			http.Error(w, "Failed to load corrections", http.StatusInternalServerError)
+			return
+		}
+		corrections = append(corrections, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(corrections)
+}
+
+// prefixColumns qualifies a comma separated column list with a table alias
+func prefixColumns(alias, columns string) string {
+	parts := strings.Split(columns, ",")
+	for i, c := range parts {
+		parts[i] = alias + "." + strings.TrimSpace(c)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ApproveCorrection applies a pending correction and marks it approved
+func ApproveCorrection(w http.ResponseWriter, r *http.Request) {
+	decideCorrection(w, r, requestApproved)
+}
+
+// RejectCorrection marks a pending correction rejected. The note should say
+// why.
+func RejectCorrection(w http.ResponseWriter, r *http.Request) {
+	decideCorrection(w, r, requestRejected)
+}
+
+func decideCorrection(w http.ResponseWriter, r *http.Request, decision string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid correction ID", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var c models.AttendanceCorrection
+	err = scanCorrection(database.DB.QueryRow(`SELECT `+correctionColumns+` FROM attendance_corrections WHERE id = $1`, id), &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Correction not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load correction", http.StatusInternalServerError)
+		return
+	}
+	if !requireStudentAccess(w, r, c.StudentID) {
+		return
+	}
+	p := principalFromContext(r.Context())
+	if c.SubmittedByStaff != nil && *c.SubmittedByStaff == p.StaffID && p.Role != roleAdmin {
+		http.Error(w, "A correction must be decided by someone other than the person who submitted it", http.StatusForbidden)
+		return
+	}
+
+	err = applyCorrectionDecision(database.DB, id, decision, p.StaffID, strings.TrimSpace(body.Note))
+	if errors.Is(err, errInvalidCorrection) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error deciding correction %d: %v", id, err)
+		http.Error(w, "Failed to update correction", http.StatusInternalServerError)
+		return
+	}
+
+	if err := scanCorrection(database.DB.QueryRow(`SELECT `+correctionColumns+` FROM attendance_corrections WHERE id = $1`, id), &c); err != nil {
+		http.Error(w, "Failed to load correction", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// applyCorrectionDecision records the decision on a pending correction. An
+// approval appends the corrected events to the log, each pointing at the
+// event it supersedes, and updates the session projection. The original
+// events are left untouched.
+func applyCorrectionDecision(db *sql.DB, id int, decision string, staffID int, note string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var c models.AttendanceCorrection
+	if err := scanCorrection(tx.QueryRow(`SELECT `+correctionColumns+` FROM attendance_corrections WHERE id = $1 FOR UPDATE`, id), &c); err != nil {
+		return err
+	}
+	if c.Status != requestPending {
+		return fmt.Errorf("%w: already %s", errInvalidCorrection, c.Status)
+	}
+
+	if decision == requestApproved {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1, $2)`, attendanceLockNamespace, c.StudentID); err != nil {
+			return fmt.Errorf("lock attendance: %w", err)
+		}
+		session, err := loadCorrectionSession(tx, c.StudentID, c.SessionID, "FOR UPDATE")
+		if err != nil {
+			return err
+		}
+		if err := checkCorrection(&c, session); err != nil {
+			return err
+		}
+		if err := applyCorrection(db, tx, &c, session); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`UPDATE attendance_corrections SET status = $1, decided_by = $2, decided_at = NOW(), decision_note = $3 WHERE id = $4`,
+		decision, staffID, note, id,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyCorrection writes an approved correction into the event log and the
+// session projection
+func applyCorrection(db *sql.DB, tx *sql.Tx, c *models.AttendanceCorrection, session *models.Attendance) error {
+	if session == nil {
+		return createCorrectedSession(db, tx, c)
+	}
+	sessionID := int(session.ID)
+
+	// Anything the correction does not change is carried over from the
+	// session, so the new event is a full restatement of that end
+	var occurred time.Time
+	var lat, long *float64
+	if c.EventType == eventCheckOut {
+		occurred = session.CheckOutDateTime.Time
+		if session.CheckOutLat.Valid && session.CheckOutLong.Valid {
+			lat, long = &session.CheckOutLat.Float64, &session.CheckOutLong.Float64
+		}
+	} else {
+		if session.CheckInDateTime != nil {
+			occurred = *session.CheckInDateTime
+		}
+		lat, long = session.CheckInLat, session.CheckInLong
+	}
+	if c.RequestedTime != nil {
+		occurred = *c.RequestedTime
+	}
+	loc, err := studentLocation(db, c.StudentID, occurred)
+	if err != nil {
+		return fmt.Errorf("load timezone: %w", err)
+	}
+	latitude, longitude := lat, long
+	if c.Latitude != nil && c.Longitude != nil {
+		latitude, longitude = c.Latitude, c.Longitude
+	} else if lat == nil || long == nil {
+		latitude, longitude = nil, nil
+	}
+
+	var supersedes *int
+	column := "check_in_event_id"
+	if c.EventType == eventCheckOut {
+		column = "check_out_event_id"
+	}
+	if err := tx.QueryRow(`SELECT `+column+` FROM attendance WHERE id = $1`, sessionID).Scan(&supersedes); err != nil {
+		return fmt.Errorf("load superseded event: %w", err)
+	}
+
+	fence, err := evaluateGeofence(db, c.StudentID, localDate(occurred, loc), latitude, longitude)
+	if err != nil {
+		return err
+	}
+	eventID, err := appendCorrectionEvent(tx, c, sessionID, c.EventType, occurred, latitude, longitude, fence, supersedes)
+	if err != nil {
+		return err
+	}
+
+	if c.EventType == eventCheckIn {
+		// Lateness is recomputed only where it was measured before, or for a
+		// session that had no check-in at all
+		late := session.LateMinutes
+		if session.ScheduledCheckIn != nil && (late != nil || session.CheckInDateTime == nil) {
+			m := minutesAfter(occurred, *session.ScheduledCheckIn)
+			late = &m
+		}
+		_, err = tx.Exec(
+			`UPDATE attendance SET check_in_date_time = $1, check_in_lat = $2, check_in_long = $3, check_in_event_id = $4,
+				check_in_geofence = $5, check_in_distance_m = $6, late_minutes = $7, orphan_checkout = false, corrected = true,
+				check_in_verification = 'correction'
+			WHERE id = $8`,
+			occurred, latitude, longitude, eventID, fence.Status, fence.DistanceMeters, late, sessionID,
+		)
+		if err == nil {
+			err = clearAbsence(tx, c.StudentID, occurred, loc)
+		}
+	} else {
+		// A break left running ends with the corrected check-out
+		var breakMinutes, paid int
+		breakMinutes, paid, err = endBreak(tx, session, eventID, occurred, latitude, longitude)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			`UPDATE attendance SET check_out_date_time = $1, check_out_lat = $2, check_out_long = $3, check_out_event_id = $4,
+				check_out_geofence = $5, check_out_distance_m = $6, early_leave_minutes = $7,
+				break_minutes = break_minutes + $8, paid_break_minutes = paid_break_minutes + $9, on_break_since = NULL, corrected = true,
+				check_out_verification = 'correction'
+			WHERE id = $10`,
+			occurred, latitude, longitude, eventID, fence.Status, fence.DistanceMeters,
+			earlyLeave(session.ScheduledCheckOut, occurred), breakMinutes, paid, sessionID,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("update session: %w", err)
+	}
+	return nil
+}
+
+// createCorrectedSession records a session the trainee never checked in to,
+// optionally with its check-out
+func createCorrectedSession(db *sql.DB, tx *sql.Tx, c *models.AttendanceCorrection) error {
+	checkIn := *c.RequestedTime
+	loc, err := studentLocation(db, c.StudentID, checkIn)
+	if err != nil {
+		return fmt.Errorf("load timezone: %w", err)
+	}
+	schedIn, schedOut, err := scheduledTimes(db, c.StudentID, checkIn, loc)
+	if err != nil {
+		return err
+	}
+	startOfDay, endOfDay := dayBounds(checkIn, loc)
+	var firstToday bool
+	err = tx.QueryRow(
+		`SELECT NOT EXISTS (SELECT 1 FROM attendance WHERE student_id = $1 AND check_in_date_time >= $2 AND check_in_date_time < $3)`,
+		c.StudentID, startOfDay, endOfDay,
+	).Scan(&firstToday)
+	if err != nil {
+		return fmt.Errorf("check earlier sessions: %w", err)
+	}
+	var late *int
+	if firstToday && schedIn != nil {
+		m := minutesAfter(checkIn, *schedIn)
+		late = &m
+	}
+
+	fence, err := evaluateGeofence(db, c.StudentID, localDate(checkIn, loc), c.Latitude, c.Longitude)
+	if err != nil {
+		return err
+	}
+	var sessionID int
+	err = tx.QueryRow(
+		`INSERT INTO attendance (student_id, check_in_date_time, check_in_lat, check_in_long, check_in_geofence, check_in_distance_m,
+			scheduled_check_in, scheduled_check_out, late_minutes, corrected, check_in_verification)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, true, 'correction') RETURNING id`,
+		c.StudentID, checkIn, c.Latitude, c.Longitude, fence.Status, fence.DistanceMeters, schedIn, schedOut, late,
+	).Scan(&sessionID)
+	if err != nil {
+		return fmt.Errorf("create session: %w", err)
+	}
+	inID, err := appendCorrectionEvent(tx, c, sessionID, eventCheckIn, checkIn, c.Latitude, c.Longitude, fence, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE attendance SET check_in_event_id = $1 WHERE id = $2`, inID, sessionID); err != nil {
+		return fmt.Errorf("update session: %w", err)
+	}
+	if err := clearAbsence(tx, c.StudentID, checkIn, loc); err != nil {
+		return err
+	}
+
+	if c.RequestedEndTime == nil {
+		return nil
+	}
+	checkOut := *c.RequestedEndTime
+	outID, err := appendCorrectionEvent(tx, c, sessionID, eventCheckOut, checkOut, c.Latitude, c.Longitude, fence, nil)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`UPDATE attendance SET check_out_date_time = $1, check_out_lat = $2, check_out_long = $3, check_out_event_id = $4,
+			check_out_geofence = $5, check_out_distance_m = $6, early_leave_minutes = $7, check_out_verification = 'correction'
+		WHERE id = $8`,
+		checkOut, c.Latitude, c.Longitude, outID, fence.Status, fence.DistanceMeters, earlyLeave(schedOut, checkOut), sessionID,
+	)
+	if err != nil {
+		return fmt.Errorf("update session: %w", err)
+	}
+	return nil
+}
+
+// appendCorrectionEvent adds an event produced by an approved correction to
+// the log
+func appendCorrectionEvent(tx *sql.Tx, c *models.AttendanceCorrection, sessionID int, eventType string, at time.Time,
+	lat, long *float64, fence geofenceResult, supersedes *int) (int, error) {
+	var id int
+	err := tx.QueryRow(
+		`INSERT INTO attendance_events (student_id, session_id, event_type, occurred_at, latitude, longitude, source,
+			geofence_status, distance_m, flagged, correction_id, supersedes_event_id, verification_method)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13) RETURNING id`,
+		c.StudentID, sessionID, eventType, at, lat, long, sourceCorrection,
+		fence.Status, fence.DistanceMeters, fence.Flagged, c.ID, supersedes, verifyCorrection,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("append event: %w", err)
+	}
+	return id, nil
+}
+
+// clearAbsence clears an absence recorded on the local day containing t
+func clearAbsence(tx *sql.Tx, studentID int, t time.Time, loc *time.Location) error {
+	_, err := tx.Exec(
+		`UPDATE absences SET cleared_at = NOW() WHERE student_id = $1 AND date = $2 AND cleared_at IS NULL`,
+		studentID, localDate(t, loc),
+	)
+	if err != nil {
+		return fmt.Errorf("clear absence: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// enrollDevice stores a newly paired device. Only the hash of the secret is
+// persisted; the caller hands the plaintext secret to the device once.
+func enrollDevice(db *sql.DB, studentID int, secretCode string, device models.DeviceEnrollment) (int, error) {
+	name := strings.TrimSpace(device.DeviceName)
+	if name == "" {
+		name = "Unnamed device"
+	}
+	var id int
+	err := db.QueryRow(
+		`INSERT INTO authorized_devices (student_id, secret_hash, device_name, platform, last_seen_at)
+		VALUES ($1, $2, $3, $4, NOW()) RETURNING id`,
+		studentID, hashToken(secretCode), name, strings.ToLower(strings.TrimSpace(device.Platform)),
+	).Scan(&id)
+	return id, err
+}
+
+// deviceIsActive reports whether a paired device still exists and has not
+// been revoked
+func deviceIsActive(db *sql.DB, deviceID int) (bool, error) {
+	var active bool
+	err := db.QueryRow(`SELECT revoked_at IS NULL FROM authorized_devices WHERE id = $1`, deviceID).Scan(&active)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return active, err
+}
+
+// resolveDeviceOwner returns the trainee whose devices are being managed.
+// Trainees manage their own; staff need PermManageDevices.
+func resolveDeviceOwner(w http.ResponseWriter, r *http.Request) (int, bool) {
+	p := principalFromContext(r.Context())
+	if p.IsStaff() && !p.Can(PermManageDevices) {
+		http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+		return 0, false
+	}
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return 0, false
+	}
+	return studentID, true
+}
+
+// ListDevices returns the devices paired with a trainee
+func ListDevices(w http.ResponseWriter, r *http.Request) {
+	studentID, ok := resolveDeviceOwner(w, r)
+	if !ok {
+		return
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT id, student_id, COALESCE(device_name, ''), COALESCE(platform, ''), created_at, last_seen_at, revoked_at
+		FROM authorized_devices WHERE student_id = $1 ORDER BY created_at DESC`,
+		studentID,
+	)
+	if err != nil {
+		log.Printf("Error fetching devices for student %d: %v", studentID, err)
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []models.AuthorizedDevice{}
+	for rows.Next() {
+		var d models.AuthorizedDevice
+		if err := rows.Scan(&d.ID, &d.StudentID, &d.DeviceName, &d.Platform, &d.CreatedAt, &d.LastSeenAt, &d.RevokedAt); err != nil {
+			http.Error(w, "Failed to scan devices", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to fetch devices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(devices)
+}
+
+// RevokeDevice revokes a paired device and every session bound to it
+func RevokeDevice(w http.ResponseWriter, r *http.Request) {
+	studentID, ok := resolveDeviceOwner(w, r)
+	if !ok {
+		return
+	}
+	deviceID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := revokeDevice(database.DB, studentID, deviceID); errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Device not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error revoking device %d: %v", deviceID, err)
+		http.Error(w, "Failed to revoke device", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeDevice marks the student's device revoked and revokes its refresh
+// tokens. It returns sql.ErrNoRows when the device does not belong to the
+// student.
+func revokeDevice(db *sql.DB, studentID, deviceID int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE authorized_devices SET revoked_at = COALESCE(revoked_at, NOW()) WHERE id = $1 AND student_id = $2`,
+		deviceID, studentID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE device_id = $1 AND revoked_at IS NULL`, deviceID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
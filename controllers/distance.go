@@ -0,0 +1,342 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LatLng is a WGS84 coordinate
+type LatLng struct {
+	Lat float64
+	Lng float64
+}
+
+// DistanceProvider measures the travel distance between two points in metres
+type DistanceProvider interface {
+	Name() string
+	Distance(ctx context.Context, from, to LatLng) (int, error)
+}
+
+// DistanceResult is a measured distance and where it came from
+type DistanceResult struct {
+	Meters   int
+	Provider string
+	Cached   bool
+}
+
+// distances is the provider chain used for route distances. It defaults to
+// haversine only until LoadDistanceProviders runs.
+var distances = newDistanceChain([]DistanceProvider{HaversineProvider{}}, 3*time.Second, 24*time.Hour, 4)
+
+// LoadDistanceProviders builds the provider chain from the environment.
+// DISTANCE_PROVIDERS is a comma separated order such as "osrm,google"; by
+// default every configured provider is tried in the order google, osrm,
+// valhalla. Haversine is always the last resort so lookups never fail outright.
+func LoadDistanceProviders() {
+	client := &http.Client{}
+	available := map[string]DistanceProvider{"haversine": HaversineProvider{}}
+	if key := os.Getenv("GOOGLE_MAPS_API_KEY"); key != "" {
+		available["google"] = &GoogleDistanceProvider{APIKey: key, Client: client}
+	}
+	if base := os.Getenv("OSRM_URL"); base != "" {
+		profile := os.Getenv("OSRM_PROFILE")
+		if profile == "" {
+			profile = "driving"
+		}
+		available["osrm"] = &OSRMDistanceProvider{BaseURL: strings.TrimRight(base, "/"), Profile: profile, Client: client}
+	}
+	if base := os.Getenv("VALHALLA_URL"); base != "" {
+		costing := os.Getenv("VALHALLA_COSTING")
+		if costing == "" {
+			costing = "auto"
+		}
+		available["valhalla"] = &ValhallaDistanceProvider{BaseURL: strings.TrimRight(base, "/"), Costing: costing, Client: client}
+	}
+
+	order := []string{"google", "osrm", "valhalla"}
+	if v := os.Getenv("DISTANCE_PROVIDERS"); v != "" {
+		order = strings.Split(v, ",")
+	}
+	var chain []DistanceProvider
+	var names []string
+	for _, name := range order {
+		name = strings.ToLower(strings.TrimSpace(name))
+		p, ok := available[name]
+		if !ok {
+			if name != "" {
+				log.Printf("Distance provider %q is not configured, skipping", name)
+			}
+			continue
+		}
+		if name == "haversine" {
+			continue
+		}
+		chain = append(chain, p)
+		names = append(names, name)
+	}
+	chain = append(chain, HaversineProvider{})
+	names = append(names, "haversine")
+
+	timeout := time.Duration(envInt("DISTANCE_TIMEOUT_MS", 3000)) * time.Millisecond
+	ttl := time.Duration(envInt("DISTANCE_CACHE_TTL_MINUTES", 1440)) * time.Minute
+	precision := envInt("DISTANCE_CACHE_PRECISION", 4)
+	distances = newDistanceChain(chain, timeout, ttl, precision)
+	log.Printf("✅ Distance providers: %s", strings.Join(names, " → "))
+}
+
+// distanceChain tries each provider in order, giving each its own timeout,
+// and caches successful lookups
+type distanceChain struct {
+	providers []DistanceProvider
+	timeout   time.Duration
+	cache     *distanceCache
+}
+
+func newDistanceChain(providers []DistanceProvider, timeout, ttl time.Duration, precision int) *distanceChain {
+	return &distanceChain{
+		providers: providers,
+		timeout:   timeout,
+		cache:     &distanceCache{ttl: ttl, precision: precision, entries: map[string]distanceCacheEntry{}},
+	}
+}
+
+// Measure returns the distance from the first provider that answers
+func (c *distanceChain) Measure(ctx context.Context, from, to LatLng) (DistanceResult, error) {
+	key := c.cache.key(from, to)
+	if res, ok := c.cache.get(key); ok {
+		res.Cached = true
+		return res, nil
+	}
+
+	var errs []error
+	for _, p := range c.providers {
+		pctx, cancel := context.WithTimeout(ctx, c.timeout)
+		meters, err := p.Distance(pctx, from, to)
+		cancel()
+		if err != nil {
+			log.Printf("Distance provider %s failed: %v", p.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		res := DistanceResult{Meters: meters, Provider: p.Name()}
+		// Straight-line results are cheap and only stand in for an outage,
+		// so they are not cached in place of a real route
+		if p.Name() != "haversine" {
+			c.cache.put(key, res)
+		}
+		return res, nil
+	}
+	return DistanceResult{}, errors.Join(errs...)
+}
+
+type distanceCacheEntry struct {
+	result  DistanceResult
+	expires time.Time
+}
+
+// distanceCache keeps route distances keyed on coordinates rounded to
+// precision decimal places (4 is roughly 11 m)
+type distanceCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	precision int
+	entries   map[string]distanceCacheEntry
+}
+
+const distanceCacheMaxEntries = 10000
+
+func (c *distanceCache) key(from, to LatLng) string {
+	return fmt.Sprintf("%.*f,%.*f;%.*f,%.*f",
+		c.precision, from.Lat, c.precision, from.Lng, c.precision, to.Lat, c.precision, to.Lng)
+}
+
+func (c *distanceCache) get(key string) (DistanceResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return DistanceResult{}, false
+	}
+	return e.result, true
+}
+
+func (c *distanceCache) put(key string, res DistanceResult) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= distanceCacheMaxEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full of live entries: start over rather than grow unbounded
+		if len(c.entries) >= distanceCacheMaxEntries {
+			c.entries = map[string]distanceCacheEntry{}
+		}
+	}
+	c.entries[key] = distanceCacheEntry{result: res, expires: time.Now().Add(c.ttl)}
+}
+
+// HaversineProvider returns the straight-line distance. It needs no network
+// and never fails.
+type HaversineProvider struct{}
+
+func (HaversineProvider) Name() string { return "haversine" }
+
+func (HaversineProvider) Distance(ctx context.Context, from, to LatLng) (int, error) {
+	return haversine(from.Lat, from.Lng, to.Lat, to.Lng), nil
+}
+
+// GoogleDistanceProvider uses the Google Distance Matrix API
+type GoogleDistanceProvider struct {
+	APIKey string
+	Client *http.Client
+}
+
+// Google Distance Matrix API response struct (partial)
+type googleDistanceMatrixResponse struct {
+	Rows []struct {
+		Elements []struct {
+			Distance struct {
+				Value int `json:"value"`
+			} `json:"distance"`
+			Status string `json:"status"`
+		} `json:"elements"`
+	} `json:"rows"`
+	Status string `json:"status"`
+}
+
+func (p *GoogleDistanceProvider) Name() string { return "google" }
+
+func (p *GoogleDistanceProvider) Distance(ctx context.Context, from, to LatLng) (int, error) {
+	q := url.Values{}
+	q.Set("origins", fmt.Sprintf("%f,%f", from.Lat, from.Lng))
+	q.Set("destinations", fmt.Sprintf("%f,%f", to.Lat, to.Lng))
+	q.Set("key", p.APIKey)
+	var apiResp googleDistanceMatrixResponse
+	if err := getJSON(ctx, p.Client, "https://maps.googleapis.com/maps/api/distancematrix/json?"+q.Encode(), &apiResp); err != nil {
+		return 0, err
+	}
+	if apiResp.Status != "OK" ||
+		len(apiResp.Rows) == 0 ||
+		len(apiResp.Rows[0].Elements) == 0 ||
+		apiResp.Rows[0].Elements[0].Status != "OK" {
+		return 0, fmt.Errorf("google API error or no route found (status %s)", apiResp.Status)
+	}
+	return apiResp.Rows[0].Elements[0].Distance.Value, nil
+}
+
+// OSRMDistanceProvider uses the route service of a self-hosted OSRM server
+type OSRMDistanceProvider struct {
+	BaseURL string
+	Profile string
+	Client  *http.Client
+}
+
+func (p *OSRMDistanceProvider) Name() string { return "osrm" }
+
+func (p *OSRMDistanceProvider) Distance(ctx context.Context, from, to LatLng) (int, error) {
+	// OSRM takes longitude first
+	u := fmt.Sprintf("%s/route/v1/%s/%f,%f;%f,%f?overview=false",
+		p.BaseURL, p.Profile, from.Lng, from.Lat, to.Lng, to.Lat)
+	var resp struct {
+		Code   string `json:"code"`
+		Routes []struct {
+			Distance float64 `json:"distance"`
+		} `json:"routes"`
+	}
+	if err := getJSON(ctx, p.Client, u, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Code != "Ok" || len(resp.Routes) == 0 {
+		return 0, fmt.Errorf("osrm returned %q with %d routes", resp.Code, len(resp.Routes))
+	}
+	return int(math.Round(resp.Routes[0].Distance)), nil
+}
+
+// ValhallaDistanceProvider uses the route action of a self-hosted Valhalla
+// server
+type ValhallaDistanceProvider struct {
+	BaseURL string
+	Costing string
+	Client  *http.Client
+}
+
+func (p *ValhallaDistanceProvider) Name() string { return "valhalla" }
+
+func (p *ValhallaDistanceProvider) Distance(ctx context.Context, from, to LatLng) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"locations": []map[string]float64{
+			{"lat": from.Lat, "lon": from.Lng},
+			{"lat": to.Lat, "lon": to.Lng},
+		},
+		"costing": p.Costing,
+		"units":   "kilometers",
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.BaseURL+"/route", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var resp struct {
+		Trip struct {
+			Status  int `json:"status"`
+			Summary struct {
+				Length float64 `json:"length"`
+			} `json:"summary"`
+		} `json:"trip"`
+	}
+	if err := doJSON(p.Client, req, &resp); err != nil {
+		return 0, err
+	}
+	if resp.Trip.Status != 0 {
+		return 0, fmt.Errorf("valhalla trip status %d", resp.Trip.Status)
+	}
+	return int(math.Round(resp.Trip.Summary.Length * 1000)), nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		// The parse error quotes the URL, which can hold an API key
+		return errors.New("invalid request URL")
+	}
+	return doJSON(client, req, out)
+}
+
+// doJSON sends req and decodes the JSON response into out. Errors name the
+// host only, never the full URL, since some providers take the API key in
+// the query string and these errors are logged.
+func doJSON(client *http.Client, req *http.Request, out interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			return fmt.Errorf("%s %s: %w", uerr.Op, req.URL.Host, uerr.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// failingTransport fails every request the way a timeout or DNS failure
+// would
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestGoogleDistanceErrorHidesKey(t *testing.T) {
+	p := &GoogleDistanceProvider{APIKey: "secret-key-123", Client: &http.Client{Transport: failingTransport{}}}
+	_, err := p.Distance(context.Background(), LatLng{Lat: 6.9, Lng: 79.8}, LatLng{Lat: 7.0, Lng: 79.9})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(err.Error(), "secret-key-123") {
+		t.Fatalf("error leaks the API key: %v", err)
+	}
+	if !strings.Contains(err.Error(), "maps.googleapis.com") {
+		t.Errorf("error should still name the host: %v", err)
+	}
+}
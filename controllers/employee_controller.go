@@ -18,7 +18,7 @@ type EmployeeResponse struct {
 	EmployerAddress *string    `json:"employer_address,omitempty"`
 	SupervisorID    *int       `json:"supervisor_id,omitempty"`
 	SupervisorName  *string    `json:"supervisor_name,omitempty"`
-	LatestOTPCode   *string    `json:"latest_otp_code,omitempty"`
+	OTPActive       bool       `json:"otp_active"`
 	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
 }
 
@@ -37,22 +37,23 @@ func GetEmployeeData(w http.ResponseWriter, r *http.Request) {
 			CONCAT_WS(', ', e.address_line1, e.address_line2, e.address_line3) AS employer_address,
 			sup.supervisor_id AS supervisor_id,
 			sup.first_name || ' ' || sup.last_name AS supervisor_name,
-			o.otp_code AS latest_otp_code,
+			COALESCE(NOT o.is_used AND o.expires_at > NOW(), false) AS otp_active,
 			o.expires_at
 		FROM 
 			student s
 		LEFT JOIN employer e ON s.employer_id = e.id
 		LEFT JOIN supervisor sup ON s.supervisor_id = sup.supervisor_id
 		LEFT JOIN LATERAL (
-			SELECT otp_code, expires_at
+			SELECT is_used, expires_at
 			FROM otps
 			WHERE otps.student_id = s.id
 			ORDER BY created_at DESC
 			LIMIT 1
-		) o ON true;
-	`
+		) o ON true
+		WHERE `
 
-	rows, err := database.DB.Query(query)
+	scope, args := studentScope(principalFromContext(r.Context()), "s", nil)
+	rows, err := database.DB.Query(query+scope, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -71,7 +72,7 @@ func GetEmployeeData(w http.ResponseWriter, r *http.Request) {
 			&res.EmployerAddress,
 			&res.SupervisorID,
 			&res.SupervisorName,
-			&res.LatestOTPCode,
+			&res.OTPActive,
 			&res.ExpiresAt,
 		); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
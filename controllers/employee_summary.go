@@ -4,15 +4,16 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
-	"strconv"
 	"time"
 
 	"server/database"
 )
 
 type Attendance struct {
-	CheckIn  time.Time  `json:"check_in_date_time"`
-	CheckOut *time.Time `json:"check_out_date_time"`
+	CheckIn           time.Time  `json:"check_in_date_time"`
+	CheckOut          *time.Time `json:"check_out_date_time"`
+	LateMinutes       *int       `json:"late_minutes"`
+	EarlyLeaveMinutes *int       `json:"early_leave_minutes"`
 }
 
 type Mood struct {
@@ -27,23 +28,25 @@ type EmployeeSummary struct {
 }
 
 func GetEmployeeSummary(w http.ResponseWriter, r *http.Request) {
-	idStr := r.Header.Get("student-id")
-	if idStr == "" {
-		http.Error(w, `{"error":"Missing student-id header"}`, http.StatusBadRequest)
-		return
-	}
-	studentID, err := strconv.Atoi(idStr)
+	studentID, err := resolveStudentID(r)
 	if err != nil {
-		http.Error(w, `{"error":"Invalid student-id header"}`, http.StatusBadRequest)
+		writeResolveError(w, err)
 		return
 	}
 
 	summary := EmployeeSummary{}
 
-	// 1. Last 5 attendance records (before today)
+	loc, err := studentLocation(database.DB, studentID, time.Now())
+	if err != nil {
+		http.Error(w, `{"error":"Failed to load timezone"}`, http.StatusInternalServerError)
+		return
+	}
+	startOfToday, _ := dayBounds(time.Now(), loc)
+
+	// 1. Last 5 attendance records (before today in the trainee's timezone)
 	rows, err := database.DB.Query(
-		`SELECT check_in_date_time, check_out_date_time FROM attendance WHERE student_id = $1 AND DATE(check_in_date_time) < CURRENT_DATE ORDER BY check_in_date_time DESC LIMIT 5`,
-		studentID,
+		`SELECT check_in_date_time, check_out_date_time, late_minutes, early_leave_minutes FROM attendance WHERE student_id = $1 AND check_in_date_time < $2 ORDER BY check_in_date_time DESC LIMIT 5`,
+		studentID, startOfToday,
 	)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to fetch attendance"}`, http.StatusInternalServerError)
@@ -53,7 +56,7 @@ func GetEmployeeSummary(w http.ResponseWriter, r *http.Request) {
 	for rows.Next() {
 		var att Attendance
 		var checkOut sql.NullTime
-		if err := rows.Scan(&att.CheckIn, &checkOut); err != nil {
+		if err := rows.Scan(&att.CheckIn, &checkOut, &att.LateMinutes, &att.EarlyLeaveMinutes); err != nil {
 			http.Error(w, `{"error":"Failed to scan attendance"}`, http.StatusInternalServerError)
 			return
 		}
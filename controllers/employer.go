@@ -3,92 +3,216 @@ package controllers
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"server/database"
 	"server/models"
+)
 
-	"github.com/gorilla/mux"
+// Digits allowed in an employer's contact number, as in E.164
+const (
+	minPhoneDigits = 7
+	maxPhoneDigits = 15
 )
 
+// errEmployerUnavailable is returned when a trainee is given an employer that
+// does not exist or has been archived
+var errEmployerUnavailable = errors.New("employer_id does not exist or is archived")
+
+const employerColumns = `id, name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat, timezone,
+	geofence_radius_m, geofence_policy, max_break_minutes, paid_break_minutes, archived_at, ` + geocodingColumns
+
+func scanEmployer(row interface{ Scan(...interface{}) error }, e *models.Employer) error {
+	dest := []interface{}{&e.ID, &e.Name, &e.ContactNumber, &e.AddressLine1, &e.AddressLine2, &e.AddressLine3, &e.Longitude, &e.Latitude, &e.Timezone,
+		&e.GeofenceRadiusM, &e.GeofencePolicy, &e.MaxBreakMinutes, &e.PaidBreakMinutes, &e.ArchivedAt}
+	if err := row.Scan(append(dest, geocodingDest(&e.Geocoding)...)...); err != nil {
+		return err
+	}
+	markReview(&e.Geocoding)
+	return nil
+}
+
+// employerAddress is the address of an employer as sent to the geocoder
+func employerAddress(in *models.EmployerInput) string {
+	return joinAddress(in.AddressLine1, in.AddressLine2, in.AddressLine3)
+}
+
+// validPhoneNumber accepts a number made of digits with the usual
+// separators and an optional leading +
+func validPhoneNumber(number string) bool {
+	digits := 0
+	for i, c := range number {
+		switch {
+		case c >= '0' && c <= '9':
+			digits++
+		case c == '+' && i == 0, c == ' ', c == '-', c == '(', c == ')', c == '.':
+		default:
+			return false
+		}
+	}
+	return digits >= minPhoneDigits && digits <= maxPhoneDigits
+}
+
+// validateEmployer checks an employer body and normalises it. The timezone
+// is returned validated; an empty geofence_policy clears the override.
+func validateEmployer(in *models.EmployerInput) (*string, error) {
+	in.Name = strings.TrimSpace(in.Name)
+	in.ContactNumber = strings.TrimSpace(in.ContactNumber)
+	if in.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if in.ContactNumber != "" && !validPhoneNumber(in.ContactNumber) {
+		return nil, errors.New("contact_number must be a phone number of 7 to 15 digits")
+	}
+	if math.Abs(in.Latitude) > 90 || math.Abs(in.Longitude) > 180 {
+		return nil, errors.New("addr_lat must be between -90 and 90 and addr_long between -180 and 180")
+	}
+	tz, err := validateTimezone(in.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGeofenceSettings(in.GeofenceRadiusM, in.GeofencePolicy); err != nil {
+		return nil, err
+	}
+	if err := validateBreakSettings(in.MaxBreakMinutes, in.PaidBreakMinutes); err != nil {
+		return nil, err
+	}
+	if in.GeofencePolicy != nil && *in.GeofencePolicy == "" {
+		in.GeofencePolicy = nil
+	}
+	return tz, nil
+}
+
+// validateStudentEmployer checks a trainee's employer exists and is not
+// archived
+func validateStudentEmployer(employerID *uint) error {
+	if employerID == nil {
+		return nil
+	}
+	var ok bool
+	err := database.DB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM employer WHERE id = $1 AND archived_at IS NULL)`, *employerID,
+	).Scan(&ok)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errEmployerUnavailable
+	}
+	return nil
+}
+
+// GetEmployers godoc
+// @Summary List employers
+// @Description Lists employers by name. Archived ones are left out unless include_archived=true.
+// @Tags employers
+// @Produce json
+// @Param include_archived query bool false "Include archived employers"
+// @Success 200 {array} models.Employer
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /get-employers [get]
+func GetEmployers(w http.ResponseWriter, r *http.Request) {
+	includeArchived := r.URL.Query().Get("include_archived") == "true"
+	rows, err := database.DB.Query(
+		`SELECT `+employerColumns+` FROM employer WHERE $1 OR archived_at IS NULL ORDER BY name, id`, includeArchived,
+	)
+	if err != nil {
+		log.Printf("Error loading employers: %v", err)
+		http.Error(w, "Failed to load employers", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	employers := []models.Employer{}
+	for rows.Next() {
+		var e models.Employer
+		if err := scanEmployer(rows, &e); err != nil {
+			log.Printf("Error loading employers: %v", err)
+			http.Error(w, "Failed to load employers", http.StatusInternalServerError)
+			return
+		}
+		employers = append(employers, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(employers)
+}
+
 // CreateEmployer godoc
 // @Summary Create a new employer
-// @Description Create a new employer with the input payload
+// @Description Create a new employer. The address is geocoded: addr_lat and addr_long are filled in when left at 0 and flagged when they disagree with it.
 // @Tags employers
 // @Accept json
 // @Produce json
-//
-//	@Param employer body struct {
-//		Name          string  `json:"name"`
-//		ContactNumber string  `json:"contact_number"`
-//		AddressLine1  string  `json:"address_line_1"`
-//		AddressLine2  string  `json:"address_line_2"`
-//		AddressLine3  string  `json:"address_line_3"`
-//		Longitude     float64 `json:"addr_long"`
-//		Latitude      float64 `json:"addr_lat"`
-//	} true "Employer input"
-//
-// @Success 200 {object} models.Employer
+// @Param employer body models.EmployerInput true "Employer input"
+// @Success 201 {object} models.Employer
 // @Failure 400 {string} string "Bad Request"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /employers [post]
+// @Router /create-employer [post]
 func CreateEmployer(w http.ResponseWriter, r *http.Request) {
-	var employerInput struct {
-		Name          string  `json:"name"`
-		ContactNumber string  `json:"contact_number"`
-		AddressLine1  string  `json:"address_line_1"`
-		AddressLine2  string  `json:"address_line_2"`
-		AddressLine3  string  `json:"address_line_3"`
-		Longitude     float64 `json:"addr_long"`
-		Latitude      float64 `json:"addr_lat"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&employerInput); err != nil {
+	var in models.EmployerInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	tz, err := validateEmployer(&in)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	geo := locateAddress(r.Context(), employerAddress(&in), &in.Latitude, &in.Longitude, nil)
+	args := append([]interface{}{in.Name, in.ContactNumber, in.AddressLine1, in.AddressLine2, in.AddressLine3, in.Longitude, in.Latitude, tz,
+		in.GeofenceRadiusM, in.GeofencePolicy, in.MaxBreakMinutes, in.PaidBreakMinutes}, geocodingArgs(&geo)...)
 	var employer models.Employer
-	err := database.DB.QueryRow(
-		`INSERT INTO employer (name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat)
-		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat`,
-		employerInput.Name, employerInput.ContactNumber, employerInput.AddressLine1, employerInput.AddressLine2, employerInput.AddressLine3, employerInput.Longitude, employerInput.Latitude,
-	).Scan(&employer.ID, &employer.Name, &employer.ContactNumber, &employer.AddressLine1, &employer.AddressLine2, &employer.AddressLine3, &employer.Longitude, &employer.Latitude)
+	err = scanEmployer(database.DB.QueryRow(
+		`INSERT INTO employer (name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat, timezone, geofence_radius_m, geofence_policy,
+			max_break_minutes, paid_break_minutes, `+geocodingColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21) RETURNING `+employerColumns,
+		args...,
+	), &employer)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error creating employer: %v", err)
+		http.Error(w, "Failed to create employer", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(employer)
 }
 
 // GetEmployer godoc
 // @Summary Get an employer by ID
-// @Description Get details of an employer by ID
+// @Description Get details of an employer by ID. Employer contacts can only read their own.
 // @Tags employers
 // @Produce json
-// @Param id path int true "Employer ID"
+// @Param employer-id header int true "Employer ID"
 // @Success 200 {object} models.Employer
-// @Failure 400 {string} string "Invalid ID"
+// @Failure 400 {string} string "Invalid or missing employer-id header"
 // @Failure 404 {string} string "Employer not found"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /employers/{id} [get]
+// @Router /get-employer [get]
 func GetEmployer(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id, err := strconv.Atoi(r.Header.Get("employer-id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		http.Error(w, "Invalid or missing employer-id header", http.StatusBadRequest)
+		return
+	}
+	if !employerAllowed(principalFromContext(r.Context()), id) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
 		return
 	}
 	var employer models.Employer
-	err = database.DB.QueryRow(
-		`SELECT id, name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat FROM employer WHERE id = $1`,
-		id,
-	).Scan(&employer.ID, &employer.Name, &employer.ContactNumber, &employer.AddressLine1, &employer.AddressLine2, &employer.AddressLine3, &employer.Longitude, &employer.Latitude)
-	if err == sql.ErrNoRows {
+	err = scanEmployer(database.DB.QueryRow(`SELECT `+employerColumns+` FROM employer WHERE id = $1`, id), &employer)
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Employer not found", http.StatusNotFound)
 		return
 	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error loading employer %d: %v", id, err)
+		http.Error(w, "Failed to load employer", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -97,68 +221,64 @@ func GetEmployer(w http.ResponseWriter, r *http.Request) {
 
 // UpdateEmployer godoc
 // @Summary Update an employer by ID
-// @Description Update details of an employer by ID
+// @Description Update details of an employer by ID. A changed address is geocoded again and changed coordinates need confirming again.
 // @Tags employers
 // @Accept json
 // @Produce json
-// @Param id path int true "Employer ID"
-//
-//	@Param employer body struct {
-//		Name          string  `json:"name"`
-//		ContactNumber string  `json:"contact_number"`
-//		AddressLine1  string  `json:"address_line1"`
-//		AddressLine2  string  `json:"address_line2"`
-//		AddressLine3  string  `json:"address_line3"`
-//		Longitude     float64 `json:"addr_long"`
-//		Latitude      float64 `json:"addr_lat"`
-//	} true "Employer input"
-//
+// @Param employer-id header int true "Employer ID"
+// @Param employer body models.EmployerInput true "Employer input"
 // @Success 200 {object} models.Employer
-// @Failure 400 {string} string "Invalid ID"
+// @Failure 400 {string} string "Bad Request"
 // @Failure 404 {string} string "Employer not found"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /employers/{id} [put]
+// @Router /update-employer [put]
 func UpdateEmployer(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id, err := strconv.Atoi(r.Header.Get("employer-id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		http.Error(w, "Invalid or missing employer-id header", http.StatusBadRequest)
 		return
 	}
-	var employerInput struct {
-		Name          string  `json:"name"`
-		ContactNumber string  `json:"contact_number"`
-		AddressLine1  string  `json:"address_line1"`
-		AddressLine2  string  `json:"address_line2"`
-		AddressLine3  string  `json:"address_line3"`
-		Longitude     float64 `json:"addr_long"`
-		Latitude      float64 `json:"addr_lat"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&employerInput); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	var in models.EmployerInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
 		return
 	}
-	res, err := database.DB.Exec(
-		`UPDATE employer SET name = $1, contact_number = $2, address_line1 = $3, address_line2 = $4, address_line3 = $5, addr_long = $6, addr_lat = $7 WHERE id = $8`,
-		employerInput.Name, employerInput.ContactNumber, employerInput.AddressLine1, employerInput.AddressLine2, employerInput.AddressLine3, employerInput.Longitude, employerInput.Latitude, id,
-	)
+	tz, err := validateEmployer(&in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
+	var current models.Employer
+	err = scanEmployer(database.DB.QueryRow(`SELECT `+employerColumns+` FROM employer WHERE id = $1`, id), &current)
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Employer not found", http.StatusNotFound)
 		return
+	} else if err != nil {
+		log.Printf("Error loading employer %d: %v", id, err)
+		http.Error(w, "Failed to update employer", http.StatusInternalServerError)
+		return
 	}
-	// Return the updated employer
+	geo := locateAddress(r.Context(), employerAddress(&in), &in.Latitude, &in.Longitude, &storedLocation{
+		Address: joinAddress(current.AddressLine1, current.AddressLine2, current.AddressLine3),
+		Lat:     current.Latitude, Long: current.Longitude, Geocoding: current.Geocoding,
+	})
+	args := append([]interface{}{in.Name, in.ContactNumber, in.AddressLine1, in.AddressLine2, in.AddressLine3, in.Longitude, in.Latitude, tz,
+		in.GeofenceRadiusM, in.GeofencePolicy, in.MaxBreakMinutes, in.PaidBreakMinutes}, geocodingArgs(&geo)...)
 	var employer models.Employer
-	err = database.DB.QueryRow(
-		`SELECT id, name, contact_number, address_line1, address_line2, address_line3, addr_long, addr_lat FROM employer WHERE id = $1`,
-		id,
-	).Scan(&employer.ID, &employer.Name, &employer.ContactNumber, &employer.AddressLine1, &employer.AddressLine2, &employer.AddressLine3, &employer.Longitude, &employer.Latitude)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	err = scanEmployer(database.DB.QueryRow(
+		`UPDATE employer SET name = $1, contact_number = $2, address_line1 = $3, address_line2 = $4, address_line3 = $5, addr_long = $6, addr_lat = $7, timezone = $8,
+			geofence_radius_m = $9, geofence_policy = $10, max_break_minutes = $11, paid_break_minutes = $12,
+			geocode_lat = $13, geocode_long = $14, geocode_confidence = $15, geocode_provider = $16, geocoded_at = $17,
+			location_source = $18, location_mismatch_m = $19, location_confirmed_by = $20, location_confirmed_at = $21
+		WHERE id = $22 RETURNING `+employerColumns,
+		append(args, id)...,
+	), &employer)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error updating employer %d: %v", id, err)
+		http.Error(w, "Failed to update employer", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -167,46 +287,110 @@ func UpdateEmployer(w http.ResponseWriter, r *http.Request) {
 
 // DeleteEmployer godoc
 // @Summary Delete an employer by ID
-// @Description Delete an employer by ID
+// @Description Refused while trainees are placed there, now or from a later date. An employer with past placements is archived so their history keeps its employer; one without is deleted with its sites and closures. Either way its staff accounts are deactivated and its site codes revoked.
 // @Tags employers
-// @Param id path int true "Employer ID"
-// @Success 204 {string} string "No Content"
-// @Failure 400 {string} string "Invalid ID"
+// @Param employer-id header int true "Employer ID"
+// @Success 200 {object} models.Employer "Archived"
+// @Success 204 {string} string "Deleted"
+// @Failure 400 {string} string "Invalid or missing employer-id header"
+// @Failure 404 {string} string "Employer not found"
+// @Failure 409 {string} string "Trainees are still placed there"
 // @Failure 500 {string} string "Internal Server Error"
-// @Router /employers/{id} [delete]
+// @Router /delete-employer [delete]
 func DeleteEmployer(w http.ResponseWriter, r *http.Request) {
-	params := mux.Vars(r)
-	id, err := strconv.Atoi(params["id"])
+	id, err := strconv.Atoi(r.Header.Get("employer-id"))
 	if err != nil {
-		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		http.Error(w, "Invalid or missing employer-id header", http.StatusBadRequest)
 		return
 	}
-	res, err := database.DB.Exec(`DELETE FROM employer WHERE id = $1`, id)
+	fail := func(err error) {
+		log.Printf("Error deleting employer %d: %v", id, err)
+		http.Error(w, "Failed to delete employer", http.StatusInternalServerError)
+	}
+	tx, err := database.DB.Begin()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		fail(err)
 		return
 	}
-	n, _ := res.RowsAffected()
-	if n == 0 {
+	defer tx.Rollback()
+
+	var placed, history bool
+	err = tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM student WHERE employer_id = $1)
+				OR EXISTS (SELECT 1 FROM placements WHERE employer_id = $1 AND status <> 'void' AND (end_date IS NULL OR end_date >= $2::date)),
+			EXISTS (SELECT 1 FROM placements WHERE employer_id = $1)
+		FROM employer WHERE id = $1 FOR UPDATE`,
+		id, placementToday(time.Now()),
+	).Scan(&placed, &history)
+	if errors.Is(err, sql.ErrNoRows) {
 		http.Error(w, "Employer not found", http.StatusNotFound)
 		return
+	} else if err != nil {
+		fail(err)
+		return
+	}
+	if placed {
+		http.Error(w, "Trainees are still placed with this employer; transfer or end their placements first", http.StatusConflict)
+		return
+	}
+
+	// Its contacts lose access and its workplace codes stop working
+	for _, q := range []string{
+		`UPDATE staff_accounts SET is_active = FALSE WHERE employer_id = $1 AND is_active`,
+		`UPDATE site_token_keys SET revoked_at = NOW() WHERE employer_id = $1 AND revoked_at IS NULL`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if history {
+		var employer models.Employer
+		err := scanEmployer(tx.QueryRow(
+			`UPDATE employer SET archived_at = COALESCE(archived_at, NOW()) WHERE id = $1 RETURNING `+employerColumns, id,
+		), &employer)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		log.Printf("Employer %d archived", id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(employer)
+		return
+	}
+	for _, q := range []string{
+		`DELETE FROM employer_sites WHERE employer_id = $1`,
+		`DELETE FROM employer_closures WHERE employer_id = $1`,
+		`DELETE FROM employer WHERE id = $1`,
+	} {
+		if _, err := tx.Exec(q, id); err != nil {
+			fail(err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		fail(err)
+		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // GetAllEmployerIDsAndNames godoc
 // @Summary Get all employer IDs and names
-// @Description Returns a list of all employer IDs and their names
+// @Description Returns a list of the IDs and names of employers that are not archived
 // @Tags employers
 // @Produce json
 // @Success 200 {array} object
-// @Router /employers/ids-names [get]
+// @Router /get-employer-ids [get]
 func GetAllEmployerIDsAndNames(w http.ResponseWriter, r *http.Request) {
 	type EmployerIDName struct {
 		ID   uint64 `json:"id"`
 		Name string `json:"name"`
 	}
-	rows, err := database.DB.Query(`SELECT id, name FROM employer`)
+	rows, err := database.DB.Query(`SELECT id, name FROM employer WHERE archived_at IS NULL`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
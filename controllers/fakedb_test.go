@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeQuery answers one statement sent to a fake database with the columns
+// and rows it returns
+type fakeQuery func(query string, args []driver.Value) (columns []string, rows [][]driver.Value, err error)
+
+var (
+	fakeDBs          sync.Map
+	registerFakeOnce sync.Once
+)
+
+// openFakeDB returns a database whose queries are all answered by answer, so
+// code written against *sql.DB can be tested without Postgres
+func openFakeDB(t *testing.T, answer fakeQuery) *sql.DB {
+	t.Helper()
+	registerFakeOnce.Do(func() { sql.Register("fakedb", fakeDriver{}) })
+	fakeDBs.Store(t.Name(), answer)
+	db, err := sql.Open("fakedb", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeDBs.Delete(t.Name())
+	})
+	return db
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	answer, ok := fakeDBs.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("fakedb: no database %q", name)
+	}
+	return fakeConn{answer.(fakeQuery)}, nil
+}
+
+type fakeConn struct{ answer fakeQuery }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.answer, query}, nil }
+func (fakeConn) Close() error                                { return nil }
+func (fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakedb: transactions are not supported")
+}
+
+type fakeStmt struct {
+	answer fakeQuery
+	query  string
+}
+
+func (fakeStmt) Close() error  { return nil }
+func (fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, rows, err := s.answer(s.query, args)
+	return driver.RowsAffected(len(rows)), err
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, rows, err := s.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
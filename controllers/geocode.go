@@ -0,0 +1,256 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errAddressNotFound is returned by a geocoder that has no match for an
+// address
+var errAddressNotFound = errors.New("address not found")
+
+// GeocodeResult is the position of an address. Confidence runs from 0 (a
+// rough guess such as the centre of a town) to 1 (the exact building).
+type GeocodeResult struct {
+	Position   LatLng
+	Confidence float64
+	Provider   string
+}
+
+// Geocoder turns a postal address into coordinates
+type Geocoder interface {
+	Name() string
+	Geocode(ctx context.Context, address string) (GeocodeResult, error)
+}
+
+// geocoder is the configured geocoder, nil when addresses are not geocoded
+var geocoder Geocoder
+
+// geocodeTimeout bounds each lookup so saving a record never hangs on it
+var geocodeTimeout = 5 * time.Second
+
+// LoadGeocoder picks the geocoder from GEOCODER: google (needs
+// GOOGLE_MAPS_API_KEY), nominatim (needs NOMINATIM_URL), static (reads
+// GEOCODER_STATIC_FILE) or off. Unset, it uses Google when a key is
+// configured, then Nominatim when a URL is, and otherwise stays off.
+func LoadGeocoder() {
+	client := &http.Client{}
+	country := strings.ToLower(strings.TrimSpace(os.Getenv("GEOCODE_COUNTRY")))
+	name := strings.ToLower(strings.TrimSpace(os.Getenv("GEOCODER")))
+	if name == "" {
+		switch {
+		case os.Getenv("GOOGLE_MAPS_API_KEY") != "":
+			name = "google"
+		case os.Getenv("NOMINATIM_URL") != "":
+			name = "nominatim"
+		default:
+			name = "off"
+		}
+	}
+	geocodeTimeout = time.Duration(envInt("GEOCODER_TIMEOUT_MS", 5000)) * time.Millisecond
+
+	switch name {
+	case "google":
+		key := os.Getenv("GOOGLE_MAPS_API_KEY")
+		if key == "" {
+			log.Fatal("❌ GEOCODER=google needs GOOGLE_MAPS_API_KEY")
+		}
+		geocoder = &GoogleGeocoder{APIKey: key, Region: country, Client: client}
+	case "nominatim":
+		base := os.Getenv("NOMINATIM_URL")
+		if base == "" {
+			log.Fatal("❌ GEOCODER=nominatim needs NOMINATIM_URL")
+		}
+		geocoder = &NominatimGeocoder{BaseURL: strings.TrimRight(base, "/"), CountryCodes: country, Client: client}
+	case "static":
+		g, err := LoadStaticGeocoder(os.Getenv("GEOCODER_STATIC_FILE"))
+		if err != nil {
+			log.Fatalf("❌ GEOCODER=static: %v", err)
+		}
+		geocoder = g
+	case "off":
+		geocoder = nil
+		log.Println("Geocoding is off; coordinates are taken as entered")
+		return
+	default:
+		log.Fatalf("❌ Unknown GEOCODER %q", name)
+	}
+	log.Printf("✅ Geocoder: %s", geocoder.Name())
+}
+
+// GoogleGeocoder uses the Google Geocoding API. Region biases results
+// towards a country (a ccTLD such as "lk").
+type GoogleGeocoder struct {
+	APIKey string
+	Region string
+	Client *http.Client
+}
+
+// Google Geocoding API response struct (partial)
+type googleGeocodeResponse struct {
+	Results []struct {
+		Geometry struct {
+			Location struct {
+				Lat float64 `json:"lat"`
+				Lng float64 `json:"lng"`
+			} `json:"location"`
+			LocationType string `json:"location_type"`
+		} `json:"geometry"`
+		PartialMatch bool `json:"partial_match"`
+	} `json:"results"`
+	Status string `json:"status"`
+}
+
+// googleLocationConfidence rates Google's location_type
+var googleLocationConfidence = map[string]float64{
+	"ROOFTOP":            1,
+	"RANGE_INTERPOLATED": 0.8,
+	"GEOMETRIC_CENTER":   0.6,
+	"APPROXIMATE":        0.4,
+}
+
+func (g *GoogleGeocoder) Name() string { return "google" }
+
+func (g *GoogleGeocoder) Geocode(ctx context.Context, address string) (GeocodeResult, error) {
+	q := url.Values{}
+	q.Set("address", address)
+	q.Set("key", g.APIKey)
+	if g.Region != "" {
+		q.Set("region", g.Region)
+	}
+	var resp googleGeocodeResponse
+	if err := getJSON(ctx, g.Client, "https://maps.googleapis.com/maps/api/geocode/json?"+q.Encode(), &resp); err != nil {
+		return GeocodeResult{}, err
+	}
+	if resp.Status == "ZERO_RESULTS" || (resp.Status == "OK" && len(resp.Results) == 0) {
+		return GeocodeResult{}, errAddressNotFound
+	}
+	if resp.Status != "OK" {
+		return GeocodeResult{}, fmt.Errorf("google geocoding status %s", resp.Status)
+	}
+	best := resp.Results[0]
+	confidence := googleLocationConfidence[best.Geometry.LocationType]
+	if best.PartialMatch {
+		confidence *= 0.7
+	}
+	return GeocodeResult{
+		Position:   LatLng{Lat: best.Geometry.Location.Lat, Lng: best.Geometry.Location.Lng},
+		Confidence: confidence,
+		Provider:   g.Name(),
+	}, nil
+}
+
+// NominatimGeocoder uses the search API of a Nominatim compatible server,
+// normally one run alongside the app. CountryCodes limits results to a
+// comma separated list of ISO 3166-1 alpha-2 codes.
+type NominatimGeocoder struct {
+	BaseURL      string
+	CountryCodes string
+	Client       *http.Client
+}
+
+func (g *NominatimGeocoder) Name() string { return "nominatim" }
+
+func (g *NominatimGeocoder) Geocode(ctx context.Context, address string) (GeocodeResult, error) {
+	q := url.Values{}
+	q.Set("q", address)
+	q.Set("format", "jsonv2")
+	q.Set("limit", "1")
+	if g.CountryCodes != "" {
+		q.Set("countrycodes", g.CountryCodes)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.BaseURL+"/search?"+q.Encode(), nil)
+	if err != nil {
+		return GeocodeResult{}, err
+	}
+	// Nominatim's usage policy asks every client to identify itself
+	req.Header.Set("User-Agent", "attendance-server")
+	var results []struct {
+		Lat       string `json:"lat"`
+		Lon       string `json:"lon"`
+		PlaceRank int    `json:"place_rank"`
+	}
+	if err := doJSON(g.Client, req, &results); err != nil {
+		return GeocodeResult{}, err
+	}
+	if len(results) == 0 {
+		return GeocodeResult{}, errAddressNotFound
+	}
+	lat, err1 := strconv.ParseFloat(results[0].Lat, 64)
+	lng, err2 := strconv.ParseFloat(results[0].Lon, 64)
+	if err1 != nil || err2 != nil {
+		return GeocodeResult{}, fmt.Errorf("nominatim returned an invalid position %q,%q", results[0].Lat, results[0].Lon)
+	}
+	// place_rank 30 is a single building; lower ranks are streets, towns
+	// and regions
+	confidence := float64(results[0].PlaceRank) / 30
+	if confidence > 1 {
+		confidence = 1
+	}
+	return GeocodeResult{Position: LatLng{Lat: lat, Lng: lng}, Confidence: confidence, Provider: g.Name()}, nil
+}
+
+// StaticGeocoder answers from a fixed table of addresses, for tests and
+// local development. Addresses match regardless of case, spacing and
+// punctuation.
+type StaticGeocoder struct {
+	entries map[string]LatLng
+}
+
+// NewStaticGeocoder returns a geocoder that knows the given addresses
+func NewStaticGeocoder(entries map[string]LatLng) *StaticGeocoder {
+	g := &StaticGeocoder{entries: map[string]LatLng{}}
+	for address, pos := range entries {
+		g.entries[staticAddressKey(address)] = pos
+	}
+	return g
+}
+
+// LoadStaticGeocoder reads a JSON object mapping each address to
+// {"lat": ..., "long": ...}
+func LoadStaticGeocoder(path string) (*StaticGeocoder, error) {
+	if path == "" {
+		return nil, errors.New("GEOCODER_STATIC_FILE is not set")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var table map[string]struct {
+		Lat  float64 `json:"lat"`
+		Long float64 `json:"long"`
+	}
+	if err := json.Unmarshal(b, &table); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	entries := make(map[string]LatLng, len(table))
+	for address, pos := range table {
+		entries[address] = LatLng{Lat: pos.Lat, Lng: pos.Long}
+	}
+	return NewStaticGeocoder(entries), nil
+}
+
+func staticAddressKey(address string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(address), func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c > 127)
+	}), " ")
+}
+
+func (g *StaticGeocoder) Name() string { return "static" }
+
+func (g *StaticGeocoder) Geocode(ctx context.Context, address string) (GeocodeResult, error) {
+	pos, ok := g.entries[staticAddressKey(address)]
+	if !ok {
+		return GeocodeResult{}, errAddressNotFound
+	}
+	return GeocodeResult{Position: pos, Confidence: 1, Provider: g.Name()}, nil
+}
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGoogleGeocodeErrorHidesKey(t *testing.T) {
+	g := &GoogleGeocoder{APIKey: "secret-key-123", Client: &http.Client{Transport: failingTransport{}}}
+	_, err := g.Geocode(context.Background(), "1 Galle Road, Colombo")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(err.Error(), "secret-key-123") {
+		t.Fatalf("error leaks the API key: %v", err)
+	}
+}
+
+func TestStaticAddressKey(t *testing.T) {
+	tests := []struct {
+		address, want string
+	}{
+		{"1 Galle Road, Colombo 03", "1 galle road colombo 03"},
+		{"  1,Galle   Road.\tColombo-03 ", "1 galle road colombo 03"},
+		{"No. 12/B, Kandy Rd", "no 12 b kandy rd"},
+		{"ÉCOLE Street", "école street"},
+		{"කොළඹ 07", "කොළඹ 07"},
+		{"", ""},
+		{" ,.- ", ""},
+	}
+	for _, tt := range tests {
+		if got := staticAddressKey(tt.address); got != tt.want {
+			t.Errorf("staticAddressKey(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestStaticGeocoderIgnoresFormatting(t *testing.T) {
+	g := NewStaticGeocoder(map[string]LatLng{"1 Galle Road, Colombo 03": {Lat: 6.9, Lng: 79.85}})
+	res, err := g.Geocode(context.Background(), "1 galle road colombo-03")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Position != (LatLng{Lat: 6.9, Lng: 79.85}) {
+		t.Errorf("position = %+v", res.Position)
+	}
+	if _, err := g.Geocode(context.Background(), "2 Galle Road, Colombo 03"); err != errAddressNotFound {
+		t.Errorf("err = %v, want errAddressNotFound", err)
+	}
+}
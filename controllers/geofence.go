@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	geofenceInside  = "inside"
+	geofenceOutside = "outside"
+	geofenceUnknown = "unknown"
+
+	// What happens to an event recorded outside the geofence
+	geofencePolicyReject = "reject"
+	geofencePolicyFlag   = "flag"
+	geofencePolicySilent = "silent"
+)
+
+// errOutsideGeofence is returned when the employer's policy rejects events
+// recorded outside its geofence
+var errOutsideGeofence = errors.New("outside the workplace geofence")
+
+// geofenceResult is how an attendance event's position relates to the
+// trainee's workplace
+type geofenceResult struct {
+	Status         string
+	DistanceMeters *int
+	RadiusMeters   int
+	Policy         string
+	Flagged        bool
+	// Polygon is set when the site's boundary was used instead of a radius.
+	// DistanceMeters is then the distance to the boundary, 0 inside it.
+	Polygon bool
+	// Fenced is set when the workplace has a position or boundary, so an
+	// event without one cannot be checked against it
+	Fenced bool
+}
+
+// defaultGeofence returns the radius and policy used for employers that do
+// not set their own
+func defaultGeofence() (int, string) {
+	radius := envInt("GEOFENCE_DEFAULT_RADIUS_METERS", 200)
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("GEOFENCE_DEFAULT_POLICY")))
+	if !validGeofencePolicy(policy) {
+		policy = geofencePolicyFlag
+	}
+	return radius, policy
+}
+
+func validGeofencePolicy(p string) bool {
+	switch p {
+	case geofencePolicyReject, geofencePolicyFlag, geofencePolicySilent:
+		return true
+	}
+	return false
+}
+
+// validateGeofenceSettings checks an employer's optional geofence overrides
+func validateGeofenceSettings(radius *int, policy *string) error {
+	if radius != nil && (*radius <= 0 || *radius > 50000) {
+		return errors.New("geofence_radius_m must be between 1 and 50000")
+	}
+	if policy != nil && *policy != "" && !validGeofencePolicy(*policy) {
+		return errors.New("geofence_policy must be reject, flag or silent")
+	}
+	return nil
+}
+
+// hasPosition reports whether a coordinate pair was actually supplied. The app
+// sends 0,0 when it has no fix.
+func hasPosition(lat, long *float64) bool {
+	return lat != nil && long != nil && !(*lat == 0 && *long == 0)
+}
+
+// outOfRange reports whether a supplied latitude or longitude is beyond
+// 90 or 180 degrees either side of zero, which no device can report
+func outOfRange(lat, long *float64) bool {
+	return (lat != nil && math.Abs(*lat) > 90) || (long != nil && math.Abs(*long) > 180)
+}
+
+// evaluateGeofence compares a position with the trainee's workplace on day:
+// their site when they are placed at one, otherwise the employer. The status is
+// unknown when either side has no coordinates. Unknown positions are flagged
+// unless the policy is silent, since they cannot be verified.
+func evaluateGeofence(db *sql.DB, studentID int, day string, lat, long *float64) (geofenceResult, error) {
+	radius, policy := defaultGeofence()
+	res := geofenceResult{Status: geofenceUnknown, RadiusMeters: radius, Policy: policy}
+
+	wp, found, err := loadWorkplace(db, studentID, day)
+	if err != nil {
+		return res, fmt.Errorf("load employer geofence: %w", err)
+	}
+	if wp.RadiusM != nil {
+		res.RadiusMeters = *wp.RadiusM
+	}
+	if wp.Policy != nil && validGeofencePolicy(*wp.Policy) {
+		res.Policy = *wp.Policy
+	}
+
+	res.Fenced = found && (len(wp.Polygon) > 0 || wp.Position != nil)
+	switch {
+	case !found || !hasPosition(lat, long):
+	case len(wp.Polygon) > 0:
+		res.Polygon = true
+		d := 0
+		res.Status = geofenceInside
+		if !insidePolygon(*lat, *long, wp.Polygon) {
+			d = polygonDistance(*lat, *long, wp.Polygon)
+			res.Status = geofenceOutside
+		}
+		res.DistanceMeters = &d
+	case wp.Position != nil:
+		d := haversine(*lat, *long, wp.Position.Lat, wp.Position.Lng)
+		res.DistanceMeters = &d
+		res.Status = geofenceInside
+		if d > res.RadiusMeters {
+			res.Status = geofenceOutside
+		}
+	}
+
+	res.Flagged = res.Status != geofenceInside && res.Policy != geofencePolicySilent
+	return res, nil
+}
+
+// rejects reports whether the policy refuses the event outright. Under
+// reject an event without a position is refused too when the workplace has
+// one, since otherwise leaving out the coordinates would get round it.
+func (g geofenceResult) rejects() bool {
+	if g.Policy != geofencePolicyReject {
+		return false
+	}
+	return g.Status == geofenceOutside || (g.Status == geofenceUnknown && g.Fenced)
+}
+
+// clearlyOutside reports whether the position is outside the geofence even
+// allowing for the accuracy the device reported. A fix without a reported
+// accuracy is taken at face value.
+func (g geofenceResult) clearlyOutside(accuracyM *float64) bool {
+	if g.Status != geofenceOutside || g.DistanceMeters == nil {
+		return false
+	}
+	beyond := float64(*g.DistanceMeters)
+	if !g.Polygon {
+		beyond -= float64(g.RadiusMeters)
+	}
+	return accuracyM == nil || beyond > *accuracyM
+}
+
+// rejectionError describes a rejected event for the trainee
+func (g geofenceResult) rejectionError() error {
+	if g.Status == geofenceUnknown {
+		return fmt.Errorf("%w: no position was sent, which the workplace requires unless its site code is scanned", errOutsideGeofence)
+	}
+	if g.Polygon {
+		return fmt.Errorf("%w: %d m outside the site boundary", errOutsideGeofence, *g.DistanceMeters)
+	}
+	return fmt.Errorf("%w: %d m from the workplace, allowed %d m", errOutsideGeofence, *g.DistanceMeters, g.RadiusMeters)
+}
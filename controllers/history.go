@@ -0,0 +1,310 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+const (
+	historyDefaultLimit = 50
+	historyMaxLimit     = 200
+)
+
+// historyStatuses maps each ?status= value to the condition on the history
+// row (aliased h) it selects
+var historyStatuses = map[string]string{
+	"on_time":     "h.kind = 'session' AND h.late_minutes = 0",
+	"late":        "h.kind = 'session' AND h.late_minutes > 0",
+	"left_early":  "h.kind = 'session' AND h.early_leave_minutes > 0",
+	"absent":      "h.kind = 'absence' AND h.excused IS NULL",
+	"excused":     "h.kind = 'absence' AND h.excused IS NOT NULL",
+	"auto_closed": "h.auto_closed",
+	"off_site":    "(h.check_in_geofence = 'outside' OR h.check_out_geofence = 'outside')",
+	"open":        "h.kind = 'session' AND h.check_in_date_time IS NOT NULL AND h.check_out_date_time IS NULL",
+	"corrected":   "h.corrected",
+	"flagged":     "h.flagged",
+}
+
+// historyQuery unions sessions with absences so both can be paged together.
+// Absences cleared by a late check-in are left out; excused ones stay.
+// Employer and supervisor are the ones of the placement on the entry's
+// date; %[1]s is the placeholder of the organisation's timezone and %[2]s
+// and %[3]s the conditions pushed into the session and absence branches.
+var historyQuery = `
+	SELECT h.kind, h.id, h.student_id, s.first_name, s.last_name, pl.employer_id, ` + placementSupervisor + `, h.at,
+		h.check_in_date_time, h.check_out_date_time, h.late_minutes, h.early_leave_minutes, h.break_minutes,
+		h.check_in_geofence, h.check_out_geofence, h.absence_date, h.excused, h.auto_closed, h.corrected, h.flagged
+	FROM (
+		SELECT 'session' AS kind, a.id, a.student_id, ` + historySessionBranch.at + ` AS at,
+			a.check_in_date_time::timestamptz AS check_in_date_time, a.check_out_date_time::timestamptz AS check_out_date_time,
+			a.late_minutes, a.early_leave_minutes, a.break_minutes, a.check_in_geofence, a.check_out_geofence,
+			NULL::date AS absence_date, NULL::text AS excused, a.auto_closed, a.corrected, a.flagged
+		FROM attendance a WHERE %[2]s
+		UNION ALL
+		SELECT 'absence', ab.id, ab.student_id, ` + historyAbsenceBranch.at + `,
+			NULL, NULL, NULL, NULL, NULL, NULL, NULL,
+			ab.date, ab.excused, false, false, false
+		FROM absences ab WHERE (ab.cleared_at IS NULL OR ab.excused IS NOT NULL) AND %[3]s
+	) h
+	JOIN student s ON s.id = h.student_id
+	` + historyPlacement + `
+	WHERE `
+
+// historyBranch names the columns of one side of the history union, so the
+// student, date and cursor conditions can be applied before the rows are
+// merged instead of on the computed sort key
+type historyBranch struct {
+	student, at, kind, id string
+}
+
+var (
+	historySessionBranch = historyBranch{"a.student_id", "COALESCE(a.check_in_date_time, a.check_out_date_time)::timestamptz", "'session'", "a.id"}
+	historyAbsenceBranch = historyBranch{"ab.student_id", "COALESCE(ab.scheduled_start, ab.date::timestamptz)", "'absence'", "ab.id"}
+)
+
+// historyPlacement joins the placement on an entry's local date
+var historyPlacement = placementAsOf("h.student_id", "COALESCE(h.absence_date, (h.at AT TIME ZONE %[1]s)::date)")
+
+// historyCursor is the sort key of the last row of a page
+type historyCursor struct {
+	At   time.Time
+	Kind string
+	ID   int
+}
+
+func (c historyCursor) encode() string {
+	raw := fmt.Sprintf("%d|%s|%d", c.At.UnixNano(), c.Kind, c.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeHistoryCursor(s string) (historyCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return historyCursor{}, err
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return historyCursor{}, errors.New("malformed cursor")
+	}
+	nanos, err1 := strconv.ParseInt(parts[0], 10, 64)
+	id, err2 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil {
+		return historyCursor{}, errors.New("malformed cursor")
+	}
+	return historyCursor{At: time.Unix(0, nanos), Kind: parts[1], ID: id}, nil
+}
+
+// GetAttendanceHistory pages through attendance sessions and absences.
+// Trainees only see their own; staff see the trainees they manage, employer
+// contacts the entries dated while a trainee was placed with them. Staff can
+// narrow it with student_id, employer_id and supervisor_id, which match the
+// placement the trainee was on at the time. from and to are dates in the
+// organisation's timezone. status takes a comma separated list and matches
+// entries with any of them. Results are newest first unless sort=asc.
+func GetAttendanceHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := principalFromContext(r.Context())
+	var conds []string
+	var args []interface{}
+	// branchConds are applied inside both sides of the union
+	var branchConds []func(b historyBranch) string
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if p != nil && p.Role == roleEmployer && p.EmployerID != nil {
+		// Employer contacts see the entries of the days a trainee was placed
+		// with them, whoever the trainee is with now
+		employer := arg(*p.EmployerID)
+		conds = append(conds, "pl.employer_id = "+employer)
+		branchConds = append(branchConds, func(b historyBranch) string {
+			return b.student + " IN (SELECT student_id FROM placements WHERE employer_id = " + employer + " AND status <> 'void')"
+		})
+	} else {
+		var scope string
+		scope, args = studentScope(p, "s", args)
+		conds = append(conds, scope)
+	}
+	bad := func(msg string) { http.Error(w, msg, http.StatusBadRequest) }
+	tz := arg(orgLocation.String())
+
+	for param, column := range map[string]string{"employer_id": "pl.employer_id", "supervisor_id": placementSupervisor} {
+		if v := q.Get(param); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				bad("Invalid " + param)
+				return
+			}
+			conds = append(conds, column+" = "+arg(id))
+		}
+	}
+	if v := q.Get("student_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			bad("Invalid student_id")
+			return
+		}
+		ph := arg(id)
+		branchConds = append(branchConds, func(b historyBranch) string { return b.student + " = " + ph })
+	}
+	if v := q.Get("from"); v != "" {
+		d, err := time.ParseInLocation(dateLayout, v, orgLocation)
+		if err != nil {
+			bad("from must be YYYY-MM-DD")
+			return
+		}
+		ph := arg(d.UTC())
+		branchConds = append(branchConds, func(b historyBranch) string { return b.at + " >= " + ph })
+	}
+	if v := q.Get("to"); v != "" {
+		d, err := time.ParseInLocation(dateLayout, v, orgLocation)
+		if err != nil {
+			bad("to must be YYYY-MM-DD")
+			return
+		}
+		ph := arg(d.AddDate(0, 0, 1).UTC())
+		branchConds = append(branchConds, func(b historyBranch) string { return b.at + " < " + ph })
+	}
+	if v := q.Get("status"); v != "" {
+		var matches []string
+		for _, st := range strings.Split(v, ",") {
+			cond, ok := historyStatuses[strings.TrimSpace(st)]
+			if !ok {
+				bad("Unknown status " + st)
+				return
+			}
+			matches = append(matches, "("+cond+")")
+		}
+		conds = append(conds, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	order, cmp := "DESC", "<"
+	switch q.Get("sort") {
+	case "", "desc":
+	case "asc":
+		order, cmp = "ASC", ">"
+	default:
+		bad("sort must be asc or desc")
+		return
+	}
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeHistoryCursor(v)
+		if err != nil {
+			bad("Invalid cursor")
+			return
+		}
+		at, kind, id := arg(c.At), arg(c.Kind), arg(c.ID)
+		branchConds = append(branchConds, func(b historyBranch) string {
+			return fmt.Sprintf("(%s, %s, %s) %s (%s::timestamptz, %s::text, %s::int)", b.at, b.kind, b.id, cmp, at, kind, id)
+		})
+	}
+
+	limit := historyDefaultLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > historyMaxLimit {
+			bad("limit must be between 1 and 200")
+			return
+		}
+		limit = n
+	}
+
+	branchWhere := func(b historyBranch) string {
+		where := []string{"TRUE"}
+		for _, cond := range branchConds {
+			where = append(where, cond(b))
+		}
+		return strings.Join(where, " AND ")
+	}
+	query := fmt.Sprintf(historyQuery, tz, branchWhere(historySessionBranch), branchWhere(historyAbsenceBranch)) +
+		strings.Join(conds, " AND ") +
+		fmt.Sprintf(" ORDER BY h.at %[1]s, h.kind %[1]s, h.id %[1]s LIMIT %d", order, limit+1)
+	rows, err := database.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error loading attendance history: %v", err)
+		http.Error(w, "Failed to load attendance history", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	page := models.HistoryPage{Items: []models.HistoryEntry{}}
+	for rows.Next() {
+		var e models.HistoryEntry
+		var absenceDate sql.NullTime
+		var autoClosed, corrected, flagged bool
+		err := rows.Scan(&e.Type, &e.ID, &e.StudentID, &e.FirstName, &e.LastName, &e.EmployerID, &e.SupervisorID, &e.At,
+			&e.CheckInDateTime, &e.CheckOutDateTime, &e.LateMinutes, &e.EarlyLeaveMinutes, &e.BreakMinutes,
+			&e.CheckInGeofence, &e.CheckOutGeofence, &absenceDate, &e.Excused, &autoClosed, &corrected, &flagged)
+		if err != nil {
+			log.Printf("Error scanning attendance history: %v", err)
+			http.Error(w, "Failed to load attendance history", http.StatusInternalServerError)
+			return
+		}
+		if absenceDate.Valid {
+			d := absenceDate.Time.Format(dateLayout)
+			e.AbsenceDate = &d
+		}
+		e.Statuses = historyEntryStatuses(&e, autoClosed, corrected, flagged)
+		page.Items = append(page.Items, e)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, "Failed to load attendance history", http.StatusInternalServerError)
+		return
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = historyCursor{At: last.At, Kind: last.Type, ID: last.ID}.encode()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// historyEntryStatuses works out which status filters an entry matches,
+// mirroring historyStatuses
+func historyEntryStatuses(e *models.HistoryEntry, autoClosed, corrected, flagged bool) []string {
+	statuses := []string{}
+	if e.Type == "absence" {
+		if e.Excused != nil {
+			return append(statuses, "excused")
+		}
+		return append(statuses, "absent")
+	}
+	if e.LateMinutes != nil {
+		if *e.LateMinutes > 0 {
+			statuses = append(statuses, "late")
+		} else {
+			statuses = append(statuses, "on_time")
+		}
+	}
+	if e.EarlyLeaveMinutes != nil && *e.EarlyLeaveMinutes > 0 {
+		statuses = append(statuses, "left_early")
+	}
+	if e.CheckInDateTime != nil && e.CheckOutDateTime == nil {
+		statuses = append(statuses, "open")
+	}
+	if (e.CheckInGeofence != nil && *e.CheckInGeofence == geofenceOutside) || (e.CheckOutGeofence != nil && *e.CheckOutGeofence == geofenceOutside) {
+		statuses = append(statuses, "off_site")
+	}
+	for _, s := range []struct {
+		set  bool
+		name string
+	}{{autoClosed, "auto_closed"}, {corrected, "corrected"}, {flagged, "flagged"}} {
+		if s.set {
+			statuses = append(statuses, s.name)
+		}
+	}
+	return statuses
+}
@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestHistoryCursorRoundTrip(t *testing.T) {
+	for _, c := range []historyCursor{
+		{At: time.Date(2026, 3, 29, 1, 30, 0, 123456789, time.UTC), Kind: "session", ID: 42},
+		{At: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Kind: "absence", ID: 1},
+	} {
+		got, err := decodeHistoryCursor(c.encode())
+		if err != nil {
+			t.Fatalf("decode %+v: %v", c, err)
+		}
+		if !got.At.Equal(c.At) || got.Kind != c.Kind || got.ID != c.ID {
+			t.Errorf("got %+v, want %+v", got, c)
+		}
+	}
+}
+
+func TestDecodeHistoryCursorRejectsMalformed(t *testing.T) {
+	enc := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	for name, cursor := range map[string]string{
+		"not base64":    "!!!",
+		"padded base64": base64.URLEncoding.EncodeToString([]byte("1|session|2")),
+		"too few parts": enc("1|session"),
+		"too many":      enc("1|session|2|3"),
+		"bad time":      enc("soon|session|2"),
+		"bad id":        enc("1|session|two"),
+		"empty":         "",
+	} {
+		if _, err := decodeHistoryCursor(cursor); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
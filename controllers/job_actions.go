@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// GetJobActions lists what the background jobs did to the trainees the caller
+// manages, newest first. ?pending=true limits it to actions nobody has
+// reviewed yet.
+func GetJobActions(w http.ResponseWriter, r *http.Request) {
+	var args []interface{}
+	pending := r.URL.Query().Get("pending") == "true"
+	args = append(args, pending)
+	scope, args := studentScope(principalFromContext(r.Context()), "s", args)
+
+	rows, err := database.DB.Query(
+		`SELECT j.id, j.job, j.action, j.student_id, s.first_name, s.last_name, j.attendance_id, j.absence_id,
+			j.detail, j.created_at, j.reviewed_by, j.reviewed_at, j.review_note
+		FROM job_actions j
+		JOIN student s ON s.id = j.student_id
+		WHERE (NOT $1 OR j.reviewed_at IS NULL) AND `+scope+`
+		ORDER BY j.created_at DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading job actions: %v", err)
+		http.Error(w, "Failed to load job actions", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	actions := []models.JobAction{}
+	for rows.Next() {
+		var a models.JobAction
+		if err := rows.Scan(&a.ID, &a.Job, &a.Action, &a.StudentID, &a.FirstName, &a.LastName, &a.AttendanceID, &a.AbsenceID,
+			&a.Detail, &a.CreatedAt, &a.ReviewedBy, &a.ReviewedAt, &a.ReviewNote); err != nil {
+			http.Error(w, "Failed to load job actions", http.StatusInternalServerError)
+			return
+		}
+		actions = append(actions, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(actions)
+}
+
+// ReviewJobAction marks a job action as reviewed by the calling staff member,
+// with an optional note
+func ReviewJobAction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid job action ID", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var studentID int
+	err = database.DB.QueryRow(`SELECT student_id FROM job_actions WHERE id = $1`, id).Scan(&studentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Job action not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load job action", http.StatusInternalServerError)
+		return
+	}
+	if !requireStudentAccess(w, r, studentID) {
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	_, err = database.DB.Exec(
+		`UPDATE job_actions SET reviewed_by = $1, reviewed_at = NOW(), review_note = $2 WHERE id = $3`,
+		p.StaffID, strings.TrimSpace(body.Note), id,
+	)
+	if err != nil {
+		log.Printf("Error reviewing job action %d: %v", id, err)
+		http.Error(w, "Failed to review job action", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"server/database"
+
+	"github.com/lib/pq"
+)
+
+const (
+	jobAbsences  = "absence_detection"
+	jobAutoClose = "auto_close"
+
+	actionAbsent     = "marked_absent"
+	actionAutoClosed = "auto_closed"
+
+	// Namespace for the advisory lock that keeps one replica running the jobs
+	jobsLockNamespace = 7008
+)
+
+// StartBackgroundJobs runs the attendance jobs every JOBS_INTERVAL_MINUTES
+// (default 5) until the process exits. Set JOBS_ENABLED=false to run them on
+// another instance only. When several replicas are up, an advisory lock makes
+// sure only one of them works through a given run.
+func StartBackgroundJobs() {
+	if strings.EqualFold(strings.TrimSpace(os.Getenv("JOBS_ENABLED")), "false") {
+		log.Println("Background jobs disabled")
+		return
+	}
+	interval := time.Duration(envInt("JOBS_INTERVAL_MINUTES", 5)) * time.Minute
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runJobs(context.Background(), database.DB, time.Now())
+			<-ticker.C
+		}
+	}()
+	log.Printf("Background jobs running every %s", interval)
+}
+
+// runJobs takes the jobs lock and runs each job once. Another replica holding
+// the lock means this run is skipped.
+func runJobs(ctx context.Context, db *sql.DB, now time.Time) {
+	// Session level advisory locks belong to a connection, so hold one for
+	// the whole run
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		log.Printf("Background jobs: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1, 0)`, jobsLockNamespace).Scan(&locked); err != nil {
+		log.Printf("Background jobs: take lock: %v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1, 0)`, jobsLockNamespace)
+
+	// Placements first, so the other jobs see who works where today
+	if n, err := applyDuePlacements(db, now); err != nil {
+		log.Printf("Background jobs: placements: %v", err)
+	} else if n > 0 {
+		log.Printf("Background jobs: moved %d trainees to their current placement", n)
+	}
+	if n, err := closeOpenSessions(db, now); err != nil {
+		log.Printf("Background jobs: auto-close: %v", err)
+	} else if n > 0 {
+		log.Printf("Background jobs: auto-closed %d sessions", n)
+	}
+	if n, err := detectAbsences(db, now); err != nil {
+		log.Printf("Background jobs: absences: %v", err)
+	} else if n > 0 {
+		log.Printf("Background jobs: recorded %d absences", n)
+	}
+	if n, err := flagBreakOverruns(db, now); err != nil {
+		log.Printf("Background jobs: break overruns: %v", err)
+	} else if n > 0 {
+		log.Printf("Background jobs: raised %d break overruns", n)
+	}
+	if n, err := flagOverdueCommutes(db, now); err != nil {
+		log.Printf("Background jobs: commutes: %v", err)
+	} else if n > 0 {
+		log.Printf("Background jobs: raised %d overdue commutes", n)
+	}
+}
+
+// absenceGrace is how long after the scheduled start a trainee who has not
+// checked in is marked absent
+func absenceGrace() time.Duration {
+	return time.Duration(envInt("ABSENCE_GRACE_MINUTES", 60)) * time.Minute
+}
+
+// autoCloseGrace is how long after the scheduled end an open session is
+// closed for the trainee
+func autoCloseGrace() time.Duration {
+	return time.Duration(envInt("AUTO_CLOSE_GRACE_MINUTES", 60)) * time.Minute
+}
+
+// logJobAction records what a job did so a supervisor can review it
+func logJobAction(db *sql.DB, job, action string, studentID int, attendanceID, absenceID *int, detail string) {
+	_, err := db.Exec(
+		`INSERT INTO job_actions (job, action, student_id, attendance_id, absence_id, detail) VALUES ($1, $2, $3, $4, $5, $6)`,
+		job, action, studentID, attendanceID, absenceID, detail,
+	)
+	if err != nil {
+		log.Printf("Background jobs: log %s for student %d: %v", action, studentID, err)
+	}
+}
+
+// closeOpenSessions checks out sessions the trainee forgot to close. The
+// check-out is recorded at the scheduled end time, or at maxSessionLength
+// after the check-in when the session had no schedule, and the session is
+// marked auto_closed.
+func closeOpenSessions(db *sql.DB, now time.Time) (int, error) {
+	rows, err := db.Query(
+		`SELECT id, student_id, check_in_date_time, scheduled_check_out FROM attendance
+		WHERE check_out_date_time IS NULL AND check_in_date_time IS NOT NULL
+			AND ((scheduled_check_out IS NOT NULL AND scheduled_check_out < $1)
+				OR (scheduled_check_out IS NULL AND check_in_date_time < $2))`,
+		now.Add(-autoCloseGrace()), now.Add(-maxSessionLength()),
+	)
+	if err != nil {
+		return 0, err
+	}
+	type openSession struct {
+		id, studentID int
+		checkIn       time.Time
+		closeAt       *time.Time
+	}
+	var open []openSession
+	for rows.Next() {
+		var s openSession
+		if err := rows.Scan(&s.id, &s.studentID, &s.checkIn, &s.closeAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		open = append(open, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	closed := 0
+	for _, s := range open {
+		at := s.checkIn.Add(maxSessionLength())
+		if s.closeAt != nil {
+			at = *s.closeAt
+		}
+		// A check-in after the scheduled end closes when it started
+		if at.Before(s.checkIn) {
+			at = s.checkIn
+		}
+		_, session, err := recordAttendanceEvent(db, attendanceInput{
+			StudentID:  s.studentID,
+			EventType:  eventCheckOut,
+			OccurredAt: at,
+			Source:     sourceAutoClose,
+			SessionID:  s.id,
+		})
+		if err != nil {
+			// The trainee may have checked out since the query ran
+			log.Printf("Background jobs: auto-close session %d: %v", s.id, err)
+			continue
+		}
+		id := int(session.ID)
+		logJobAction(db, jobAutoClose, actionAutoClosed, s.studentID, &id, nil,
+			fmt.Sprintf("Checked out at %s, no check-out was recorded", at.Format(time.RFC3339)))
+		closed++
+	}
+	return closed, nil
+}
+
+// detectAbsences records an absence for every trainee who was scheduled to
+// work today or yesterday, is past the grace period after their first shift
+// and has not checked in that day. Only trainees with a placement around
+// those days are looked at; resolveSchedules settles the exact dates.
+func detectAbsences(db *sql.DB, now time.Time) (int, error) {
+	// The margin covers trainees in timezones either side of the
+	// organisation's
+	rows, err := db.Query(
+		`SELECT DISTINCT student_id FROM placements
+		WHERE status <> 'void' AND start_date <= $1::date + 1 AND (end_date IS NULL OR end_date >= $1::date - 2)`,
+		placementToday(now),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	locs, err := studentTimezones(db, ids, now)
+	if err != nil {
+		return 0, err
+	}
+
+	recorded := 0
+	// Yesterday as well, in case the server was down over the grace period
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		n, err := recordAbsences(db, day, locs, now)
+		recorded += n
+		if err != nil {
+			return recorded, err
+		}
+	}
+	return recorded, nil
+}
+
+// recordAbsences marks trainees absent on the local day containing day when
+// they were due and never checked in. It returns how many new absences were
+// recorded.
+func recordAbsences(db *sql.DB, day time.Time, locs map[int]*time.Location, now time.Time) (int, error) {
+	scheds, err := resolveSchedules(db, day, locs)
+	if err != nil {
+		return 0, err
+	}
+	var ids []int
+	var dates, starts, dayStarts, dayEnds []string
+	for id, sched := range scheds {
+		if !sched.Scheduled || now.Before(sched.Shifts[0].Start.Add(absenceGrace())) {
+			continue
+		}
+		startOfDay, endOfDay := dayBounds(day, locs[id])
+		ids = append(ids, id)
+		dates = append(dates, sched.Date)
+		starts = append(starts, sched.Shifts[0].Start.Format(time.RFC3339))
+		dayStarts = append(dayStarts, startOfDay.Format(time.RFC3339))
+		dayEnds = append(dayEnds, endOfDay.Format(time.RFC3339))
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	// Absences already recorded by an earlier run are left alone
+	rows, err := db.Query(
+		`INSERT INTO absences (student_id, date, scheduled_start)
+		SELECT q.student_id, q.date, q.scheduled_start
+		FROM unnest($1::int[], $2::date[], $3::timestamptz[], $4::timestamptz[], $5::timestamptz[])
+			AS q(student_id, date, scheduled_start, day_start, day_end)
+		WHERE NOT EXISTS (
+			SELECT 1 FROM attendance a
+			WHERE a.student_id = q.student_id AND a.check_in_date_time >= q.day_start AND a.check_in_date_time < q.day_end
+		)
+		ON CONFLICT (student_id, date) DO NOTHING
+		RETURNING id, student_id`,
+		pq.Array(ids), pq.Array(dates), pq.Array(starts), pq.Array(dayStarts), pq.Array(dayEnds),
+	)
+	if err != nil {
+		return 0, err
+	}
+	type absence struct{ id, studentID int }
+	var added []absence
+	for rows.Next() {
+		var a absence
+		if err := rows.Scan(&a.id, &a.studentID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		added = append(added, a)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, a := range added {
+		sched := scheds[a.studentID]
+		logJobAction(db, jobAbsences, actionAbsent, a.studentID, nil, &a.id,
+			fmt.Sprintf("No check-in on %s, scheduled from %s", sched.Date, sched.Shifts[0].Start.In(locs[a.studentID]).Format("15:04")))
+	}
+	return len(added), nil
+}
@@ -0,0 +1,200 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// leaveTypes are the kinds of leave a trainee can request
+var leaveTypes = map[string]bool{"sick": true, "personal": true, "family": true, "study": true, "other": true}
+
+// maxLeaveDays bounds a single leave request
+const maxLeaveDays = 90
+
+const leaveColumns = `id, student_id, start_date, end_date, leave_type, reason, status,
+	submitted_by_student, submitted_by_staff, decided_by, decided_at, decision_note, created_at`
+
+func scanLeave(row interface{ Scan(...interface{}) error }, l *models.LeaveRequest) error {
+	var start, end time.Time
+	err := row.Scan(&l.ID, &l.StudentID, &start, &end, &l.LeaveType, &l.Reason, &l.Status,
+		&l.SubmittedByStudent, &l.SubmittedByStaff, &l.DecidedBy, &l.DecidedAt, &l.DecisionNote, &l.CreatedAt)
+	l.StartDate, l.EndDate = start.Format(dateLayout), end.Format(dateLayout)
+	return err
+}
+
+// CreateLeaveRequest submits a leave request. Trainees submit for
+// themselves; staff pass the student-id header. Requests start pending.
+func CreateLeaveRequest(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	var l models.LeaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	start, err1 := time.Parse(dateLayout, l.StartDate)
+	end, err2 := time.Parse(dateLayout, l.EndDate)
+	if err1 != nil || err2 != nil {
+		http.Error(w, "start_date and end_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if end.Before(start) {
+		http.Error(w, "end_date is before start_date", http.StatusBadRequest)
+		return
+	}
+	if end.Sub(start) >= maxLeaveDays*24*time.Hour {
+		http.Error(w, "A leave request can cover at most 90 days", http.StatusBadRequest)
+		return
+	}
+	l.LeaveType = strings.ToLower(strings.TrimSpace(l.LeaveType))
+	if !leaveTypes[l.LeaveType] {
+		http.Error(w, "leave_type must be sick, personal, family, study or other", http.StatusBadRequest)
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	var byStudent, byStaff *int
+	if p.Role == roleTrainee {
+		byStudent = &p.StudentID
+	} else {
+		byStaff = &p.StaffID
+	}
+	err = scanLeave(database.DB.QueryRow(
+		`INSERT INTO leave_requests (student_id, start_date, end_date, leave_type, reason, submitted_by_student, submitted_by_staff)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING `+leaveColumns,
+		studentID, l.StartDate, l.EndDate, l.LeaveType, strings.TrimSpace(l.Reason), byStudent, byStaff,
+	), &l)
+	if err != nil {
+		log.Printf("Error saving leave request for student %d: %v", studentID, err)
+		http.Error(w, "Failed to submit leave request", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(l)
+}
+
+// GetLeaveRequests lists leave requests, newest first. Trainees see their
+// own. Staff see the trainees they manage, or one trainee with the
+// student-id header. ?status= filters by pending, approved or rejected.
+func GetLeaveRequests(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	args := []interface{}{r.URL.Query().Get("status")}
+	var scope string
+	if p.Role == roleTrainee || r.Header.Get("student-id") != "" {
+		studentID, err := resolveStudentID(r)
+		if err != nil {
+			writeResolveError(w, err)
+			return
+		}
+		args = append(args, studentID)
+		scope = "s.id = $2"
+	} else {
+		scope, args = studentScope(p, "s", args)
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT `+prefixColumns("l", leaveColumns)+` FROM leave_requests l
+		JOIN student s ON s.id = l.student_id
+		WHERE ($1 = '' OR l.status = $1) AND `+scope+`
+		ORDER BY l.created_at DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading leave requests: %v", err)
+		http.Error(w, "Failed to load leave requests", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	requests := []models.LeaveRequest{}
+	for rows.Next() {
+		var l models.LeaveRequest
+		if err := scanLeave(rows, &l); err != nil {
+			http.Error(w, "Failed to load leave requests", http.StatusInternalServerError)
+			return
+		}
+		requests = append(requests, l)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(requests)
+}
+
+// ApproveLeaveRequest approves pending leave. Absences already recorded on
+// those days are excused.
+func ApproveLeaveRequest(w http.ResponseWriter, r *http.Request) {
+	decideLeaveRequest(w, r, requestApproved)
+}
+
+// RejectLeaveRequest rejects pending leave
+func RejectLeaveRequest(w http.ResponseWriter, r *http.Request) {
+	decideLeaveRequest(w, r, requestRejected)
+}
+
+func decideLeaveRequest(w http.ResponseWriter, r *http.Request, decision string) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid leave request ID", http.StatusBadRequest)
+		return
+	}
+	var body struct {
+		Note string `json:"note"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var l models.LeaveRequest
+	err = scanLeave(database.DB.QueryRow(`SELECT `+leaveColumns+` FROM leave_requests WHERE id = $1`, id), &l)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Leave request not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load leave request", http.StatusInternalServerError)
+		return
+	}
+	if !requireStudentAccess(w, r, l.StudentID) {
+		return
+	}
+	p := principalFromContext(r.Context())
+	if l.SubmittedByStaff != nil && *l.SubmittedByStaff == p.StaffID && p.Role != roleAdmin {
+		http.Error(w, "Leave must be decided by someone other than the person who requested it", http.StatusForbidden)
+		return
+	}
+
+	err = scanLeave(database.DB.QueryRow(
+		`UPDATE leave_requests SET status = $1, decided_by = $2, decided_at = NOW(), decision_note = $3
+		WHERE id = $4 AND status = 'pending' RETURNING `+leaveColumns,
+		decision, p.StaffID, strings.TrimSpace(body.Note), id,
+	), &l)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Leave request was already decided", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error deciding leave request %d: %v", id, err)
+		http.Error(w, "Failed to update leave request", http.StatusInternalServerError)
+		return
+	}
+	if decision == requestApproved {
+		excuseAbsences(database.DB, excusedLeave, "a.student_id = $2 AND a.date BETWEEN $3::date AND $4::date",
+			l.StudentID, l.StartDate, l.EndDate)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l)
+}
@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+// Where a record's stored coordinates came from
+const (
+	locationManual    = "manual"
+	locationGeocoded  = "geocoded"
+	locationConfirmed = "confirmed"
+)
+
+// geocodingColumns are the geocoding columns shared by employer and student
+const geocodingColumns = `geocode_lat, geocode_long, geocode_confidence, geocode_provider, geocoded_at,
+	location_source, location_mismatch_m, location_confirmed_by, location_confirmed_at`
+
+// geocodingDest returns scan destinations for geocodingColumns
+func geocodingDest(g *models.Geocoding) []interface{} {
+	return []interface{}{&g.Latitude, &g.Longitude, &g.Confidence, &g.Provider, &g.GeocodedAt,
+		&g.Source, &g.MismatchM, &g.ConfirmedBy, &g.ConfirmedAt}
+}
+
+// geocodingArgs returns the values of geocodingColumns to store
+func geocodingArgs(g *models.Geocoding) []interface{} {
+	return []interface{}{g.Latitude, g.Longitude, g.Confidence, g.Provider, g.GeocodedAt,
+		g.Source, g.MismatchM, g.ConfirmedBy, g.ConfirmedAt}
+}
+
+// geocodeMismatchMeters is how far typed coordinates may be from the
+// geocoded address before the record is flagged
+func geocodeMismatchMeters() int {
+	return envInt("GEOCODE_MISMATCH_METERS", 500)
+}
+
+// geocodeMinConfidence is the confidence below which geocoded coordinates
+// are flagged for staff to check
+func geocodeMinConfidence() float64 {
+	return float64(envInt("GEOCODE_MIN_CONFIDENCE_PERCENT", 50)) / 100
+}
+
+// needsReviewCondition selects rows whose coordinates need checking, as
+// markReview decides. $1 is geocodeMinConfidence.
+const needsReviewCondition = `location_source <> 'confirmed'
+	AND (location_mismatch_m IS NOT NULL OR (location_source = 'geocoded' AND COALESCE(geocode_confidence, 0) < $1))`
+
+// markReview works out NeedsReview, mirroring needsReviewCondition
+func markReview(g *models.Geocoding) {
+	lowConfidence := g.Source == locationGeocoded && (g.Confidence == nil || *g.Confidence < geocodeMinConfidence())
+	g.NeedsReview = g.Source != locationConfirmed && (g.MismatchM != nil || lowConfidence)
+}
+
+// joinAddress is an address for the geocoder, from its non-empty lines
+func joinAddress(lines ...string) string {
+	var parts []string
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// storedLocation is what a record held before an update
+type storedLocation struct {
+	Address   string
+	Lat, Long float64
+	Geocoding models.Geocoding
+}
+
+// locateAddress works out the geocoding of a record being saved. The
+// address is only looked up when it is new or has changed. Missing
+// coordinates (0, 0) are filled in from the geocoder; typed ones are kept
+// and compared with it. Editing the coordinates undoes a confirmation.
+// A failed lookup leaves the record as entered.
+func locateAddress(ctx context.Context, address string, lat, long *float64, prev *storedLocation) models.Geocoding {
+	var g models.Geocoding
+	if prev != nil && prev.Address == address {
+		g = prev.Geocoding
+		if prev.Lat == *lat && prev.Long == *long {
+			markReview(&g)
+			return g
+		}
+		g.Source, g.ConfirmedBy, g.ConfirmedAt = locationManual, nil, nil
+	} else {
+		g = models.Geocoding{Source: locationManual}
+		if geocoder != nil && address != "" {
+			gctx, cancel := context.WithTimeout(ctx, geocodeTimeout)
+			res, err := geocoder.Geocode(gctx, address)
+			cancel()
+			if err != nil {
+				if !errors.Is(err, errAddressNotFound) {
+					log.Printf("Geocoder %s failed: %v", geocoder.Name(), err)
+				}
+			} else {
+				now := time.Now()
+				g.Latitude, g.Longitude = &res.Position.Lat, &res.Position.Lng
+				g.Confidence, g.Provider, g.GeocodedAt = &res.Confidence, res.Provider, &now
+			}
+		}
+	}
+
+	g.MismatchM = nil
+	if g.Latitude != nil && g.Longitude != nil {
+		if !hasPosition(lat, long) {
+			*lat, *long = *g.Latitude, *g.Longitude
+			g.Source = locationGeocoded
+		} else if d := haversine(*lat, *long, *g.Latitude, *g.Longitude); d > geocodeMismatchMeters() {
+			g.MismatchM = &d
+		}
+	}
+	markReview(&g)
+	return g
+}
+
+// locationTable describes how a kind of record stores its location. The
+// names are fixed strings, never client input.
+type locationTable struct {
+	kind, label, table, latColumn, longColumn, name, address string
+}
+
+var (
+	employerLocations = locationTable{
+		kind: "employer", label: "Employer", table: "employer", latColumn: "addr_lat", longColumn: "addr_long",
+		name:    "name",
+		address: "CONCAT_WS(', ', NULLIF(address_line1, ''), NULLIF(address_line2, ''), NULLIF(address_line3, ''))",
+	}
+	studentLocations = locationTable{
+		kind: "student", label: "Student", table: "student", latColumn: "home_lat", longColumn: "home_long",
+		name:    "first_name || ' ' || last_name",
+		address: "CONCAT_WS(', ', NULLIF(address_line1, ''), NULLIF(address_line2, ''), NULLIF(city, ''))",
+	}
+)
+
+// reviewSelect selects a LocationReview from the table
+func (t locationTable) reviewSelect() string {
+	return fmt.Sprintf(`SELECT '%s', id, %s, %s, %s, %s, %s FROM %s`,
+		t.kind, t.name, t.address, t.latColumn, t.longColumn, geocodingColumns, t.table)
+}
+
+func scanLocationReview(row interface{ Scan(...interface{}) error }, lr *models.LocationReview) error {
+	dest := append([]interface{}{&lr.Kind, &lr.ID, &lr.Name, &lr.Address, &lr.Latitude, &lr.Longitude}, geocodingDest(&lr.Geocoding)...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	markReview(&lr.Geocoding)
+	return nil
+}
+
+// GetLocationReviews lists employers and trainees whose coordinates
+// disagree with their address, or were geocoded with low confidence, and
+// have not been confirmed. Trainees are limited to the ones the caller
+// manages; employers are only listed for staff who manage them.
+func GetLocationReviews(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	args := []interface{}{geocodeMinConfidence(), p.Can(PermManageEmployers)}
+	scope, args := studentScope(p, "student", args)
+	rows, err := database.DB.Query(
+		employerLocations.reviewSelect()+` WHERE $2 AND archived_at IS NULL AND `+needsReviewCondition+`
+		UNION ALL
+		`+studentLocations.reviewSelect()+` WHERE `+scope+` AND `+needsReviewCondition+`
+		ORDER BY 1, 3`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading location reviews: %v", err)
+		http.Error(w, "Failed to load location reviews", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	reviews := []models.LocationReview{}
+	for rows.Next() {
+		var lr models.LocationReview
+		if err := scanLocationReview(rows, &lr); err != nil {
+			log.Printf("Error loading location reviews: %v", err)
+			http.Error(w, "Failed to load location reviews", http.StatusInternalServerError)
+			return
+		}
+		reviews = append(reviews, lr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reviews)
+}
+
+// ConfirmEmployerLocation settles the coordinates of the employer in the
+// employer-id header
+func ConfirmEmployerLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.Header.Get("employer-id"))
+	if err != nil {
+		http.Error(w, "Invalid or missing employer-id header", http.StatusBadRequest)
+		return
+	}
+	confirmLocation(w, r, employerLocations, id)
+}
+
+// ConfirmStudentLocation settles the home coordinates of the trainee in the
+// student-id header
+func ConfirmStudentLocation(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.Header.Get("student-id"))
+	if err != nil {
+		http.Error(w, "Invalid or missing student-id header", http.StatusBadRequest)
+		return
+	}
+	if !requireStudentAccess(w, r, id) {
+		return
+	}
+	confirmLocation(w, r, studentLocations, id)
+}
+
+// confirmLocation marks a record's coordinates as checked by staff, after
+// optionally replacing them with the geocoded position or with coordinates
+// from the body. A confirmed record is no longer flagged.
+func confirmLocation(w http.ResponseWriter, r *http.Request, t locationTable, id int) {
+	var c models.LocationConfirmation
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	// $1 and $2 are the new coordinates; NULL keeps the stored ones, or
+	// takes the geocoded ones
+	keep := fmt.Sprintf("%[1]s = COALESCE($1, %[1]s), %[2]s = COALESCE($2, %[2]s)", t.latColumn, t.longColumn)
+	switch {
+	case c.Latitude != nil || c.Longitude != nil:
+		if !hasPosition(c.Latitude, c.Longitude) || math.Abs(*c.Latitude) > 90 || math.Abs(*c.Longitude) > 180 {
+			http.Error(w, "latitude and longitude must be a valid position", http.StatusBadRequest)
+			return
+		}
+	case c.Use == "geocoded":
+		keep = fmt.Sprintf("%s = COALESCE($1, geocode_lat), %s = COALESCE($2, geocode_long)", t.latColumn, t.longColumn)
+	case c.Use == "current":
+	default:
+		http.Error(w, "Pass use (geocoded or current) or latitude and longitude", http.StatusBadRequest)
+		return
+	}
+
+	var geocoded bool
+	err := database.DB.QueryRow(fmt.Sprintf(`SELECT geocode_lat IS NOT NULL FROM %s WHERE id = $1`, t.table), id).Scan(&geocoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, t.label+" not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error loading location of %s %d: %v", t.kind, id, err)
+		http.Error(w, "Failed to confirm location", http.StatusInternalServerError)
+		return
+	}
+	if c.Latitude == nil && c.Use == "geocoded" && !geocoded {
+		http.Error(w, "The address has no geocoded position to use", http.StatusConflict)
+		return
+	}
+	var staffID *int
+	if p := principalFromContext(r.Context()); p.IsStaff() {
+		staffID = &p.StaffID
+	}
+
+	var lr models.LocationReview
+	err = scanLocationReview(database.DB.QueryRow(
+		fmt.Sprintf(`UPDATE %s SET %s, location_source = '%s', location_mismatch_m = NULL,
+			location_confirmed_by = $3, location_confirmed_at = NOW()
+		WHERE id = $4
+		RETURNING '%s', id, %s, %s, %s, %s, %s`,
+			t.table, keep, locationConfirmed, t.kind, t.name, t.address, t.latColumn, t.longColumn, geocodingColumns),
+		c.Latitude, c.Longitude, staffID, id,
+	), &lr)
+	if err != nil {
+		log.Printf("Error confirming location of %s %d: %v", t.kind, id, err)
+		http.Error(w, "Failed to confirm location", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lr)
+}
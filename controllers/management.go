@@ -36,9 +36,10 @@ func GetManagementTable(w http.ResponseWriter, r *http.Request) {
 		FROM student AS s
 		LEFT JOIN employer AS e ON s.employer_id = e.id
 		LEFT JOIN supervisor AS sup ON s.supervisor_id = sup.supervisor_id
-	`
+		WHERE `
 
-	rows, err := database.DB.Query(query)
+	scope, args := studentScope(principalFromContext(r.Context()), "s", nil)
+	rows, err := database.DB.Query(query+scope, args...)
 	if err != nil {
 		http.Error(w, "Failed to fetch data", http.StatusInternalServerError)
 		return
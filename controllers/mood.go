@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"server/database"
 	"server/models"
-	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -22,7 +21,8 @@ import (
 // @Router /moods [get]
 func GetMoods(w http.ResponseWriter, r *http.Request) {
 	var moods []models.Mood
-	rows, err := database.DB.Query("SELECT id, student_id, recorded_at, emotion, is_daily FROM mood")
+	scope, args := studentScope(principalFromContext(r.Context()), "s", nil)
+	rows, err := database.DB.Query("SELECT m.id, m.student_id, m.recorded_at, m.emotion, m.is_daily FROM mood m JOIN student s ON s.id = m.student_id WHERE "+scope, args...)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -50,16 +50,10 @@ func GetMoods(w http.ResponseWriter, r *http.Request) {
 // @Failure 404 {string} string "Not Found"
 // @Router /moods/{id} [get]
 func GetMood(w http.ResponseWriter, r *http.Request) {
-	StudentIDHeader := r.Header.Get("student-id")
-	if StudentIDHeader == "" {
-		log.Println("Missing student-id header")
-		http.Error(w, "Missing student-id header", http.StatusBadRequest)
-		return
-	}
-	studentID, err := strconv.Atoi(StudentIDHeader)
+	studentID, err := authenticatedStudentID(r)
 	if err != nil {
-		log.Printf("Invalid student-id header: %v", err)
-		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
+		log.Printf("Unauthenticated mood request: %v", err)
+		http.Error(w, "Trainee session required", http.StatusUnauthorized)
 		return
 	}
 	vars := mux.Vars(r)
@@ -86,16 +80,10 @@ func GetMood(w http.ResponseWriter, r *http.Request) {
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /moods [post]
 func CreateMood(w http.ResponseWriter, r *http.Request) {
-	StudentIDHeader := r.Header.Get("student-id")
-	if StudentIDHeader == "" {
-		log.Println("Missing student-id header")
-		http.Error(w, "Missing student-id header", http.StatusBadRequest)
-		return
-	}
-	studentID, err := strconv.Atoi(StudentIDHeader)
+	studentID, err := authenticatedStudentID(r)
 	if err != nil {
-		log.Printf("Invalid student-id header: %v", err)
-		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
+		log.Printf("Unauthenticated mood request: %v", err)
+		http.Error(w, "Trainee session required", http.StatusUnauthorized)
 		return
 	}
 	var payload struct {
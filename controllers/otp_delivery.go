@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	channelSMS   = "sms"
+	channelEmail = "email"
+
+	// OTP delivery choices offered to staff when generating a code
+	deliveryDisplay         = "display"
+	deliverySMSTrainee      = "sms"
+	deliverySMSGuardian     = "sms_guardian"
+	deliveryEmailSupervisor = "email_supervisor"
+)
+
+var errChannelNotConfigured = errors.New("delivery channel is not configured")
+
+// OutboundMessage is a text message to a single recipient
+type OutboundMessage struct {
+	Channel string    `json:"channel"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject,omitempty"`
+	Body    string    `json:"body"`
+	SentAt  time.Time `json:"sent_at"`
+}
+
+// DeliveryChannel sends messages through one medium such as SMS or email
+type DeliveryChannel interface {
+	Name() string
+	Send(ctx context.Context, msg OutboundMessage) error
+}
+
+// channels holds the configured delivery channels keyed by name. A channel
+// that is not configured is simply absent.
+var channels = map[string]DeliveryChannel{}
+
+// fakeOutbox is set when the in-process fake gateway is in use
+var fakeOutbox *FakeChannel
+
+// loadDeliveryChannels configures the channels from the environment. With
+// OTP_DELIVERY_MODE=fake every channel is replaced by an in-process fake that
+// records what would have been sent.
+func loadDeliveryChannels() map[string]DeliveryChannel {
+	if os.Getenv("OTP_DELIVERY_MODE") == "fake" {
+		log.Println("⚠️ OTP_DELIVERY_MODE=fake: messages are recorded, not sent")
+		fakeOutbox = NewFakeChannel()
+		return map[string]DeliveryChannel{channelSMS: fakeOutbox, channelEmail: fakeOutbox}
+	}
+
+	configured := map[string]DeliveryChannel{}
+	if host, from := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_FROM"); host != "" && from != "" {
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		configured[channelEmail] = &SMTPChannel{
+			Addr:     host + ":" + port,
+			Host:     host,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+	if url := os.Getenv("SMS_GATEWAY_URL"); url != "" {
+		configured[channelSMS] = &HTTPSMSChannel{
+			URL:    url,
+			APIKey: os.Getenv("SMS_GATEWAY_API_KEY"),
+			Sender: os.Getenv("SMS_SENDER_ID"),
+			Client: &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return configured
+}
+
+// sendMessage delivers a message over the named channel
+func sendMessage(ctx context.Context, channel string, msg OutboundMessage) error {
+	ch, ok := channels[channel]
+	if !ok {
+		return fmt.Errorf("%s: %w", channel, errChannelNotConfigured)
+	}
+	msg.Channel = channel
+	if channel == channelSMS {
+		msg.To = normalizePhoneNumber(msg.To)
+	}
+	return ch.Send(ctx, msg)
+}
+
+// normalizePhoneNumber strips formatting and, when SMS_DEFAULT_COUNTRY_CODE is
+// set, turns a local number with a leading 0 into E.164
+func normalizePhoneNumber(number string) string {
+	var b strings.Builder
+	for i, c := range strings.TrimSpace(number) {
+		if (c >= '0' && c <= '9') || (c == '+' && i == 0) {
+			b.WriteRune(c)
+		}
+	}
+	n := b.String()
+	if cc := os.Getenv("SMS_DEFAULT_COUNTRY_CODE"); cc != "" && strings.HasPrefix(n, "0") {
+		n = "+" + strings.TrimPrefix(cc, "+") + n[1:]
+	}
+	return n
+}
+
+// maskRecipient hides most of a phone number or email address for display
+func maskRecipient(to string) string {
+	if local, domain, ok := strings.Cut(to, "@"); ok {
+		if len(local) > 1 {
+			local = local[:1]
+		}
+		return local + "***@" + domain
+	}
+	if len(to) <= 3 {
+		return "***"
+	}
+	return strings.Repeat("*", len(to)-3) + to[len(to)-3:]
+}
+
+// smtpTimeout bounds a whole SMTP exchange when the caller's context has no
+// earlier deadline, so a hung server cannot hold a request open
+const smtpTimeout = 30 * time.Second
+
+// SMTPChannel sends email through an SMTP server
+type SMTPChannel struct {
+	Addr     string
+	Host     string
+	Username string
+	Password string
+	From     string
+}
+
+func (c *SMTPChannel) Name() string { return channelEmail }
+
+// headerValue drops line breaks so a value cannot start another header
+var headerValue = strings.NewReplacer("\r", "", "\n", "")
+
+// smtpMessage formats a plain text email. The subject is Q-encoded so it may
+// hold any UTF-8 text.
+func smtpMessage(from, to, subject, body string) []byte {
+	return []byte("From: " + headerValue.Replace(from) + "\r\n" +
+		"To: " + headerValue.Replace(to) + "\r\n" +
+		"Subject: " + mime.QEncoding.Encode("UTF-8", headerValue.Replace(subject)) + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		body + "\r\n")
+}
+
+// Send does what smtp.SendMail does, but gives up when ctx is done or after
+// smtpTimeout
+func (c *SMTPChannel) Send(ctx context.Context, msg OutboundMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+	to := headerValue.Replace(msg.To)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: c.Host}); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	wc, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(smtpMessage(c.From, to, msg.Subject, msg.Body)); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// HTTPSMSChannel posts messages to an HTTP SMS gateway as
+// {"to": ..., "from": ..., "message": ...} with a bearer API key
+type HTTPSMSChannel struct {
+	URL    string
+	APIKey string
+	Sender string
+	Client *http.Client
+}
+
+func (c *HTTPSMSChannel) Name() string { return channelSMS }
+
+func (c *HTTPSMSChannel) Send(ctx context.Context, msg OutboundMessage) error {
+	payload, err := json.Marshal(map[string]string{
+		"to":      msg.To,
+		"from":    c.Sender,
+		"message": msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sms gateway returned %s", resp.Status)
+	}
+	return nil
+}
+
+// FakeChannel records messages in memory instead of sending them. It backs
+// OTP_DELIVERY_MODE=fake and can be used directly in tests.
+type FakeChannel struct {
+	mu   sync.Mutex
+	sent []OutboundMessage
+}
+
+// NewFakeChannel returns an empty fake channel
+func NewFakeChannel() *FakeChannel {
+	return &FakeChannel{}
+}
+
+func (c *FakeChannel) Name() string { return "fake" }
+
+func (c *FakeChannel) Send(ctx context.Context, msg OutboundMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msg.SentAt = time.Now()
+	c.sent = append(c.sent, msg)
+	log.Printf("Fake %s message to %s recorded", msg.Channel, maskRecipient(msg.To))
+	return nil
+}
+
+// Sent returns a copy of the recorded messages, oldest first
+func (c *FakeChannel) Sent() []OutboundMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]OutboundMessage(nil), c.sent...)
+}
+
+// GetFakeOutbox lists the messages recorded by the fake gateway
+func GetFakeOutbox(w http.ResponseWriter, r *http.Request) {
+	if fakeOutbox == nil {
+		http.Error(w, "Fake delivery is not enabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(fakeOutbox.Sent())
+}
+
+// FakeDeliveryEnabled reports whether the fake gateway is in use
+func FakeDeliveryEnabled() bool {
+	return fakeOutbox != nil
+}
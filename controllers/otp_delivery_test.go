@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSMTPMessageHeaders(t *testing.T) {
+	msg := string(smtpMessage("noreply@example.com", "a@example.com\r\nBcc: b@example.com", "Code\r\nBcc: c@example.com", "Hello"))
+	headers, body, _ := strings.Cut(msg, "\r\n\r\n")
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Fatalf("header injected: %q", msg)
+		}
+	}
+	if !strings.Contains(headers, "To: a@example.comBcc: b@example.com") {
+		t.Errorf("line breaks should be dropped from To: %q", headers)
+	}
+	if body != "Hello\r\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestSMTPMessageEncodesSubject(t *testing.T) {
+	msg := string(smtpMessage("noreply@example.com", "a@example.com", "Código de acceso", "Hello"))
+	if !strings.Contains(msg, "Subject: =?UTF-8?q?") {
+		t.Errorf("subject not Q-encoded: %q", msg)
+	}
+	if !strings.Contains(string(smtpMessage("x@example.com", "a@example.com", "Your login code", "")), "Subject: Your login code\r\n") {
+		t.Error("plain ASCII subjects should be left as they are")
+	}
+}
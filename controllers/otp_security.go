@@ -0,0 +1,319 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// otpPolicy holds the OTP format and brute-force limits
+type otpPolicy struct {
+	length int
+	ttl    time.Duration
+	// hashKey keys the HMAC used to store codes, so a leaked table cannot be
+	// reversed by hashing all 10^length codes
+	hashKey []byte
+
+	window            time.Duration
+	maxFailuresPerIP  int
+	maxFailuresGlobal int
+	// guessesPerCode is how many wrong codes may be tried while a code is
+	// outstanding before it is retired
+	guessesPerCode    int
+	trustProxyHeaders bool
+}
+
+// loadOTPPolicy reads the OTP settings from the environment
+func loadOTPPolicy() *otpPolicy {
+	length := envInt("OTP_LENGTH", 6)
+	if length < 4 || length > 10 {
+		log.Printf("OTP_LENGTH must be between 4 and 10, using 6")
+		length = 6
+	}
+	ttl := envInt("OTP_TTL_MINUTES", 30)
+	if ttl < 1 || ttl > 120 {
+		log.Printf("OTP_TTL_MINUTES must be between 1 and 120, using 30")
+		ttl = 30
+	}
+	// By default a code is retired once a thousandth of the code space has
+	// been tried against it
+	guesses := envInt("OTP_MAX_GUESSES_PER_CODE", int(math.Pow10(length))/1000)
+	if guesses < 1 {
+		log.Printf("OTP_MAX_GUESSES_PER_CODE must be at least 1, using 1")
+		guesses = 1
+	}
+	key := os.Getenv("OTP_HASH_KEY")
+	if key == "" {
+		key = string(sessions.secret)
+	}
+	return &otpPolicy{
+		length:            length,
+		ttl:               time.Duration(ttl) * time.Minute,
+		hashKey:           []byte(key),
+		window:            time.Duration(envInt("OTP_LOCKOUT_WINDOW_MINUTES", 15)) * time.Minute,
+		maxFailuresPerIP:  envInt("OTP_MAX_FAILURES_PER_IP", 5),
+		maxFailuresGlobal: envInt("OTP_MAX_FAILURES_GLOBAL", 100),
+		guessesPerCode:    guesses,
+		trustProxyHeaders: os.Getenv("TRUST_PROXY_HEADERS") == "true",
+	}
+}
+
+// hash returns the keyed hash stored in place of a code
+func (p *otpPolicy) hash(code string) string {
+	mac := hmac.New(sha256.New, p.hashKey)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// wellFormed reports whether a submitted code has the configured shape
+func (p *otpPolicy) wellFormed(code string) bool {
+	if len(code) != p.length {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only honoured
+// when the server runs behind a trusted proxy.
+func (p *otpPolicy) clientIP(r *http.Request) string {
+	if p.trustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			first, _, _ := strings.Cut(fwd, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// otpLockedError is returned while an IP is locked out
+type otpLockedError struct {
+	scope      string
+	retryAfter time.Duration
+}
+
+func (e *otpLockedError) Error() string {
+	return fmt.Sprintf("too many failed OTP attempts (%s), retry in %s", e.scope, e.retryAfter.Round(time.Second))
+}
+
+// checkLockout counts recent failures for the IP. Failures across all IPs
+// only raise an alert, so one attacker cannot lock every trainee out;
+// codeExposed bounds how often any one code can be guessed at instead.
+func (p *otpPolicy) checkLockout(attempts otpAttemptLog, ip string) error {
+	since := time.Now().Add(-p.window)
+	count, oldest, err := attempts.failuresFrom(ip, since)
+	if err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if count >= p.maxFailuresPerIP {
+		return &otpLockedError{scope: "address", retryAfter: time.Until(oldest.Add(p.window))}
+	}
+
+	if count, err = attempts.failures(since); err != nil {
+		return fmt.Errorf("database error: %w", err)
+	}
+	if count >= p.maxFailuresGlobal {
+		log.Printf("ALERT: %d failed OTP attempts from all addresses in the last %s", count, p.window)
+	}
+	return nil
+}
+
+// codeExposed reports whether a code issued at issuedAt has been outstanding
+// through guessesPerCode guesses. Only well-formed codes that matched nothing
+// count: malformed input cannot hit a code, and locked out callers never get
+// as far as guessing. An exposed code is retired rather than redeemed, which
+// bounds the chance of guessing it no matter how many addresses an attacker
+// uses.
+func (p *otpPolicy) codeExposed(attempts otpAttemptLog, issuedAt time.Time) (bool, error) {
+	count, err := attempts.guesses(issuedAt)
+	if err != nil {
+		return false, fmt.Errorf("database error: %w", err)
+	}
+	return count >= p.guessesPerCode, nil
+}
+
+// Reasons an OTP validation attempt is recorded with
+const (
+	otpRedeemed    = "redeemed"
+	otpMalformed   = "malformed"
+	otpNotFound    = "not_found"
+	otpAlreadyUsed = "already_used"
+	otpExpired     = "expired"
+	otpExposed     = "exposed"
+)
+
+// otpAttempt is one OTP validation attempt. StudentID and OTPID are 0 when
+// the code matched nothing.
+type otpAttempt struct {
+	IP        string
+	StudentID int
+	OTPID     int
+	Success   bool
+	Reason    string
+}
+
+// otpAttemptLog stores OTP validation attempts and counts the ones the
+// lockouts are based on
+type otpAttemptLog interface {
+	record(a otpAttempt) error
+	// failuresFrom counts failures from ip since a time and returns the
+	// oldest of them
+	failuresFrom(ip string, since time.Time) (int, time.Time, error)
+	// failures counts failures from every address since a time
+	failures(since time.Time) (int, error)
+	// guesses counts well-formed codes that matched nothing since a time
+	guesses(since time.Time) (int, error)
+}
+
+// sqlAttemptLog keeps OTP attempts in the otp_attempts table
+type sqlAttemptLog struct {
+	db *sql.DB
+}
+
+func (l sqlAttemptLog) record(a otpAttempt) error {
+	_, err := l.db.Exec(
+		`INSERT INTO otp_attempts (ip_address, student_id, otp_id, success, reason) VALUES ($1, $2, $3, $4, $5)`,
+		a.IP, sql.NullInt64{Int64: int64(a.StudentID), Valid: a.StudentID > 0}, sql.NullInt64{Int64: int64(a.OTPID), Valid: a.OTPID > 0},
+		a.Success, a.Reason,
+	)
+	return err
+}
+
+func (l sqlAttemptLog) failuresFrom(ip string, since time.Time) (int, time.Time, error) {
+	var count int
+	var oldest sql.NullTime
+	err := l.db.QueryRow(
+		`SELECT COUNT(*), MIN(created_at) FROM otp_attempts WHERE ip_address = $1 AND NOT success AND created_at > $2`,
+		ip, since,
+	).Scan(&count, &oldest)
+	return count, oldest.Time, err
+}
+
+func (l sqlAttemptLog) failures(since time.Time) (int, error) {
+	var count int
+	err := l.db.QueryRow(`SELECT COUNT(*) FROM otp_attempts WHERE NOT success AND created_at > $1`, since).Scan(&count)
+	return count, err
+}
+
+func (l sqlAttemptLog) guesses(since time.Time) (int, error) {
+	var count int
+	err := l.db.QueryRow(
+		`SELECT COUNT(*) FROM otp_attempts WHERE NOT success AND reason = $1 AND created_at > $2`, otpNotFound, since,
+	).Scan(&count)
+	return count, err
+}
+
+// staffLogins throttles staff logins with the same window and per-address
+// limit as OTP validation
+var staffLogins *otpPolicy
+
+const (
+	staffAttemptPassword = "password"
+	staffAttemptCode     = "code"
+	staffAttemptRequest  = "code_request"
+
+	// staffMaxFailuresPerEmail bounds password and code guesses against one
+	// account across addresses
+	staffMaxFailuresPerEmail = 10
+	// staffMaxCodeRequests bounds login codes sent to one address, since
+	// every new code starts a fresh attempt budget
+	staffMaxCodeRequests      = 3
+	staffMaxCodeRequestsPerIP = 20
+)
+
+// recentStaffAttempts counts the staff login attempts in the window that
+// match cond, and returns when the oldest of them falls out of it
+func (p *otpPolicy) recentStaffAttempts(db *sql.DB, cond string, args ...interface{}) (int, time.Duration, error) {
+	args = append(args, time.Now().Add(-p.window))
+	var count int
+	var oldest sql.NullTime
+	err := db.QueryRow(
+		fmt.Sprintf(`SELECT COUNT(*), MIN(created_at) FROM staff_login_attempts WHERE %s AND created_at > $%d`, cond, len(args)),
+		args...,
+	).Scan(&count, &oldest)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database error: %w", err)
+	}
+	return count, time.Until(oldest.Time.Add(p.window)), nil
+}
+
+// checkStaffLockout counts recent failed staff logins from the IP and for
+// the email. Unknown addresses are counted too, so a lockout does not give
+// away which accounts exist.
+func (p *otpPolicy) checkStaffLockout(db *sql.DB, ip, email string) error {
+	count, retry, err := p.recentStaffAttempts(db, "ip_address = $1 AND kind <> $2 AND NOT success", ip, staffAttemptRequest)
+	if err != nil {
+		return err
+	}
+	if count >= p.maxFailuresPerIP {
+		return &otpLockedError{scope: "address", retryAfter: retry}
+	}
+	count, retry, err = p.recentStaffAttempts(db, "email = $1 AND kind <> $2 AND NOT success", email, staffAttemptRequest)
+	if err != nil {
+		return err
+	}
+	if count >= staffMaxFailuresPerEmail {
+		return &otpLockedError{scope: "account", retryAfter: retry}
+	}
+	return nil
+}
+
+// checkStaffCodeRequests limits how many login codes are sent to an email
+// and requested from an IP
+func (p *otpPolicy) checkStaffCodeRequests(db *sql.DB, ip, email string) error {
+	count, retry, err := p.recentStaffAttempts(db, "email = $1 AND kind = $2", email, staffAttemptRequest)
+	if err != nil {
+		return err
+	}
+	if count >= staffMaxCodeRequests {
+		return &otpLockedError{scope: "account", retryAfter: retry}
+	}
+	count, retry, err = p.recentStaffAttempts(db, "ip_address = $1 AND kind = $2", ip, staffAttemptRequest)
+	if err != nil {
+		return err
+	}
+	if count >= staffMaxCodeRequestsPerIP {
+		return &otpLockedError{scope: "address", retryAfter: retry}
+	}
+	return nil
+}
+
+// recordStaffAttempt writes an audit row for a staff login or code request
+func recordStaffAttempt(db *sql.DB, ip, email, kind string, success bool) {
+	_, err := db.Exec(
+		`INSERT INTO staff_login_attempts (ip_address, email, kind, success) VALUES ($1, $2, $3, $4)`,
+		ip, email, kind, success,
+	)
+	if err != nil {
+		log.Printf("Error recording staff %s attempt from %s: %v", kind, ip, err)
+	}
+}
+
+// recordOTPAttempt writes an audit row for a validation attempt
+func recordOTPAttempt(attempts otpAttemptLog, a otpAttempt) {
+	if err := attempts.record(a); err != nil {
+		log.Printf("Error recording OTP attempt from %s: %v", a.IP, err)
+	}
+}
+
+// retryAfterSeconds formats a duration for the Retry-After header
+func retryAfterSeconds(d time.Duration) string {
+	return fmt.Sprintf("%d", int(math.Max(1, math.Ceil(d.Seconds()))))
+}
@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"server/models"
+)
+
+func TestOTPPolicyHash(t *testing.T) {
+	p := &otpPolicy{length: 6, hashKey: []byte("key-one")}
+	other := &otpPolicy{length: 6, hashKey: []byte("key-two")}
+
+	h := p.hash("123456")
+	if h != p.hash("123456") {
+		t.Error("hash is not deterministic")
+	}
+	if len(h) != 64 || strings.Trim(h, "0123456789abcdef") != "" {
+		t.Errorf("hash %q is not hex encoded SHA-256", h)
+	}
+	if strings.Contains(h, "123456") {
+		t.Error("hash contains the code")
+	}
+	if h == p.hash("123457") {
+		t.Error("different codes share a hash")
+	}
+	if h == other.hash("123456") {
+		t.Error("hash does not depend on the key")
+	}
+}
+
+func TestOTPPolicyWellFormed(t *testing.T) {
+	p := &otpPolicy{length: 6}
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"123456", true},
+		{"000000", true},
+		{"12345", false},
+		{"1234567", false},
+		{"12345a", false},
+		{" 12345", false},
+		{"12-456", false},
+		{"١٢٣٤٥٦", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := p.wellFormed(tt.code); got != tt.want {
+			t.Errorf("wellFormed(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
+
+// memoryAttemptLog keeps OTP attempts in memory
+type memoryAttemptLog struct {
+	rows []memoryAttempt
+}
+
+type memoryAttempt struct {
+	otpAttempt
+	at time.Time
+}
+
+func (l *memoryAttemptLog) record(a otpAttempt) error {
+	l.rows = append(l.rows, memoryAttempt{a, time.Now()})
+	return nil
+}
+
+func (l *memoryAttemptLog) count(since time.Time, match func(a otpAttempt) bool) (int, time.Time) {
+	n, oldest := 0, time.Time{}
+	for _, r := range l.rows {
+		if !r.Success && r.at.After(since) && match(r.otpAttempt) {
+			if n == 0 {
+				oldest = r.at
+			}
+			n++
+		}
+	}
+	return n, oldest
+}
+
+func (l *memoryAttemptLog) failuresFrom(ip string, since time.Time) (int, time.Time, error) {
+	n, oldest := l.count(since, func(a otpAttempt) bool { return a.IP == ip })
+	return n, oldest, nil
+}
+
+func (l *memoryAttemptLog) failures(since time.Time) (int, error) {
+	n, _ := l.count(since, func(otpAttempt) bool { return true })
+	return n, nil
+}
+
+func (l *memoryAttemptLog) guesses(since time.Time) (int, error) {
+	n, _ := l.count(since, func(a otpAttempt) bool { return a.Reason == otpNotFound })
+	return n, nil
+}
+
+func TestMalformedAndLockedOutAttemptsDoNotRetireCodes(t *testing.T) {
+	attempts := &memoryAttemptLog{}
+	s := &AuthService{
+		otp:      &otpPolicy{length: 6, window: 15 * time.Minute, maxFailuresPerIP: 5, maxFailuresGlobal: 100, guessesPerCode: 1000},
+		attempts: attempts,
+	}
+	issued := time.Now().Add(-time.Second)
+
+	// 50 addresses each send 20 malformed codes; after the first 5 every
+	// address is locked out
+	locked := 0
+	for ip := 0; ip < 50; ip++ {
+		for i := 0; i < 20; i++ {
+			resp, err := s.ValidateOTP("12ab56", fmt.Sprintf("10.0.0.%d", ip), models.DeviceEnrollment{})
+			var lockErr *otpLockedError
+			if errors.As(err, &lockErr) {
+				locked++
+				continue
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Success {
+				t.Fatal("a malformed code was accepted")
+			}
+		}
+	}
+	if locked != 50*15 {
+		t.Errorf("%d attempts were locked out, want %d", locked, 50*15)
+	}
+	exposed, err := s.otp.codeExposed(attempts, issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exposed {
+		t.Error("malformed and locked out attempts retired an outstanding code")
+	}
+
+	// Guesses that reach the lookup do count
+	for i := 0; i < 1000; i++ {
+		attempts.record(otpAttempt{IP: fmt.Sprintf("10.1.%d.%d", i/250, i%250), Reason: otpNotFound})
+	}
+	if exposed, _ := s.otp.codeExposed(attempts, issued); !exposed {
+		t.Error("a code outstanding through 1000 guesses should be retired")
+	}
+	if exposed, _ := s.otp.codeExposed(attempts, time.Now()); exposed {
+		t.Error("a code issued after the guesses should not be retired")
+	}
+}
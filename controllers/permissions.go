@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"server/database"
+)
+
+const (
+	roleAdmin      = "admin"
+	roleSupervisor = "supervisor"
+	roleEmployer   = "employer"
+)
+
+// Permission names an action a staff role may perform
+type Permission string
+
+const (
+	PermViewTrainees      Permission = "trainees:view"
+	PermManageTrainees    Permission = "trainees:manage"
+	PermDeleteTrainees    Permission = "trainees:delete"
+	PermIssueOTP          Permission = "otp:issue"
+	PermManageDevices     Permission = "devices:manage"
+	PermViewDirectory     Permission = "directory:view"
+	PermManageSupervisors Permission = "supervisors:manage"
+	PermManageEmployers   Permission = "employers:manage"
+	PermManageStaff       Permission = "staff:manage"
+	PermManageCalendar    Permission = "calendar:manage"
+	PermManageClosures    Permission = "closures:manage"
+	PermIssueSiteTokens   Permission = "site_tokens:issue"
+	PermManageSites       Permission = "sites:manage"
+)
+
+// rolePermissions maps each staff role to what it may do. Supervisors and
+// employer contacts are additionally limited to their own trainees by
+// studentScope and canAccessStudent.
+var rolePermissions = map[string][]Permission{
+	roleAdmin: {
+		PermViewTrainees, PermManageTrainees, PermDeleteTrainees, PermIssueOTP, PermManageDevices,
+		PermViewDirectory, PermManageSupervisors, PermManageEmployers, PermManageStaff,
+		PermManageCalendar, PermManageClosures, PermIssueSiteTokens, PermManageSites,
+	},
+	roleSupervisor: {
+		PermViewTrainees, PermManageTrainees, PermIssueOTP, PermManageDevices, PermViewDirectory,
+	},
+	roleEmployer: {
+		PermViewTrainees, PermManageClosures, PermIssueSiteTokens, PermManageSites,
+	},
+}
+
+// Can reports whether the principal holds a permission
+func (p *Principal) Can(perm Permission) bool {
+	if p == nil {
+		return false
+	}
+	for _, granted := range rolePermissions[p.Role] {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// IsStaff reports whether the principal is a dashboard user
+func (p *Principal) IsStaff() bool {
+	return p != nil && p.StaffID > 0
+}
+
+// RequirePermission returns middleware that authenticates the request and
+// only lets staff holding perm through
+func RequirePermission(perm Permission) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodOptions && !principalFromContext(r.Context()).Can(perm) {
+				http.Error(w, "You do not have permission to perform this action", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// studentScope returns a SQL condition that limits student rows (aliased as
+// alias) to the ones the principal may see. Bind values are appended to args
+// and the placeholders numbered after the ones already there.
+func studentScope(p *Principal, alias string, args []interface{}) (string, []interface{}) {
+	switch {
+	case p == nil:
+		return "FALSE", args
+	case p.Role == roleAdmin:
+		return "TRUE", args
+	case p.Role == roleTrainee:
+		args = append(args, p.StudentID)
+		return fmt.Sprintf("%s.id = $%d", alias, len(args)), args
+	case p.Role == roleSupervisor && p.SupervisorID != nil:
+		args = append(args, *p.SupervisorID)
+		return fmt.Sprintf("%s.supervisor_id = $%d", alias, len(args)), args
+	case p.Role == roleEmployer && p.EmployerID != nil:
+		args = append(args, *p.EmployerID)
+		return fmt.Sprintf("%s.employer_id = $%d", alias, len(args)), args
+	}
+	return "FALSE", args
+}
+
+// canAccessStudent reports whether the principal may see the given trainee
+func canAccessStudent(p *Principal, studentID int) (bool, error) {
+	args := []interface{}{studentID}
+	scope, args := studentScope(p, "s", args)
+	var exists bool
+	err := database.DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM student s WHERE s.id = $1 AND "+scope+")", args...,
+	).Scan(&exists)
+	return exists, err
+}
+
+var (
+	errStudentNotAccessible = errors.New("student not found")
+	errStudentHeader        = errors.New("invalid or missing student-id header")
+	errNotAuthenticated     = errors.New("request is not authenticated")
+)
+
+// resolveStudentID returns the trainee a request is about. Trainees always act
+// on themselves; staff name the trainee in the student-id header and must be
+// allowed to see them.
+func resolveStudentID(r *http.Request) (int, error) {
+	p := principalFromContext(r.Context())
+	if p == nil {
+		return 0, errNotAuthenticated
+	}
+	if p.Role == roleTrainee {
+		return p.StudentID, nil
+	}
+
+	studentID, err := strconv.Atoi(r.Header.Get("student-id"))
+	if err != nil {
+		return 0, errStudentHeader
+	}
+	ok, err := canAccessStudent(p, studentID)
+	if err != nil {
+		return 0, fmt.Errorf("database error: %w", err)
+	}
+	if !ok {
+		return 0, errStudentNotAccessible
+	}
+	return studentID, nil
+}
+
+// writeResolveError maps a resolveStudentID error to an HTTP response
+func writeResolveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotAuthenticated):
+		unauthorized(w, "Authentication required")
+	case errors.Is(err, errStudentHeader):
+		http.Error(w, "Invalid or missing student-id header", http.StatusBadRequest)
+	case errors.Is(err, errStudentNotAccessible):
+		http.Error(w, "Student not found", http.StatusNotFound)
+	default:
+		log.Printf("Could not resolve student: %v", err)
+		http.Error(w, "Failed to resolve student", http.StatusInternalServerError)
+	}
+}
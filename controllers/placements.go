@@ -0,0 +1,644 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Placement statuses. A placement starts on trial or active and is ended
+// with a reason. A void placement never took effect; it is kept for the
+// record but ignored everywhere else.
+const (
+	placementTrial  = "trial"
+	placementActive = "active"
+	placementEnded  = "ended"
+	placementVoid   = "void"
+
+	maxHoursPerWeek = 80
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// placementAsOf joins, as pl, the placement a trainee (student, a column
+// reference) was on during day (a date expression). Columns are NULL when
+// they had none that day.
+func placementAsOf(student, day string) string {
+	return `LEFT JOIN LATERAL (
+		SELECT x.id, x.employer_id, x.site_id, x.supervisor_id FROM placements x
+		WHERE x.student_id = ` + student + ` AND x.status <> 'void'
+			AND x.start_date <= ` + day + ` AND (x.end_date IS NULL OR x.end_date >= ` + day + `)
+		ORDER BY x.start_date DESC LIMIT 1
+	) pl ON TRUE`
+}
+
+// placementSupervisor is the supervisor of a record joined with
+// placementAsOf. Outside any placement the trainee's current supervisor is
+// used, since coaching carries on between jobs.
+const placementSupervisor = `CASE WHEN pl.id IS NULL THEN s.supervisor_id ELSE pl.supervisor_id END`
+
+// placementEmployer and placementSite are the employer and site of a record
+// joined with placementAsOf, or the trainee's current ones outside any
+// placement
+const (
+	placementEmployer = `COALESCE(pl.employer_id, s.employer_id)`
+	placementSite     = `CASE WHEN pl.id IS NULL THEN s.site_id ELSE pl.site_id END`
+)
+
+// placementToday is the current date placements are compared against
+func placementToday(now time.Time) string {
+	return localDate(now, orgLocation)
+}
+
+// syncPlacements copies the placement each trainee is on today into the
+// student's employer_id, site_id and supervisor_id, which the rest of the
+// app treats as current. A studentID of 0 syncs everyone. Trainees who have
+// never had a placement are left alone.
+func syncPlacements(q execer, day string, studentID int) (int, error) {
+	res, err := q.Exec(
+		`UPDATE student s SET employer_id = cur.employer_id, site_id = cur.site_id,
+			supervisor_id = CASE WHEN cur.placement_id IS NULL THEN s.supervisor_id ELSE cur.supervisor_id END
+		FROM (
+			SELECT st.id, pl.id AS placement_id, pl.employer_id, pl.site_id, pl.supervisor_id FROM student st
+			`+placementAsOf("st.id", "$1::date")+`
+			WHERE ($2 = 0 OR st.id = $2) AND EXISTS (SELECT 1 FROM placements p WHERE p.student_id = st.id)
+		) cur
+		WHERE cur.id = s.id AND (s.employer_id IS DISTINCT FROM cur.employer_id OR s.site_id IS DISTINCT FROM cur.site_id
+			OR (cur.placement_id IS NOT NULL AND s.supervisor_id IS DISTINCT FROM cur.supervisor_id))`,
+		day, studentID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// applyDuePlacements runs syncPlacements for everyone so placements dated
+// to start or end on a later day take effect
+func applyDuePlacements(db *sql.DB, now time.Time) (int, error) {
+	return syncPlacements(db, placementToday(now), 0)
+}
+
+const placementColumns = `p.id, p.student_id, p.employer_id, COALESCE(e.name, ''), p.site_id, p.supervisor_id, p.job_title,
+	p.hours_per_week::float8, p.status, p.start_date, p.end_date, p.end_reason, p.created_by, p.created_at`
+
+const placementFrom = ` FROM placements p LEFT JOIN employer e ON e.id = p.employer_id`
+
+func scanPlacement(row interface{ Scan(...interface{}) error }, p *models.Placement) error {
+	var start time.Time
+	var end sql.NullTime
+	err := row.Scan(&p.ID, &p.StudentID, &p.EmployerID, &p.EmployerName, &p.SiteID, &p.SupervisorID, &p.JobTitle,
+		&p.HoursPerWeek, &p.Status, &start, &end, &p.EndReason, &p.CreatedBy, &p.CreatedAt)
+	if err != nil {
+		return err
+	}
+	p.StartDate = start.Format(dateLayout)
+	if end.Valid {
+		d := end.Time.Format(dateLayout)
+		p.EndDate = &d
+	}
+	return nil
+}
+
+// loadPlacement reads a placement, locking it when q is a transaction
+func loadPlacement(q queryRower, id int, lock bool) (*models.Placement, error) {
+	query := `SELECT ` + placementColumns + placementFrom + ` WHERE p.id = $1`
+	if lock {
+		query += ` FOR UPDATE OF p`
+	}
+	var p models.Placement
+	if err := scanPlacement(q.QueryRow(query, id), &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// validatePlacement checks the parts of a placement that come from the
+// client. The employer must exist and not be archived, the site must belong
+// to it and the supervisor must exist. Problems with the input are errPlacementInvalid.
+func validatePlacement(p *models.Placement) error {
+	switch p.Status {
+	case "":
+		p.Status = placementActive
+	case placementTrial, placementActive:
+	default:
+		return errPlacementInvalid("status must be trial or active")
+	}
+	if p.HoursPerWeek != nil && (*p.HoursPerWeek <= 0 || *p.HoursPerWeek > maxHoursPerWeek) {
+		return errPlacementInvalid(fmt.Sprintf("hours_per_week must be between 0 and %d", maxHoursPerWeek))
+	}
+	p.JobTitle = strings.TrimSpace(p.JobTitle)
+
+	var employerOK, siteOK, supervisorOK bool
+	err := database.DB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM employer WHERE id = $1 AND archived_at IS NULL),
+			$2::int IS NULL OR EXISTS (SELECT 1 FROM employer_sites WHERE id = $2 AND employer_id = $1),
+			$3::int IS NULL OR EXISTS (SELECT 1 FROM supervisor WHERE supervisor_id = $3)`,
+		p.EmployerID, p.SiteID, p.SupervisorID,
+	).Scan(&employerOK, &siteOK, &supervisorOK)
+	switch {
+	case err != nil:
+		return fmt.Errorf("check placement: %w", err)
+	case !employerOK:
+		return errPlacementInvalid(errEmployerUnavailable.Error())
+	case !siteOK:
+		return errPlacementInvalid(errSiteNotAtEmployer.Error())
+	case !supervisorOK:
+		return errPlacementInvalid("supervisor_id does not exist")
+	}
+	return nil
+}
+
+// errPlacementInvalid is a validation failure reported to the client as is
+type errPlacementInvalid string
+
+func (e errPlacementInvalid) Error() string { return string(e) }
+
+// writePlacementError answers a validatePlacement error
+func writePlacementError(w http.ResponseWriter, err error) {
+	var invalid errPlacementInvalid
+	if errors.As(err, &invalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Error validating placement: %v", err)
+	http.Error(w, "Failed to save placement", http.StatusInternalServerError)
+}
+
+// placeWithSupervisor applies the rule that supervisors can only place
+// trainees with themselves
+func placeWithSupervisor(r *http.Request, pl *models.Placement) {
+	if p := principalFromContext(r.Context()); p.Role == roleSupervisor {
+		pl.SupervisorID = p.SupervisorID
+	}
+}
+
+func staffIDOf(r *http.Request) *int {
+	if p := principalFromContext(r.Context()); p.IsStaff() {
+		id := p.StaffID
+		return &id
+	}
+	return nil
+}
+
+// errPlacementOverlap is returned by insertPlacement when the trainee is
+// already placed during some of the new placement
+var errPlacementOverlap = errors.New("trainee already has a placement during that time")
+
+// insertPlacement adds a placement inside tx and returns its id. Open
+// placements run indefinitely, so one can only be added after the last.
+func insertPlacement(tx *sql.Tx, p *models.Placement) error {
+	var overlaps bool
+	err := tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM placements WHERE student_id = $1 AND status <> 'void'
+			AND (end_date IS NULL OR end_date >= $2::date))`,
+		p.StudentID, p.StartDate,
+	).Scan(&overlaps)
+	if err != nil {
+		return err
+	}
+	if overlaps {
+		return errPlacementOverlap
+	}
+	return tx.QueryRow(
+		`INSERT INTO placements (student_id, employer_id, site_id, supervisor_id, job_title, hours_per_week, status, start_date, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		p.StudentID, p.EmployerID, p.SiteID, p.SupervisorID, p.JobTitle, p.HoursPerWeek, p.Status, p.StartDate, p.CreatedBy,
+	).Scan(&p.ID)
+}
+
+// GetPlacements lists placements, newest first. Trainees see their own.
+// Staff see the trainees they manage, or one trainee with the student-id
+// header, and can narrow it with ?employer_id=.
+func GetPlacements(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	employerID := 0
+	if v := r.URL.Query().Get("employer_id"); v != "" {
+		var err error
+		if employerID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid employer_id", http.StatusBadRequest)
+			return
+		}
+	}
+	args := []interface{}{employerID}
+	var scope string
+	if p.Role == roleTrainee || r.Header.Get("student-id") != "" {
+		studentID, err := resolveStudentID(r)
+		if err != nil {
+			writeResolveError(w, err)
+			return
+		}
+		args = append(args, studentID)
+		scope = "s.id = $2"
+	} else {
+		scope, args = studentScope(p, "s", args)
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT `+placementColumns+placementFrom+`
+		JOIN student s ON s.id = p.student_id
+		WHERE ($1 = 0 OR p.employer_id = $1) AND `+scope+`
+		ORDER BY p.start_date DESC, p.id DESC LIMIT 500`, args...,
+	)
+	if err != nil {
+		log.Printf("Error loading placements: %v", err)
+		http.Error(w, "Failed to load placements", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	placements := []models.Placement{}
+	for rows.Next() {
+		var pl models.Placement
+		if err := scanPlacement(rows, &pl); err != nil {
+			log.Printf("Error loading placements: %v", err)
+			http.Error(w, "Failed to load placements", http.StatusInternalServerError)
+			return
+		}
+		placements = append(placements, pl)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(placements)
+}
+
+// StartPlacement places a trainee with an employer from start_date (default
+// today). A trainee has one placement at a time, so an open one has to be
+// transferred or ended first.
+func StartPlacement(w http.ResponseWriter, r *http.Request) {
+	var pl models.Placement
+	if err := json.NewDecoder(r.Body).Decode(&pl); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !requireStudentAccess(w, r, pl.StudentID) {
+		return
+	}
+	today := placementToday(time.Now())
+	if pl.StartDate == "" {
+		pl.StartDate = today
+	} else if _, err := time.Parse(dateLayout, pl.StartDate); err != nil {
+		http.Error(w, "start_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	placeWithSupervisor(r, &pl)
+	if err := validatePlacement(&pl); err != nil {
+		writePlacementError(w, err)
+		return
+	}
+	pl.CreatedBy = staffIDOf(r)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to start placement", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// Serialises placement changes for the trainee
+	if _, err := tx.Exec(`SELECT id FROM student WHERE id = $1 FOR UPDATE`, pl.StudentID); err != nil {
+		http.Error(w, "Failed to start placement", http.StatusInternalServerError)
+		return
+	}
+	if err := insertPlacement(tx, &pl); errors.Is(err, errPlacementOverlap) {
+		http.Error(w, "Trainee already has a placement on or after that date; transfer or end it first", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error starting placement for student %d: %v", pl.StudentID, err)
+		http.Error(w, "Failed to start placement", http.StatusInternalServerError)
+		return
+	}
+	if _, err := syncPlacements(tx, today, pl.StudentID); err != nil {
+		log.Printf("Error syncing placement of student %d: %v", pl.StudentID, err)
+		http.Error(w, "Failed to start placement", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Failed to start placement", http.StatusInternalServerError)
+		return
+	}
+	respondPlacement(w, pl.ID, http.StatusCreated)
+}
+
+// lockOpenPlacement loads the placement in the URL inside tx and checks the
+// caller manages its trainee and that it has not ended. It writes the error
+// response itself.
+func lockOpenPlacement(w http.ResponseWriter, r *http.Request, tx *sql.Tx) (*models.Placement, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid placement ID", http.StatusBadRequest)
+		return nil, false
+	}
+	pl, err := loadPlacement(tx, id, true)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Placement not found", http.StatusNotFound)
+		return nil, false
+	} else if err != nil {
+		log.Printf("Error loading placement %d: %v", id, err)
+		http.Error(w, "Failed to load placement", http.StatusInternalServerError)
+		return nil, false
+	}
+	if ok, err := canAccessStudent(principalFromContext(r.Context()), pl.StudentID); err != nil {
+		http.Error(w, "Failed to load placement", http.StatusInternalServerError)
+		return nil, false
+	} else if !ok {
+		http.Error(w, "Placement not found", http.StatusNotFound)
+		return nil, false
+	}
+	if pl.EndDate != nil {
+		http.Error(w, "Placement has already ended", http.StatusConflict)
+		return nil, false
+	}
+	return pl, true
+}
+
+// UpdatePlacement changes the job title, hours or status of a placement
+// that has not ended, e.g. to confirm a trainee after their trial
+func UpdatePlacement(w http.ResponseWriter, r *http.Request) {
+	var input models.Placement
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to update placement", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	pl, ok := lockOpenPlacement(w, r, tx)
+	if !ok {
+		return
+	}
+	pl.JobTitle, pl.HoursPerWeek, pl.Status = input.JobTitle, input.HoursPerWeek, input.Status
+	if err := validatePlacement(pl); err != nil {
+		writePlacementError(w, err)
+		return
+	}
+	_, err = tx.Exec(
+		`UPDATE placements SET job_title = $1, hours_per_week = $2, status = $3 WHERE id = $4`,
+		pl.JobTitle, pl.HoursPerWeek, pl.Status, pl.ID,
+	)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating placement %d: %v", pl.ID, err)
+		http.Error(w, "Failed to update placement", http.StatusInternalServerError)
+		return
+	}
+	respondPlacement(w, pl.ID, http.StatusOK)
+}
+
+// TransferPlacement ends a placement the day before date and starts the
+// trainee on a new one from date, with another employer, site or
+// supervisor. Fields left out carry over; the site only carries over when
+// the employer stays the same.
+func TransferPlacement(w http.ResponseWriter, r *http.Request) {
+	var t models.PlacementTransfer
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	date, err := time.Parse(dateLayout, t.Date)
+	if err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if t.Reason = strings.TrimSpace(t.Reason); t.Reason == "" {
+		t.Reason = "transferred"
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to transfer placement", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	old, ok := lockOpenPlacement(w, r, tx)
+	if !ok {
+		return
+	}
+	if t.Date <= old.StartDate {
+		http.Error(w, "date must be after the placement's start_date", http.StatusBadRequest)
+		return
+	}
+
+	next := models.Placement{
+		StudentID: old.StudentID, EmployerID: old.EmployerID, SiteID: old.SiteID, SupervisorID: old.SupervisorID,
+		JobTitle: old.JobTitle, HoursPerWeek: old.HoursPerWeek, Status: t.Status, StartDate: t.Date, CreatedBy: staffIDOf(r),
+	}
+	if t.EmployerID != nil && *t.EmployerID != old.EmployerID {
+		next.EmployerID, next.SiteID = *t.EmployerID, nil
+	}
+	if t.SiteID != nil {
+		next.SiteID = t.SiteID
+	}
+	if t.SupervisorID != nil {
+		next.SupervisorID = t.SupervisorID
+	}
+	if t.JobTitle != nil {
+		next.JobTitle = *t.JobTitle
+	}
+	if t.HoursPerWeek != nil {
+		next.HoursPerWeek = t.HoursPerWeek
+	}
+	placeWithSupervisor(r, &next)
+	if err := validatePlacement(&next); err != nil {
+		writePlacementError(w, err)
+		return
+	}
+
+	_, err = tx.Exec(
+		`UPDATE placements SET end_date = $1, status = $2, end_reason = $3 WHERE id = $4`,
+		date.AddDate(0, 0, -1).Format(dateLayout), placementEnded, t.Reason, old.ID,
+	)
+	if err == nil {
+		err = insertPlacement(tx, &next)
+	}
+	if err == nil {
+		_, err = syncPlacements(tx, placementToday(time.Now()), old.StudentID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if errors.Is(err, errPlacementOverlap) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error transferring placement %d: %v", old.ID, err)
+		http.Error(w, "Failed to transfer placement", http.StatusInternalServerError)
+		return
+	}
+	respondPlacement(w, next.ID, http.StatusCreated)
+}
+
+// EndPlacement closes a placement with end_date (default today) as its last
+// day. reason is required.
+func EndPlacement(w http.ResponseWriter, r *http.Request) {
+	var e models.PlacementEnd
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if e.Reason = strings.TrimSpace(e.Reason); e.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+	today := placementToday(time.Now())
+	if e.EndDate == "" {
+		e.EndDate = today
+	} else if _, err := time.Parse(dateLayout, e.EndDate); err != nil {
+		http.Error(w, "end_date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to end placement", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	pl, ok := lockOpenPlacement(w, r, tx)
+	if !ok {
+		return
+	}
+	if e.EndDate < pl.StartDate {
+		http.Error(w, "end_date cannot be before the placement's start_date", http.StatusBadRequest)
+		return
+	}
+	_, err = tx.Exec(
+		`UPDATE placements SET end_date = $1, status = $2, end_reason = $3 WHERE id = $4`,
+		e.EndDate, placementEnded, e.Reason, pl.ID,
+	)
+	if err == nil {
+		_, err = syncPlacements(tx, today, pl.StudentID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error ending placement %d: %v", pl.ID, err)
+		http.Error(w, "Failed to end placement", http.StatusInternalServerError)
+		return
+	}
+	respondPlacement(w, pl.ID, http.StatusOK)
+}
+
+func respondPlacement(w http.ResponseWriter, id, status int) {
+	pl, err := loadPlacement(database.DB, id, false)
+	if err != nil {
+		log.Printf("Error loading placement %d: %v", id, err)
+		http.Error(w, "Failed to load placement", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(pl)
+}
+
+// errPlacementScheduled is returned by placeFromStudentRecord when a
+// placement change is already dated for a later day
+var errPlacementScheduled = errors.New("trainee has a placement change scheduled; use the placement endpoints")
+
+// placeFromStudentRecord keeps placements in step when the employer, site
+// or supervisor is edited on the trainee record instead of through the
+// placement endpoints. Call it only when one of them changed. The change
+// takes effect today: the placement in force ends yesterday and a new one
+// starts, or it is corrected in place (or voided, when the employer is
+// removed) if it only started today. It refuses with errPlacementScheduled
+// while a transfer or end is pending, rather than guess how to merge them.
+func placeFromStudentRecord(tx *sql.Tx, studentID int, employerID, siteID, supervisorID *uint, staffID *int) error {
+	today := placementToday(time.Now())
+	var scheduled bool
+	err := tx.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM placements WHERE student_id = $1 AND status <> 'void'
+			AND (start_date > $2::date OR end_date >= $2::date))`,
+		studentID, today,
+	).Scan(&scheduled)
+	if err != nil {
+		return err
+	}
+	if scheduled {
+		return errPlacementScheduled
+	}
+
+	var cur struct {
+		id, employerID       int
+		siteID, supervisorID *int
+		start                time.Time
+	}
+	err = tx.QueryRow(
+		`SELECT id, employer_id, site_id, supervisor_id, start_date FROM placements
+		WHERE student_id = $1 AND status <> 'void' AND start_date <= $2::date AND end_date IS NULL
+		ORDER BY start_date DESC LIMIT 1 FOR UPDATE`, studentID, today,
+	).Scan(&cur.id, &cur.employerID, &cur.siteID, &cur.supervisorID, &cur.start)
+	found := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	employer, site, supervisor := uintToIntPtr(employerID), uintToIntPtr(siteID), uintToIntPtr(supervisorID)
+	if found && employer != nil && *employer == cur.employerID && sameIntPtr(site, cur.siteID) && sameIntPtr(supervisor, cur.supervisorID) {
+		return nil
+	}
+	if found {
+		switch {
+		case cur.start.Format(dateLayout) == today && employer == nil:
+			_, err = tx.Exec(
+				`UPDATE placements SET end_date = start_date, status = $1, end_reason = $2 WHERE id = $3`,
+				placementVoid, "removed on trainee record", cur.id,
+			)
+			return err
+		case cur.start.Format(dateLayout) == today:
+			_, err = tx.Exec(
+				`UPDATE placements SET employer_id = $1, site_id = $2, supervisor_id = $3 WHERE id = $4`,
+				*employer, site, supervisor, cur.id,
+			)
+			return err
+		}
+		_, err = tx.Exec(
+			`UPDATE placements SET end_date = $1::date - 1, status = $2, end_reason = $3 WHERE id = $4`,
+			today, placementEnded, "changed on trainee record", cur.id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if employer == nil {
+		return nil
+	}
+	pl := models.Placement{
+		StudentID: studentID, EmployerID: *employer, SiteID: site, SupervisorID: supervisor,
+		Status: placementActive, StartDate: today, CreatedBy: staffID,
+	}
+	return insertPlacement(tx, &pl)
+}
+
+func uintToIntPtr(u *uint) *int {
+	if u == nil {
+		return nil
+	}
+	v := int(*u)
+	return &v
+}
+
+func sameUintPtr(a, b *uint) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
+
+func sameIntPtr(a, b *int) bool {
+	return (a == nil && b == nil) || (a != nil && b != nil && *a == *b)
+}
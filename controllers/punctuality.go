@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"time"
+)
+
+// clockLayouts are the formats accepted for student.check_in_time and
+// check_out_time
+var clockLayouts = []string{"15:04:05", "15:04", "3:04 PM", "3:04PM", "3:04 pm", "3:04pm"}
+
+// parseClock parses a time of day such as "08:30" or "8:30 AM" and returns
+// it on the given local day
+func parseClock(value string, day time.Time, loc *time.Location) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range clockLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		d := day.In(loc)
+		return time.Date(d.Year(), d.Month(), d.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc), true
+	}
+	return time.Time{}, false
+}
+
+// scheduledTimes returns when the trainee was expected to start and finish on
+// the local day containing day. Both are nil on a day off or when the trainee
+// has no schedule.
+func scheduledTimes(db *sql.DB, studentID int, day time.Time, loc *time.Location) (*time.Time, *time.Time, error) {
+	sched, err := resolveSchedule(db, studentID, day, loc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !sched.Scheduled {
+		return nil, nil, nil
+	}
+	start := sched.Shifts[0].Start
+	end := sched.Shifts[len(sched.Shifts)-1].End
+	return &start, &end, nil
+}
+
+// minutesAfter returns how many whole minutes actual is after reference, or
+// zero when it is not after it
+func minutesAfter(actual, reference time.Time) int {
+	if !actual.After(reference) {
+		return 0
+	}
+	return int(math.Round(actual.Sub(reference).Minutes()))
+}
@@ -0,0 +1,250 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"server/models"
+
+	"github.com/lib/pq"
+)
+
+const (
+	scheduleSourceOverride = "override"
+	scheduleSourceSchedule = "schedule"
+	scheduleSourceLegacy   = "legacy"
+	scheduleSourceNone     = "none"
+	scheduleSourceUnplaced = "unplaced"
+)
+
+// resolveSchedule works out what a trainee is expected to work on the local
+// day containing day. See resolveSchedules.
+func resolveSchedule(db *sql.DB, studentID int, day time.Time, loc *time.Location) (*models.DaySchedule, error) {
+	scheds, err := resolveSchedules(db, day, map[int]*time.Location{studentID: loc})
+	if err != nil {
+		return nil, err
+	}
+	return scheds[studentID], nil
+}
+
+// resolveSchedules works out what each trainee in locs is expected to work
+// on the local day containing day in their timezone, keyed by student ID,
+// in a fixed number of queries. A trainee with no placement that day is not
+// scheduled. Otherwise a one-off override wins over the weekly schedule in
+// force on that date for the placement they were on; trainees with no
+// schedule at all fall back to the fixed student.check_in_time and
+// check_out_time on every day. Holidays, employer closures and approved
+// leave excuse the trainee from the day.
+func resolveSchedules(db *sql.DB, day time.Time, locs map[int]*time.Location) (map[int]*models.DaySchedule, error) {
+	out := make(map[int]*models.DaySchedule, len(locs))
+	if len(locs) == 0 {
+		return out, nil
+	}
+	ids := make([]int, 0, len(locs))
+	dates := make([]string, 0, len(locs))
+	for id, loc := range locs {
+		ids = append(ids, id)
+		dates = append(dates, localDate(day, loc))
+		out[id] = &models.DaySchedule{StudentID: id, Date: localDate(day, loc), Source: scheduleSourceNone, Shifts: []models.ShiftWindow{}}
+	}
+
+	rows, err := db.Query(
+		`SELECT q.student_id, pl.id IS NOT NULL, o.id IS NOT NULL, COALESCE(o.day_off, false), o.start_time, o.end_time,
+			ws.id, s.check_in_time, s.check_out_time
+		FROM unnest($1::int[], $2::date[]) AS q(student_id, date)
+		JOIN student s ON s.id = q.student_id
+		`+placementAsOf("q.student_id", "q.date")+`
+		LEFT JOIN schedule_overrides o ON o.student_id = q.student_id AND o.date = q.date
+		LEFT JOIN LATERAL (
+			SELECT w.id FROM work_schedules w
+			WHERE w.student_id = q.student_id AND w.effective_from <= q.date AND (w.effective_to IS NULL OR w.effective_to >= q.date)
+				AND (w.placement_id IS NULL OR w.placement_id = pl.id)
+			ORDER BY w.effective_from DESC, w.id DESC LIMIT 1
+		) ws ON TRUE`,
+		pq.Array(ids), pq.Array(dates),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load schedules: %w", err)
+	}
+	type dayRow struct {
+		studentID                          int
+		placed, override, dayOff           bool
+		start, end, legacyStart, legacyEnd sql.NullString
+		scheduleID                         sql.NullInt64
+	}
+	var found []dayRow
+	var scheduleIDs []int
+	for rows.Next() {
+		var d dayRow
+		if err := rows.Scan(&d.studentID, &d.placed, &d.override, &d.dayOff, &d.start, &d.end,
+			&d.scheduleID, &d.legacyStart, &d.legacyEnd); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan schedule: %w", err)
+		}
+		found = append(found, d)
+		if d.placed && !d.override && d.scheduleID.Valid {
+			scheduleIDs = append(scheduleIDs, int(d.scheduleID.Int64))
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	shifts := map[int][]models.ScheduleShift{}
+	if len(scheduleIDs) > 0 {
+		if shifts, err = loadShifts(db, scheduleIDs, -1); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, row := range found {
+		res, loc := out[row.studentID], locs[row.studentID]
+		d := day.In(loc)
+		switch {
+		case !row.placed:
+			// Not working anywhere that day
+			res.Source = scheduleSourceUnplaced
+		case row.override:
+			res.Source = scheduleSourceOverride
+			if !row.dayOff {
+				if w, ok := shiftWindow(d, row.start.String, row.end.String, loc); ok {
+					res.Shifts = append(res.Shifts, w)
+				}
+			}
+		case row.scheduleID.Valid:
+			res.Source = scheduleSourceSchedule
+			for _, sh := range shifts[int(row.scheduleID.Int64)] {
+				if sh.Weekday != int(d.Weekday()) {
+					continue
+				}
+				w, ok := shiftWindow(d, sh.StartTime, sh.EndTime, loc)
+				if !ok {
+					continue
+				}
+				for _, b := range sh.Breaks {
+					if bw, ok := breakWindow(w, b.StartTime, b.EndTime, loc); ok {
+						w.Breaks = append(w.Breaks, bw)
+					}
+				}
+				res.Shifts = append(res.Shifts, w)
+			}
+		default:
+			if w, ok := shiftWindow(d, row.legacyStart.String, row.legacyEnd.String, loc); ok {
+				res.Source = scheduleSourceLegacy
+				res.Shifts = append(res.Shifts, w)
+			}
+		}
+		res.Scheduled = len(res.Shifts) > 0
+	}
+
+	excuses, err := excusedDays(db, ids, dates)
+	if err != nil {
+		return nil, err
+	}
+	for id, e := range excuses {
+		out[id].Excused, out[id].ExcusedReason = e.kind, e.reason
+		out[id].Scheduled = false
+	}
+	return out, nil
+}
+
+// shiftWindow places a start and end time of day on a date. An end at or
+// before the start finishes the next day.
+func shiftWindow(day time.Time, start, end string, loc *time.Location) (models.ShiftWindow, bool) {
+	s, ok1 := parseClock(start, day, loc)
+	e, ok2 := parseClock(end, day, loc)
+	if !ok1 || !ok2 {
+		return models.ShiftWindow{}, false
+	}
+	if !e.After(s) {
+		e = e.AddDate(0, 0, 1)
+	}
+	return models.ShiftWindow{Start: s, End: e, Breaks: []models.BreakWindow{}}, true
+}
+
+// breakWindow places a break inside a resolved shift, moving it to the next
+// day when the shift runs past midnight
+func breakWindow(shift models.ShiftWindow, start, end string, loc *time.Location) (models.BreakWindow, bool) {
+	s, ok1 := parseClock(start, shift.Start, loc)
+	e, ok2 := parseClock(end, shift.Start, loc)
+	if !ok1 || !ok2 {
+		return models.BreakWindow{}, false
+	}
+	if s.Before(shift.Start) {
+		s = s.AddDate(0, 0, 1)
+	}
+	for !e.After(s) {
+		e = e.AddDate(0, 0, 1)
+	}
+	return models.BreakWindow{Start: s, End: e}, true
+}
+
+// loadShifts returns the shifts (with breaks) of the given schedules keyed by
+// schedule ID. A weekday of -1 loads every day.
+func loadShifts(db *sql.DB, scheduleIDs []int, weekday int) (map[int][]models.ScheduleShift, error) {
+	rows, err := db.Query(
+		`SELECT id, schedule_id, weekday, start_time, end_time FROM schedule_shifts
+		WHERE schedule_id = ANY($1) AND ($2::int < 0 OR weekday = $2::int)
+		ORDER BY weekday, start_time`,
+		pq.Array(scheduleIDs), weekday,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load shifts: %w", err)
+	}
+	defer rows.Close()
+
+	out := map[int][]models.ScheduleShift{}
+	var shiftIDs []int
+	owner := map[int]int{}
+	for rows.Next() {
+		var sh models.ScheduleShift
+		var scheduleID int
+		if err := rows.Scan(&sh.ID, &scheduleID, &sh.Weekday, &sh.StartTime, &sh.EndTime); err != nil {
+			return nil, fmt.Errorf("scan shift: %w", err)
+		}
+		sh.StartTime, sh.EndTime = trimSeconds(sh.StartTime), trimSeconds(sh.EndTime)
+		sh.Breaks = []models.ScheduleBreak{}
+		out[scheduleID] = append(out[scheduleID], sh)
+		shiftIDs = append(shiftIDs, sh.ID)
+		owner[sh.ID] = scheduleID
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(shiftIDs) == 0 {
+		return out, nil
+	}
+
+	brows, err := db.Query(
+		`SELECT id, shift_id, start_time, end_time FROM schedule_breaks WHERE shift_id = ANY($1) ORDER BY start_time`,
+		pq.Array(shiftIDs),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load breaks: %w", err)
+	}
+	defer brows.Close()
+	for brows.Next() {
+		var b models.ScheduleBreak
+		var shiftID int
+		if err := brows.Scan(&b.ID, &shiftID, &b.StartTime, &b.EndTime); err != nil {
+			return nil, fmt.Errorf("scan break: %w", err)
+		}
+		b.StartTime, b.EndTime = trimSeconds(b.StartTime), trimSeconds(b.EndTime)
+		shifts := out[owner[shiftID]]
+		for i := range shifts {
+			if shifts[i].ID == shiftID {
+				shifts[i].Breaks = append(shifts[i].Breaks, b)
+			}
+		}
+	}
+	return out, brows.Err()
+}
+
+// trimSeconds turns Postgres "09:00:00" into "09:00" when the seconds are zero
+func trimSeconds(t string) string {
+	if len(t) == 8 && t[5:] == ":00" {
+		return t[:5]
+	}
+	return t
+}
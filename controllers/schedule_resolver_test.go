@@ -0,0 +1,43 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShiftWindowAcrossDST(t *testing.T) {
+	london := mustLoadLocation("Europe/London")
+	// Clocks go forward on 29 March 2026 and back on 25 October 2026
+	date := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 12, 0, 0, 0, london) }
+	tests := []struct {
+		name       string
+		day        time.Time
+		start, end string
+		wantStart  string
+		want       time.Duration
+	}{
+		{"day shift on the spring change", date(2026, 3, 29), "09:00", "17:00", "2026-03-29T09:00:00+01:00", 8 * time.Hour},
+		{"night shift into the spring change", date(2026, 3, 28), "22:00", "06:00", "2026-03-28T22:00:00Z", 7 * time.Hour},
+		{"night shift into the autumn change", date(2026, 10, 24), "22:00", "06:00", "2026-10-24T22:00:00+01:00", 9 * time.Hour},
+		{"day shift on the autumn change", date(2026, 10, 25), "09:00", "17:00", "2026-10-25T09:00:00Z", 8 * time.Hour},
+		{"end equal to start runs a full day", date(2026, 6, 1), "08:00", "08:00", "2026-06-01T08:00:00+01:00", 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, ok := shiftWindow(tt.day, tt.start, tt.end, london)
+			if !ok {
+				t.Fatal("shiftWindow failed")
+			}
+			if got := w.Start.Format(time.RFC3339); got != tt.wantStart {
+				t.Errorf("start = %s, want %s", got, tt.wantStart)
+			}
+			if got := w.End.Sub(w.Start); got != tt.want {
+				t.Errorf("length = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, ok := shiftWindow(date(2026, 6, 1), "nine", "17:00", london); ok {
+		t.Error("an unreadable start should fail")
+	}
+}
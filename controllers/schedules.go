@@ -0,0 +1,529 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+const dateLayout = "2006-01-02"
+
+// normalizeClock checks a time of day and returns it as HH:MM or HH:MM:SS
+func normalizeClock(value string) (string, error) {
+	t, ok := parseClock(value, time.Now(), time.UTC)
+	if !ok {
+		return "", fmt.Errorf("invalid time %q, use HH:MM", value)
+	}
+	if t.Second() != 0 {
+		return t.Format("15:04:05"), nil
+	}
+	return t.Format("15:04"), nil
+}
+
+// validateSchedule checks a schedule and normalises its dates and times
+func validateSchedule(s *models.WorkSchedule) error {
+	if s.StudentID <= 0 {
+		return errors.New("student_id is required")
+	}
+	from, err := time.Parse(dateLayout, s.EffectiveFrom)
+	if err != nil {
+		return errors.New("effective_from must be a date (YYYY-MM-DD)")
+	}
+	if s.EffectiveTo != nil && *s.EffectiveTo == "" {
+		s.EffectiveTo = nil
+	}
+	if s.EffectiveTo != nil {
+		to, err := time.Parse(dateLayout, *s.EffectiveTo)
+		if err != nil {
+			return errors.New("effective_to must be a date (YYYY-MM-DD)")
+		}
+		if to.Before(from) {
+			return errors.New("effective_to is before effective_from")
+		}
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	for i := range s.Shifts {
+		sh := &s.Shifts[i]
+		if sh.Weekday < 0 || sh.Weekday > 6 {
+			return errors.New("weekday must be 0 (Sunday) to 6 (Saturday)")
+		}
+		if sh.StartTime, err = normalizeClock(sh.StartTime); err != nil {
+			return err
+		}
+		if sh.EndTime, err = normalizeClock(sh.EndTime); err != nil {
+			return err
+		}
+		if sh.StartTime == sh.EndTime {
+			return errors.New("a shift must not start and end at the same time")
+		}
+		for j := range sh.Breaks {
+			b := &sh.Breaks[j]
+			if b.StartTime, err = normalizeClock(b.StartTime); err != nil {
+				return err
+			}
+			if b.EndTime, err = normalizeClock(b.EndTime); err != nil {
+				return err
+			}
+			w, _ := shiftWindow(time.Now(), sh.StartTime, sh.EndTime, time.UTC)
+			bw, _ := breakWindow(w, b.StartTime, b.EndTime, time.UTC)
+			if bw.Start.Before(w.Start) || bw.End.After(w.End) {
+				return fmt.Errorf("break %s-%s is outside the shift %s-%s", b.StartTime, b.EndTime, sh.StartTime, sh.EndTime)
+			}
+		}
+	}
+	return nil
+}
+
+// errScheduleOutsidePlacement is returned by attachPlacement when the
+// placement asked for does not cover the schedule
+var errScheduleOutsidePlacement = errors.New("placement_id must be one of the trainee's placements and cover effective_from")
+
+// attachPlacement links a schedule to its placement: the one given, or the
+// one in force on effective_from. The schedule's employer follows the
+// placement. A trainee with no placement keeps an unlinked schedule.
+func attachPlacement(q queryRower, s *models.WorkSchedule) error {
+	var placementID, employerID int
+	err := q.QueryRow(
+		`SELECT id, employer_id FROM placements
+		WHERE student_id = $1 AND status <> 'void' AND ($2::int IS NULL OR id = $2)
+			AND start_date <= $3::date AND (end_date IS NULL OR end_date >= $3::date)
+		ORDER BY start_date DESC LIMIT 1`,
+		s.StudentID, s.PlacementID, s.EffectiveFrom,
+	).Scan(&placementID, &employerID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows) && s.PlacementID != nil:
+		return errScheduleOutsidePlacement
+	case errors.Is(err, sql.ErrNoRows):
+		return nil
+	case err != nil:
+		return err
+	}
+	s.PlacementID, s.EmployerID = &placementID, &employerID
+	return nil
+}
+
+// writeAttachError answers an attachPlacement error
+func writeAttachError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errScheduleOutsidePlacement) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Error linking schedule to a placement: %v", err)
+	http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+}
+
+// requireStudentAccess writes a 404 and returns false when the caller may not
+// manage the trainee
+func requireStudentAccess(w http.ResponseWriter, r *http.Request, studentID int) bool {
+	ok, err := canAccessStudent(principalFromContext(r.Context()), studentID)
+	if err != nil {
+		log.Printf("Error checking access to student %d: %v", studentID, err)
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// scheduleFromPath loads the owner of the schedule named in the URL and checks
+// the caller may manage them
+func scheduleFromPath(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid schedule ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	var studentID int
+	err = database.DB.QueryRow(`SELECT student_id FROM work_schedules WHERE id = $1`, id).Scan(&studentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Schedule not found", http.StatusNotFound)
+		return 0, 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to load schedule", http.StatusInternalServerError)
+		return 0, 0, false
+	}
+	if !requireStudentAccess(w, r, studentID) {
+		return 0, 0, false
+	}
+	return id, studentID, true
+}
+
+// loadSchedules returns a trainee's schedules, newest first. When id is
+// non-zero only that schedule is returned.
+func loadSchedules(db *sql.DB, studentID, id int) ([]models.WorkSchedule, error) {
+	rows, err := db.Query(
+		`SELECT id, student_id, placement_id, employer_id, name, effective_from, effective_to FROM work_schedules
+		WHERE student_id = $1 AND ($2 = 0 OR id = $2)
+		ORDER BY effective_from DESC, id DESC`, studentID, id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []models.WorkSchedule{}
+	var ids []int
+	for rows.Next() {
+		var s models.WorkSchedule
+		var from time.Time
+		var to sql.NullTime
+		if err := rows.Scan(&s.ID, &s.StudentID, &s.PlacementID, &s.EmployerID, &s.Name, &from, &to); err != nil {
+			return nil, err
+		}
+		s.EffectiveFrom = from.Format(dateLayout)
+		if to.Valid {
+			d := to.Time.Format(dateLayout)
+			s.EffectiveTo = &d
+		}
+		schedules = append(schedules, s)
+		ids = append(ids, s.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return schedules, nil
+	}
+
+	shifts, err := loadShifts(db, ids, -1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		schedules[i].Shifts = shifts[schedules[i].ID]
+		if schedules[i].Shifts == nil {
+			schedules[i].Shifts = []models.ScheduleShift{}
+		}
+	}
+	return schedules, nil
+}
+
+// saveShifts replaces the shifts and breaks of a schedule
+func saveShifts(tx *sql.Tx, scheduleID int, shifts []models.ScheduleShift) error {
+	if _, err := tx.Exec(`DELETE FROM schedule_shifts WHERE schedule_id = $1`, scheduleID); err != nil {
+		return err
+	}
+	for _, sh := range shifts {
+		var shiftID int
+		err := tx.QueryRow(
+			`INSERT INTO schedule_shifts (schedule_id, weekday, start_time, end_time) VALUES ($1, $2, $3, $4) RETURNING id`,
+			scheduleID, sh.Weekday, sh.StartTime, sh.EndTime,
+		).Scan(&shiftID)
+		if err != nil {
+			return err
+		}
+		for _, b := range sh.Breaks {
+			if _, err := tx.Exec(
+				`INSERT INTO schedule_breaks (shift_id, start_time, end_time) VALUES ($1, $2, $3)`,
+				shiftID, b.StartTime, b.EndTime,
+			); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeSchedule(w http.ResponseWriter, status, studentID, id int) {
+	schedules, err := loadSchedules(database.DB, studentID, id)
+	if err != nil || len(schedules) == 0 {
+		log.Printf("Error reloading schedule %d: %v", id, err)
+		http.Error(w, "Failed to load schedule", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(schedules[0])
+}
+
+// GetSchedules lists a trainee's weekly schedules. Trainees see their own;
+// staff pass the student-id header.
+func GetSchedules(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	schedules, err := loadSchedules(database.DB, studentID, 0)
+	if err != nil {
+		log.Printf("Error loading schedules for student %d: %v", studentID, err)
+		http.Error(w, "Failed to load schedules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(schedules)
+}
+
+// CreateSchedule adds a weekly schedule with its shifts and breaks
+func CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var in models.WorkSchedule
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateSchedule(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requireStudentAccess(w, r, in.StudentID) {
+		return
+	}
+	if err := attachPlacement(database.DB, &in); err != nil {
+		writeAttachError(w, err)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		`INSERT INTO work_schedules (student_id, placement_id, employer_id, name, effective_from, effective_to)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		in.StudentID, in.PlacementID, in.EmployerID, in.Name, in.EffectiveFrom, in.EffectiveTo,
+	).Scan(&in.ID)
+	if err == nil {
+		err = saveShifts(tx, in.ID, in.Shifts)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error creating schedule for student %d: %v", in.StudentID, err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	writeSchedule(w, http.StatusCreated, in.StudentID, in.ID)
+}
+
+// UpdateSchedule replaces a schedule, including all of its shifts
+func UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	id, studentID, ok := scheduleFromPath(w, r)
+	if !ok {
+		return
+	}
+	var in models.WorkSchedule
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	// A schedule cannot be moved to another trainee
+	in.StudentID = studentID
+	if err := validateSchedule(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := attachPlacement(database.DB, &in); err != nil {
+		writeAttachError(w, err)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`UPDATE work_schedules SET placement_id = $1, employer_id = $2, name = $3, effective_from = $4, effective_to = $5 WHERE id = $6`,
+		in.PlacementID, in.EmployerID, in.Name, in.EffectiveFrom, in.EffectiveTo, id,
+	)
+	if err == nil {
+		err = saveShifts(tx, id, in.Shifts)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error updating schedule %d: %v", id, err)
+		http.Error(w, "Failed to save schedule", http.StatusInternalServerError)
+		return
+	}
+	writeSchedule(w, http.StatusOK, studentID, id)
+}
+
+// DeleteSchedule removes a schedule. Attendance already recorded keeps the
+// scheduled times it was evaluated against.
+func DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	id, _, ok := scheduleFromPath(w, r)
+	if !ok {
+		return
+	}
+	if _, err := database.DB.Exec(`DELETE FROM work_schedules WHERE id = $1`, id); err != nil {
+		log.Printf("Error deleting schedule %d: %v", id, err)
+		http.Error(w, "Failed to delete schedule", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetScheduleOverrides lists a trainee's one-off overrides, optionally
+// limited with from and to query parameters (YYYY-MM-DD)
+func GetScheduleOverrides(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	from, to := r.URL.Query().Get("from"), r.URL.Query().Get("to")
+	for _, d := range []string{from, to} {
+		if _, err := time.Parse(dateLayout, d); d != "" && err != nil {
+			http.Error(w, "from and to must be dates (YYYY-MM-DD)", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT id, student_id, date, day_off, start_time, end_time, reason FROM schedule_overrides
+		WHERE student_id = $1 AND ($2 = '' OR date >= $2::date) AND ($3 = '' OR date <= $3::date)
+		ORDER BY date`, studentID, from, to,
+	)
+	if err != nil {
+		log.Printf("Error loading overrides for student %d: %v", studentID, err)
+		http.Error(w, "Failed to load overrides", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	overrides := []models.ScheduleOverride{}
+	for rows.Next() {
+		var o models.ScheduleOverride
+		var date time.Time
+		if err := rows.Scan(&o.ID, &o.StudentID, &date, &o.DayOff, &o.StartTime, &o.EndTime, &o.Reason); err != nil {
+			http.Error(w, "Failed to load overrides", http.StatusInternalServerError)
+			return
+		}
+		o.Date = date.Format(dateLayout)
+		for _, t := range []*string{o.StartTime, o.EndTime} {
+			if t != nil {
+				*t = trimSeconds(*t)
+			}
+		}
+		overrides = append(overrides, o)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(overrides)
+}
+
+// SaveScheduleOverride sets the override for a trainee on a date, replacing
+// any existing one
+func SaveScheduleOverride(w http.ResponseWriter, r *http.Request) {
+	var in models.ScheduleOverride
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse(dateLayout, in.Date); err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	if in.DayOff {
+		in.StartTime, in.EndTime = nil, nil
+	} else {
+		if in.StartTime == nil || in.EndTime == nil {
+			http.Error(w, "start_time and end_time are required unless day_off is set", http.StatusBadRequest)
+			return
+		}
+		for _, t := range []*string{in.StartTime, in.EndTime} {
+			v, err := normalizeClock(*t)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			*t = v
+		}
+	}
+	if !requireStudentAccess(w, r, in.StudentID) {
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	err := database.DB.QueryRow(
+		`INSERT INTO schedule_overrides (student_id, date, day_off, start_time, end_time, reason, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (student_id, date) DO UPDATE SET day_off = EXCLUDED.day_off, start_time = EXCLUDED.start_time,
+			end_time = EXCLUDED.end_time, reason = EXCLUDED.reason, created_by = EXCLUDED.created_by, created_at = NOW()
+		RETURNING id`,
+		in.StudentID, in.Date, in.DayOff, in.StartTime, in.EndTime, strings.TrimSpace(in.Reason), p.StaffID,
+	).Scan(&in.ID)
+	if err != nil {
+		log.Printf("Error saving override for student %d: %v", in.StudentID, err)
+		http.Error(w, "Failed to save override", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(in)
+}
+
+// DeleteScheduleOverride removes a one-off override
+func DeleteScheduleOverride(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid override ID", http.StatusBadRequest)
+		return
+	}
+	var studentID int
+	err = database.DB.QueryRow(`SELECT student_id FROM schedule_overrides WHERE id = $1`, id).Scan(&studentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Override not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to load override", http.StatusInternalServerError)
+		return
+	}
+	if !requireStudentAccess(w, r, studentID) {
+		return
+	}
+	if _, err := database.DB.Exec(`DELETE FROM schedule_overrides WHERE id = $1`, id); err != nil {
+		http.Error(w, "Failed to delete override", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetDaySchedule resolves what a trainee is expected to work on a date
+// (?date=YYYY-MM-DD, default today in the trainee's timezone)
+func GetDaySchedule(w http.ResponseWriter, r *http.Request) {
+	studentID, err := resolveStudentID(r)
+	if err != nil {
+		writeResolveError(w, err)
+		return
+	}
+	loc, err := studentLocation(database.DB, studentID, time.Now())
+	if err != nil {
+		http.Error(w, "Failed to load timezone", http.StatusInternalServerError)
+		return
+	}
+	day := time.Now()
+	if v := r.URL.Query().Get("date"); v != "" {
+		// Noon avoids landing on the wrong date around DST changes
+		if day, err = time.ParseInLocation(dateLayout, v, loc); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = day.Add(12 * time.Hour)
+	}
+	sched, err := resolveSchedule(database.DB, studentID, day, loc)
+	if err != nil {
+		log.Printf("Error resolving schedule for student %d: %v", studentID, err)
+		http.Error(w, "Failed to resolve schedule", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sched)
+}
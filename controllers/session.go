@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/models"
+)
+
+const (
+	roleTrainee = "trainee"
+
+	subjectStudent = "student"
+	subjectStaff   = "staff"
+
+	tokenTypeAccess = "access"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// sessionConfig holds the signing key and lifetimes used for session tokens
+type sessionConfig struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+var sessions *sessionConfig
+
+// loadSessionConfig reads the token settings from the environment. The signing
+// secret is mandatory; the lifetimes fall back to sensible defaults.
+func loadSessionConfig() *sessionConfig {
+	secret := os.Getenv("AUTH_TOKEN_SECRET")
+	if len(secret) < 32 {
+		log.Fatal("❌ AUTH_TOKEN_SECRET must be set to at least 32 characters")
+	}
+	return &sessionConfig{
+		secret:     []byte(secret),
+		accessTTL:  time.Duration(envInt("ACCESS_TOKEN_TTL_MINUTES", 15)) * time.Minute,
+		refreshTTL: time.Duration(envInt("REFRESH_TOKEN_TTL_DAYS", 30)) * 24 * time.Hour,
+	}
+}
+
+// envInt returns the integer value of an environment variable or def when it
+// is unset or malformed
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// sessionClaims is the payload of a signed access token
+type sessionClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role"`
+	DeviceID  int    `json:"did,omitempty"`
+	TokenType string `json:"typ"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// studentSubject builds the token subject for a trainee
+func studentSubject(studentID int) string {
+	return fmt.Sprintf("%s:%d", subjectStudent, studentID)
+}
+
+// parseSubject splits a token subject into its kind and numeric ID
+func parseSubject(subject string) (string, int, error) {
+	kind, idStr, ok := strings.Cut(subject, ":")
+	if !ok {
+		return "", 0, errInvalidToken
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return "", 0, errInvalidToken
+	}
+	return kind, id, nil
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// signAccessToken encodes the claims as an HS256 JWT
+func (c *sessionConfig) signAccessToken(claims sessionClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + c.sign(unsigned), nil
+}
+
+func (c *sessionConfig) sign(data string) string {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAccessToken verifies the signature and expiry of an access token
+func (c *sessionConfig) parseAccessToken(token string) (*sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, errInvalidToken
+	}
+	if !hmac.Equal([]byte(c.sign(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return nil, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errInvalidToken
+	}
+	if claims.TokenType != tokenTypeAccess {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, errExpiredToken
+	}
+	return &claims, nil
+}
+
+// randomToken returns n bytes of crypto-random data, hex encoded
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the SHA-256 hex digest stored in place of a bearer secret
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// staffSubject builds the token subject for a staff account
+func staffSubject(staffID int) string {
+	return fmt.Sprintf("%s:%d", subjectStaff, staffID)
+}
+
+// roleForSubject resolves the role carried in access tokens for a subject.
+// Staff roles are read from the database so that deactivated accounts cannot
+// refresh their sessions.
+func roleForSubject(db *sql.DB, subject string) (string, error) {
+	kind, id, err := parseSubject(subject)
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case subjectStudent:
+		return roleTrainee, nil
+	case subjectStaff:
+		var role string
+		err := db.QueryRow(`SELECT role FROM staff_accounts WHERE id = $1 AND is_active`, id).Scan(&role)
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errInvalidToken
+		}
+		return role, err
+	}
+	return "", errInvalidToken
+}
+
+// issueSession mints a new access token and stores a fresh refresh token for
+// the subject. deviceID binds the session to a paired device; pass 0 for
+// sessions that are not tied to one.
+func issueSession(db *sql.DB, subject string, deviceID int) (*models.SessionTokens, int, error) {
+	role, err := roleForSubject(db, subject)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	now := time.Now()
+	jti, err := randomToken(16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to generate token id: %w", err)
+	}
+	accessToken, err := sessions.signAccessToken(sessionClaims{
+		Subject:   subject,
+		Role:      role,
+		DeviceID:  deviceID,
+		TokenType: tokenTypeAccess,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(sessions.accessTTL).Unix(),
+		ID:        jti,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to sign access token: %w", err)
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to generate refresh token: %w", err)
+	}
+	refreshExpiresAt := now.Add(sessions.refreshTTL)
+
+	var refreshID int
+	err = db.QueryRow(
+		`INSERT INTO refresh_tokens (subject, token_hash, expires_at, device_id) VALUES ($1, $2, $3, $4) RETURNING id`,
+		subject, hashToken(refreshToken), refreshExpiresAt, sql.NullInt64{Int64: int64(deviceID), Valid: deviceID > 0},
+	).Scan(&refreshID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return &models.SessionTokens{
+		AccessToken:      accessToken,
+		TokenType:        "Bearer",
+		ExpiresAt:        now.Add(sessions.accessTTL),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, refreshID, nil
+}
+
+// refreshSession rotates a refresh token: the presented token is revoked and a
+// new pair is issued. Presenting a token that was already rotated revokes every
+// session of that subject, since it means the token has leaked.
+func refreshSession(db *sql.DB, refreshToken string) (*models.SessionTokens, error) {
+	var (
+		id        int
+		subject   string
+		expiresAt time.Time
+		revokedAt sql.NullTime
+		deviceID  sql.NullInt64
+	)
+	err := db.QueryRow(
+		`SELECT id, subject, expires_at, revoked_at, device_id FROM refresh_tokens WHERE token_hash = $1`,
+		hashToken(refreshToken),
+	).Scan(&id, &subject, &expiresAt, &revokedAt, &deviceID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidToken
+	} else if err != nil {
+		return nil, fmt.Errorf("database error: %w", err)
+	}
+
+	if revokedAt.Valid {
+		log.Printf("Revoked refresh token %d presented again, revoking all sessions for %s", id, subject)
+		if err := revokeSubjectSessions(db, subject); err != nil {
+			log.Printf("Error revoking sessions for %s: %v", subject, err)
+		}
+		return nil, errInvalidToken
+	}
+	if time.Now().After(expiresAt) {
+		return nil, errExpiredToken
+	}
+	if deviceID.Valid {
+		active, err := deviceIsActive(db, int(deviceID.Int64))
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, errInvalidToken
+		}
+	}
+
+	tokens, newID, err := issueSession(db, subject, int(deviceID.Int64))
+	if err != nil {
+		return nil, err
+	}
+	res, err := db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = NOW(), replaced_by = $1 WHERE id = $2 AND revoked_at IS NULL`,
+		newID, id,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke refresh token: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// Another request rotated the same token first
+		db.Exec(`UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1`, newID)
+		return nil, errInvalidToken
+	}
+	return tokens, nil
+}
+
+// revokeRefreshToken revokes a single refresh token
+func revokeRefreshToken(db *sql.DB, refreshToken string) error {
+	_, err := db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = NOW() WHERE token_hash = $1 AND revoked_at IS NULL`,
+		hashToken(refreshToken),
+	)
+	return err
+}
+
+// revokeSubjectSessions revokes every outstanding refresh token of a subject
+func revokeSubjectSessions(db *sql.DB, subject string) error {
+	_, err := db.Exec(
+		`UPDATE refresh_tokens SET revoked_at = NOW() WHERE subject = $1 AND revoked_at IS NULL`,
+		subject,
+	)
+	return err
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	c := &sessionConfig{secret: []byte("0123456789abcdef0123456789abcdef")}
+	other := &sessionConfig{secret: []byte("fedcba9876543210fedcba9876543210")}
+	now := time.Now().Unix()
+	valid := sessionClaims{Subject: studentSubject(7), Role: roleTrainee, TokenType: tokenTypeAccess, IssuedAt: now, ExpiresAt: now + 600, ID: "a"}
+	sign := func(c *sessionConfig, claims sessionClaims) string {
+		tok, err := c.signAccessToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	good := sign(c, valid)
+	parts := strings.Split(good, ".")
+	expired, refresh := valid, valid
+	expired.ExpiresAt = now - 1
+	refresh.TokenType = "refresh"
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", good, nil},
+		{"expired", sign(c, expired), errExpiredToken},
+		{"not an access token", sign(c, refresh), errInvalidToken},
+		{"other secret", sign(other, valid), errInvalidToken},
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"staff:1","typ":"access","exp":9999999999}`)) + "." + parts[2], errInvalidToken},
+		{"other header", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "." + parts[2], errInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1], errInvalidToken},
+		{"empty", "", errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := c.parseAccessToken(tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			if err == nil && (claims.Subject != valid.Subject || claims.Role != valid.Role) {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
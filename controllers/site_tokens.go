@@ -0,0 +1,362 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+// How an attendance event was tied to the workplace
+const (
+	verifyQR         = "qr"
+	verifyNFC        = "nfc"
+	verifyKiosk      = "kiosk"
+	verifyGPS        = "gps"
+	verifyNone       = "none"
+	verifyCorrection = "correction"
+
+	siteTokenPrefix = "st1"
+
+	// Allowance for the trainee's phone and the kiosk disagreeing on the time
+	siteTokenLeeway = 2 * time.Minute
+	// Longest a printed token may be issued for
+	maxPrintedTokenDays = 366
+)
+
+// errInvalidSiteToken is returned when a scanned token is malformed, forged,
+// revoked, outside its time window or for another workplace
+var errInvalidSiteToken = errors.New("invalid site token")
+
+// siteTokenClaims is what a site token vouches for: a workplace, the key it
+// was signed with, how it is presented and when it is valid. SiteID narrows
+// the workplace to one of the employer's sites; 0 is any of them.
+type siteTokenClaims struct {
+	EmployerID int
+	SiteID     int
+	KeyID      int
+	Method     string
+	NotBefore  time.Time
+	ExpiresAt  time.Time
+}
+
+// siteTokenSecret is the root every employer's signing key is derived from.
+// SITE_TOKEN_SECRET defaults to AUTH_TOKEN_SECRET; changing it invalidates
+// every printed token.
+func siteTokenSecret() []byte {
+	if key := os.Getenv("SITE_TOKEN_SECRET"); key != "" {
+		return []byte(key)
+	}
+	return sessions.secret
+}
+
+// kioskStep is how long each kiosk code is shown for
+func kioskStep() time.Duration {
+	step := time.Duration(envInt("SITE_TOKEN_KIOSK_SECONDS", 60)) * time.Second
+	if step < 15*time.Second {
+		step = 15 * time.Second
+	}
+	return step
+}
+
+// signingKey derives the key for one of an employer's key rows, so rotating
+// to a new row changes every token without storing secrets in the database
+func signingKey(employerID, keyID int) []byte {
+	mac := hmac.New(sha256.New, siteTokenSecret())
+	fmt.Fprintf(mac, "site-token|%d|%d", employerID, keyID)
+	return mac.Sum(nil)
+}
+
+// payload is employer.key.method.nbf.exp, followed by .site for codes
+// limited to one site
+func (c siteTokenClaims) payload() string {
+	p := fmt.Sprintf("%d.%d.%s.%d.%d", c.EmployerID, c.KeyID, c.Method, c.NotBefore.Unix(), c.ExpiresAt.Unix())
+	if c.SiteID != 0 {
+		p += fmt.Sprintf(".%d", c.SiteID)
+	}
+	return p
+}
+
+// sign encodes the claims as st1.<payload>.<signature>
+func (c siteTokenClaims) sign() string {
+	payload := c.payload()
+	mac := hmac.New(sha256.New, signingKey(c.EmployerID, c.KeyID))
+	mac.Write([]byte(payload))
+	enc := base64.RawURLEncoding
+	return siteTokenPrefix + "." + enc.EncodeToString([]byte(payload)) + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+// parseSiteToken checks a token's signature and returns its claims. The key
+// row still has to be checked for revocation.
+func parseSiteToken(token string) (*siteTokenClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 || parts[0] != siteTokenPrefix {
+		return nil, fmt.Errorf("%w: malformed", errInvalidSiteToken)
+	}
+	enc := base64.RawURLEncoding
+	payload, err1 := enc.DecodeString(parts[1])
+	sig, err2 := enc.DecodeString(parts[2])
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("%w: malformed", errInvalidSiteToken)
+	}
+	fields := strings.Split(string(payload), ".")
+	if len(fields) != 5 && len(fields) != 6 {
+		return nil, fmt.Errorf("%w: malformed", errInvalidSiteToken)
+	}
+	employerID, err1 := strconv.Atoi(fields[0])
+	keyID, err2 := strconv.Atoi(fields[1])
+	nbf, err3 := strconv.ParseInt(fields[3], 10, 64)
+	exp, err4 := strconv.ParseInt(fields[4], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return nil, fmt.Errorf("%w: malformed", errInvalidSiteToken)
+	}
+	c := &siteTokenClaims{EmployerID: employerID, KeyID: keyID, Method: fields[2], NotBefore: time.Unix(nbf, 0), ExpiresAt: time.Unix(exp, 0)}
+	if len(fields) == 6 {
+		if c.SiteID, err1 = strconv.Atoi(fields[5]); err1 != nil || c.SiteID <= 0 {
+			return nil, fmt.Errorf("%w: malformed", errInvalidSiteToken)
+		}
+	}
+
+	mac := hmac.New(sha256.New, signingKey(employerID, keyID))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", errInvalidSiteToken)
+	}
+	switch c.Method {
+	case verifyQR, verifyNFC, verifyKiosk:
+	default:
+		return nil, fmt.Errorf("%w: unknown method", errInvalidSiteToken)
+	}
+	return c, nil
+}
+
+// verifySiteToken checks a token scanned with an attendance event at time
+// at and returns how it was presented (qr, nfc or kiosk). The token must be
+// for the workplace the trainee was placed at on that day in loc, and for
+// their site when it names one.
+func verifySiteToken(db *sql.DB, studentID int, token string, at time.Time, loc *time.Location) (string, error) {
+	c, err := parseSiteToken(token)
+	if err != nil {
+		return "", err
+	}
+	if at.Before(c.NotBefore.Add(-siteTokenLeeway)) || at.After(c.ExpiresAt.Add(siteTokenLeeway)) {
+		return "", fmt.Errorf("%w: not valid at %s", errInvalidSiteToken, at.UTC().Format(time.RFC3339))
+	}
+
+	var revoked bool
+	err = db.QueryRow(
+		`SELECT revoked_at IS NOT NULL FROM site_token_keys WHERE id = $1 AND employer_id = $2`, c.KeyID, c.EmployerID,
+	).Scan(&revoked)
+	if errors.Is(err, sql.ErrNoRows) || revoked {
+		return "", fmt.Errorf("%w: replaced by a newer code", errInvalidSiteToken)
+	} else if err != nil {
+		return "", fmt.Errorf("load site token key: %w", err)
+	}
+
+	var employerID, siteID sql.NullInt64
+	err = db.QueryRow(
+		`SELECT `+placementEmployer+`, `+placementSite+`
+		FROM student s `+placementAsOf("s.id", "$2::date")+`
+		WHERE s.id = $1`, studentID, localDate(at, loc),
+	).Scan(&employerID, &siteID)
+	if err != nil {
+		return "", fmt.Errorf("load employer: %w", err)
+	}
+	if !employerID.Valid || int(employerID.Int64) != c.EmployerID {
+		return "", fmt.Errorf("%w: this code belongs to another workplace", errInvalidSiteToken)
+	}
+	if c.SiteID != 0 && (!siteID.Valid || int(siteID.Int64) != c.SiteID) {
+		return "", fmt.Errorf("%w: this code belongs to another site", errInvalidSiteToken)
+	}
+	return c.Method, nil
+}
+
+// activeSiteKey returns the employer's current key row, creating the first
+// one on demand
+func activeSiteKey(db *sql.DB, employerID, staffID int) (int, error) {
+	var id int
+	err := db.QueryRow(
+		`SELECT id FROM site_token_keys WHERE employer_id = $1 AND revoked_at IS NULL ORDER BY id DESC LIMIT 1`, employerID,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = db.QueryRow(
+			`INSERT INTO site_token_keys (employer_id, created_by) VALUES ($1, $2) RETURNING id`, employerID, staffID,
+		).Scan(&id)
+	}
+	return id, err
+}
+
+// siteTokenEmployer checks the caller may manage codes for the employer and
+// that it exists, writing the error response when not. A non-zero siteID
+// must be one of the employer's sites.
+func siteTokenEmployer(w http.ResponseWriter, r *http.Request, employerID, siteID int) bool {
+	if !employerAllowed(principalFromContext(r.Context()), employerID) {
+		http.Error(w, "Employer contacts can only manage their own workplace", http.StatusForbidden)
+		return false
+	}
+	var exists bool
+	if err := database.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM employer WHERE id = $1)`, employerID).Scan(&exists); err != nil {
+		http.Error(w, "Failed to load employer", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return false
+	}
+	if siteID == 0 {
+		return true
+	}
+	err := database.DB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM employer_sites WHERE id = $1 AND employer_id = $2)`, siteID, employerID,
+	).Scan(&exists)
+	if err != nil {
+		http.Error(w, "Failed to load site", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// siteIDPtr is the site a token is limited to, for the response
+func siteIDPtr(id int) *int {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// IssueSiteToken signs a long-lived token to print as a QR code or write to
+// an NFC tag at the workplace. It stays valid for valid_days (default
+// SITE_TOKEN_PRINTED_DAYS, 90) or until the employer's codes are rotated.
+// With site_id it is only accepted from trainees placed at that site.
+func IssueSiteToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		EmployerID int    `json:"employer_id"`
+		SiteID     int    `json:"site_id"`
+		Method     string `json:"method"`
+		ValidDays  int    `json:"valid_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if body.Method != verifyQR && body.Method != verifyNFC {
+		http.Error(w, "method must be qr or nfc", http.StatusBadRequest)
+		return
+	}
+	if body.ValidDays == 0 {
+		body.ValidDays = envInt("SITE_TOKEN_PRINTED_DAYS", 90)
+	}
+	if body.ValidDays < 1 || body.ValidDays > maxPrintedTokenDays {
+		http.Error(w, "valid_days must be between 1 and 366", http.StatusBadRequest)
+		return
+	}
+	if !siteTokenEmployer(w, r, body.EmployerID, body.SiteID) {
+		return
+	}
+	keyID, err := activeSiteKey(database.DB, body.EmployerID, principalFromContext(r.Context()).StaffID)
+	if err != nil {
+		log.Printf("Error loading site key for employer %d: %v", body.EmployerID, err)
+		http.Error(w, "Failed to issue site token", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().Truncate(time.Second)
+	c := siteTokenClaims{EmployerID: body.EmployerID, SiteID: body.SiteID, KeyID: keyID, Method: body.Method, NotBefore: now, ExpiresAt: now.AddDate(0, 0, body.ValidDays)}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.SiteToken{
+		Token: c.sign(), EmployerID: c.EmployerID, SiteID: siteIDPtr(c.SiteID), Method: c.Method, NotBefore: c.NotBefore, ExpiresAt: c.ExpiresAt,
+	})
+}
+
+// GetKioskToken returns the code a kiosk page should show right now. A new
+// code starts every SITE_TOKEN_KIOSK_SECONDS (default 60) and each is
+// accepted until the one after it ends, so a scan just before the change
+// still works. The kiosk should fetch again at refresh_at. A kiosk at a
+// branch passes its site_id.
+func GetKioskToken(w http.ResponseWriter, r *http.Request) {
+	employerID, err := strconv.Atoi(r.URL.Query().Get("employer_id"))
+	if err != nil {
+		http.Error(w, "Invalid employer_id", http.StatusBadRequest)
+		return
+	}
+	siteID := 0
+	if v := r.URL.Query().Get("site_id"); v != "" {
+		if siteID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid site_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if !siteTokenEmployer(w, r, employerID, siteID) {
+		return
+	}
+	keyID, err := activeSiteKey(database.DB, employerID, principalFromContext(r.Context()).StaffID)
+	if err != nil {
+		log.Printf("Error loading site key for employer %d: %v", employerID, err)
+		http.Error(w, "Failed to issue site token", http.StatusInternalServerError)
+		return
+	}
+
+	step := kioskStep()
+	start := time.Now().Truncate(step)
+	c := siteTokenClaims{EmployerID: employerID, SiteID: siteID, KeyID: keyID, Method: verifyKiosk, NotBefore: start, ExpiresAt: start.Add(2 * step)}
+	refresh := start.Add(step)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(models.SiteToken{
+		Token: c.sign(), EmployerID: employerID, SiteID: siteIDPtr(siteID), Method: verifyKiosk, NotBefore: c.NotBefore, ExpiresAt: c.ExpiresAt, RefreshAt: &refresh,
+	})
+}
+
+// RotateSiteTokens revokes every code issued for an employer, for example
+// when a printed code has been copied. New codes have to be printed and
+// kiosks pick up the change on their next refresh.
+func RotateSiteTokens(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		EmployerID int `json:"employer_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if !siteTokenEmployer(w, r, body.EmployerID, 0) {
+		return
+	}
+	p := principalFromContext(r.Context())
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to rotate site tokens", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`UPDATE site_token_keys SET revoked_at = NOW() WHERE employer_id = $1 AND revoked_at IS NULL`, body.EmployerID)
+	if err == nil {
+		_, err = tx.Exec(`INSERT INTO site_token_keys (employer_id, created_by) VALUES ($1, $2)`, body.EmployerID, p.StaffID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error rotating site tokens for employer %d: %v", body.EmployerID, err)
+		http.Error(w, "Failed to rotate site tokens", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Site tokens for employer %d rotated by staff %d", body.EmployerID, p.StaffID)
+	w.WriteHeader(http.StatusNoContent)
+}
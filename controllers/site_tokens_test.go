@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteTokenRoundTrip(t *testing.T) {
+	t.Setenv("SITE_TOKEN_SECRET", "site-token-test-secret")
+	nbf := time.Unix(1767225600, 0)
+	for _, c := range []siteTokenClaims{
+		{EmployerID: 3, KeyID: 9, Method: verifyQR, NotBefore: nbf, ExpiresAt: nbf.Add(time.Hour)},
+		{EmployerID: 3, SiteID: 12, KeyID: 9, Method: verifyKiosk, NotBefore: nbf, ExpiresAt: nbf.Add(time.Minute)},
+	} {
+		got, err := parseSiteToken(c.sign())
+		if err != nil {
+			t.Fatalf("parse %+v: %v", c, err)
+		}
+		if *got != c {
+			t.Errorf("got %+v, want %+v", *got, c)
+		}
+	}
+}
+
+func TestParseSiteTokenRejectsTampering(t *testing.T) {
+	t.Setenv("SITE_TOKEN_SECRET", "site-token-test-secret")
+	nbf := time.Unix(1767225600, 0)
+	claims := siteTokenClaims{EmployerID: 3, KeyID: 9, Method: verifyNFC, NotBefore: nbf, ExpiresAt: nbf.Add(time.Hour)}
+	token := claims.sign()
+	parts := strings.Split(token, ".")
+	enc := base64.RawURLEncoding
+	// resign keeps the signature of the original token over a new payload
+	resign := func(payload string) string {
+		return parts[0] + "." + enc.EncodeToString([]byte(payload)) + "." + parts[2]
+	}
+	otherEmployer := claims
+	otherEmployer.EmployerID = 4
+	badMethod := claims
+	badMethod.Method = verifyGPS
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other employer", resign(otherEmployer.payload())},
+		{"extended expiry", resign(strings.Replace(claims.payload(), ".1767229200", ".1767315600", 1))},
+		{"narrowed to a site", resign(claims.payload() + ".5")},
+		{"signature of another token", parts[0] + "." + parts[1] + "." + strings.Split(otherEmployer.sign(), ".")[2]},
+		{"unknown method", badMethod.sign()},
+		{"wrong prefix", "st2." + parts[1] + "." + parts[2]},
+		{"missing signature", parts[0] + "." + parts[1]},
+		{"bad base64", parts[0] + ".!!." + parts[2]},
+		{"site zero", resign(claims.payload() + ".0")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseSiteToken(tt.token); !errors.Is(err, errInvalidSiteToken) {
+				t.Fatalf("err = %v, want errInvalidSiteToken", err)
+			}
+		})
+	}
+
+	t.Setenv("SITE_TOKEN_SECRET", "rotated-secret")
+	if _, err := parseSiteToken(token); !errors.Is(err, errInvalidSiteToken) {
+		t.Errorf("token signed with the old secret should be rejected, got %v", err)
+	}
+}
+
+func TestSiteTokenFollowsPlacementOnTheLocalDay(t *testing.T) {
+	t.Setenv("SITE_TOKEN_SECRET", "site-token-test-secret")
+	db := placementChangeDB(t)
+	nbf := time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)
+	oldSite := siteTokenClaims{EmployerID: 1, SiteID: 10, KeyID: 4, Method: verifyQR, NotBefore: nbf, ExpiresAt: nbf.Add(48 * time.Hour)}
+	newSite := siteTokenClaims{EmployerID: 2, SiteID: 20, KeyID: 5, Method: verifyNFC, NotBefore: nbf, ExpiresAt: nbf.Add(48 * time.Hour)}
+
+	// 18:00 UTC is 23:30 in Colombo, still the last day at the old site;
+	// 19:00 UTC is 00:30 on the first day at the new one
+	lastDay := time.Date(2024, 2, 29, 18, 0, 0, 0, time.UTC)
+	firstDay := time.Date(2024, 2, 29, 19, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		claims siteTokenClaims
+		at     time.Time
+		valid  bool
+	}{
+		{"old site on the last day", oldSite, lastDay, true},
+		{"new site on the last day", newSite, lastDay, false},
+		{"new site on the first day", newSite, firstDay, true},
+		{"old site on the first day", oldSite, firstDay, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, err := verifySiteToken(db, 7, tt.claims.sign(), tt.at, orgLocation)
+			switch {
+			case tt.valid && err != nil:
+				t.Fatalf("err = %v, want the token accepted", err)
+			case tt.valid && method != tt.claims.Method:
+				t.Errorf("method = %q, want %q", method, tt.claims.Method)
+			case !tt.valid && !errors.Is(err, errInvalidSiteToken):
+				t.Errorf("err = %v, want errInvalidSiteToken", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on a site's geofence polygon
+const (
+	minPolygonPoints = 3
+	maxPolygonPoints = 100
+)
+
+// errSiteNotAtEmployer is returned when a trainee is placed at a site of
+// another employer
+var errSiteNotAtEmployer = errors.New("site_id must be a site of the trainee's employer")
+
+// workplace is where a trainee is expected to work: their site when they are
+// placed at one, otherwise their employer's head office
+type workplace struct {
+	SiteID   *int
+	Position *LatLng
+	// RadiusM is nil when neither the site nor the employer sets one
+	RadiusM *int
+	Polygon []models.GeoPoint
+	Policy  *string
+}
+
+// loadWorkplace returns the trainee's workplace on day, a local date, from
+// the placement they were on then. found is false when the trainee has no
+// employer.
+func loadWorkplace(q queryRower, studentID int, day string) (workplace, bool, error) {
+	var wp workplace
+	var siteID, siteRadius, empRadius sql.NullInt64
+	var siteLat, siteLong, empLat, empLong sql.NullFloat64
+	var polygon []byte
+	var policy sql.NullString
+	err := q.QueryRow(
+		`SELECT st.id, st.addr_lat, st.addr_long, st.geofence_radius_m, st.geofence_polygon,
+			e.addr_lat, e.addr_long, e.geofence_radius_m, e.geofence_policy
+		FROM student s
+		`+placementAsOf("s.id", "$2::date")+`
+		JOIN employer e ON e.id = `+placementEmployer+`
+		LEFT JOIN employer_sites st ON st.id = `+placementSite+` AND st.employer_id = e.id
+		WHERE s.id = $1`, studentID, day,
+	).Scan(&siteID, &siteLat, &siteLong, &siteRadius, &polygon, &empLat, &empLong, &empRadius, &policy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return wp, false, nil
+	} else if err != nil {
+		return wp, false, fmt.Errorf("load workplace: %w", err)
+	}
+	if policy.Valid {
+		wp.Policy = &policy.String
+	}
+	if empRadius.Valid {
+		r := int(empRadius.Int64)
+		wp.RadiusM = &r
+	}
+	lat, long := empLat, empLong
+	if siteID.Valid {
+		id := int(siteID.Int64)
+		wp.SiteID = &id
+		lat, long = siteLat, siteLong
+		if siteRadius.Valid {
+			r := int(siteRadius.Int64)
+			wp.RadiusM = &r
+		}
+		if len(polygon) > 0 {
+			if err := json.Unmarshal(polygon, &wp.Polygon); err != nil {
+				return wp, false, fmt.Errorf("site %d polygon: %w", id, err)
+			}
+		}
+	}
+	if lat.Valid && long.Valid && hasPosition(&lat.Float64, &long.Float64) {
+		wp.Position = &LatLng{Lat: lat.Float64, Lng: long.Float64}
+	}
+	return wp, true, nil
+}
+
+// insidePolygon reports whether a point lies inside the polygon, by ray
+// casting. Sites are small enough to treat latitude and longitude as flat.
+func insidePolygon(lat, long float64, polygon []models.GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > lat) != (b.Lat > lat) && long < (b.Long-a.Long)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Long {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// polygonDistance is how far a point is from the nearest edge of the
+// polygon, in metres
+func polygonDistance(lat, long float64, polygon []models.GeoPoint) int {
+	// Project onto a flat plane in metres around the point
+	const metresPerDegree = 111320.0
+	scale := math.Cos(lat * math.Pi / 180)
+	project := func(p models.GeoPoint) (float64, float64) {
+		return (p.Long - long) * metresPerDegree * scale, (p.Lat - lat) * metresPerDegree
+	}
+	best := math.Inf(1)
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		ax, ay := project(polygon[j])
+		bx, by := project(polygon[i])
+		dx, dy := bx-ax, by-ay
+		t := 0.0
+		if l := dx*dx + dy*dy; l > 0 {
+			t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/l))
+		}
+		best = math.Min(best, math.Hypot(ax+t*dx, ay+t*dy))
+	}
+	return int(best)
+}
+
+// polygonCentre is the average of the polygon's corners, used as the site's
+// position when none is given
+func polygonCentre(polygon []models.GeoPoint) (float64, float64) {
+	var lat, long float64
+	for _, p := range polygon {
+		lat += p.Lat
+		long += p.Long
+	}
+	return lat / float64(len(polygon)), long / float64(len(polygon))
+}
+
+// validateSite checks a site before it is saved and fills in its position
+// from the polygon when only the polygon is given
+func validateSite(s *models.EmployerSite) error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		return errors.New("name is required")
+	}
+	if s.GeofenceRadiusM != nil && (*s.GeofenceRadiusM <= 0 || *s.GeofenceRadiusM > 50000) {
+		return errors.New("geofence_radius_m must be between 1 and 50000")
+	}
+	if len(s.GeofencePolygon) > 0 {
+		if len(s.GeofencePolygon) < minPolygonPoints || len(s.GeofencePolygon) > maxPolygonPoints {
+			return errors.New("geofence_polygon must have between 3 and 100 points")
+		}
+		for _, p := range s.GeofencePolygon {
+			if math.Abs(p.Lat) > 90 || math.Abs(p.Long) > 180 {
+				return errors.New("geofence_polygon has a point that is not a valid position")
+			}
+		}
+		if s.Latitude == 0 && s.Longitude == 0 {
+			s.Latitude, s.Longitude = polygonCentre(s.GeofencePolygon)
+		}
+	}
+	if !hasPosition(&s.Latitude, &s.Longitude) || math.Abs(s.Latitude) > 90 || math.Abs(s.Longitude) > 180 {
+		return errors.New("addr_lat and addr_long must be a valid position")
+	}
+	return nil
+}
+
+// validateStudentSite checks a trainee's site belongs to their employer
+func validateStudentSite(siteID, employerID *uint) error {
+	if siteID == nil {
+		return nil
+	}
+	if employerID == nil {
+		return errSiteNotAtEmployer
+	}
+	var ok bool
+	err := database.DB.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM employer_sites WHERE id = $1 AND employer_id = $2)`, *siteID, *employerID,
+	).Scan(&ok)
+	if err != nil {
+		return fmt.Errorf("check site: %w", err)
+	}
+	if !ok {
+		return errSiteNotAtEmployer
+	}
+	return nil
+}
+
+const siteColumns = `st.id, st.employer_id, st.name, st.address_line1, st.address_line2, st.city, st.addr_lat, st.addr_long,
+	st.geofence_radius_m, st.geofence_polygon, st.contact_name, st.contact_number, st.contact_email,
+	(SELECT COUNT(*) FROM student s WHERE s.site_id = st.id)`
+
+func scanSite(row interface{ Scan(...interface{}) error }, s *models.EmployerSite) error {
+	var polygon []byte
+	err := row.Scan(&s.ID, &s.EmployerID, &s.Name, &s.AddressLine1, &s.AddressLine2, &s.City, &s.Latitude, &s.Longitude,
+		&s.GeofenceRadiusM, &polygon, &s.ContactName, &s.ContactNumber, &s.ContactEmail, &s.Trainees)
+	if err != nil {
+		return err
+	}
+	if len(polygon) > 0 {
+		return json.Unmarshal(polygon, &s.GeofencePolygon)
+	}
+	return nil
+}
+
+// polygonParam is the value stored for a site's polygon, NULL when it has none
+func polygonParam(polygon []models.GeoPoint) (interface{}, error) {
+	if len(polygon) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(polygon)
+	return string(b), err
+}
+
+// GetEmployerSites lists an employer's sites (?employer_id=), or every site
+// the caller can see. Employer contacts only see their own.
+func GetEmployerSites(w http.ResponseWriter, r *http.Request) {
+	employerID := 0
+	if v := r.URL.Query().Get("employer_id"); v != "" {
+		var err error
+		if employerID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, "Invalid employer_id", http.StatusBadRequest)
+			return
+		}
+	}
+	if p := principalFromContext(r.Context()); p.Role == roleEmployer {
+		if p.EmployerID == nil {
+			employerID = -1
+		} else {
+			employerID = *p.EmployerID
+		}
+	}
+
+	rows, err := database.DB.Query(
+		`SELECT `+siteColumns+` FROM employer_sites st WHERE ($1 = 0 OR st.employer_id = $1) ORDER BY st.employer_id, st.name`, employerID,
+	)
+	if err != nil {
+		log.Printf("Error loading sites: %v", err)
+		http.Error(w, "Failed to load sites", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	sites := []models.EmployerSite{}
+	for rows.Next() {
+		var s models.EmployerSite
+		if err := scanSite(rows, &s); err != nil {
+			log.Printf("Error loading sites: %v", err)
+			http.Error(w, "Failed to load sites", http.StatusInternalServerError)
+			return
+		}
+		sites = append(sites, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sites)
+}
+
+// CreateEmployerSite adds a site to an employer
+func CreateEmployerSite(w http.ResponseWriter, r *http.Request) {
+	var s models.EmployerSite
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateSite(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !employerAllowed(principalFromContext(r.Context()), s.EmployerID) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return
+	}
+	polygon, err := polygonParam(s.GeofencePolygon)
+	if err != nil {
+		http.Error(w, "Invalid geofence_polygon", http.StatusBadRequest)
+		return
+	}
+
+	err = database.DB.QueryRow(
+		`INSERT INTO employer_sites (employer_id, name, address_line1, address_line2, city, addr_lat, addr_long,
+			geofence_radius_m, geofence_polygon, contact_name, contact_number, contact_email)
+		SELECT id, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12 FROM employer WHERE id = $1
+		RETURNING id`,
+		s.EmployerID, s.Name, s.AddressLine1, s.AddressLine2, s.City, s.Latitude, s.Longitude,
+		s.GeofenceRadiusM, polygon, s.ContactName, s.ContactNumber, s.ContactEmail,
+	).Scan(&s.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Employer not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error creating site for employer %d: %v", s.EmployerID, err)
+		http.Error(w, "Failed to create site", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// loadSiteEmployer returns the employer a site belongs to, writing a 404 when
+// the site does not exist or the caller cannot manage it
+func loadSiteEmployer(w http.ResponseWriter, r *http.Request, id int) (int, bool) {
+	var employerID int
+	err := database.DB.QueryRow(`SELECT employer_id FROM employer_sites WHERE id = $1`, id).Scan(&employerID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !employerAllowed(principalFromContext(r.Context()), employerID)) {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return 0, false
+	} else if err != nil {
+		http.Error(w, "Failed to load site", http.StatusInternalServerError)
+		return 0, false
+	}
+	return employerID, true
+}
+
+// UpdateEmployerSite replaces a site's details. A site cannot move to
+// another employer.
+func UpdateEmployerSite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid site ID", http.StatusBadRequest)
+		return
+	}
+	employerID, ok := loadSiteEmployer(w, r, id)
+	if !ok {
+		return
+	}
+	var s models.EmployerSite
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if err := validateSite(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	polygon, err := polygonParam(s.GeofencePolygon)
+	if err != nil {
+		http.Error(w, "Invalid geofence_polygon", http.StatusBadRequest)
+		return
+	}
+
+	err = scanSite(database.DB.QueryRow(
+		`UPDATE employer_sites st SET name = $1, address_line1 = $2, address_line2 = $3, city = $4, addr_lat = $5, addr_long = $6,
+			geofence_radius_m = $7, geofence_polygon = $8, contact_name = $9, contact_number = $10, contact_email = $11
+		WHERE id = $12 RETURNING `+siteColumns,
+		s.Name, s.AddressLine1, s.AddressLine2, s.City, s.Latitude, s.Longitude,
+		s.GeofenceRadiusM, polygon, s.ContactName, s.ContactNumber, s.ContactEmail, id,
+	), &s)
+	if err != nil {
+		log.Printf("Error updating site %d of employer %d: %v", id, employerID, err)
+		http.Error(w, "Failed to update site", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// DeleteEmployerSite removes a site nobody is or was placed at. Trainees have
+// to be moved to another site first, and sites in past placements are kept
+// for their history.
+func DeleteEmployerSite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid site ID", http.StatusBadRequest)
+		return
+	}
+	if _, ok := loadSiteEmployer(w, r, id); !ok {
+		return
+	}
+	res, err := database.DB.Exec(
+		`DELETE FROM employer_sites WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM student WHERE site_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM placements WHERE site_id = $1 AND status <> 'void')`, id,
+	)
+	if err != nil {
+		log.Printf("Error deleting site %d: %v", id, err)
+		http.Error(w, "Failed to delete site", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Trainees are or were placed at this site", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"server/models"
+)
+
+// A square of about 111 m a side near Colombo, and an L-shaped site
+var (
+	testSquare = []models.GeoPoint{{Lat: 6.900, Long: 79.850}, {Lat: 6.900, Long: 79.851}, {Lat: 6.901, Long: 79.851}, {Lat: 6.901, Long: 79.850}}
+	testL      = []models.GeoPoint{
+		{Lat: 6.900, Long: 79.850}, {Lat: 6.900, Long: 79.852}, {Lat: 6.901, Long: 79.852},
+		{Lat: 6.901, Long: 79.851}, {Lat: 6.902, Long: 79.851}, {Lat: 6.902, Long: 79.850},
+	}
+)
+
+func TestInsidePolygon(t *testing.T) {
+	tests := []struct {
+		name      string
+		lat, long float64
+		polygon   []models.GeoPoint
+		want      bool
+	}{
+		{"centre of square", 6.9005, 79.8505, testSquare, true},
+		{"north of square", 6.9020, 79.8505, testSquare, false},
+		{"east of square", 6.9005, 79.8520, testSquare, false},
+		{"in the foot of the L", 6.9005, 79.8515, testL, true},
+		{"in the stem of the L", 6.9015, 79.8505, testL, true},
+		{"in the notch of the L", 6.9015, 79.8515, testL, false},
+		{"no polygon", 6.9005, 79.8505, nil, false},
+	}
+	for _, tt := range tests {
+		if got := insidePolygon(tt.lat, tt.long, tt.polygon); got != tt.want {
+			t.Errorf("%s: insidePolygon = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolygonDistance(t *testing.T) {
+	tests := []struct {
+		name      string
+		lat, long float64
+		polygon   []models.GeoPoint
+		want      int
+	}{
+		// 0.001 degrees of latitude is about 111 m
+		{"north of square", 6.902, 79.8505, testSquare, 111},
+		{"centre of square", 6.9005, 79.8505, testSquare, 55},
+		{"on an edge", 6.900, 79.8505, testSquare, 0},
+		{"in the notch of the L", 6.9015, 79.8515, testL, 55},
+	}
+	for _, tt := range tests {
+		got := polygonDistance(tt.lat, tt.long, tt.polygon)
+		if got < tt.want-2 || got > tt.want+2 {
+			t.Errorf("%s: polygonDistance = %d, want about %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+// placementChangeDB is a trainee who moved on 2024-03-01 from site 10 of
+// employer 1, fenced by testSquare, to site 20 of employer 2 in Kandy
+func placementChangeDB(t *testing.T) *sql.DB {
+	polygon, err := json.Marshal(testSquare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+		var day string
+		if len(args) > 1 {
+			day, _ = args[1].(string)
+		}
+		moved := day >= "2024-03-01"
+		switch {
+		case strings.Contains(query, "timezone"):
+			return []string{"own", "employer"}, [][]driver.Value{{"", ""}}, nil
+		case strings.Contains(query, "site_token_keys"):
+			return []string{"revoked"}, [][]driver.Value{{false}}, nil
+		case !strings.Contains(query, "placements x"):
+			t.Fatalf("unexpected query %s", query)
+		case strings.Contains(query, "geofence_polygon") && moved:
+			return []string{"id", "lat", "long", "radius", "polygon", "e_lat", "e_long", "e_radius", "policy"},
+				[][]driver.Value{{int64(20), 7.2906, 80.6337, int64(100), nil, 7.29, 80.63, nil, nil}}, nil
+		case strings.Contains(query, "geofence_polygon"):
+			return []string{"id", "lat", "long", "radius", "polygon", "e_lat", "e_long", "e_radius", "policy"},
+				[][]driver.Value{{int64(10), 6.9005, 79.8505, nil, polygon, 6.95, 79.85, nil, nil}}, nil
+		case moved:
+			return []string{"employer_id", "site_id"}, [][]driver.Value{{int64(2), int64(20)}}, nil
+		}
+		return []string{"employer_id", "site_id"}, [][]driver.Value{{int64(1), int64(10)}}, nil
+	})
+}
+
+func TestGeofenceFollowsPlacementOnTheDay(t *testing.T) {
+	db := placementChangeDB(t)
+	lat, long := 6.9005, 79.8505
+
+	before, err := evaluateGeofence(db, 7, "2024-02-29", &lat, &long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Status != geofenceInside || !before.Polygon {
+		t.Errorf("last day at the old site: status %s polygon %v, want inside the polygon", before.Status, before.Polygon)
+	}
+
+	after, err := evaluateGeofence(db, 7, "2024-03-01", &lat, &long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Status != geofenceOutside || after.Polygon || after.RadiusMeters != 100 {
+		t.Errorf("first day at the new site: status %s polygon %v radius %d, want outside the 100 m radius",
+			after.Status, after.Polygon, after.RadiusMeters)
+	}
+}
@@ -0,0 +1,216 @@
+package controllers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"server/database"
+	"server/models"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// validateStaffInput checks the role and the supervisor/employer link that
+// goes with it
+func validateStaffInput(in *models.StaffAccountInput) error {
+	in.Email = strings.TrimSpace(in.Email)
+	if _, err := mail.ParseAddress(in.Email); err != nil {
+		return errors.New("a valid email is required")
+	}
+	switch in.Role {
+	case roleAdmin:
+		in.SupervisorID, in.EmployerID = nil, nil
+	case roleSupervisor:
+		if in.SupervisorID == nil {
+			return errors.New("supervisor accounts require supervisor_id")
+		}
+		in.EmployerID = nil
+	case roleEmployer:
+		if in.EmployerID == nil {
+			return errors.New("employer accounts require employer_id")
+		}
+		in.SupervisorID = nil
+	default:
+		return fmt.Errorf("role must be one of %s, %s, %s", roleAdmin, roleSupervisor, roleEmployer)
+	}
+	if in.Password != "" && len(in.Password) < minPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint error
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// GetStaffAccounts lists every staff account
+func GetStaffAccounts(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`SELECT ` + staffAccountColumns + ` FROM staff_accounts ORDER BY id`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	accounts := []models.StaffAccount{}
+	for rows.Next() {
+		a, err := scanStaffAccount(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		accounts = append(accounts, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accounts)
+}
+
+// CreateStaffAccount creates a staff account. The password is optional;
+// accounts without one log in with emailed codes.
+func CreateStaffAccount(w http.ResponseWriter, r *http.Request) {
+	var in models.StaffAccountInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateStaffInput(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash sql.NullString
+	if in.Password != "" {
+		hash, err := hashPassword(in.Password)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		passwordHash = sql.NullString{String: hash, Valid: true}
+	}
+
+	a, err := scanStaffAccount(database.DB.QueryRow(
+		`INSERT INTO staff_accounts (email, display_name, password_hash, role, supervisor_id, employer_id)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING `+staffAccountColumns,
+		in.Email, in.DisplayName, passwordHash, in.Role, in.SupervisorID, in.EmployerID,
+	))
+	if isUniqueViolation(err) {
+		http.Error(w, "An account with this email already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error creating staff account: %v", err)
+		http.Error(w, "Failed to create staff account", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+// UpdateStaffAccount updates a staff account's details, role and status
+func UpdateStaffAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	var in models.StaffAccountInput
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateStaffInput(&in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p := principalFromContext(r.Context()); p.StaffID == id && (in.Role != roleAdmin || (in.IsActive != nil && !*in.IsActive)) {
+		http.Error(w, "You cannot remove your own admin access", http.StatusBadRequest)
+		return
+	}
+
+	var passwordHash sql.NullString
+	if in.Password != "" {
+		hash, err := hashPassword(in.Password)
+		if err != nil {
+			http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+			return
+		}
+		passwordHash = sql.NullString{String: hash, Valid: true}
+	}
+
+	a, err := scanStaffAccount(database.DB.QueryRow(
+		`UPDATE staff_accounts SET email = $1, display_name = $2, role = $3, supervisor_id = $4, employer_id = $5,
+			is_active = COALESCE($6, is_active), password_hash = COALESCE($7, password_hash)
+		WHERE id = $8 RETURNING `+staffAccountColumns,
+		in.Email, in.DisplayName, in.Role, in.SupervisorID, in.EmployerID, in.IsActive, passwordHash, id,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Staff account not found", http.StatusNotFound)
+		return
+	} else if isUniqueViolation(err) {
+		http.Error(w, "An account with this email already exists", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error updating staff account %d: %v", id, err)
+		http.Error(w, "Failed to update staff account", http.StatusInternalServerError)
+		return
+	}
+	if !a.IsActive {
+		if err := revokeSubjectSessions(database.DB, staffSubject(a.ID)); err != nil {
+			log.Printf("Error revoking sessions for staff %d: %v", a.ID, err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+// DeactivateStaffAccount disables a staff account and ends its sessions.
+// Accounts are kept so that audit records still resolve.
+func DeactivateStaffAccount(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	if principalFromContext(r.Context()).StaffID == id {
+		http.Error(w, "You cannot deactivate your own account", http.StatusBadRequest)
+		return
+	}
+	res, err := database.DB.Exec(`UPDATE staff_accounts SET is_active = FALSE WHERE id = $1`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Staff account not found", http.StatusNotFound)
+		return
+	}
+	if err := revokeSubjectSessions(database.DB, staffSubject(id)); err != nil {
+		log.Printf("Error revoking sessions for staff %d: %v", id, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCurrentStaff returns the caller's own staff account
+func GetCurrentStaff(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	if !p.IsStaff() {
+		http.Error(w, "Staff session required", http.StatusForbidden)
+		return
+	}
+	a, err := scanStaffAccount(database.DB.QueryRow(`SELECT `+staffAccountColumns+` FROM staff_accounts WHERE id = $1`, p.StaffID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,363 @@
+package controllers
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+const (
+	passwordIterations   = 600000
+	minPasswordLength    = 10
+	staffCodeDigits      = 6
+	staffCodeTTL         = 10 * time.Minute
+	staffCodeMaxAttempts = 5
+)
+
+// hashPassword derives a PBKDF2-SHA256 hash encoded as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword verifies a password against a hash made by hashPassword
+func checkPassword(encoded, password string) bool {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// dummyPasswordHash is checked when a login names no usable account, so the
+// response takes as long as a wrong password would and does not give away
+// which emails exist
+var dummyPasswordHash = fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+	base64.RawStdEncoding.EncodeToString(make([]byte, 16)), base64.RawStdEncoding.EncodeToString(make([]byte, 32)))
+
+// staffThrottled answers the request when a staff login limit check failed
+// and reports whether it did
+func staffThrottled(w http.ResponseWriter, err error, message string) bool {
+	var locked *otpLockedError
+	if errors.As(err, &locked) {
+		w.Header().Set("Retry-After", retryAfterSeconds(locked.retryAfter))
+		http.Error(w, message, http.StatusTooManyRequests)
+		return true
+	} else if err != nil {
+		log.Printf("Error checking staff login limits: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
+const staffAccountColumns = `id, email, display_name, role, supervisor_id, employer_id, is_active, last_login_at, created_at`
+
+func scanStaffAccount(row interface{ Scan(...interface{}) error }) (models.StaffAccount, error) {
+	var a models.StaffAccount
+	err := row.Scan(&a.ID, &a.Email, &a.DisplayName, &a.Role, &a.SupervisorID, &a.EmployerID, &a.IsActive, &a.LastLoginAt, &a.CreatedAt)
+	return a, err
+}
+
+// startStaffSession records the login and issues a session for the account
+func startStaffSession(w http.ResponseWriter, account models.StaffAccount) {
+	if _, err := database.DB.Exec(`UPDATE staff_accounts SET last_login_at = NOW() WHERE id = $1`, account.ID); err != nil {
+		log.Printf("Error recording login for staff %d: %v", account.ID, err)
+	}
+	tokens, _, err := issueSession(database.DB, staffSubject(account.ID), 0)
+	if err != nil {
+		log.Printf("Error issuing session for staff %d: %v", account.ID, err)
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.StaffLoginResponse{Staff: account, SessionTokens: tokens})
+}
+
+// StaffLogin authenticates a staff member with email and password. Failed
+// attempts are throttled per address and per email.
+func StaffLogin(w http.ResponseWriter, r *http.Request) {
+	var req models.StaffLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	email, ip := strings.ToLower(strings.TrimSpace(req.Email)), staffLogins.clientIP(r)
+	if staffThrottled(w, staffLogins.checkStaffLockout(database.DB, ip, email), "Too many failed attempts, try again later") {
+		return
+	}
+
+	var passwordHash sql.NullString
+	row := database.DB.QueryRow(
+		`SELECT `+staffAccountColumns+`, password_hash FROM staff_accounts WHERE LOWER(email) = $1`, email,
+	)
+	var a models.StaffAccount
+	err := row.Scan(&a.ID, &a.Email, &a.DisplayName, &a.Role, &a.SupervisorID, &a.EmployerID, &a.IsActive, &a.LastLoginAt, &a.CreatedAt, &passwordHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Error loading staff account: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	usable := err == nil && a.IsActive && passwordHash.Valid
+	if !usable {
+		passwordHash.String = dummyPasswordHash
+	}
+	if !checkPassword(passwordHash.String, req.Password) || !usable {
+		recordStaffAttempt(database.DB, ip, email, staffAttemptPassword, false)
+		unauthorized(w, "Invalid email or password")
+		return
+	}
+	recordStaffAttempt(database.DB, ip, email, staffAttemptPassword, true)
+	startStaffSession(w, a)
+}
+
+// RequestStaffLoginCode emails a one-time login code. The response is the
+// same whether or not the address belongs to an account. Requests are
+// limited per email and per address, and refused while logins are locked.
+func RequestStaffLoginCode(w http.ResponseWriter, r *http.Request) {
+	var req models.StaffCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	email, ip := strings.ToLower(strings.TrimSpace(req.Email)), staffLogins.clientIP(r)
+	if staffThrottled(w, staffLogins.checkStaffLockout(database.DB, ip, email), "Too many failed attempts, try again later") ||
+		staffThrottled(w, staffLogins.checkStaffCodeRequests(database.DB, ip, email), "Too many login codes requested, try again later") {
+		return
+	}
+	recordStaffAttempt(database.DB, ip, email, staffAttemptRequest, true)
+
+	a, err := scanStaffAccount(database.DB.QueryRow(
+		`SELECT `+staffAccountColumns+` FROM staff_accounts WHERE LOWER(email) = $1 AND is_active`, email,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	} else if err != nil {
+		log.Printf("Error loading staff account: %v", err)
+		http.Error(w, "Failed to send login code", http.StatusInternalServerError)
+		return
+	}
+
+	code, err := randomDigits(staffCodeDigits)
+	if err != nil {
+		http.Error(w, "Failed to generate login code", http.StatusInternalServerError)
+		return
+	}
+	if _, err := database.DB.Exec(`UPDATE staff_login_codes SET used_at = NOW() WHERE staff_id = $1 AND used_at IS NULL`, a.ID); err != nil {
+		log.Printf("Error invalidating login codes for staff %d: %v", a.ID, err)
+		http.Error(w, "Failed to send login code", http.StatusInternalServerError)
+		return
+	}
+	if _, err := database.DB.Exec(
+		`INSERT INTO staff_login_codes (staff_id, code_hash, expires_at) VALUES ($1, $2, $3)`,
+		a.ID, hashToken(code), time.Now().Add(staffCodeTTL),
+	); err != nil {
+		log.Printf("Error storing login code for staff %d: %v", a.ID, err)
+		http.Error(w, "Failed to send login code", http.StatusInternalServerError)
+		return
+	}
+
+	err = sendMessage(r.Context(), channelEmail, OutboundMessage{
+		To:      a.Email,
+		Subject: "Your login code",
+		Body:    fmt.Sprintf("Your login code is %s. It expires in %d minutes.", code, int(staffCodeTTL.Minutes())),
+	})
+	if errors.Is(err, errChannelNotConfigured) {
+		http.Error(w, "Email login is not available", http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		log.Printf("Error emailing login code to staff %d: %v", a.ID, err)
+		http.Error(w, "Failed to send login code", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// StaffCodeLogin completes a login with an emailed code. Failed attempts
+// count towards the same lockout as passwords.
+func StaffCodeLogin(w http.ResponseWriter, r *http.Request) {
+	var req models.StaffCodeLoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	email, ip := strings.ToLower(strings.TrimSpace(req.Email)), staffLogins.clientIP(r)
+	if staffThrottled(w, staffLogins.checkStaffLockout(database.DB, ip, email), "Too many failed attempts, try again later") {
+		return
+	}
+	rejected := func() {
+		recordStaffAttempt(database.DB, ip, email, staffAttemptCode, false)
+		unauthorized(w, "Invalid or expired code")
+	}
+
+	a, err := scanStaffAccount(database.DB.QueryRow(
+		`SELECT `+staffAccountColumns+` FROM staff_accounts WHERE LOWER(email) = $1 AND is_active`, email,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		rejected()
+		return
+	} else if err != nil {
+		log.Printf("Error loading staff account: %v", err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		codeID    int
+		codeHash  string
+		attempts  int
+		expiresAt time.Time
+	)
+	err = database.DB.QueryRow(
+		`SELECT id, code_hash, attempts, expires_at FROM staff_login_codes
+		WHERE staff_id = $1 AND used_at IS NULL ORDER BY created_at DESC LIMIT 1`, a.ID,
+	).Scan(&codeID, &codeHash, &attempts, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		rejected()
+		return
+	} else if err != nil {
+		log.Printf("Error loading login code for staff %d: %v", a.ID, err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+
+	if time.Now().After(expiresAt) || attempts >= staffCodeMaxAttempts {
+		database.DB.Exec(`UPDATE staff_login_codes SET used_at = NOW() WHERE id = $1`, codeID)
+		rejected()
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(strings.TrimSpace(req.Code))), []byte(codeHash)) != 1 {
+		database.DB.Exec(`UPDATE staff_login_codes SET attempts = attempts + 1 WHERE id = $1`, codeID)
+		rejected()
+		return
+	}
+
+	res, err := database.DB.Exec(`UPDATE staff_login_codes SET used_at = NOW() WHERE id = $1 AND used_at IS NULL`, codeID)
+	if err != nil {
+		log.Printf("Error redeeming login code %d: %v", codeID, err)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		rejected()
+		return
+	}
+	recordStaffAttempt(database.DB, ip, email, staffAttemptCode, true)
+	startStaffSession(w, a)
+}
+
+// ChangeStaffPassword lets a staff member change their own password
+func ChangeStaffPassword(w http.ResponseWriter, r *http.Request) {
+	p := principalFromContext(r.Context())
+	if !p.IsStaff() {
+		http.Error(w, "Staff session required", http.StatusForbidden)
+		return
+	}
+	var req models.PasswordChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(req.NewPassword) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must be at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	var current sql.NullString
+	if err := database.DB.QueryRow(`SELECT password_hash FROM staff_accounts WHERE id = $1`, p.StaffID).Scan(&current); err != nil {
+		log.Printf("Error loading password for staff %d: %v", p.StaffID, err)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	// Accounts that only ever used email codes have no password to confirm
+	if current.Valid && !checkPassword(current.String, req.CurrentPassword) {
+		unauthorized(w, "Current password is incorrect")
+		return
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := database.DB.Exec(`UPDATE staff_accounts SET password_hash = $1 WHERE id = $2`, hash, p.StaffID); err != nil {
+		log.Printf("Error updating password for staff %d: %v", p.StaffID, err)
+		http.Error(w, "Failed to change password", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// EnsureBootstrapAdmin creates the first admin account from STAFF_ADMIN_EMAIL
+// and STAFF_ADMIN_PASSWORD when no admin exists yet
+func EnsureBootstrapAdmin() {
+	email := strings.TrimSpace(os.Getenv("STAFF_ADMIN_EMAIL"))
+	password := os.Getenv("STAFF_ADMIN_PASSWORD")
+	if email == "" || password == "" {
+		return
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow(`SELECT EXISTS (SELECT 1 FROM staff_accounts WHERE role = 'admin')`).Scan(&exists); err != nil {
+		log.Printf("⚠️ Could not check for admin accounts: %v", err)
+		return
+	}
+	if exists {
+		return
+	}
+
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("⚠️ Could not hash bootstrap admin password: %v", err)
+		return
+	}
+	if _, err := database.DB.Exec(
+		`INSERT INTO staff_accounts (email, display_name, password_hash, role) VALUES ($1, 'Administrator', $2, 'admin')`,
+		email, hash,
+	); err != nil {
+		log.Printf("⚠️ Could not create bootstrap admin: %v", err)
+		return
+	}
+	log.Printf("✅ Created bootstrap admin account %s", email)
+}
@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"server/database"
@@ -9,16 +10,22 @@ import (
 	"strconv"
 )
 
-func getStudentIDFromHeader(r *http.Request) (int, error) {
-	StudentIDHeader := r.Header.Get("student-id")
-	if StudentIDHeader == "" {
-		return 0, http.ErrMissingFile
-	}
-	studentID, err := strconv.Atoi(StudentIDHeader)
-	if err != nil {
-		return 0, err
+const studentColumns = `id, first_name, last_name, dob, gender, address_line1, address_line2, city, contact_number, contact_number_guardian,
+	supervisor_id, remarks, home_long, home_lat, employer_id, site_id, check_in_time, check_out_time, timezone, ` + geocodingColumns
+
+func scanStudent(row interface{ Scan(...interface{}) error }, s *models.Student) error {
+	dest := []interface{}{&s.ID, &s.FirstName, &s.LastName, &s.DOB, &s.Gender, &s.AddressLine1, &s.AddressLine2, &s.City, &s.ContactNumber, &s.ContactNumberGuardian,
+		&s.SupervisorID, &s.Remarks, &s.HomeLong, &s.HomeLat, &s.EmployerID, &s.SiteID, &s.CheckInTime, &s.CheckOutTime, &s.Timezone}
+	if err := row.Scan(append(dest, geocodingDest(&s.Geocoding)...)...); err != nil {
+		return err
 	}
-	return studentID, nil
+	markReview(&s.Geocoding)
+	return nil
+}
+
+// studentAddress is a trainee's home address as sent to the geocoder
+func studentAddress(s *models.Student) string {
+	return joinAddress(s.AddressLine1, s.AddressLine2, s.City)
 }
 
 // GetStudents godoc
@@ -31,7 +38,8 @@ func getStudentIDFromHeader(r *http.Request) (int, error) {
 // @Router /students [get]
 func GetStudents(w http.ResponseWriter, r *http.Request) {
 	var students []models.Student
-	rows, err := database.DB.Query("SELECT id, first_name, last_name, dob, gender, address_line1, address_line2, city, contact_number, contact_number_guardian, supervisor_id, remarks, home_long, home_lat, employer_id, check_in_time, check_out_time FROM student")
+	scope, args := studentScope(principalFromContext(r.Context()), "student", nil)
+	rows, err := database.DB.Query("SELECT "+studentColumns+" FROM student WHERE "+scope, args...)
 	if err != nil {
 		log.Printf("Error fetching students: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -40,7 +48,7 @@ func GetStudents(w http.ResponseWriter, r *http.Request) {
 	defer rows.Close()
 	for rows.Next() {
 		var s models.Student
-		if err := rows.Scan(&s.ID, &s.FirstName, &s.LastName, &s.DOB, &s.Gender, &s.AddressLine1, &s.AddressLine2, &s.City, &s.ContactNumber, &s.ContactNumberGuardian, &s.SupervisorID, &s.Remarks, &s.HomeLong, &s.HomeLat, &s.EmployerID, &s.CheckInTime, &s.CheckOutTime); err != nil {
+		if err := scanStudent(rows, &s); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -56,20 +64,20 @@ func GetStudents(w http.ResponseWriter, r *http.Request) {
 // @Description Get a student by ID
 // @Tags students
 // @Produce json
-// @Param student-id header string true "Student ID"
+// @Param Authorization header string true "Bearer access token"
+// @Param student-id header string false "Student ID (staff only)"
 // @Success 200 {object} models.Student
-// @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
 // @Failure 404 {string} string "Not Found"
 // @Router /get-student [get]
 func GetStudent(w http.ResponseWriter, r *http.Request) {
-	studentID, err := getStudentIDFromHeader(r)
+	studentID, err := resolveStudentID(r)
 	if err != nil {
-		log.Printf("Error extracting student-id: %v", err)
-		http.Error(w, "Invalid or missing student-id header", http.StatusBadRequest)
+		writeResolveError(w, err)
 		return
 	}
 	var s models.Student
-	err = database.DB.QueryRow("SELECT id, first_name, last_name, dob, gender, address_line1, address_line2, city, contact_number, contact_number_guardian, supervisor_id, remarks, home_long, home_lat, employer_id, check_in_time, check_out_time FROM student WHERE id = $1", studentID).Scan(&s.ID, &s.FirstName, &s.LastName, &s.DOB, &s.Gender, &s.AddressLine1, &s.AddressLine2, &s.City, &s.ContactNumber, &s.ContactNumberGuardian, &s.SupervisorID, &s.Remarks, &s.HomeLong, &s.HomeLat, &s.EmployerID, &s.CheckInTime, &s.CheckOutTime)
+	err = scanStudent(database.DB.QueryRow("SELECT "+studentColumns+" FROM student WHERE id = $1", studentID), &s)
 	if err != nil {
 		log.Printf("Error fetching student with ID %d: %v", studentID, err)
 		http.Error(w, err.Error(), http.StatusNotFound)
@@ -97,9 +105,48 @@ func CreateStudent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `INSERT INTO student (first_name, last_name, dob, gender, address_line1, address_line2, city, contact_number, contact_number_guardian, supervisor_id, remarks, home_long, home_lat, employer_id, check_in_time, check_out_time) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16) RETURNING id`
-	err := database.DB.QueryRow(query, s.FirstName, s.LastName, s.DOB, s.Gender, s.AddressLine1, s.AddressLine2, s.City, s.ContactNumber, s.ContactNumberGuardian, s.SupervisorID, s.Remarks, s.HomeLong, s.HomeLat, s.EmployerID, s.CheckInTime, s.CheckOutTime).Scan(&s.ID)
+	// Supervisors can only create trainees assigned to themselves
+	if p := principalFromContext(r.Context()); p.Role == roleSupervisor {
+		s.SupervisorID = supervisorIDOf(p)
+	}
+	tz, err := validateTimezone(s.Timezone)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Timezone = tz
+	if err := validateStudentEmployer(s.EmployerID); errors.Is(err, errEmployerUnavailable) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create student", http.StatusInternalServerError)
+		return
+	}
+	if err := validateStudentSite(s.SiteID, s.EmployerID); errors.Is(err, errSiteNotAtEmployer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to create student", http.StatusInternalServerError)
+		return
+	}
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, "Failed to create student", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	s.Geocoding = locateAddress(r.Context(), studentAddress(&s), &s.HomeLat, &s.HomeLong, nil)
+	query := `INSERT INTO student (first_name, last_name, dob, gender, address_line1, address_line2, city, contact_number, contact_number_guardian, supervisor_id, remarks, home_long, home_lat, employer_id, check_in_time, check_out_time, timezone, site_id, ` + geocodingColumns + `) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19,$20,$21,$22,$23,$24,$25,$26,$27) RETURNING id`
+	args := append([]interface{}{s.FirstName, s.LastName, s.DOB, s.Gender, s.AddressLine1, s.AddressLine2, s.City, s.ContactNumber, s.ContactNumberGuardian, s.SupervisorID, s.Remarks, s.HomeLong, s.HomeLat, s.EmployerID, s.CheckInTime, s.CheckOutTime, s.Timezone, s.SiteID}, geocodingArgs(&s.Geocoding)...)
+	err = tx.QueryRow(query, args...).Scan(&s.ID)
+	if err == nil {
+		err = placeFromStudentRecord(tx, int(s.ID), s.EmployerID, s.SiteID, s.SupervisorID, staffIDOf(r))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error creating student: %v", err)
 		http.Error(w, "Failed to create student", http.StatusInternalServerError)
 		return
 	}
@@ -132,17 +179,75 @@ func UpdateStudent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
 		return
 	}
+	p := principalFromContext(r.Context())
+	if ok, err := canAccessStudent(p, int(id)); err != nil {
+		http.Error(w, "Failed to update student", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	}
 	var input models.Student
 	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	query := `UPDATE student SET first_name=$1, last_name=$2, dob=$3, gender=$4, address_line1=$5, address_line2=$6, city=$7, contact_number=$8, contact_number_guardian=$9, supervisor_id=$10, remarks=$11, home_long=$12, home_lat=$13, employer_id=$14, check_in_time=$15, check_out_time=$16 WHERE id=$17`
-	_, err = database.DB.Exec(query, input.FirstName, input.LastName, input.DOB, input.Gender, input.AddressLine1, input.AddressLine2, input.City, input.ContactNumber, input.ContactNumberGuardian, input.SupervisorID, input.Remarks, input.HomeLong, input.HomeLat, input.EmployerID, input.CheckInTime, input.CheckOutTime, id)
+	if p.Role == roleSupervisor {
+		input.SupervisorID = supervisorIDOf(p)
+	}
+	if input.Timezone, err = validateTimezone(input.Timezone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateStudentEmployer(input.EmployerID); errors.Is(err, errEmployerUnavailable) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update student", http.StatusInternalServerError)
+		return
+	}
+	if err := validateStudentSite(input.SiteID, input.EmployerID); errors.Is(err, errSiteNotAtEmployer) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Failed to update student", http.StatusInternalServerError)
+		return
+	}
+	var current models.Student
+	if err := scanStudent(database.DB.QueryRow("SELECT "+studentColumns+" FROM student WHERE id = $1", id), &current); err != nil {
+		log.Printf("Error loading student %d: %v", id, err)
+		http.Error(w, "Failed to update student", http.StatusInternalServerError)
+		return
+	}
+	input.Geocoding = locateAddress(r.Context(), studentAddress(&input), &input.HomeLat, &input.HomeLong, &storedLocation{
+		Address: studentAddress(&current), Lat: current.HomeLat, Long: current.HomeLong, Geocoding: current.Geocoding,
+	})
+	query := `UPDATE student SET first_name=$1, last_name=$2, dob=$3, gender=$4, address_line1=$5, address_line2=$6, city=$7, contact_number=$8, contact_number_guardian=$9, supervisor_id=$10, remarks=$11, home_long=$12, home_lat=$13, employer_id=$14, check_in_time=$15, check_out_time=$16, timezone=$17, site_id=$18,
+		geocode_lat=$19, geocode_long=$20, geocode_confidence=$21, geocode_provider=$22, geocoded_at=$23, location_source=$24, location_mismatch_m=$25, location_confirmed_by=$26, location_confirmed_at=$27 WHERE id=$28`
+	args := append([]interface{}{input.FirstName, input.LastName, input.DOB, input.Gender, input.AddressLine1, input.AddressLine2, input.City, input.ContactNumber, input.ContactNumberGuardian, input.SupervisorID, input.Remarks, input.HomeLong, input.HomeLat, input.EmployerID, input.CheckInTime, input.CheckOutTime, input.Timezone, input.SiteID}, geocodingArgs(&input.Geocoding)...)
+	tx, err := database.DB.Begin()
 	if err != nil {
 		http.Error(w, "Failed to update student", http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+	_, err = tx.Exec(query, append(args, id)...)
+	placementChanged := !sameUintPtr(input.EmployerID, current.EmployerID) || !sameUintPtr(input.SiteID, current.SiteID) ||
+		!sameUintPtr(input.SupervisorID, current.SupervisorID)
+	if err == nil && placementChanged {
+		err = placeFromStudentRecord(tx, int(id), input.EmployerID, input.SiteID, input.SupervisorID, staffIDOf(r))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if errors.Is(err, errPlacementScheduled) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Printf("Error updating student %d: %v", id, err)
+		http.Error(w, "Failed to update student", http.StatusInternalServerError)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"data": input})
 }
@@ -166,6 +271,13 @@ func DeleteStudent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
 		return
 	}
+	if ok, err := canAccessStudent(principalFromContext(r.Context()), int(id)); err != nil {
+		http.Error(w, "Failed to delete student", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	}
 	_, err = database.DB.Exec("DELETE FROM student WHERE id = $1", id)
 	if err != nil {
 		http.Error(w, "Failed to delete student", http.StatusInternalServerError)
@@ -174,3 +286,12 @@ func DeleteStudent(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{"data": "Student deleted successfully"})
 }
+
+// supervisorIDOf returns the supervisor row a supervisor account is linked to
+func supervisorIDOf(p *Principal) *uint {
+	if p.SupervisorID == nil {
+		return nil
+	}
+	id := uint(*p.SupervisorID)
+	return &id
+}
@@ -0,0 +1,430 @@
+package controllers
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"server/database"
+	"server/models"
+)
+
+const (
+	dayWorked   = "worked"
+	dayOpen     = "open"
+	dayAbsent   = "absent"
+	dayExcused  = "excused"
+	dayOff      = "day_off"
+	dayUpcoming = "upcoming"
+
+	monthLayout = "2006-01"
+)
+
+// errStudentNotFound is returned when a timesheet is asked for a trainee who
+// does not exist
+var errStudentNotFound = errors.New("student not found")
+
+// buildTimesheet works out a trainee's month (YYYY-MM) day by day in their
+// own timezone. Sessions belong to the day of their check-in, or of the
+// check-out for an orphan checkout. With onlyEmployer set, the sheet keeps
+// just the days the trainee was placed with that employer.
+func buildTimesheet(db *sql.DB, studentID int, month string, now time.Time, onlyEmployer *int) (*models.Timesheet, error) {
+	ts := &models.Timesheet{StudentID: studentID, Month: month, Days: []models.TimesheetDay{}}
+	err := db.QueryRow(`SELECT first_name, last_name FROM student WHERE id = $1`, studentID).Scan(&ts.FirstName, &ts.LastName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errStudentNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("load student: %w", err)
+	}
+
+	// The sheet is kept in the timezone of the month's latest placement
+	last, err := time.ParseInLocation(monthLayout, month, orgLocation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid month %q", month)
+	}
+	last = last.AddDate(0, 1, 0).Add(-time.Second)
+	if now.Before(last) {
+		last = now
+	}
+	loc, err := studentLocation(db, studentID, last)
+	if err != nil {
+		return nil, fmt.Errorf("load timezone: %w", err)
+	}
+	ts.Timezone = loc.String()
+	first, err := time.ParseInLocation(monthLayout, month, loc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid month %q", month)
+	}
+	next := first.AddDate(0, 1, 0)
+
+	// Each day belongs to the employer of the placement on that date; the
+	// timesheet as a whole to the latest one of the month
+	placements, err := monthPlacements(db, studentID, first, next)
+	if err != nil {
+		return nil, fmt.Errorf("load placements: %w", err)
+	}
+	for i := range placements {
+		if onlyEmployer == nil || placements[i].EmployerID == *onlyEmployer {
+			ts.EmployerID, ts.EmployerName = &placements[i].EmployerID, placements[i].EmployerName
+		}
+	}
+
+	// Sessions of the month grouped by local date
+	rows, err := db.Query(
+		`SELECT `+sessionColumns+` FROM attendance
+		WHERE student_id = $1 AND COALESCE(check_in_date_time, check_out_date_time) >= $2
+			AND COALESCE(check_in_date_time, check_out_date_time) < $3
+		ORDER BY COALESCE(check_in_date_time, check_out_date_time)`,
+		studentID, first.UTC(), next.UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("load sessions: %w", err)
+	}
+	sessions := map[string][]models.Attendance{}
+	for rows.Next() {
+		var s models.Attendance
+		if err := scanSession(rows, &s); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("scan session: %w", err)
+		}
+		at := s.CheckOutDateTime.Time
+		if s.CheckInDateTime != nil {
+			at = *s.CheckInDateTime
+		}
+		date := localDate(at, loc)
+		sessions[date] = append(sessions[date], s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for d := first; d.Before(next); d = d.AddDate(0, 0, 1) {
+		// Noon keeps the date stable across DST changes
+		noon := d.Add(12 * time.Hour)
+		sched, err := resolveSchedule(db, studentID, noon, loc)
+		if err != nil {
+			return nil, err
+		}
+		day := models.TimesheetDay{Date: sched.Date, Excused: sched.Excused, ExcusedReason: sched.ExcusedReason}
+		for i := range placements {
+			if pl := &placements[i]; pl.StartDate <= day.Date && (pl.EndDate == nil || *pl.EndDate >= day.Date) {
+				day.EmployerID, day.EmployerName = &pl.EmployerID, pl.EmployerName
+			}
+		}
+		if onlyEmployer != nil && (day.EmployerID == nil || *day.EmployerID != *onlyEmployer) {
+			continue
+		}
+		if sched.Scheduled {
+			day.ScheduledMinutes = scheduledMinutes(sched)
+		}
+
+		for _, s := range sessions[sched.Date] {
+			day.Sessions++
+			day.BreakMinutes += s.BreakMinutes
+			if s.LateMinutes != nil {
+				day.LateMinutes += *s.LateMinutes
+			}
+			if s.EarlyLeaveMinutes != nil {
+				day.EarlyLeaveMinutes += *s.EarlyLeaveMinutes
+			}
+			if s.CheckInDateTime != nil && (day.CheckIn == nil || s.CheckInDateTime.Before(*day.CheckIn)) {
+				day.CheckIn = s.CheckInDateTime
+			}
+			if s.CheckOutDateTime.Valid && (day.CheckOut == nil || s.CheckOutDateTime.Time.After(*day.CheckOut)) {
+				t := s.CheckOutDateTime.Time
+				day.CheckOut = &t
+			}
+			day.PaidBreakMinutes += s.PaidBreakMinutes
+			if s.NetWorkedMinutes != nil {
+				day.WorkedMinutes += *s.NetWorkedMinutes
+			}
+		}
+
+		_, endOfDay := dayBounds(noon, loc)
+		switch {
+		case day.Sessions > 0 && day.CheckIn != nil && day.CheckOut == nil:
+			day.Status = dayOpen
+		case day.Sessions > 0:
+			day.Status = dayWorked
+		case sched.Excused != "":
+			day.Status = dayExcused
+		case !sched.Scheduled:
+			day.Status = dayOff
+		case !endOfDay.After(now):
+			day.Status = dayAbsent
+		default:
+			day.Status = dayUpcoming
+		}
+		addToTotals(&ts.Totals, day)
+		ts.Days = append(ts.Days, day)
+	}
+	return ts, nil
+}
+
+// scheduledMinutes is the working time of a resolved day, less planned breaks
+func scheduledMinutes(sched *models.DaySchedule) int {
+	total := 0
+	for _, sh := range sched.Shifts {
+		total += minutesAfter(sh.End, sh.Start)
+		for _, b := range sh.Breaks {
+			total -= minutesAfter(b.End, b.Start)
+		}
+	}
+	if total < 0 {
+		return 0
+	}
+	return total
+}
+
+func addToTotals(t *models.TimesheetTotals, day models.TimesheetDay) {
+	t.ScheduledMinutes += day.ScheduledMinutes
+	t.WorkedMinutes += day.WorkedMinutes
+	t.BreakMinutes += day.BreakMinutes
+	t.PaidBreakMinutes += day.PaidBreakMinutes
+	t.LateMinutes += day.LateMinutes
+	t.EarlyLeaveMinutes += day.EarlyLeaveMinutes
+	if day.LateMinutes > 0 {
+		t.LateDays++
+	}
+	switch day.Status {
+	case dayWorked, dayOpen:
+		t.DaysWorked++
+	case dayAbsent:
+		t.Absences++
+	}
+	if day.Excused != "" {
+		t.ExcusedDays++
+	}
+}
+
+// buildTimesheets builds the month for each trainee in turn
+func buildTimesheets(db *sql.DB, studentIDs []int, month string, onlyEmployer *int) ([]*models.Timesheet, error) {
+	now := time.Now()
+	sheets := make([]*models.Timesheet, 0, len(studentIDs))
+	for _, id := range studentIDs {
+		ts, err := buildTimesheet(db, id, month, now, onlyEmployer)
+		if err != nil {
+			return nil, fmt.Errorf("student %d: %w", id, err)
+		}
+		sheets = append(sheets, ts)
+	}
+	return sheets, nil
+}
+
+// monthPlacements lists a trainee's placements overlapping [first, next),
+// oldest first
+func monthPlacements(db *sql.DB, studentID int, first, next time.Time) ([]models.Placement, error) {
+	rows, err := db.Query(
+		`SELECT `+placementColumns+placementFrom+`
+		WHERE p.student_id = $1 AND p.status <> 'void' AND p.start_date < $3::date AND (p.end_date IS NULL OR p.end_date >= $2::date)
+		ORDER BY p.start_date, p.id`,
+		studentID, first.Format(dateLayout), next.Format(dateLayout),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var placements []models.Placement
+	for rows.Next() {
+		var pl models.Placement
+		if err := scanPlacement(rows, &pl); err != nil {
+			return nil, err
+		}
+		placements = append(placements, pl)
+	}
+	return placements, rows.Err()
+}
+
+// employerStudentIDs lists the trainees placed with an employer at some
+// point in month (YYYY-MM), limited to those matching scope (a studentScope
+// condition on alias s)
+func employerStudentIDs(db *sql.DB, employerID int, month string, scope string, args []interface{}) ([]int, error) {
+	args = append(args, employerID, month+"-01")
+	n := len(args)
+	rows, err := db.Query(
+		fmt.Sprintf(`SELECT s.id FROM student s WHERE EXISTS (
+			SELECT 1 FROM placements p WHERE p.student_id = s.id AND p.employer_id = $%[1]d AND p.status <> 'void'
+				AND p.start_date < $%[2]d::date + INTERVAL '1 month' AND (p.end_date IS NULL OR p.end_date >= $%[2]d::date)
+		) AND %[3]s ORDER BY s.last_name, s.first_name`, n-1, n, scope),
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ExportTimesheets downloads monthly timesheets. month is YYYY-MM and format
+// is csv (the default), xlsx or pdf. Pass student_id for one trainee or
+// employer_id for every trainee the caller manages who was placed there
+// during the month. Employer contacts get the trainees placed with them
+// during the month, limited to the days they were.
+func ExportTimesheets(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	month := q.Get("month")
+	if _, err := time.Parse(monthLayout, month); err != nil {
+		http.Error(w, "month must be YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType, ok := timesheetFormats[format]
+	if !ok {
+		http.Error(w, "format must be csv, xlsx or pdf", http.StatusBadRequest)
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	var onlyEmployer *int
+	if p != nil && p.Role == roleEmployer {
+		onlyEmployer = p.EmployerID
+	}
+	var ids []int
+	var name string
+	switch {
+	case q.Get("student_id") != "" && q.Get("employer_id") == "":
+		id, err := strconv.Atoi(q.Get("student_id"))
+		if err != nil {
+			http.Error(w, "Invalid student_id", http.StatusBadRequest)
+			return
+		}
+		if onlyEmployer != nil {
+			// Trainees who have moved on stay visible for the months they
+			// were placed with the employer
+			placed, err := employerStudentIDs(database.DB, *onlyEmployer, month, "s.id = $1", []interface{}{id})
+			if err != nil {
+				log.Printf("Error checking placements of student %d: %v", id, err)
+				http.Error(w, "Failed to build timesheets", http.StatusInternalServerError)
+				return
+			}
+			if len(placed) == 0 {
+				http.Error(w, "Student not found", http.StatusNotFound)
+				return
+			}
+		} else if !requireStudentAccess(w, r, id) {
+			return
+		}
+		ids, name = []int{id}, fmt.Sprintf("student-%d", id)
+	case q.Get("employer_id") != "" && q.Get("student_id") == "":
+		id, err := strconv.Atoi(q.Get("employer_id"))
+		if err != nil {
+			http.Error(w, "Invalid employer_id", http.StatusBadRequest)
+			return
+		}
+		scope, args := studentScope(p, "s", nil)
+		if onlyEmployer != nil {
+			// Matching the placement is enough; the trainee may have moved on
+			scope, args = "TRUE", nil
+			if id != *onlyEmployer {
+				scope = "FALSE"
+			}
+		}
+		ids, err = employerStudentIDs(database.DB, id, month, scope, args)
+		if err != nil {
+			log.Printf("Error loading trainees of employer %d: %v", id, err)
+			http.Error(w, "Failed to build timesheets", http.StatusInternalServerError)
+			return
+		}
+		if len(ids) == 0 {
+			http.Error(w, "No trainees found for that employer", http.StatusNotFound)
+			return
+		}
+		name = fmt.Sprintf("employer-%d", id)
+	default:
+		http.Error(w, "Pass either student_id or employer_id", http.StatusBadRequest)
+		return
+	}
+
+	sheets, err := buildTimesheets(database.DB, ids, month, onlyEmployer)
+	if errors.Is(err, errStudentNotFound) {
+		http.Error(w, "Student not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error building timesheets for %s %s: %v", name, month, err)
+		http.Error(w, "Failed to build timesheets", http.StatusInternalServerError)
+		return
+	}
+	// Rendered in memory so a failure can still be reported as an error
+	var buf bytes.Buffer
+	if err := writeTimesheets(&buf, format, sheets); err != nil {
+		log.Printf("Error rendering %s timesheets: %v", format, err)
+		http.Error(w, "Failed to build timesheets", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="timesheet-%s-%s.%s"`, month, name, format))
+	w.Write(buf.Bytes())
+}
+
+// RunTimesheetCommand implements "server timesheet", which writes the same
+// export as /timesheets/export without going through the API. It runs with
+// full access, so it is meant for operators with database credentials.
+func RunTimesheetCommand(args []string) error {
+	fs := flag.NewFlagSet("timesheet", flag.ContinueOnError)
+	month := fs.String("month", time.Now().In(orgLocation).AddDate(0, -1, 0).Format(monthLayout), "month to export, YYYY-MM (default last month)")
+	studentID := fs.Int("student", 0, "export one trainee")
+	employerID := fs.Int("employer", 0, "export every trainee placed with an employer")
+	format := fs.String("format", "csv", "csv, xlsx or pdf")
+	out := fs.String("out", "", "file to write (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := time.Parse(monthLayout, *month); err != nil {
+		return fmt.Errorf("-month must be YYYY-MM")
+	}
+	if _, ok := timesheetFormats[*format]; !ok {
+		return fmt.Errorf("-format must be csv, xlsx or pdf")
+	}
+
+	var ids []int
+	switch {
+	case *studentID != 0 && *employerID == 0:
+		ids = []int{*studentID}
+	case *employerID != 0 && *studentID == 0:
+		var err error
+		if ids, err = employerStudentIDs(database.DB, *employerID, *month, "TRUE", nil); err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			return fmt.Errorf("employer %d has no trainees", *employerID)
+		}
+	default:
+		return fmt.Errorf("pass either -student or -employer")
+	}
+
+	sheets, err := buildTimesheets(database.DB, ids, *month, nil)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		return writeTimesheets(os.Stdout, *format, sheets)
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := writeTimesheets(f, *format, sheets); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,419 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"server/models"
+)
+
+// timesheetFormats maps each export format to its content type
+var timesheetFormats = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"pdf":  "application/pdf",
+}
+
+var timesheetColumns = []string{
+	"Student ID", "Last name", "First name", "Employer", "Date", "Day", "Status", "Note",
+	"Scheduled hours", "Check in", "Check out", "Worked hours", "Break minutes", "Paid break minutes", "Late minutes", "Early leave minutes",
+}
+
+// writeTimesheets renders timesheets in one of timesheetFormats
+func writeTimesheets(w io.Writer, format string, sheets []*models.Timesheet) error {
+	switch format {
+	case "csv":
+		return writeTimesheetCSV(w, sheets)
+	case "xlsx":
+		return writeTimesheetXLSX(w, sheets)
+	case "pdf":
+		return writeTimesheetPDF(w, sheets)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+// timesheetRows flattens a timesheet into table rows in timesheetColumns
+// order, followed by a totals row. Times are in the trainee's timezone.
+func timesheetRows(ts *models.Timesheet) [][]string {
+	loc := locationFor(ts.Timezone)
+	id := strconv.Itoa(ts.StudentID)
+	rows := make([][]string, 0, len(ts.Days)+1)
+	for _, d := range ts.Days {
+		date, _ := time.Parse(dateLayout, d.Date)
+		rows = append(rows, []string{
+			id, ts.LastName, ts.FirstName, d.EmployerName, d.Date, date.Format("Mon"), d.Status, d.ExcusedReason,
+			hours(d.ScheduledMinutes), clock(d.CheckIn, loc), clock(d.CheckOut, loc), hours(d.WorkedMinutes),
+			strconv.Itoa(d.BreakMinutes), strconv.Itoa(d.PaidBreakMinutes), strconv.Itoa(d.LateMinutes), strconv.Itoa(d.EarlyLeaveMinutes),
+		})
+	}
+	t := ts.Totals
+	note := fmt.Sprintf("%d worked, %d absent, %d excused, %d late", t.DaysWorked, t.Absences, t.ExcusedDays, t.LateDays)
+	rows = append(rows, []string{
+		id, ts.LastName, ts.FirstName, ts.EmployerName, "TOTAL", "", "", note,
+		hours(t.ScheduledMinutes), "", "", hours(t.WorkedMinutes),
+		strconv.Itoa(t.BreakMinutes), strconv.Itoa(t.PaidBreakMinutes), strconv.Itoa(t.LateMinutes), strconv.Itoa(t.EarlyLeaveMinutes),
+	})
+	return rows
+}
+
+// hours formats minutes as decimal hours
+func hours(minutes int) string {
+	return strconv.FormatFloat(float64(minutes)/60, 'f', 2, 64)
+}
+
+// hoursMinutes formats minutes as H:MM
+func hoursMinutes(minutes int) string {
+	return fmt.Sprintf("%d:%02d", minutes/60, minutes%60)
+}
+
+func clock(t *time.Time, loc *time.Location) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(loc).Format("15:04")
+}
+
+func writeTimesheetCSV(w io.Writer, sheets []*models.Timesheet) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(timesheetColumns); err != nil {
+		return err
+	}
+	for _, ts := range sheets {
+		if err := cw.WriteAll(timesheetRows(ts)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// numericColumns are the timesheetColumns written as numbers in XLSX
+var numericColumns = map[int]bool{0: true, 8: true, 11: true, 12: true, 13: true, 14: true, 15: true}
+
+// writeTimesheetXLSX writes a minimal Office Open XML workbook with one sheet
+// per trainee
+func writeTimesheetXLSX(w io.Writer, sheets []*models.Timesheet) error {
+	zw := zip.NewWriter(w)
+	add := func(name, body string) error {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(f, xml.Header+body)
+		return err
+	}
+
+	var types, wbSheets, wbRels strings.Builder
+	used := map[string]bool{}
+	for i, ts := range sheets {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/xl/worksheets/sheet%d.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>`, n)
+		fmt.Fprintf(&wbSheets, `<sheet name="%s" sheetId="%d" r:id="rId%d"/>`, xmlEscape(sheetName(ts, used)), n, n)
+		fmt.Fprintf(&wbRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet%d.xml"/>`, n, n)
+		if err := add(fmt.Sprintf("xl/worksheets/sheet%d.xml", n), worksheetXML(ts)); err != nil {
+			return err
+		}
+	}
+	stylesRel := len(sheets) + 1
+	fmt.Fprintf(&wbRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>`, stylesRel)
+
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+			types.String() + `</Types>`},
+		{"_rels/.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets>` + wbSheets.String() + `</sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			wbRels.String() + `</Relationships>`},
+		// Style 1 is bold, used for headings and totals
+		{"xl/styles.xml", `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+			`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+			`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+			`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+			`<cellXfs count="2"><xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/><xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/></cellXfs>` +
+			`</styleSheet>`},
+	}
+	for _, p := range parts {
+		if err := add(p.name, p.body); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func worksheetXML(ts *models.Timesheet) string {
+	var b strings.Builder
+	b.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	row := 0
+	writeRow := func(cells []string, bold, numeric bool) {
+		row++
+		fmt.Fprintf(&b, `<row r="%d">`, row)
+		for i, v := range cells {
+			if v == "" {
+				continue
+			}
+			ref := fmt.Sprintf("%s%d", columnName(i), row)
+			style := ""
+			if bold {
+				style = ` s="1"`
+			}
+			if numeric && numericColumns[i] {
+				fmt.Fprintf(&b, `<c r="%s"%s><v>%s</v></c>`, ref, style, v)
+			} else {
+				fmt.Fprintf(&b, `<c r="%s"%s t="inlineStr"><is><t>%s</t></is></c>`, ref, style, xmlEscape(v))
+			}
+		}
+		b.WriteString(`</row>`)
+	}
+
+	writeRow([]string{"Timesheet " + ts.Month, ts.FirstName + " " + ts.LastName, ts.EmployerName}, true, false)
+	writeRow([]string{"Timezone", ts.Timezone}, false, false)
+	writeRow(timesheetColumns, true, false)
+	rows := timesheetRows(ts)
+	for i, r := range rows {
+		writeRow(r, i == len(rows)-1, true)
+	}
+	b.WriteString(`</sheetData></worksheet>`)
+	return b.String()
+}
+
+// columnName turns a zero based column index into A, B, ... AA
+func columnName(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+// sheetName is a unique worksheet name of at most 31 characters without the
+// characters Excel forbids
+func sheetName(ts *models.Timesheet, used map[string]bool) string {
+	base := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(ts.LastName+" "+ts.FirstName))
+	if base == "" {
+		base = "Student " + strconv.Itoa(ts.StudentID)
+	}
+	name := truncateRunes(base, 31)
+	for n := 2; used[strings.ToLower(name)]; n++ {
+		suffix := fmt.Sprintf(" (%d)", n)
+		name = strings.TrimSpace(truncateRunes(base, 31-len(suffix))) + suffix
+	}
+	used[strings.ToLower(name)] = true
+	return name
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// pdfColumn is a column of the PDF day table
+type pdfColumn struct {
+	title string
+	x     float64
+	value func(d models.TimesheetDay, loc *time.Location) string
+}
+
+var pdfColumns = []pdfColumn{
+	{"Date", 40, func(d models.TimesheetDay, _ *time.Location) string { return d.Date }},
+	{"Day", 100, func(d models.TimesheetDay, _ *time.Location) string {
+		date, _ := time.Parse(dateLayout, d.Date)
+		return date.Format("Mon")
+	}},
+	{"Status", 128, func(d models.TimesheetDay, _ *time.Location) string { return d.Status }},
+	{"Sched.", 180, func(d models.TimesheetDay, _ *time.Location) string { return hoursMinutes(d.ScheduledMinutes) }},
+	{"In", 218, func(d models.TimesheetDay, loc *time.Location) string { return clock(d.CheckIn, loc) }},
+	{"Out", 252, func(d models.TimesheetDay, loc *time.Location) string { return clock(d.CheckOut, loc) }},
+	{"Worked", 286, func(d models.TimesheetDay, _ *time.Location) string { return hoursMinutes(d.WorkedMinutes) }},
+	{"Break", 326, func(d models.TimesheetDay, _ *time.Location) string { return strconv.Itoa(d.BreakMinutes) }},
+	{"Late", 358, func(d models.TimesheetDay, _ *time.Location) string { return strconv.Itoa(d.LateMinutes) }},
+	{"Early", 386, func(d models.TimesheetDay, _ *time.Location) string { return strconv.Itoa(d.EarlyLeaveMinutes) }},
+	{"Note", 418, func(d models.TimesheetDay, _ *time.Location) string { return truncateRunes(d.ExcusedReason, 30) }},
+}
+
+// Lowest baselines on a PDF page for a day row, and for the totals, which
+// must stay clear of the signature lines at the foot of the last page
+const (
+	pdfLowestRow    = 50.0
+	pdfLowestTotals = 110.0
+)
+
+// writeTimesheetPDF writes a plain PDF with A4 pages for each trainee: the
+// day table, the month's totals and lines for the trainee, supervisor and
+// employer to sign. Only the built-in Helvetica font is used, so characters
+// outside Latin-1 print as "?".
+func writeTimesheetPDF(w io.Writer, sheets []*models.Timesheet) error {
+	// Objects 1-4 are the catalog, page tree and the two fonts; each page
+	// adds its content stream and page object
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>",
+	}
+	var kids []string
+	for _, ts := range sheets {
+		for _, content := range timesheetPages(ts) {
+			contentObj, pageObj := len(objects)+1, len(objects)+2
+			objects = append(objects,
+				fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+				fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", contentObj),
+			)
+			kids = append(kids, fmt.Sprintf("%d 0 R", pageObj))
+		}
+	}
+	objects[1] = fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(kids))
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// timesheetPages are the content streams of one trainee's PDF pages. Days
+// that do not fit continue on the next page under the same headings, and
+// the totals move to a page of their own when they would run into the
+// signature lines.
+func timesheetPages(ts *models.Timesheet) []string {
+	loc := locationFor(ts.Timezone)
+	var pages []string
+	var b strings.Builder
+	text := func(font string, size, x, y float64, s string) {
+		fmt.Fprintf(&b, "BT /%s %.0f Tf %.1f %.1f Td (%s) Tj ET\n", font, size, x, y, pdfString(s))
+	}
+	line := func(x1, y1, x2, y2 float64) {
+		fmt.Fprintf(&b, "%.1f %.1f m %.1f %.1f l S\n", x1, y1, x2, y2)
+	}
+
+	var y float64
+	newPage := func() {
+		if b.Len() > 0 {
+			pages = append(pages, b.String())
+			b.Reset()
+		}
+		title := "Monthly timesheet - " + ts.Month
+		if len(pages) > 0 {
+			title += " (continued)"
+		}
+		y = 800
+		text("F2", 16, 40, y, title)
+		y -= 22
+		text("F1", 10, 40, y, fmt.Sprintf("Trainee: %s %s (ID %d)", ts.FirstName, ts.LastName, ts.StudentID))
+		y -= 14
+		employer := ts.EmployerName
+		if employer == "" {
+			employer = "-"
+		}
+		text("F1", 10, 40, y, "Employer: "+employer)
+		y -= 14
+		text("F1", 10, 40, y, "Timezone: "+ts.Timezone)
+	}
+	tableHead := func() {
+		y -= 24
+		for _, c := range pdfColumns {
+			text("F2", 8, c.x, y, c.title)
+		}
+		line(40, y-4, 555, y-4)
+		y -= 16
+	}
+
+	newPage()
+	tableHead()
+	for _, d := range ts.Days {
+		if y < pdfLowestRow {
+			line(40, y+8, 555, y+8)
+			newPage()
+			tableHead()
+		}
+		for _, c := range pdfColumns {
+			text("F1", 8, c.x, y, c.value(d, loc))
+		}
+		y -= 12
+	}
+	line(40, y+8, 555, y+8)
+
+	// The totals heading and three lines below it
+	if y-10-14-2*12 < pdfLowestTotals {
+		newPage()
+	}
+	t := ts.Totals
+	y -= 10
+	text("F2", 10, 40, y, "Totals")
+	y -= 14
+	for _, s := range []string{
+		fmt.Sprintf("Scheduled %s h, worked %s h, breaks %d min of which %d paid", hoursMinutes(t.ScheduledMinutes), hoursMinutes(t.WorkedMinutes), t.BreakMinutes, t.PaidBreakMinutes),
+		fmt.Sprintf("Days worked %d, absences %d, excused days %d", t.DaysWorked, t.Absences, t.ExcusedDays),
+		fmt.Sprintf("Late on %d days (%d min), left early %d min", t.LateDays, t.LateMinutes, t.EarlyLeaveMinutes),
+	} {
+		text("F1", 9, 40, y, s)
+		y -= 12
+	}
+
+	// Signature block
+	y = 90
+	for i, who := range []string{"Trainee", "Supervisor", "Employer"} {
+		x := 40 + float64(i)*180
+		line(x, y, x+150, y)
+		text("F1", 8, x, y-10, who+" signature")
+		line(x, y-34, x+150, y-34)
+		text("F1", 8, x, y-44, "Date")
+	}
+	return append(pages, b.String())
+}
+
+// pdfString escapes a PDF literal string, replacing anything WinAnsi cannot
+// show
+func pdfString(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(byte(r))
+		case r < 0x20 || (r >= 0x7f && r < 0xa0) || r > 0xff:
+			b.WriteByte('?')
+		default:
+			b.WriteByte(byte(r))
+		}
+	}
+	return b.String()
+}
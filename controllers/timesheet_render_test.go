@@ -0,0 +1,421 @@
+package controllers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"server/models"
+)
+
+// testTimesheet is a trainee's sheet with days worked from 1 March 2024.
+// Months never have more than 31 days, but longer tables must still lay out.
+func testTimesheet(days int) *models.Timesheet {
+	ts := &models.Timesheet{
+		StudentID: 7, FirstName: "Zoë", LastName: "O'Brien <&>", EmployerName: "Acme (Pvt) Ltd",
+		Month: "2024-03", Timezone: "Asia/Colombo",
+		Totals: models.TimesheetTotals{ScheduledMinutes: 480 * days, WorkedMinutes: 475 * days, DaysWorked: days},
+	}
+	first := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < days; i++ {
+		// 03:35 UTC is 09:05 in Colombo
+		in := first.AddDate(0, 0, i).Add(3*time.Hour + 35*time.Minute)
+		out := in.Add(8 * time.Hour)
+		ts.Days = append(ts.Days, models.TimesheetDay{
+			Date: first.AddDate(0, 0, i).Format(dateLayout), EmployerName: ts.EmployerName, Status: dayWorked,
+			ScheduledMinutes: 480, CheckIn: &in, CheckOut: &out, WorkedMinutes: 475, BreakMinutes: 5, LateMinutes: 5,
+		})
+	}
+	return ts
+}
+
+func TestColumnName(t *testing.T) {
+	tests := []struct {
+		i    int
+		want string
+	}{
+		{0, "A"}, {15, "P"}, {25, "Z"}, {26, "AA"}, {27, "AB"}, {51, "AZ"}, {52, "BA"}, {701, "ZZ"}, {702, "AAA"},
+	}
+	for _, tt := range tests {
+		if got := columnName(tt.i); got != tt.want {
+			t.Errorf("columnName(%d) = %s, want %s", tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestSheetName(t *testing.T) {
+	used := map[string]bool{}
+	tests := []struct {
+		name        string
+		first, last string
+		want        string
+	}{
+		{"plain", "Nimal", "Perera", "Perera Nimal"},
+		{"forbidden characters", "A/B", "[Silva]: *?\\", "Silva  AB"},
+		{"clash differs only in case", "NIMAL", "PERERA", "PERERA NIMAL (2)"},
+		{"third clash", "Nimal", "Perera", "Perera Nimal (3)"},
+		{"long name", "Bartholomew", "Wickremasinghe-Gunawardena", "Wickremasinghe-Gunawardena Bart"},
+		{"long name clash", "Bartholomew", "Wickremasinghe-Gunawardena", "Wickremasinghe-Gunawardena (2)"},
+		{"counted in characters", "Ōkubo", "Ōkubo-Ōkubo-Ōkubo-Ōkubo", "Ōkubo-Ōkubo-Ōkubo-Ōkubo Ōkubo"},
+		{"no usable name", "", "?*", "Student 7"},
+	}
+	for _, tt := range tests {
+		got := sheetName(&models.Timesheet{StudentID: 7, FirstName: tt.first, LastName: tt.last}, used)
+		if got != tt.want {
+			t.Errorf("%s: sheetName = %q, want %q", tt.name, got, tt.want)
+		}
+		if n := len([]rune(got)); n > 31 {
+			t.Errorf("%s: sheetName %q is %d characters", tt.name, got, n)
+		}
+	}
+}
+
+// xlsxCell is a worksheet cell as written by worksheetXML
+type xlsxCell struct {
+	Ref   string `xml:"r,attr"`
+	Style string `xml:"s,attr"`
+	Type  string `xml:"t,attr"`
+	Value string `xml:"v"`
+	Text  string `xml:"is>t"`
+}
+
+func TestWriteTimesheetXLSX(t *testing.T) {
+	sheets := []*models.Timesheet{testTimesheet(3), testTimesheet(1)}
+	var buf bytes.Buffer
+	if err := writeTimesheetXLSX(&buf, sheets); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("not a zip archive: %v", err)
+	}
+	parts := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{
+		"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml",
+		"xl/worksheets/sheet1.xml", "xl/worksheets/sheet2.xml",
+	} {
+		body, ok := parts[name]
+		if !ok {
+			t.Errorf("missing part %s", name)
+			continue
+		}
+		dec := xml.NewDecoder(bytes.NewReader(body))
+		for {
+			if _, err := dec.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s is not well-formed: %v", name, err)
+				break
+			}
+		}
+	}
+	if n := strings.Count(string(parts["[Content_Types].xml"]), "/xl/worksheets/sheet"); n != 2 {
+		t.Errorf("content types list %d worksheets, want 2", n)
+	}
+
+	var wb struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(parts["xl/workbook.xml"], &wb); err != nil {
+		t.Fatal(err)
+	}
+	if len(wb.Sheets) != 2 || wb.Sheets[0].Name != "O'Brien <&> Zoë" || wb.Sheets[1].Name != "O'Brien <&> Zoë (2)" {
+		t.Errorf("sheet names = %+v", wb.Sheets)
+	}
+
+	var ws struct {
+		Rows []struct {
+			Ref   int        `xml:"r,attr"`
+			Cells []xlsxCell `xml:"c"`
+		} `xml:"sheetData>row"`
+	}
+	if err := xml.Unmarshal(parts["xl/worksheets/sheet1.xml"], &ws); err != nil {
+		t.Fatal(err)
+	}
+	// Title, timezone, headings, three days and the totals
+	if len(ws.Rows) != 7 {
+		t.Fatalf("sheet1 has %d rows, want 7", len(ws.Rows))
+	}
+	cells := map[string]xlsxCell{}
+	for i, row := range ws.Rows {
+		if row.Ref != i+1 {
+			t.Errorf("row %d is numbered %d", i+1, row.Ref)
+		}
+		for _, c := range row.Cells {
+			if !strings.HasSuffix(c.Ref, strconv.Itoa(row.Ref)) {
+				t.Errorf("cell %s is in row %d", c.Ref, row.Ref)
+			}
+			cells[c.Ref] = c
+		}
+	}
+
+	tests := []struct {
+		ref     string
+		text    string
+		number  string
+		bold    bool
+		missing bool
+	}{
+		{ref: "A1", text: "Timesheet 2024-03", bold: true},
+		{ref: "B1", text: "Zoë O'Brien <&>", bold: true},
+		{ref: "B2", text: "Asia/Colombo"},
+		{ref: "P3", text: "Early leave minutes", bold: true},
+		{ref: "A4", number: "7"},
+		{ref: "B4", text: "O'Brien <&>"},
+		{ref: "D4", text: "Acme (Pvt) Ltd"},
+		{ref: "E4", text: "2024-03-01"},
+		{ref: "F4", text: "Fri"},
+		{ref: "H4", missing: true},
+		{ref: "I4", number: "8.00"},
+		{ref: "J4", text: "09:05"},
+		{ref: "K4", text: "17:05"},
+		{ref: "L4", number: "7.92"},
+		{ref: "O4", number: "5"},
+		{ref: "E6", text: "2024-03-03"},
+		{ref: "E7", text: "TOTAL", bold: true},
+		{ref: "H7", text: "3 worked, 0 absent, 0 excused, 0 late", bold: true},
+		{ref: "L7", number: "23.75", bold: true},
+	}
+	for _, tt := range tests {
+		c, ok := cells[tt.ref]
+		switch {
+		case tt.missing:
+			if ok {
+				t.Errorf("%s = %+v, want no cell", tt.ref, c)
+			}
+			continue
+		case !ok:
+			t.Errorf("%s missing", tt.ref)
+			continue
+		case tt.number != "" && (c.Type != "" || c.Value != tt.number):
+			t.Errorf("%s = %+v, want the number %s", tt.ref, c, tt.number)
+		case tt.number == "" && (c.Type != "inlineStr" || c.Text != tt.text):
+			t.Errorf("%s = %+v, want the text %q", tt.ref, c, tt.text)
+		}
+		if bold := c.Style == "1"; bold != tt.bold {
+			t.Errorf("%s bold = %v, want %v", tt.ref, bold, tt.bold)
+		}
+	}
+}
+
+func TestPDFString(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "Worked 8:00", "Worked 8:00"},
+		{"parentheses and backslash", `Acme (Pvt) Ltd \ Colombo`, `Acme \(Pvt\) Ltd \\ Colombo`},
+		{"Latin-1 as single bytes", "Zoë", "Zo\xeb"},
+		{"outside Latin-1", "Ōkubo €5", "?kubo ?5"},
+		{"control characters", "a\tb\nc", "a?b?c"},
+		{"C1 controls", "a\u0085b", "a?b"},
+	}
+	for _, tt := range tests {
+		if got := pdfString(tt.in); got != tt.want {
+			t.Errorf("%s: pdfString(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+var (
+	pdfObjectRe = regexp.MustCompile(`(?s)^(\d+) 0 obj\n(.*?)\nendobj\n`)
+	pdfStreamRe = regexp.MustCompile(`(?s)^<< /Length (\d+) >>\nstream\n(.*)\nendstream$`)
+	pdfTextRe   = regexp.MustCompile(`BT /F\d \d+ Tf ([\d.]+) ([\d.-]+) Td \(((?:\\.|[^\\)])*)\) Tj ET`)
+)
+
+// pdfText is a string drawn on a PDF page
+type pdfText struct {
+	x, y float64
+	s    string
+}
+
+// readTestPDF checks the cross-reference table and stream lengths of a PDF
+// written by writeTimesheetPDF and returns the text of each page
+func readTestPDF(t *testing.T, pdf []byte) [][]pdfText {
+	t.Helper()
+	s := string(pdf)
+	if !strings.HasPrefix(s, "%PDF-1.4\n") || !strings.HasSuffix(s, "%%EOF\n") {
+		t.Fatalf("missing PDF header or trailer")
+	}
+	tail := s[strings.LastIndex(s, "startxref\n")+len("startxref\n"):]
+	xref, err := strconv.Atoi(strings.TrimSuffix(tail, "\n%%EOF\n"))
+	if err != nil || xref >= len(s) || !strings.HasPrefix(s[xref:], "xref\n") {
+		t.Fatalf("startxref %q does not point at the xref table", tail)
+	}
+	var size int
+	if _, err := fmt.Sscanf(s[xref:], "xref\n0 %d\n", &size); err != nil {
+		t.Fatalf("xref header: %v", err)
+	}
+	if !strings.Contains(s, fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>", size)) {
+		t.Errorf("trailer does not give /Size %d", size)
+	}
+	entries := strings.Split(s[xref:], "\n")[2:]
+
+	objects := make([]string, size)
+	for i := 1; i < size; i++ {
+		var off, gen int
+		if _, err := fmt.Sscanf(entries[i], "%010d %05d n ", &off, &gen); err != nil {
+			t.Fatalf("xref entry %d %q: %v", i, entries[i], err)
+		}
+		m := pdfObjectRe.FindStringSubmatch(s[off:])
+		if m == nil || m[1] != strconv.Itoa(i) {
+			t.Fatalf("xref entry %d points at %q, not at object %d", i, truncateRunes(s[off:], 20), i)
+		}
+		objects[i] = m[2]
+	}
+
+	var pages [][]pdfText
+	for _, kid := range regexp.MustCompile(`(\d+) 0 R`).FindAllStringSubmatch(
+		regexp.MustCompile(`/Kids \[([^\]]*)\]`).FindStringSubmatch(objects[2])[1], -1) {
+		n, _ := strconv.Atoi(kid[1])
+		page := objects[n]
+		contents := regexp.MustCompile(`/Contents (\d+) 0 R`).FindStringSubmatch(page)
+		if !strings.HasPrefix(page, "<< /Type /Page ") || contents == nil {
+			t.Fatalf("object %d is not a page: %s", n, page)
+		}
+		c, _ := strconv.Atoi(contents[1])
+		m := pdfStreamRe.FindStringSubmatch(objects[c])
+		if m == nil {
+			t.Fatalf("object %d is not a stream", c)
+		}
+		if length, _ := strconv.Atoi(m[1]); length != len(m[2]) {
+			t.Errorf("stream %d has /Length %d but is %d bytes", c, length, len(m[2]))
+		}
+		var texts []pdfText
+		for _, tm := range pdfTextRe.FindAllStringSubmatch(m[2], -1) {
+			x, _ := strconv.ParseFloat(tm[1], 64)
+			y, _ := strconv.ParseFloat(tm[2], 64)
+			texts = append(texts, pdfText{x, y, tm[3]})
+		}
+		pages = append(pages, texts)
+	}
+	if want := fmt.Sprintf("/Count %d", len(pages)); !strings.Contains(objects[2], want) {
+		t.Errorf("page tree %q does not have %s", objects[2], want)
+	}
+	return pages
+}
+
+func TestWriteTimesheetPDF(t *testing.T) {
+	tests := []struct {
+		name  string
+		days  int
+		pages int
+	}{
+		{"short month", 28, 1},
+		{"long month", 31, 1},
+		{"totals pushed to the next page", 50, 2},
+		{"days continue on the next page", 70, 2},
+		{"three pages", 120, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := testTimesheet(tt.days)
+			ts.Days[0].ExcusedReason = "Poya (full moon) \\ half day"
+			var buf bytes.Buffer
+			if err := writeTimesheetPDF(&buf, []*models.Timesheet{ts}); err != nil {
+				t.Fatal(err)
+			}
+			pages := readTestPDF(t, buf.Bytes())
+			if len(pages) != tt.pages {
+				t.Fatalf("%d pages, want %d", len(pages), tt.pages)
+			}
+
+			var dates []string
+			for i, page := range pages {
+				title := "Monthly timesheet - 2024-03"
+				if i > 0 {
+					title += " \\(continued\\)"
+				}
+				if page[0].s != title {
+					t.Errorf("page %d title = %q, want %q", i+1, page[0].s, title)
+				}
+				last := i == len(pages)-1
+				var totals, signature bool
+				for _, text := range page {
+					if text.y < 40 || text.y > 842 {
+						t.Errorf("page %d: %q drawn off the page at y %.1f", i+1, text.s, text.y)
+					}
+					switch {
+					case text.x == 40 && strings.HasPrefix(text.s, "2024-"):
+						if text.y < pdfLowestRow {
+							t.Errorf("page %d: day %s at y %.1f runs into the foot of the page", i+1, text.s, text.y)
+						}
+						dates = append(dates, text.s)
+					case text.s == "Totals":
+						totals = true
+						if text.y-36 < pdfLowestTotals {
+							t.Errorf("page %d: totals at y %.1f run into the signature lines", i+1, text.y)
+						}
+					case text.s == "Trainee signature":
+						signature = true
+					}
+				}
+				if totals != last || signature != last {
+					t.Errorf("page %d: totals %v, signatures %v, want them only on the last page", i+1, totals, signature)
+				}
+			}
+			if len(dates) != tt.days {
+				t.Fatalf("%d day rows, want %d", len(dates), tt.days)
+			}
+			for i, d := range ts.Days {
+				if dates[i] != d.Date {
+					t.Fatalf("row %d is %s, want %s", i+1, dates[i], d.Date)
+				}
+			}
+
+			content := pages[0]
+			for _, want := range []string{
+				"Trainee: Zo\xeb O'Brien <&> \\(ID 7\\)", "Employer: Acme \\(Pvt\\) Ltd", "Poya \\(full moon\\) \\\\ half day", "09:05",
+			} {
+				found := false
+				for _, text := range content {
+					found = found || text.s == want
+				}
+				if !found {
+					t.Errorf("first page does not show %q", want)
+				}
+			}
+		})
+	}
+}
+
+// Every trainee starts on a new page, after however many the last one took
+func TestWriteTimesheetPDFSeveralTrainees(t *testing.T) {
+	long, short := testTimesheet(70), testTimesheet(3)
+	short.StudentID, short.FirstName, short.LastName = 8, "Nimal", "Perera"
+	var buf bytes.Buffer
+	if err := writeTimesheetPDF(&buf, []*models.Timesheet{long, short}); err != nil {
+		t.Fatal(err)
+	}
+	pages := readTestPDF(t, buf.Bytes())
+	want := []string{"Trainee: Zo\xeb O'Brien <&> \\(ID 7\\)", "Trainee: Zo\xeb O'Brien <&> \\(ID 7\\)", "Trainee: Nimal Perera \\(ID 8\\)"}
+	if len(pages) != len(want) {
+		t.Fatalf("%d pages, want %d", len(pages), len(want))
+	}
+	for i, page := range pages {
+		if page[1].s != want[i] {
+			t.Errorf("page %d is for %q, want %q", i+1, page[1].s, want[i])
+		}
+	}
+}
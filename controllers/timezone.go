@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const defaultOrgTimezone = "Asia/Colombo"
+
+// orgLocation is the organisation-wide timezone used to decide which calendar
+// day an attendance record belongs to. Employers and trainees may override it.
+var orgLocation = mustLoadLocation(defaultOrgTimezone)
+
+// LoadOrgTimezone reads ORG_TIMEZONE (an IANA name such as Asia/Colombo) and
+// exits if it is not a known zone
+func LoadOrgTimezone() {
+	name := strings.TrimSpace(os.Getenv("ORG_TIMEZONE"))
+	if name == "" {
+		name = defaultOrgTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Fatalf("❌ Invalid ORG_TIMEZONE %q: %v", name, err)
+	}
+	orgLocation = loc
+	log.Printf("✅ Attendance days use the %s timezone", loc)
+}
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// validateTimezone checks an optional timezone override. Blank values clear
+// the override.
+func validateTimezone(tz *string) (*string, error) {
+	if tz == nil || strings.TrimSpace(*tz) == "" {
+		return nil, nil
+	}
+	name := strings.TrimSpace(*tz)
+	if _, err := time.LoadLocation(name); err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", name)
+	}
+	return &name, nil
+}
+
+// locationFor turns stored overrides into a location: the first of them that
+// is set and still valid, else the organisation timezone
+func locationFor(zones ...string) *time.Location {
+	for _, tz := range zones {
+		if tz == "" {
+			continue
+		}
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			log.Printf("Ignoring invalid timezone %q: %v", tz, err)
+			continue
+		}
+		return loc
+	}
+	return orgLocation
+}
+
+// studentLocation returns the timezone a trainee's attendance at time at is
+// counted in: the trainee's own override, then that of the employer they were
+// placed with that day, then the organisation's. The placement is looked up
+// on the organisation's date, since the trainee's own is not known yet.
+func studentLocation(db *sql.DB, studentID int, at time.Time) (*time.Location, error) {
+	var own, employer string
+	err := db.QueryRow(
+		`SELECT COALESCE(s.timezone, ''), COALESCE(e.timezone, '')
+		FROM student s `+placementAsOf("s.id", "$2::date")+`
+		LEFT JOIN employer e ON e.id = `+placementEmployer+`
+		WHERE s.id = $1`, studentID, localDate(at, orgLocation),
+	).Scan(&own, &employer)
+	if err == sql.ErrNoRows {
+		return orgLocation, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return locationFor(own, employer), nil
+}
+
+// studentTimezones is studentLocation for several trainees in one query,
+// keyed by student ID. Trainees that do not exist are left out.
+func studentTimezones(db *sql.DB, studentIDs []int, at time.Time) (map[int]*time.Location, error) {
+	rows, err := db.Query(
+		`SELECT s.id, COALESCE(s.timezone, ''), COALESCE(e.timezone, '')
+		FROM student s `+placementAsOf("s.id", "$2::date")+`
+		LEFT JOIN employer e ON e.id = `+placementEmployer+`
+		WHERE s.id = ANY($1)`, pq.Array(studentIDs), localDate(at, orgLocation),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	locs := make(map[int]*time.Location, len(studentIDs))
+	for rows.Next() {
+		var id int
+		var own, employer string
+		if err := rows.Scan(&id, &own, &employer); err != nil {
+			return nil, err
+		}
+		locs[id] = locationFor(own, employer)
+	}
+	return locs, rows.Err()
+}
+
+// dayBounds returns the start and end of the local calendar day containing t.
+// The bounds are returned in UTC so they compare correctly with stored times.
+func dayBounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	local := t.In(loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	// AddDate rather than 24h so days that cross a DST change stay correct
+	end := start.AddDate(0, 0, 1)
+	return start.UTC(), end.UTC()
+}
+
+// localDate formats the calendar day t falls on in loc
+func localDate(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("2006-01-02")
+}
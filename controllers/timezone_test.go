@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalDateAndDayBounds(t *testing.T) {
+	colombo := mustLoadLocation("Asia/Colombo")
+	newYork := mustLoadLocation("America/New_York")
+	tests := []struct {
+		name       string
+		at         time.Time
+		loc        *time.Location
+		date       string
+		start, end string
+		hours      float64
+	}{
+		// 04:00 in Colombo is still the previous day in UTC
+		{"early Colombo check-in", time.Date(2024, 3, 4, 4, 0, 0, 0, colombo), colombo,
+			"2024-03-04", "2024-03-03T18:30:00Z", "2024-03-04T18:30:00Z", 24},
+		{"late Colombo check-out", time.Date(2024, 3, 4, 23, 50, 0, 0, colombo), colombo,
+			"2024-03-04", "2024-03-03T18:30:00Z", "2024-03-04T18:30:00Z", 24},
+		{"clocks go forward", time.Date(2024, 3, 10, 12, 0, 0, 0, newYork), newYork,
+			"2024-03-10", "2024-03-10T05:00:00Z", "2024-03-11T04:00:00Z", 23},
+		{"clocks go back", time.Date(2024, 11, 3, 12, 0, 0, 0, newYork), newYork,
+			"2024-11-03", "2024-11-03T04:00:00Z", "2024-11-04T05:00:00Z", 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := localDate(tt.at, tt.loc); got != tt.date {
+				t.Errorf("localDate = %s, want %s", got, tt.date)
+			}
+			start, end := dayBounds(tt.at, tt.loc)
+			if got := start.Format(time.RFC3339); got != tt.start {
+				t.Errorf("start = %s, want %s", got, tt.start)
+			}
+			if got := end.Format(time.RFC3339); got != tt.end {
+				t.Errorf("end = %s, want %s", got, tt.end)
+			}
+			if got := end.Sub(start).Hours(); got != tt.hours {
+				t.Errorf("day is %v hours, want %v", got, tt.hours)
+			}
+		})
+	}
+}
+
+func TestLocationForFallbackOrder(t *testing.T) {
+	tests := []struct {
+		name              string
+		trainee, employer string
+		want              string
+	}{
+		{"trainee override wins", "Europe/London", "Asia/Dubai", "Europe/London"},
+		{"employer without a trainee override", "", "Asia/Dubai", "Asia/Dubai"},
+		{"invalid trainee override", "Mars/Olympus", "Asia/Dubai", "Asia/Dubai"},
+		{"neither set", "", "", orgLocation.String()},
+		{"both invalid", "Mars/Olympus", "Nowhere", orgLocation.String()},
+	}
+	for _, tt := range tests {
+		if got := locationFor(tt.trainee, tt.employer).String(); got != tt.want {
+			t.Errorf("%s: locationFor = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The employer's timezone is the one of the placement on the day, not the
+// trainee's current employer. A trainee's own override still comes first.
+func TestStudentLocationFollowsPlacement(t *testing.T) {
+	tests := []struct {
+		name string
+		own  string
+		at   time.Time
+		want string
+	}{
+		{"before the move", "", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), "Asia/Colombo"},
+		// 19:00 UTC is already 1 March in the organisation's timezone
+		{"after the move", "", time.Date(2024, 2, 29, 19, 0, 0, 0, time.UTC), "Asia/Dubai"},
+		{"trainee override", "Europe/London", time.Date(2024, 2, 29, 19, 0, 0, 0, time.UTC), "Europe/London"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value, error) {
+				if !strings.Contains(query, "placements x") {
+					t.Fatalf("timezone not resolved through the placement: %s", query)
+				}
+				employer := "Asia/Colombo"
+				if args[1].(string) >= "2024-03-01" {
+					employer = "Asia/Dubai"
+				}
+				return []string{"own", "employer"}, [][]driver.Value{{tt.own, employer}}, nil
+			})
+			loc, err := studentLocation(db, 7, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loc.String() != tt.want {
+				t.Errorf("location = %s, want %s", loc, tt.want)
+			}
+		})
+	}
+}
@@ -1,30 +1,23 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"server/database"
 	"server/models"
-	"strconv"
+	"time"
 )
 
 // GetTraineeProfile handles the request to get a trainee's profile information
 func GetTraineeProfile(w http.ResponseWriter, r *http.Request) {
 	log.Println("Received trainee profile request")
 
-	// Get student ID from header
-	studentIDHeader := r.Header.Get("student-id")
-	if studentIDHeader == "" {
-		log.Println("Missing student-id header")
-		http.Error(w, "Missing student-id header", http.StatusBadRequest)
-		return
-	}
-
-	studentID, err := strconv.Atoi(studentIDHeader)
+	// Trainees get their own profile; staff name the trainee in the header
+	studentID, err := resolveStudentID(r)
 	if err != nil {
-		log.Printf("Invalid student-id header: %v", err)
-		http.Error(w, "Invalid student-id header", http.StatusBadRequest)
+		writeResolveError(w, err)
 		return
 	}
 
@@ -87,7 +80,7 @@ func GetTraineeProfile(w http.ResponseWriter, r *http.Request) {
 		FROM student s
 		JOIN attendance a ON s.id = a.student_id
 		WHERE s.id = $1
-		ORDER BY a.check_in_date_time DESC
+		ORDER BY COALESCE(a.check_in_date_time, a.check_out_date_time) DESC
 		LIMIT 5`
 
 	rows, err = database.DB.Query(query, studentID)
@@ -103,10 +96,18 @@ func GetTraineeProfile(w http.ResponseWriter, r *http.Request) {
 				ActualCheckIn     string `json:"actual_check_in"`
 				ActualCheckOut    string `json:"actual_check_out"`
 			}
-			if err := rows.Scan(&rec.ScheduledCheckIn, &rec.ScheduledCheckOut, &rec.ActualCheckIn, &rec.ActualCheckOut); err != nil {
+			// Open sessions have no check-out and orphan checkouts no check-in
+			var actualIn, actualOut sql.NullTime
+			if err := rows.Scan(&rec.ScheduledCheckIn, &rec.ScheduledCheckOut, &actualIn, &actualOut); err != nil {
 				log.Printf("Error scanning attendance row: %v", err)
 				continue
 			}
+			if actualIn.Valid {
+				rec.ActualCheckIn = actualIn.Time.Format(time.RFC3339Nano)
+			}
+			if actualOut.Valid {
+				rec.ActualCheckOut = actualOut.Time.Format(time.RFC3339Nano)
+			}
 			recentAttendanceRecords = append(recentAttendanceRecords, rec)
 		}
 	}
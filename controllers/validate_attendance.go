@@ -1,64 +1,80 @@
 package controllers
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"io"
+	"log"
 	"math"
 	"net/http"
 	"time"
+
+	"server/database"
 )
 
-// AttendancePayload represents the incoming payload
+// AttendancePayload selects which side of the latest session to report on.
+// Times are no longer accepted from the client; punctuality is computed from
+// the stored session and the trainee's schedule.
 type AttendancePayload struct {
-	CheckType         string    `json:"check_type"` // "checkin" or "checkout"
-	ScheduledCheckIn  time.Time `json:"scheduled_check_in"`
-	ScheduledCheckOut time.Time `json:"scheduled_check_out"`
-	ActualCheckIn     time.Time `json:"actual_check_in"`
-	ActualCheckOut    time.Time `json:"actual_check_out"`
+	CheckType string `json:"check_type"` // "checkin" or "checkout"
 }
 
-// AttendanceValidationResponse represents the response
+// AttendanceValidationResponse represents the response. MinutesDifference is
+// positive when the trainee was late to check in or stayed past the end, and
+// negative when they arrived early or left early.
 type AttendanceValidationResponse struct {
-	MinutesDifference int `json:"minutes_difference"`
-}
-
-// GetTimeDifferenceInMinutes calculates the difference in minutes between scheduled and actual time
-func GetTimeDifferenceInMinutes(payload AttendancePayload) int {
-	var scheduled, actual time.Time
-
-	if payload.CheckType == "checkin" {
-		scheduled = payload.ScheduledCheckIn
-		actual = payload.ActualCheckIn
-	} else if payload.CheckType == "checkout" {
-		scheduled = payload.ScheduledCheckOut
-		actual = payload.ActualCheckOut
-	} else {
-		return 0 // or handle error
-	}
-
-	diff := actual.Sub(scheduled).Minutes()
-	return int(math.Round(diff))
+	MinutesDifference int        `json:"minutes_difference"`
+	SessionID         uint       `json:"session_id"`
+	Scheduled         *time.Time `json:"scheduled"`
+	Actual            *time.Time `json:"actual"`
+	LateMinutes       *int       `json:"late_minutes"`
+	EarlyLeaveMinutes *int       `json:"early_leave_minutes"`
 }
 
 // ValidateAttendanceHandler handles the /validate-attendance endpoint
 func ValidateAttendanceHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		studentID := r.Header.Get("student-id")
-		if studentID == "" {
-			http.Error(w, "student-id header is required", http.StatusBadRequest)
+		studentID, err := authenticatedStudentID(r)
+		if err != nil {
+			http.Error(w, "Trainee session required", http.StatusUnauthorized)
 			return
 		}
 
-		var payload AttendancePayload
-		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		payload := AttendancePayload{CheckType: "checkin"}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
 			http.Error(w, "Invalid payload", http.StatusBadRequest)
 			return
 		}
+		if payload.CheckType != "checkin" && payload.CheckType != "checkout" {
+			http.Error(w, "check_type must be checkin or checkout", http.StatusBadRequest)
+			return
+		}
 
-		// You can use studentID here for logging, validation, or DB operations if needed
+		var resp AttendanceValidationResponse
+		var checkIn, checkOut sql.NullTime
+		var scheduledIn, scheduledOut *time.Time
+		err = database.DB.QueryRow(
+			`SELECT id, check_in_date_time, check_out_date_time, scheduled_check_in, scheduled_check_out, late_minutes, early_leave_minutes
+			FROM attendance WHERE student_id = $1
+			ORDER BY COALESCE(check_in_date_time, check_out_date_time) DESC LIMIT 1`, studentID,
+		).Scan(&resp.SessionID, &checkIn, &checkOut, &scheduledIn, &scheduledOut, &resp.LateMinutes, &resp.EarlyLeaveMinutes)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "No attendance recorded", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error loading attendance for student %d: %v", studentID, err)
+			http.Error(w, "Failed to load attendance", http.StatusInternalServerError)
+			return
+		}
 
-		minutesDiff := GetTimeDifferenceInMinutes(payload)
-		resp := AttendanceValidationResponse{
-			MinutesDifference: minutesDiff,
+		if payload.CheckType == "checkin" {
+			resp.Scheduled, resp.Actual = scheduledIn, nullTimePtr(checkIn)
+		} else {
+			resp.Scheduled, resp.Actual = scheduledOut, nullTimePtr(checkOut)
+		}
+		if resp.Scheduled != nil && resp.Actual != nil {
+			resp.MinutesDifference = GetTimeDifferenceInMinutes(*resp.Scheduled, *resp.Actual)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -68,3 +84,16 @@ func ValidateAttendanceHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// GetTimeDifferenceInMinutes calculates the difference in minutes between scheduled and actual time
+func GetTimeDifferenceInMinutes(scheduled, actual time.Time) int {
+	diff := actual.Sub(scheduled).Minutes()
+	return int(math.Round(diff))
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
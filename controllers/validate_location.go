@@ -1,68 +1,26 @@
 package controllers
 
 import (
-	"database/sql"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"math"
 	"net/http"
-	"os"
 	"server/database"
+	"time"
 )
 
 type LocationResponse struct {
-	EmployerLong    float64 `json:"employer_long"`
-	EmployerLat     float64 `json:"employer_lat"`
+	EmployerLong float64 `json:"employer_long"`
+	EmployerLat  float64 `json:"employer_lat"`
+	// SiteID is set when the employer position is the trainee's site
+	SiteID          *int    `json:"site_id,omitempty"`
 	StudentLong     float64 `json:"student_long"`
 	StudentLat      float64 `json:"student_lat"`
 	InRange         bool    `json:"in_range"`
 	DrivingDistance int     `json:"driving_distance_meters,omitempty"`
 	Displacement    int     `json:"displacement_meters,omitempty"`
-}
-
-// Google Distance Matrix API response struct (partial)
-type googleDistanceMatrixResponse struct {
-	Rows []struct {
-		Elements []struct {
-			Distance struct {
-				Value int `json:"value"`
-			} `json:"distance"`
-			Status string `json:"status"`
-		} `json:"elements"`
-	} `json:"rows"`
-	Status string `json:"status"`
-}
-
-func getGoogleDistance(lat1, lon1, lat2, lon2 float64) (int, error) {
-	apiKey := os.Getenv("GOOGLE_MAPS_API_KEY")
-	if apiKey == "" {
-		return 0, fmt.Errorf("google Maps API key not set")
-	}
-	url := fmt.Sprintf(
-		"https://maps.googleapis.com/maps/api/distancematrix/json?origins=%f,%f&destinations=%f,%f&key=%s",
-		lat1, lon1, lat2, lon2, apiKey,
-	)
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return 0, err
-	}
-	var apiResp googleDistanceMatrixResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return 0, err
-	}
-	if apiResp.Status != "OK" ||
-		len(apiResp.Rows) == 0 ||
-		len(apiResp.Rows[0].Elements) == 0 ||
-		apiResp.Rows[0].Elements[0].Status != "OK" {
-		return 0, fmt.Errorf("google API error or no route found")
-	}
-	return apiResp.Rows[0].Elements[0].Distance.Value, nil
+	// DistanceProvider names where DrivingDistance came from; "haversine"
+	// means no routing provider answered and it is a straight line
+	DistanceProvider string `json:"distance_provider"`
 }
 
 // Haversine formula to calculate straight-line distance in meters
@@ -87,50 +45,55 @@ func sqrt(x float64) float64     { return math.Sqrt(x) }
 
 func ValidateLocationHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		studentID := r.Header.Get("student-id")
-		if studentID == "" {
-			http.Error(w, "student_id is required", http.StatusBadRequest)
+		studentID, err := authenticatedStudentID(r)
+		if err != nil {
+			http.Error(w, "Trainee session required", http.StatusUnauthorized)
 			return
 		}
 
-		query := `
-			SELECT 
-				e.addr_long AS employer_long,
-				e.addr_lat AS employer_lat,
-				s.home_long AS student_long,
-				s.home_lat AS student_lat
-			FROM 
-				employer AS e
-			INNER JOIN 
-				student AS s 
-			ON 
-				e.id = s.employer_id
-			WHERE s.id = $1
-			LIMIT 1
-		`
-
+		// The trainee's site when they are placed at one, otherwise the
+		// employer's head office
+		now := time.Now()
+		loc, err := studentLocation(database.DB, studentID, now)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		wp, found, err := loadWorkplace(database.DB, studentID, localDate(now, loc))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "No data found", http.StatusNotFound)
+			return
+		}
 		var resp LocationResponse
-		err := database.DB.QueryRow(query, studentID).Scan(
-			&resp.EmployerLong,
-			&resp.EmployerLat,
+		if wp.Position != nil {
+			resp.EmployerLat, resp.EmployerLong = wp.Position.Lat, wp.Position.Lng
+		}
+		resp.SiteID = wp.SiteID
+		err = database.DB.QueryRow(`SELECT home_long, home_lat FROM student WHERE id = $1`, studentID).Scan(
 			&resp.StudentLong,
 			&resp.StudentLat,
 		)
-		if err == sql.ErrNoRows {
-			http.Error(w, "No data found", http.StatusNotFound)
-			return
-		} else if err != nil {
+		if err != nil {
 			http.Error(w, "Database error", http.StatusInternalServerError)
 			return
 		}
 
-		// Use Google Distance Matrix API for driving distance
-		drivingDistance, err := getGoogleDistance(resp.EmployerLat, resp.EmployerLong, resp.StudentLat, resp.StudentLong)
+		// Route distance from the configured providers
+		measured, err := distances.Measure(r.Context(),
+			LatLng{Lat: resp.EmployerLat, Lng: resp.EmployerLong},
+			LatLng{Lat: resp.StudentLat, Lng: resp.StudentLong},
+		)
 		if err != nil {
-			http.Error(w, "Failed to get distance from Google API: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Failed to measure distance: "+err.Error(), http.StatusBadGateway)
 			return
 		}
+		drivingDistance := measured.Meters
 		resp.DrivingDistance = drivingDistance
+		resp.DistanceProvider = measured.Provider
 
 		// Calculate displacement (straight-line distance)
 		resp.Displacement = haversine(resp.EmployerLat, resp.EmployerLong, resp.StudentLat, resp.StudentLong)
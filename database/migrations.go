@@ -0,0 +1,530 @@
+package database
+
+import (
+	"log"
+)
+
+// migrations holds the schema changes the server depends on. The list is
+// replayed on every start, so each statement must be idempotent. Append new
+// statements at the end; never edit one that has already shipped.
+var migrations = []string{
+	// Refresh tokens issued after a successful OTP validation. Only the
+	// SHA-256 hash of the token is stored.
+	`CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id          SERIAL PRIMARY KEY,
+		subject     TEXT NOT NULL,
+		token_hash  TEXT NOT NULL UNIQUE,
+		expires_at  TIMESTAMPTZ NOT NULL,
+		revoked_at  TIMESTAMPTZ,
+		replaced_by INTEGER REFERENCES refresh_tokens(id),
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_subject ON refresh_tokens (subject)`,
+
+	// Device enrollment. Devices are paired on OTP validation and keep only a
+	// hash of their secret; legacy plaintext rows can never be verified.
+	`CREATE TABLE IF NOT EXISTS authorized_devices (
+		id          SERIAL PRIMARY KEY,
+		student_id  INTEGER NOT NULL,
+		secret_code TEXT,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`ALTER TABLE authorized_devices
+		ADD COLUMN IF NOT EXISTS secret_hash TEXT,
+		ADD COLUMN IF NOT EXISTS device_name TEXT,
+		ADD COLUMN IF NOT EXISTS platform TEXT,
+		ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMPTZ`,
+	`ALTER TABLE authorized_devices ALTER COLUMN secret_code DROP NOT NULL`,
+	`UPDATE authorized_devices SET revoked_at = NOW() WHERE secret_hash IS NULL AND revoked_at IS NULL`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_authorized_devices_secret_hash ON authorized_devices (secret_hash)`,
+	`CREATE INDEX IF NOT EXISTS idx_authorized_devices_student ON authorized_devices (student_id)`,
+	`ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS device_id INTEGER REFERENCES authorized_devices(id)`,
+
+	// Staff accounts for the web dashboard. Supervisor accounts are linked to
+	// a supervisor row and employer contacts to an employer row, which scopes
+	// the trainees they can see.
+	`CREATE TABLE IF NOT EXISTS staff_accounts (
+		id            SERIAL PRIMARY KEY,
+		email         TEXT NOT NULL,
+		display_name  TEXT NOT NULL DEFAULT '',
+		password_hash TEXT,
+		role          TEXT NOT NULL CHECK (role IN ('admin', 'supervisor', 'employer')),
+		supervisor_id INTEGER,
+		employer_id   INTEGER,
+		is_active     BOOLEAN NOT NULL DEFAULT TRUE,
+		last_login_at TIMESTAMPTZ,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_staff_accounts_email ON staff_accounts (LOWER(email))`,
+	`CREATE TABLE IF NOT EXISTS staff_login_codes (
+		id         SERIAL PRIMARY KEY,
+		staff_id   INTEGER NOT NULL REFERENCES staff_accounts(id),
+		code_hash  TEXT NOT NULL,
+		attempts   INTEGER NOT NULL DEFAULT 0,
+		expires_at TIMESTAMPTZ NOT NULL,
+		used_at    TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_staff_login_codes_staff ON staff_login_codes (staff_id)`,
+
+	// OTPs are stored as a keyed hash so they can be verified but not read
+	// back. Plaintext codes from before this change are discarded.
+	`ALTER TABLE otps ADD COLUMN IF NOT EXISTS otp_hash TEXT`,
+	`ALTER TABLE otps ALTER COLUMN otp_code DROP NOT NULL`,
+	`UPDATE otps SET otp_code = NULL, is_used = TRUE WHERE otp_hash IS NULL AND (otp_code IS NOT NULL OR is_used = FALSE)`,
+	`CREATE INDEX IF NOT EXISTS idx_otps_otp_hash ON otps (otp_hash)`,
+	// Every OTP validation attempt. Rate limits and lockouts are computed from
+	// the failures recorded here, which also serves as the audit trail.
+	`CREATE TABLE IF NOT EXISTS otp_attempts (
+		id         SERIAL PRIMARY KEY,
+		ip_address TEXT NOT NULL,
+		student_id INTEGER,
+		otp_id     INTEGER,
+		success    BOOLEAN NOT NULL,
+		reason     TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_otp_attempts_ip_created ON otp_attempts (ip_address, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_otp_attempts_failed_created ON otp_attempts (created_at) WHERE NOT success`,
+
+	// Optional timezone overrides for attendance day boundaries. NULL means
+	// the employer's zone for a trainee, and ORG_TIMEZONE for an employer.
+	`ALTER TABLE employer ADD COLUMN IF NOT EXISTS timezone TEXT`,
+	`ALTER TABLE student ADD COLUMN IF NOT EXISTS timezone TEXT`,
+
+	// Append-only attendance event log. The attendance table is a projection
+	// of these events into sessions; the events themselves are never updated
+	// or deleted.
+	`CREATE TABLE IF NOT EXISTS attendance_events (
+		id          SERIAL PRIMARY KEY,
+		student_id  INTEGER NOT NULL,
+		session_id  INTEGER,
+		event_type  TEXT NOT NULL CHECK (event_type IN ('check_in', 'check_out', 'break_start', 'break_end')),
+		occurred_at TIMESTAMPTZ NOT NULL,
+		latitude    DOUBLE PRECISION,
+		longitude   DOUBLE PRECISION,
+		device_id   INTEGER,
+		source      TEXT NOT NULL DEFAULT 'app',
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_events_student_time ON attendance_events (student_id, occurred_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_events_session ON attendance_events (session_id)`,
+	`CREATE OR REPLACE FUNCTION attendance_events_immutable() RETURNS trigger AS $$
+	BEGIN
+		RAISE EXCEPTION 'attendance_events is append-only';
+	END;
+	$$ LANGUAGE plpgsql`,
+	`DROP TRIGGER IF EXISTS attendance_events_no_change ON attendance_events`,
+	`CREATE TRIGGER attendance_events_no_change BEFORE UPDATE OR DELETE ON attendance_events
+		FOR EACH ROW EXECUTE FUNCTION attendance_events_immutable()`,
+	`ALTER TABLE attendance
+		ADD COLUMN IF NOT EXISTS check_in_event_id INTEGER,
+		ADD COLUMN IF NOT EXISTS check_out_event_id INTEGER,
+		ADD COLUMN IF NOT EXISTS orphan_checkout BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS break_minutes INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS on_break_since TIMESTAMPTZ`,
+	`ALTER TABLE attendance ALTER COLUMN check_in_date_time DROP NOT NULL`,
+	`ALTER TABLE attendance ALTER COLUMN check_in_lat DROP NOT NULL`,
+	`ALTER TABLE attendance ALTER COLUMN check_in_long DROP NOT NULL`,
+	// Checkouts without a check-in used to be stored with a zero timestamp
+	`UPDATE attendance SET orphan_checkout = true, check_in_date_time = NULL, check_in_lat = NULL, check_in_long = NULL
+		WHERE check_in_date_time < '1971-01-01'`,
+	// Seed the event log from sessions recorded before it existed
+	`WITH ins AS (
+		INSERT INTO attendance_events (student_id, session_id, event_type, occurred_at, latitude, longitude, source)
+		SELECT student_id, id, 'check_in', check_in_date_time, check_in_lat, check_in_long, 'backfill'
+		FROM attendance WHERE check_in_event_id IS NULL AND check_in_date_time IS NOT NULL
+		RETURNING id, session_id
+	) UPDATE attendance a SET check_in_event_id = ins.id FROM ins WHERE a.id = ins.session_id`,
+	`WITH ins AS (
+		INSERT INTO attendance_events (student_id, session_id, event_type, occurred_at, latitude, longitude, source)
+		SELECT student_id, id, 'check_out', check_out_date_time, check_out_lat, check_out_long, 'backfill'
+		FROM attendance WHERE check_out_event_id IS NULL AND check_out_date_time IS NOT NULL
+		RETURNING id, session_id
+	) UPDATE attendance a SET check_out_event_id = ins.id FROM ins WHERE a.id = ins.session_id`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_open ON attendance (student_id) WHERE check_out_date_time IS NULL`,
+
+	// Per-employer geofence. NULL falls back to GEOFENCE_DEFAULT_RADIUS_METERS
+	// and GEOFENCE_DEFAULT_POLICY.
+	`ALTER TABLE employer
+		ADD COLUMN IF NOT EXISTS geofence_radius_m INTEGER CHECK (geofence_radius_m > 0),
+		ADD COLUMN IF NOT EXISTS geofence_policy TEXT CHECK (geofence_policy IN ('reject', 'flag', 'silent'))`,
+	`ALTER TABLE attendance_events
+		ADD COLUMN IF NOT EXISTS geofence_status TEXT NOT NULL DEFAULT 'unknown' CHECK (geofence_status IN ('inside', 'outside', 'unknown')),
+		ADD COLUMN IF NOT EXISTS distance_m INTEGER,
+		ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE attendance
+		ADD COLUMN IF NOT EXISTS check_in_geofence TEXT,
+		ADD COLUMN IF NOT EXISTS check_in_distance_m INTEGER,
+		ADD COLUMN IF NOT EXISTS check_out_geofence TEXT,
+		ADD COLUMN IF NOT EXISTS check_out_distance_m INTEGER,
+		ADD COLUMN IF NOT EXISTS flagged BOOLEAN NOT NULL DEFAULT false`,
+
+	// Punctuality computed by the server from the trainee's schedule
+	`ALTER TABLE attendance
+		ADD COLUMN IF NOT EXISTS scheduled_check_in TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS scheduled_check_out TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS late_minutes INTEGER,
+		ADD COLUMN IF NOT EXISTS early_leave_minutes INTEGER`,
+
+	// Weekly work schedules with breaks, and one-off overrides. Weekday 0 is
+	// Sunday. Trainees without a schedule fall back to student.check_in_time
+	// and check_out_time.
+	`CREATE TABLE IF NOT EXISTS work_schedules (
+		id             SERIAL PRIMARY KEY,
+		student_id     INTEGER NOT NULL,
+		employer_id    INTEGER,
+		name           TEXT NOT NULL DEFAULT '',
+		effective_from DATE NOT NULL,
+		effective_to   DATE,
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		CHECK (effective_to IS NULL OR effective_to >= effective_from)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_work_schedules_student ON work_schedules (student_id, effective_from)`,
+	`CREATE TABLE IF NOT EXISTS schedule_shifts (
+		id          SERIAL PRIMARY KEY,
+		schedule_id INTEGER NOT NULL REFERENCES work_schedules(id) ON DELETE CASCADE,
+		weekday     SMALLINT NOT NULL CHECK (weekday BETWEEN 0 AND 6),
+		start_time  TIME NOT NULL,
+		end_time    TIME NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_schedule_shifts_schedule ON schedule_shifts (schedule_id, weekday)`,
+	`CREATE TABLE IF NOT EXISTS schedule_breaks (
+		id         SERIAL PRIMARY KEY,
+		shift_id   INTEGER NOT NULL REFERENCES schedule_shifts(id) ON DELETE CASCADE,
+		start_time TIME NOT NULL,
+		end_time   TIME NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS schedule_overrides (
+		id          SERIAL PRIMARY KEY,
+		student_id  INTEGER NOT NULL,
+		date        DATE NOT NULL,
+		day_off     BOOLEAN NOT NULL DEFAULT false,
+		start_time  TIME,
+		end_time    TIME,
+		reason      TEXT NOT NULL DEFAULT '',
+		created_by  INTEGER,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (student_id, date),
+		CHECK (day_off OR (start_time IS NOT NULL AND end_time IS NOT NULL))
+	)`,
+	// Background jobs: detected absences, auto-closed sessions and a log of
+	// what each job did for supervisors to review
+	`ALTER TABLE attendance ADD COLUMN IF NOT EXISTS auto_closed BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS absences (
+		id              SERIAL PRIMARY KEY,
+		student_id      INTEGER NOT NULL,
+		date            DATE NOT NULL,
+		scheduled_start TIMESTAMPTZ,
+		detected_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		cleared_at      TIMESTAMPTZ,
+		UNIQUE (student_id, date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS job_actions (
+		id            SERIAL PRIMARY KEY,
+		job           TEXT NOT NULL,
+		action        TEXT NOT NULL,
+		student_id    INTEGER NOT NULL,
+		attendance_id INTEGER,
+		absence_id    INTEGER,
+		detail        TEXT NOT NULL DEFAULT '',
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		reviewed_by   INTEGER,
+		reviewed_at   TIMESTAMPTZ,
+		review_note   TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_job_actions_unreviewed ON job_actions (created_at) WHERE reviewed_at IS NULL`,
+	// Correction requests. Approved corrections are appended to the event log
+	// as new events pointing at the event they supersede.
+	`CREATE TABLE IF NOT EXISTS attendance_corrections (
+		id                   SERIAL PRIMARY KEY,
+		student_id           INTEGER NOT NULL,
+		session_id           INTEGER,
+		kind                 TEXT NOT NULL CHECK (kind IN ('missing_check_in', 'missing_check_out', 'wrong_time', 'wrong_location')),
+		event_type           TEXT NOT NULL CHECK (event_type IN ('check_in', 'check_out')),
+		requested_time       TIMESTAMPTZ,
+		requested_end_time   TIMESTAMPTZ,
+		latitude             DOUBLE PRECISION,
+		longitude            DOUBLE PRECISION,
+		reason               TEXT NOT NULL,
+		status               TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+		submitted_by_student INTEGER,
+		submitted_by_staff   INTEGER,
+		decided_by           INTEGER,
+		decided_at           TIMESTAMPTZ,
+		decision_note        TEXT NOT NULL DEFAULT '',
+		created_at           TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_corrections_pending ON attendance_corrections (created_at) WHERE status = 'pending'`,
+	`ALTER TABLE attendance_events
+		ADD COLUMN IF NOT EXISTS correction_id INTEGER,
+		ADD COLUMN IF NOT EXISTS supersedes_event_id INTEGER`,
+	`ALTER TABLE attendance ADD COLUMN IF NOT EXISTS corrected BOOLEAN NOT NULL DEFAULT false`,
+	// Offline sync: replayed events are recognised by their idempotency key,
+	// and the device's own timestamp is kept next to the corrected one
+	`ALTER TABLE attendance_events
+		ADD COLUMN IF NOT EXISTS idempotency_key TEXT,
+		ADD COLUMN IF NOT EXISTS device_occurred_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS clock_offset_s INTEGER`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS idx_attendance_events_idempotency ON attendance_events (student_id, idempotency_key)
+		WHERE idempotency_key IS NOT NULL`,
+	// Days on which a trainee is excused: organisation holidays, employer
+	// closures and approved leave
+	`CREATE TABLE IF NOT EXISTS holidays (
+		id         SERIAL PRIMARY KEY,
+		date       DATE NOT NULL UNIQUE,
+		name       TEXT NOT NULL,
+		source     TEXT NOT NULL DEFAULT 'manual',
+		uid        TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE TABLE IF NOT EXISTS employer_closures (
+		id          SERIAL PRIMARY KEY,
+		employer_id INTEGER NOT NULL,
+		date        DATE NOT NULL,
+		reason      TEXT NOT NULL DEFAULT '',
+		created_by  INTEGER,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (employer_id, date)
+	)`,
+	`CREATE TABLE IF NOT EXISTS leave_requests (
+		id                   SERIAL PRIMARY KEY,
+		student_id           INTEGER NOT NULL,
+		start_date           DATE NOT NULL,
+		end_date             DATE NOT NULL,
+		leave_type           TEXT NOT NULL,
+		reason               TEXT NOT NULL DEFAULT '',
+		status               TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'approved', 'rejected')),
+		submitted_by_student INTEGER,
+		submitted_by_staff   INTEGER,
+		decided_by           INTEGER,
+		decided_at           TIMESTAMPTZ,
+		decision_note        TEXT NOT NULL DEFAULT '',
+		created_at           TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		CHECK (end_date >= start_date)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_leave_requests_student ON leave_requests (student_id, start_date)`,
+	`ALTER TABLE absences ADD COLUMN IF NOT EXISTS excused TEXT`,
+	// Attendance history pages by time within a trainee
+	`CREATE INDEX IF NOT EXISTS idx_attendance_student_check_in ON attendance (student_id, check_in_date_time)`,
+
+	// Individual breaks within a session. minutes and paid_minutes are set
+	// when the break ends; overrun marks a break longer than the employer
+	// allows and alerted_at when the job raised it for review.
+	`CREATE TABLE IF NOT EXISTS attendance_breaks (
+		id             SERIAL PRIMARY KEY,
+		session_id     INTEGER NOT NULL,
+		student_id     INTEGER NOT NULL,
+		started_at     TIMESTAMPTZ NOT NULL,
+		start_lat      DOUBLE PRECISION,
+		start_long     DOUBLE PRECISION,
+		start_event_id INTEGER,
+		ended_at       TIMESTAMPTZ,
+		end_lat        DOUBLE PRECISION,
+		end_long       DOUBLE PRECISION,
+		end_event_id   INTEGER,
+		minutes        INTEGER,
+		paid_minutes   INTEGER NOT NULL DEFAULT 0,
+		overrun        BOOLEAN NOT NULL DEFAULT false,
+		alerted_at     TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_breaks_session ON attendance_breaks (session_id)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_breaks_student ON attendance_breaks (student_id, started_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_breaks_unalerted ON attendance_breaks (id) WHERE alerted_at IS NULL`,
+	// Breaks already running when this was deployed
+	`INSERT INTO attendance_breaks (session_id, student_id, started_at)
+		SELECT a.id, a.student_id, a.on_break_since FROM attendance a
+		WHERE a.on_break_since IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM attendance_breaks b WHERE b.session_id = a.id AND b.ended_at IS NULL)`,
+	`ALTER TABLE attendance ADD COLUMN IF NOT EXISTS paid_break_minutes INTEGER NOT NULL DEFAULT 0`,
+	// Per-employer break rules. NULL falls back to BREAK_MAX_MINUTES and
+	// BREAK_PAID_MINUTES.
+	`ALTER TABLE employer
+		ADD COLUMN IF NOT EXISTS max_break_minutes INTEGER CHECK (max_break_minutes >= 0),
+		ADD COLUMN IF NOT EXISTS paid_break_minutes INTEGER CHECK (paid_break_minutes >= 0)`,
+
+	// Site codes (QR, NFC, kiosk). Signing keys are derived from
+	// SITE_TOKEN_SECRET and the row id, so rows only record rotation.
+	`CREATE TABLE IF NOT EXISTS site_token_keys (
+		id          SERIAL PRIMARY KEY,
+		employer_id INTEGER NOT NULL,
+		created_by  INTEGER,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		revoked_at  TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_site_token_keys_employer ON site_token_keys (employer_id) WHERE revoked_at IS NULL`,
+	// How each event was tied to the workplace: qr, nfc, kiosk, gps, none or
+	// correction. NULL on events recorded before this existed.
+	`ALTER TABLE attendance_events ADD COLUMN IF NOT EXISTS verification_method TEXT`,
+	`ALTER TABLE attendance
+		ADD COLUMN IF NOT EXISTS check_in_verification TEXT,
+		ADD COLUMN IF NOT EXISTS check_out_verification TEXT`,
+	// Location anomaly scoring. The score and its reasons are stored with the
+	// event; events scoring over ANOMALY_REVIEW_SCORE also get a row in the
+	// review queue.
+	`ALTER TABLE attendance_events
+		ADD COLUMN IF NOT EXISTS accuracy_m DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS mock_location BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS anomaly_score INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS anomaly_reasons JSONB NOT NULL DEFAULT '[]'`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_events_position ON attendance_events (student_id, latitude, longitude)`,
+	`CREATE TABLE IF NOT EXISTS attendance_anomalies (
+		id          SERIAL PRIMARY KEY,
+		event_id    INTEGER NOT NULL UNIQUE,
+		student_id  INTEGER NOT NULL,
+		score       INTEGER NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		outcome     TEXT CHECK (outcome IN ('genuine', 'spoofed')),
+		reviewed_by INTEGER,
+		reviewed_at TIMESTAMPTZ,
+		review_note TEXT NOT NULL DEFAULT ''
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_attendance_anomalies_unreviewed ON attendance_anomalies (created_at) WHERE reviewed_at IS NULL`,
+	// Commute tracking is opt-in per trainee. commute_notify says who hears
+	// about departures, arrivals and overdue trips; commute_minutes overrides
+	// the travel time estimated from the route.
+	`ALTER TABLE student
+		ADD COLUMN IF NOT EXISTS commute_tracking BOOLEAN NOT NULL DEFAULT false,
+		ADD COLUMN IF NOT EXISTS commute_notify TEXT NOT NULL DEFAULT 'guardian' CHECK (commute_notify IN ('guardian', 'supervisor', 'both')),
+		ADD COLUMN IF NOT EXISTS commute_minutes INTEGER CHECK (commute_minutes > 0)`,
+	// One trip to work per trainee per day, built up from the app's pings
+	`CREATE TABLE IF NOT EXISTS commute_trips (
+		id                 SERIAL PRIMARY KEY,
+		student_id         INTEGER NOT NULL,
+		trip_date          DATE NOT NULL,
+		status             TEXT NOT NULL DEFAULT 'at_home' CHECK (status IN ('at_home', 'travelling', 'arrived', 'overdue')),
+		window_start       TIMESTAMPTZ NOT NULL,
+		window_end         TIMESTAMPTZ NOT NULL,
+		left_home_at       TIMESTAMPTZ,
+		expected_minutes   INTEGER,
+		expected_by        TIMESTAMPTZ,
+		arrived_at         TIMESTAMPTZ,
+		overdue_alerted_at TIMESTAMPTZ,
+		last_ping_at       TIMESTAMPTZ,
+		last_lat           DOUBLE PRECISION,
+		last_long          DOUBLE PRECISION,
+		UNIQUE (student_id, trip_date)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_commute_trips_travelling ON commute_trips (expected_by) WHERE status = 'travelling'`,
+	`CREATE TABLE IF NOT EXISTS commute_pings (
+		id          SERIAL PRIMARY KEY,
+		trip_id     INTEGER NOT NULL REFERENCES commute_trips (id) ON DELETE CASCADE,
+		student_id  INTEGER NOT NULL,
+		recorded_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		latitude    DOUBLE PRECISION NOT NULL,
+		longitude   DOUBLE PRECISION NOT NULL,
+		accuracy_m  DOUBLE PRECISION
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_commute_pings_trip ON commute_pings (trip_id, recorded_at)`,
+	// Branches of an employer. A trainee placed at a site is checked against
+	// the site's position and geofence instead of the employer's head office.
+	// geofence_polygon is a JSON array of {"lat", "long"} points and takes
+	// the place of the radius when set.
+	`CREATE TABLE IF NOT EXISTS employer_sites (
+		id                SERIAL PRIMARY KEY,
+		employer_id       INTEGER NOT NULL,
+		name              TEXT NOT NULL,
+		address_line1     TEXT NOT NULL DEFAULT '',
+		address_line2     TEXT NOT NULL DEFAULT '',
+		city              TEXT NOT NULL DEFAULT '',
+		addr_lat          DOUBLE PRECISION NOT NULL,
+		addr_long         DOUBLE PRECISION NOT NULL,
+		geofence_radius_m INTEGER CHECK (geofence_radius_m > 0),
+		geofence_polygon  JSONB,
+		contact_name      TEXT NOT NULL DEFAULT '',
+		contact_number    TEXT NOT NULL DEFAULT '',
+		contact_email     TEXT NOT NULL DEFAULT '',
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_employer_sites_employer ON employer_sites (employer_id)`,
+	`ALTER TABLE student ADD COLUMN IF NOT EXISTS site_id INTEGER`,
+	// Placements keep the history of a trainee's employer, site and
+	// supervisor. end_date is the last day of the placement, NULL while it
+	// is open.
+	`CREATE TABLE IF NOT EXISTS placements (
+		id             SERIAL PRIMARY KEY,
+		student_id     INTEGER NOT NULL,
+		employer_id    INTEGER NOT NULL,
+		site_id        INTEGER,
+		supervisor_id  INTEGER,
+		job_title      TEXT NOT NULL DEFAULT '',
+		hours_per_week NUMERIC(4,1),
+		status         TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('trial', 'active', 'ended')),
+		start_date     DATE NOT NULL,
+		end_date       DATE,
+		end_reason     TEXT NOT NULL DEFAULT '',
+		created_by     INTEGER,
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		CHECK (end_date IS NULL OR end_date >= start_date)
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_placements_student ON placements (student_id, start_date)`,
+	`CREATE INDEX IF NOT EXISTS idx_placements_employer ON placements (employer_id, start_date)`,
+	// Existing trainees get an open placement with their current employer,
+	// starting from their first recorded day so old attendance stays
+	// attributed to it
+	`INSERT INTO placements (student_id, employer_id, site_id, supervisor_id, start_date)
+	SELECT s.id, s.employer_id, s.site_id, s.supervisor_id, COALESCE(LEAST(
+		(SELECT MIN(COALESCE(a.check_in_date_time, a.check_out_date_time))::date FROM attendance a WHERE a.student_id = s.id),
+		(SELECT MIN(ab.date) FROM absences ab WHERE ab.student_id = s.id)
+	), CURRENT_DATE)
+	FROM student s
+	WHERE s.employer_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM placements p WHERE p.student_id = s.id)`,
+	// Employers with placement history are archived instead of deleted
+	`ALTER TABLE employer ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ`,
+	// Geocoded position of the address and how the stored coordinates
+	// compare with it. location_source is manual, geocoded or confirmed.
+	`ALTER TABLE employer ADD COLUMN IF NOT EXISTS geocode_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_long DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_confidence DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_provider TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS geocoded_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS location_source TEXT NOT NULL DEFAULT 'manual',
+		ADD COLUMN IF NOT EXISTS location_mismatch_m INTEGER,
+		ADD COLUMN IF NOT EXISTS location_confirmed_by INTEGER,
+		ADD COLUMN IF NOT EXISTS location_confirmed_at TIMESTAMPTZ`,
+	`ALTER TABLE student ADD COLUMN IF NOT EXISTS geocode_lat DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_long DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_confidence DOUBLE PRECISION,
+		ADD COLUMN IF NOT EXISTS geocode_provider TEXT NOT NULL DEFAULT '',
+		ADD COLUMN IF NOT EXISTS geocoded_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS location_source TEXT NOT NULL DEFAULT 'manual',
+		ADD COLUMN IF NOT EXISTS location_mismatch_m INTEGER,
+		ADD COLUMN IF NOT EXISTS location_confirmed_by INTEGER,
+		ADD COLUMN IF NOT EXISTS location_confirmed_at TIMESTAMPTZ`,
+	// Weekly schedules belong to a placement and stop applying when the
+	// trainee moves to another one. Existing schedules are linked to the
+	// placement in force when they took effect.
+	`ALTER TABLE work_schedules ADD COLUMN IF NOT EXISTS placement_id INTEGER`,
+	`UPDATE work_schedules w SET placement_id = p.id, employer_id = p.employer_id
+	FROM placements p
+	WHERE w.placement_id IS NULL AND p.student_id = w.student_id AND p.status <> 'void'
+		AND p.start_date <= w.effective_from AND (p.end_date IS NULL OR p.end_date >= w.effective_from)`,
+
+	// Staff logins and login code requests, throttled like OTP attempts.
+	// email is stored lower-cased whether or not it belongs to an account.
+	`CREATE TABLE IF NOT EXISTS staff_login_attempts (
+		id         SERIAL PRIMARY KEY,
+		ip_address TEXT NOT NULL,
+		email      TEXT NOT NULL,
+		kind       TEXT NOT NULL,
+		success    BOOLEAN NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_staff_login_attempts_ip ON staff_login_attempts (ip_address, created_at)`,
+	`CREATE INDEX IF NOT EXISTS idx_staff_login_attempts_email ON staff_login_attempts (email, created_at)`,
+	// Placements entered in error are voided rather than deleted
+	`ALTER TABLE placements
+		DROP CONSTRAINT IF EXISTS placements_status_check,
+		ADD CONSTRAINT placements_status_check CHECK (status IN ('trial', 'active', 'ended', 'void'))`,
+}
+
+// Migrate applies the schema migrations against the connected database.
+func Migrate() {
+	for i, stmt := range migrations {
+		if _, err := DB.Exec(stmt); err != nil {
+			log.Fatalf("❌ Migration %d failed: %v", i+1, err)
+		}
+	}
+	log.Printf("✅ Applied %d schema migrations", len(migrations))
+}
@@ -7,6 +7,7 @@ import (
 	"server/controllers"
 	"server/database"
 	"server/routes"
+	_ "time/tzdata" // the runtime image ships without zoneinfo
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -22,6 +23,19 @@ func main() {
 
 	// Connect to DB with environment variables
 	database.ConnectDB()
+	database.Migrate()
+	controllers.LoadOrgTimezone()
+
+	// "timesheet" exports timesheets and exits instead of serving
+	if len(os.Args) > 1 && os.Args[1] == "timesheet" {
+		if err := controllers.RunTimesheetCommand(os.Args[2:]); err != nil {
+			log.Fatalf("❌ Timesheet export failed: %v", err)
+		}
+		return
+	}
+	controllers.LoadDistanceProviders()
+	controllers.LoadGeocoder()
+	controllers.StartBackgroundJobs()
 
 	// Define router
 	router := mux.NewRouter()
@@ -48,6 +62,7 @@ func main() {
 	)
 
 	authService := controllers.NewAuthService()
+	controllers.EnsureBootstrapAdmin()
 	authService.RegisterRoutes(router)
 	router.Use(corsMiddleware)
 
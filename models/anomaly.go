@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// AnomalyReason is one signal that made an attendance event look spoofed.
+// Weight is how much it added to the event's anomaly score.
+type AnomalyReason struct {
+	Code   string `json:"code"`
+	Detail string `json:"detail"`
+	Weight int    `json:"weight"`
+}
+
+// AttendanceAnomaly is an entry in the review queue: an attendance event
+// whose anomaly score reached the review threshold. Outcome is genuine or
+// spoofed once a supervisor has looked at it.
+type AttendanceAnomaly struct {
+	ID         int             `json:"id"`
+	EventID    int             `json:"event_id"`
+	SessionID  *int            `json:"session_id"`
+	StudentID  int             `json:"student_id"`
+	FirstName  string          `json:"first_name"`
+	LastName   string          `json:"last_name"`
+	EventType  string          `json:"event_type"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Latitude   *float64        `json:"latitude"`
+	Longitude  *float64        `json:"longitude"`
+	AccuracyM  *float64        `json:"accuracy_m"`
+	Score      int             `json:"score"`
+	Reasons    []AnomalyReason `json:"reasons"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Outcome    *string         `json:"outcome"`
+	ReviewedBy *int            `json:"reviewed_by"`
+	ReviewedAt *time.Time      `json:"reviewed_at"`
+	ReviewNote string          `json:"review_note"`
+}
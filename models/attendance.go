@@ -5,13 +5,138 @@ import (
 	"time"
 )
 
+// Attendance is one work session derived from the attendance event log. An
+// orphan checkout is a check-out that had no open check-in; its check-in
+// fields are null.
 type Attendance struct {
 	ID               uint            `json:"id"`
 	StudentID        int             `json:"student_id"`
-	CheckInDateTime  time.Time       `json:"check_in_date_time"`
-	CheckInLong      float64         `json:"check_in_long"`
-	CheckInLat       float64         `json:"check_in_lat"`
+	CheckInDateTime  *time.Time      `json:"check_in_date_time"`
+	CheckInLong      *float64        `json:"check_in_long"`
+	CheckInLat       *float64        `json:"check_in_lat"`
 	CheckOutDateTime sql.NullTime    `json:"check_out_date_time"`
 	CheckOutLong     sql.NullFloat64 `json:"check_out_long"`
 	CheckOutLat      sql.NullFloat64 `json:"check_out_lat"`
+	OrphanCheckout   bool            `json:"orphan_checkout"`
+	BreakMinutes     int             `json:"break_minutes"`
+	OnBreakSince     sql.NullTime    `json:"on_break_since"`
+	// PaidBreakMinutes is the part of BreakMinutes that counts as working
+	// time. NetWorkedMinutes is the session length less unpaid breaks, set
+	// once the session has both a check-in and a check-out.
+	PaidBreakMinutes int  `json:"paid_break_minutes"`
+	NetWorkedMinutes *int `json:"net_worked_minutes"`
+	// Geofence results for the check-in and check-out: inside, outside or
+	// unknown, with the distance to the workplace in metres
+	CheckInGeofence   *string `json:"check_in_geofence"`
+	CheckInDistanceM  *int    `json:"check_in_distance_m"`
+	CheckOutGeofence  *string `json:"check_out_geofence"`
+	CheckOutDistanceM *int    `json:"check_out_distance_m"`
+	Flagged           bool    `json:"flagged"`
+	// Punctuality against the schedule in force when the session started.
+	// LateMinutes is only set on the first session of a day.
+	ScheduledCheckIn  *time.Time `json:"scheduled_check_in"`
+	ScheduledCheckOut *time.Time `json:"scheduled_check_out"`
+	LateMinutes       *int       `json:"late_minutes"`
+	EarlyLeaveMinutes *int       `json:"early_leave_minutes"`
+	// AutoClosed is set when the session was checked out by the server
+	// because the trainee never did
+	AutoClosed bool `json:"auto_closed"`
+	// Corrected is set once an approved correction has changed the session
+	Corrected bool `json:"corrected"`
+	// How the check-in and check-out were tied to the workplace: qr, nfc or
+	// kiosk for a scanned site code, gps, none, or correction
+	CheckInVerification  *string `json:"check_in_verification"`
+	CheckOutVerification *string `json:"check_out_verification"`
+}
+
+// AttendanceEvent is an immutable entry in the attendance event log
+type AttendanceEvent struct {
+	ID         int       `json:"id"`
+	StudentID  int       `json:"student_id"`
+	SessionID  *int      `json:"session_id"`
+	EventType  string    `json:"event_type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Latitude   *float64  `json:"latitude"`
+	Longitude  *float64  `json:"longitude"`
+	DeviceID   *int      `json:"device_id"`
+	Source     string    `json:"source"`
+	RecordedAt time.Time `json:"recorded_at"`
+	// GeofenceStatus is inside, outside or unknown
+	GeofenceStatus string `json:"geofence_status"`
+	DistanceM      *int   `json:"distance_m"`
+	Flagged        bool   `json:"flagged"`
+	// Set on events appended by an approved correction
+	CorrectionID      *int `json:"correction_id,omitempty"`
+	SupersedesEventID *int `json:"supersedes_event_id,omitempty"`
+	// Set on events uploaded by offline sync. DeviceOccurredAt is the
+	// device's timestamp before ClockOffsetS was applied to it.
+	IdempotencyKey   *string    `json:"idempotency_key,omitempty"`
+	DeviceOccurredAt *time.Time `json:"device_occurred_at,omitempty"`
+	ClockOffsetS     *int       `json:"clock_offset_s,omitempty"`
+	// VerificationMethod is qr, nfc, kiosk, gps, none or correction
+	VerificationMethod string `json:"verification_method"`
+	// What the device reported about the fix, and how suspicious the event
+	// looked when it was recorded
+	AccuracyM      *float64        `json:"accuracy_m"`
+	MockLocation   bool            `json:"mock_location"`
+	AnomalyScore   int             `json:"anomaly_score"`
+	AnomalyReasons []AnomalyReason `json:"anomaly_reasons"`
+}
+
+// AttendanceRequest is posted by the trainee app. EventType is one of
+// check_in, check_out, break_start or break_end; older clients send CheckIn
+// instead. The position is nil when the app has no fix.
+type AttendanceRequest struct {
+	EventType string   `json:"event_type"`
+	CheckIn   bool     `json:"check_in"`
+	Latitude  *float64 `json:"check_in_lat"`
+	Longitude *float64 `json:"check_in_long"`
+	// SiteToken is a code scanned from the workplace's QR code, NFC tag or
+	// kiosk. When valid it proves presence in place of the geofence.
+	SiteToken string `json:"site_token"`
+	// AccuracyM is the fix's reported accuracy radius in metres and
+	// MockLocation is set when the OS says the position came from a mock
+	// location provider. Both are optional.
+	AccuracyM    *float64 `json:"accuracy_m"`
+	MockLocation bool     `json:"mock_location"`
+}
+
+// AttendanceSyncRequest is a batch of events the app queued while offline.
+// DeviceTime is the device clock when the batch was sent and lets the
+// server correct for a wrong clock.
+type AttendanceSyncRequest struct {
+	DeviceTime *time.Time            `json:"device_time"`
+	Events     []AttendanceSyncEvent `json:"events"`
+}
+
+// AttendanceSyncEvent is one queued event. IdempotencyKey is generated by the
+// app when the event is captured and stays the same on every retry.
+type AttendanceSyncEvent struct {
+	IdempotencyKey string    `json:"idempotency_key"`
+	EventType      string    `json:"event_type"`
+	OccurredAt     time.Time `json:"occurred_at"`
+	Latitude       *float64  `json:"latitude"`
+	Longitude      *float64  `json:"longitude"`
+	DeviceID       *int      `json:"device_id"`
+	SiteToken      string    `json:"site_token"`
+	AccuracyM      *float64  `json:"accuracy_m"`
+	MockLocation   bool      `json:"mock_location"`
+}
+
+// AttendanceSyncResult is the outcome of one event in a batch. Status is
+// applied, duplicate (already synced), conflict, rejected, or error when the
+// server failed and the event should be sent again.
+type AttendanceSyncResult struct {
+	IdempotencyKey string `json:"idempotency_key"`
+	Status         string `json:"status"`
+	EventID        *int   `json:"event_id,omitempty"`
+	SessionID      *int   `json:"session_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// AttendanceSyncResponse reports every event in the batch, in the order they
+// were sent
+type AttendanceSyncResponse struct {
+	ClockOffsetSeconds int                    `json:"clock_offset_seconds"`
+	Results            []AttendanceSyncResult `json:"results"`
 }
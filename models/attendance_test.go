@@ -0,0 +1,46 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestAttendanceCheckInJSON(t *testing.T) {
+	at := time.Date(2024, 3, 4, 2, 30, 0, 0, time.UTC)
+	lat, long := 6.9271, 79.8612
+
+	tests := []struct {
+		name string
+		in   Attendance
+		want map[string]any
+	}{
+		{
+			"checked in",
+			Attendance{CheckInDateTime: &at, CheckInLat: &lat, CheckInLong: &long},
+			map[string]any{"check_in_date_time": "2024-03-04T02:30:00Z", "check_in_lat": 6.9271, "check_in_long": 79.8612},
+		},
+		{
+			"orphan checkout",
+			Attendance{OrphanCheckout: true},
+			map[string]any{"check_in_date_time": nil, "check_in_lat": nil, "check_in_long": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range tt.want {
+				if got[k] != want {
+					t.Errorf("%s = %#v, want %#v (%s)", k, got[k], want, b)
+				}
+			}
+		})
+	}
+}
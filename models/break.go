@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// AttendanceBreak is one break within a session. Minutes is set when the
+// break ends, PaidMinutes being the part of it that counts as working time.
+// Overrun is set when the break ran longer than the employer allows.
+type AttendanceBreak struct {
+	ID          int        `json:"id"`
+	SessionID   int        `json:"session_id"`
+	StudentID   int        `json:"student_id"`
+	StartedAt   time.Time  `json:"started_at"`
+	StartLat    *float64   `json:"start_lat"`
+	StartLong   *float64   `json:"start_long"`
+	EndedAt     *time.Time `json:"ended_at"`
+	EndLat      *float64   `json:"end_lat"`
+	EndLong     *float64   `json:"end_long"`
+	Minutes     *int       `json:"minutes"`
+	PaidMinutes int        `json:"paid_minutes"`
+	Overrun     bool       `json:"overrun"`
+	AlertedAt   *time.Time `json:"alerted_at"`
+}
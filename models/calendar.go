@@ -0,0 +1,38 @@
+package models
+
+import "time"
+
+// Holiday is an organisation-wide day off. Source is "manual" or "ics" for
+// days imported from an iCalendar file.
+type Holiday struct {
+	ID     int    `json:"id"`
+	Date   string `json:"date"`
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// EmployerClosure is a day an employer's workplace is closed
+type EmployerClosure struct {
+	ID         int    `json:"id"`
+	EmployerID int    `json:"employer_id"`
+	Date       string `json:"date"`
+	Reason     string `json:"reason"`
+}
+
+// LeaveRequest is a trainee's request for time off, inclusive of both dates.
+// Status moves from pending to approved or rejected.
+type LeaveRequest struct {
+	ID                 int        `json:"id"`
+	StudentID          int        `json:"student_id"`
+	StartDate          string     `json:"start_date"`
+	EndDate            string     `json:"end_date"`
+	LeaveType          string     `json:"leave_type"`
+	Reason             string     `json:"reason"`
+	Status             string     `json:"status"`
+	SubmittedByStudent *int       `json:"submitted_by_student"`
+	SubmittedByStaff   *int       `json:"submitted_by_staff"`
+	DecidedBy          *int       `json:"decided_by"`
+	DecidedAt          *time.Time `json:"decided_at"`
+	DecisionNote       string     `json:"decision_note"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
@@ -9,7 +9,24 @@ type StudentCard struct {
 	EmployerName     *string   `json:"employer_name"` // Updated to pointer to handle NULL
 	CheckInDateTime  time.Time `json:"check_in_date_time"`
 	CheckOutDateTime time.Time `json:"check_out_date_time"`
-	Emotion          string    `json:"emotion"`
+	// AttendanceDate is the local day of the latest check-in and
+	// CheckedInToday whether that day is today, both in the trainee's timezone
+	AttendanceDate string `json:"attendance_date,omitempty"`
+	CheckedInToday bool   `json:"checked_in_today"`
+	// ScheduledToday is false on the trainee's days off
+	ScheduledToday bool `json:"scheduled_today"`
+	// Status is today's state: present, on_break, checked_out, auto_closed,
+	// absent, expected (due but not in yet), excused (holiday, closure or
+	// leave) or day_off
+	Status        string `json:"status"`
+	ExcusedReason string `json:"excused_reason,omitempty"`
+	AutoClosed    bool   `json:"auto_closed"`
+	// OnBreakSince is when the running break of an open session started
+	OnBreakSince *time.Time `json:"on_break_since,omitempty"`
+	// Punctuality of the latest session as computed by the server
+	LateMinutes       *int   `json:"late_minutes"`
+	EarlyLeaveMinutes *int   `json:"early_leave_minutes"`
+	Emotion           string `json:"emotion"`
 }
 
 func (StudentCard) TableName() string {
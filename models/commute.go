@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// CommuteSettings is a trainee's opt-in to commute tracking. Notify is
+// guardian, supervisor or both. ExpectedMinutes overrides the travel time
+// estimated from the route between home and work.
+type CommuteSettings struct {
+	Enabled         bool   `json:"enabled"`
+	Notify          string `json:"notify"`
+	ExpectedMinutes *int   `json:"expected_minutes"`
+}
+
+// CommuteTrip is a trainee's journey to work on one day. Status is at_home
+// until a ping leaves home, then travelling, and finally arrived or overdue.
+// The app should send pings between WindowStart and WindowEnd.
+type CommuteTrip struct {
+	ID               int        `json:"id"`
+	StudentID        int        `json:"student_id"`
+	Date             string     `json:"date"`
+	Status           string     `json:"status"`
+	WindowStart      time.Time  `json:"window_start"`
+	WindowEnd        time.Time  `json:"window_end"`
+	LeftHomeAt       *time.Time `json:"left_home_at"`
+	ExpectedMinutes  *int       `json:"expected_minutes"`
+	ExpectedBy       *time.Time `json:"expected_by"`
+	ArrivedAt        *time.Time `json:"arrived_at"`
+	OverdueAlertedAt *time.Time `json:"overdue_alerted_at"`
+	LastPingAt       *time.Time `json:"last_ping_at"`
+	LastLat          *float64   `json:"last_lat"`
+	LastLong         *float64   `json:"last_long"`
+}
+
+// CommutePing is a position the app posts while commute mode is on
+type CommutePing struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	AccuracyM *float64 `json:"accuracy_m"`
+}
+
+// CommuteStatus is what the app needs to run commute mode: the trainee's
+// settings and today's trip, if a trip is possible today
+type CommuteStatus struct {
+	Settings CommuteSettings `json:"settings"`
+	Today    *CommuteTrip    `json:"today"`
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// AttendanceCorrection is a request to fix a trainee's attendance. Kind is
+// missing_check_in, missing_check_out, wrong_time or wrong_location and
+// EventType says which end of the session it changes. Status moves from
+// pending to approved or rejected.
+type AttendanceCorrection struct {
+	ID        int    `json:"id"`
+	StudentID int    `json:"student_id"`
+	SessionID *int   `json:"session_id"`
+	Kind      string `json:"kind"`
+	EventType string `json:"event_type"`
+	// RequestedTime is the corrected check-in or check-out time.
+	// RequestedEndTime is only used for a missing check-in with no session,
+	// to record the whole session at once.
+	RequestedTime      *time.Time `json:"requested_time"`
+	RequestedEndTime   *time.Time `json:"requested_end_time"`
+	Latitude           *float64   `json:"latitude"`
+	Longitude          *float64   `json:"longitude"`
+	Reason             string     `json:"reason"`
+	Status             string     `json:"status"`
+	SubmittedByStudent *int       `json:"submitted_by_student"`
+	SubmittedByStaff   *int       `json:"submitted_by_staff"`
+	DecidedBy          *int       `json:"decided_by"`
+	DecidedAt          *time.Time `json:"decided_at"`
+	DecisionNote       string     `json:"decision_note"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
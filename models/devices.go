@@ -2,11 +2,16 @@ package models
 
 import "time"
 
+// AuthorizedDevice is a trainee phone paired through OTP validation. The
+// device secret itself is never stored or returned, only its hash.
 type AuthorizedDevice struct {
-	ID         uint      `json:"id"`
-	StudentID  int       `json:"student_id"`
-	SecretCode string    `json:"secret_code"`
-	CreatedAt  time.Time `json:"created_at"`
+	ID         uint       `json:"id"`
+	StudentID  int        `json:"student_id"`
+	DeviceName string     `json:"device_name"`
+	Platform   string     `json:"platform"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
 }
 
 func (AuthorizedDevice) TableName() string {
@@ -17,3 +22,16 @@ type AuthRequest struct {
 	StudentID  int    `json:"student_id"`
 	SecretCode string `json:"secret_code"`
 }
+
+// DeviceEnrollment describes the device being paired during OTP validation
+type DeviceEnrollment struct {
+	DeviceName string `json:"device_name"`
+	Platform   string `json:"platform"`
+}
+
+// DeviceAuthResponse is returned by /verify-device-auth
+type DeviceAuthResponse struct {
+	Authorized bool `json:"authorized"`
+	DeviceID   int  `json:"device_id,omitempty"`
+	*SessionTokens
+}
@@ -13,6 +13,6 @@ type EmployeeModel struct {
 	EmployerAddress *string    `json:"employer_address,omitempty"`
 	SupervisorID    *int       `json:"supervisor_id,omitempty"`
 	SupervisorName  *string    `json:"supervisor_name,omitempty"`
-	LatestOTPCode   *string    `json:"latest_otp_code,omitempty"`
+	OTPActive       bool       `json:"otp_active"`
 	ExpiresAt       *time.Time `json:"expires_at,omitempty"`
 }
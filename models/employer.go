@@ -1,5 +1,7 @@
 package models
 
+import "time"
+
 // student id dropped
 type Employer struct {
 	ID            uint    `json:"id"`
@@ -10,4 +12,33 @@ type Employer struct {
 	AddressLine3  string  `json:"address_line3,omitempty"`
 	Longitude     float64 `json:"addr_long"`
 	Latitude      float64 `json:"addr_lat"`
+	Timezone      *string `json:"timezone"`
+	// GeofenceRadiusM and GeofencePolicy (reject, flag or silent) override
+	// the server defaults when set
+	GeofenceRadiusM *int    `json:"geofence_radius_m"`
+	GeofencePolicy  *string `json:"geofence_policy"`
+	// MaxBreakMinutes (0 turns off overrun alerts) and PaidBreakMinutes
+	// override the server's break rules when set
+	MaxBreakMinutes  *int `json:"max_break_minutes"`
+	PaidBreakMinutes *int `json:"paid_break_minutes"`
+	// ArchivedAt is set once the employer was deleted while it still had
+	// placement history. Archived employers cannot take new trainees.
+	ArchivedAt *time.Time `json:"archived_at"`
+	Geocoding  Geocoding  `json:"geocoding"`
+}
+
+// EmployerInput is the body of creating or updating an employer
+type EmployerInput struct {
+	Name             string  `json:"name"`
+	ContactNumber    string  `json:"contact_number"`
+	AddressLine1     string  `json:"address_line1"`
+	AddressLine2     string  `json:"address_line2"`
+	AddressLine3     string  `json:"address_line3"`
+	Longitude        float64 `json:"addr_long"`
+	Latitude         float64 `json:"addr_lat"`
+	Timezone         *string `json:"timezone"`
+	GeofenceRadiusM  *int    `json:"geofence_radius_m"`
+	GeofencePolicy   *string `json:"geofence_policy"`
+	MaxBreakMinutes  *int    `json:"max_break_minutes"`
+	PaidBreakMinutes *int    `json:"paid_break_minutes"`
 }
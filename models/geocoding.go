@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// Geocoding is what the geocoder made of a record's address and how the
+// stored coordinates relate to it. Source is geocoded when the coordinates
+// came from the geocoder, manual when they were typed in and confirmed once
+// staff have checked them. MismatchM is set when typed coordinates are
+// further than the allowed distance from the geocoded address.
+type Geocoding struct {
+	Latitude    *float64   `json:"latitude"`
+	Longitude   *float64   `json:"longitude"`
+	Confidence  *float64   `json:"confidence"`
+	Provider    string     `json:"provider"`
+	GeocodedAt  *time.Time `json:"geocoded_at"`
+	Source      string     `json:"source"`
+	MismatchM   *int       `json:"mismatch_m"`
+	ConfirmedBy *int       `json:"confirmed_by"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+	// NeedsReview is set while a mismatch or a low confidence result has
+	// not been confirmed
+	NeedsReview bool `json:"needs_review"`
+}
+
+// LocationConfirmation settles a record's coordinates. Use is geocoded to
+// take the geocoder's position or current to keep the stored one; passing
+// Latitude and Longitude instead overrides both.
+type LocationConfirmation struct {
+	Use       string   `json:"use"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+}
+
+// LocationReview is an employer or trainee whose coordinates need checking
+type LocationReview struct {
+	Kind      string    `json:"kind"`
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Address   string    `json:"address"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Geocoding Geocoding `json:"geocoding"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// HistoryEntry is one row of a trainee's attendance history: either a work
+// session or a day they were marked absent. At is the check-in (or the
+// check-out of an orphan checkout) for sessions and the scheduled start for
+// absences.
+type HistoryEntry struct {
+	Type              string     `json:"type"`
+	ID                int        `json:"id"`
+	StudentID         int        `json:"student_id"`
+	FirstName         string     `json:"first_name"`
+	LastName          string     `json:"last_name"`
+	EmployerID        *int       `json:"employer_id"`
+	SupervisorID      *int       `json:"supervisor_id"`
+	At                time.Time  `json:"at"`
+	CheckInDateTime   *time.Time `json:"check_in_date_time,omitempty"`
+	CheckOutDateTime  *time.Time `json:"check_out_date_time,omitempty"`
+	LateMinutes       *int       `json:"late_minutes,omitempty"`
+	EarlyLeaveMinutes *int       `json:"early_leave_minutes,omitempty"`
+	BreakMinutes      *int       `json:"break_minutes,omitempty"`
+	CheckInGeofence   *string    `json:"check_in_geofence,omitempty"`
+	CheckOutGeofence  *string    `json:"check_out_geofence,omitempty"`
+	AbsenceDate       *string    `json:"absence_date,omitempty"`
+	Excused           *string    `json:"excused,omitempty"`
+	// Statuses lists every status filter the entry matches, e.g. late and
+	// off_site
+	Statuses []string `json:"statuses"`
+}
+
+// HistoryPage is one page of attendance history. NextCursor is passed back
+// as ?cursor= to fetch the following page and is empty on the last one.
+type HistoryPage struct {
+	Items      []HistoryEntry `json:"items"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// JobAction is something a background job did to a trainee's attendance,
+// such as recording an absence or closing a forgotten session
+type JobAction struct {
+	ID           int        `json:"id"`
+	Job          string     `json:"job"`
+	Action       string     `json:"action"`
+	StudentID    int        `json:"student_id"`
+	FirstName    string     `json:"first_name"`
+	LastName     string     `json:"last_name"`
+	AttendanceID *int       `json:"attendance_id"`
+	AbsenceID    *int       `json:"absence_id"`
+	Detail       string     `json:"detail"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ReviewedBy   *int       `json:"reviewed_by"`
+	ReviewedAt   *time.Time `json:"reviewed_at"`
+	ReviewNote   string     `json:"review_note"`
+}
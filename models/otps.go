@@ -17,13 +17,19 @@ type OTP struct {
 // OTPRequest is used for OTP generation <@WEB DASHBOARD>
 type OTPRequest struct {
 	StudentID int `json:"student_id"`
+	// Delivery is "display" (default), "sms", "sms_guardian" or
+	// "email_supervisor"
+	Delivery string `json:"delivery"`
 }
 
-// OTPResponse is returned after OTP generation <@WEB DASHBOARD>
+// OTPResponse is returned after OTP generation <@WEB DASHBOARD>. The code is
+// only included when it is meant to be displayed.
 type OTPResponse struct {
 	StudentID int       `json:"student_id"`
-	OTPCode   string    `json:"otp_code"`
+	OTPCode   string    `json:"otp_code,omitempty"`
 	ExpiresAt time.Time `json:"expires_at"`
+	Delivery  string    `json:"delivery"`
+	SentTo    string    `json:"sent_to,omitempty"`
 }
 
 // OTPValidationRequest is used when validating OTP from a mobile app
@@ -36,5 +42,7 @@ type OTPValidationResponse struct {
 	Success    bool   `json:"success"`
 	StudentID  int    `json:"student_id"`
 	SecretCode string `json:"secret_code,omitempty"`
+	DeviceID   int    `json:"device_id,omitempty"`
 	Message    string `json:"message,omitempty"`
+	*SessionTokens
 }
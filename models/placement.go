@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Placement is a period a trainee spends with an employer, optionally at
+// one of its sites and under a supervisor. Dates are YYYY-MM-DD and
+// inclusive; EndDate is nil while the placement is open. Status is trial,
+// active or ended, with EndReason saying why it ended, or void for a
+// placement withdrawn on the day it started.
+type Placement struct {
+	ID           int       `json:"id"`
+	StudentID    int       `json:"student_id"`
+	EmployerID   int       `json:"employer_id"`
+	EmployerName string    `json:"employer_name"`
+	SiteID       *int      `json:"site_id"`
+	SupervisorID *int      `json:"supervisor_id"`
+	JobTitle     string    `json:"job_title"`
+	HoursPerWeek *float64  `json:"hours_per_week"`
+	Status       string    `json:"status"`
+	StartDate    string    `json:"start_date"`
+	EndDate      *string   `json:"end_date"`
+	EndReason    string    `json:"end_reason"`
+	CreatedBy    *int      `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// PlacementTransfer moves a trainee to a new placement starting on Date.
+// Fields left out carry over from the placement being ended.
+type PlacementTransfer struct {
+	Date         string   `json:"date"`
+	Reason       string   `json:"reason"`
+	EmployerID   *int     `json:"employer_id"`
+	SiteID       *int     `json:"site_id"`
+	SupervisorID *int     `json:"supervisor_id"`
+	JobTitle     *string  `json:"job_title"`
+	HoursPerWeek *float64 `json:"hours_per_week"`
+	Status       string   `json:"status"`
+}
+
+// PlacementEnd closes a placement after EndDate
+type PlacementEnd struct {
+	EndDate string `json:"end_date"`
+	Reason  string `json:"reason"`
+}
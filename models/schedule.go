@@ -0,0 +1,77 @@
+package models
+
+import "time"
+
+// WorkSchedule is a weekly working pattern for a trainee, valid from
+// EffectiveFrom until EffectiveTo (inclusive, open ended when nil). Dates are
+// YYYY-MM-DD in the trainee's timezone. A schedule belongs to the placement
+// it was set up for and only applies while the trainee is on it; EmployerID
+// follows the placement.
+type WorkSchedule struct {
+	ID            int             `json:"id"`
+	StudentID     int             `json:"student_id"`
+	PlacementID   *int            `json:"placement_id"`
+	EmployerID    *int            `json:"employer_id"`
+	Name          string          `json:"name"`
+	EffectiveFrom string          `json:"effective_from"`
+	EffectiveTo   *string         `json:"effective_to"`
+	Shifts        []ScheduleShift `json:"shifts"`
+}
+
+// ScheduleShift is one working window on a day of the week. Weekday is 0 for
+// Sunday through 6 for Saturday. An end time at or before the start time
+// finishes the next day.
+type ScheduleShift struct {
+	ID        int             `json:"id"`
+	Weekday   int             `json:"weekday"`
+	StartTime string          `json:"start_time"`
+	EndTime   string          `json:"end_time"`
+	Breaks    []ScheduleBreak `json:"breaks"`
+}
+
+// ScheduleBreak is a planned break within a shift
+type ScheduleBreak struct {
+	ID        int    `json:"id"`
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+}
+
+// ScheduleOverride replaces the weekly pattern on a single date, either with a
+// day off or with different hours
+type ScheduleOverride struct {
+	ID        int     `json:"id"`
+	StudentID int     `json:"student_id"`
+	Date      string  `json:"date"`
+	DayOff    bool    `json:"day_off"`
+	StartTime *string `json:"start_time"`
+	EndTime   *string `json:"end_time"`
+	Reason    string  `json:"reason"`
+}
+
+// DaySchedule is what a trainee is expected to work on one date. Source is
+// "override", "schedule", "legacy" (student.check_in_time/check_out_time),
+// "none", or "unplaced" when they have no placement that day. Excused is "holiday", "closure" or "leave" when the trainee does not
+// have to attend; Scheduled is then false but the shifts they would otherwise
+// work are still listed.
+type DaySchedule struct {
+	StudentID     int           `json:"student_id"`
+	Date          string        `json:"date"`
+	Scheduled     bool          `json:"scheduled"`
+	Source        string        `json:"source"`
+	Shifts        []ShiftWindow `json:"shifts"`
+	Excused       string        `json:"excused,omitempty"`
+	ExcusedReason string        `json:"excused_reason,omitempty"`
+}
+
+// ShiftWindow is a resolved shift on a specific date
+type ShiftWindow struct {
+	Start  time.Time     `json:"start"`
+	End    time.Time     `json:"end"`
+	Breaks []BreakWindow `json:"breaks"`
+}
+
+// BreakWindow is a resolved break on a specific date
+type BreakWindow struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
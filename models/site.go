@@ -0,0 +1,28 @@
+package models
+
+// GeoPoint is one corner of a geofence polygon
+type GeoPoint struct {
+	Lat  float64 `json:"lat"`
+	Long float64 `json:"long"`
+}
+
+// EmployerSite is a branch of an employer where trainees can be placed. A
+// site's geofence is GeofencePolygon when set, otherwise a circle of
+// GeofenceRadiusM (or the employer's radius) around its coordinates.
+type EmployerSite struct {
+	ID              int        `json:"id"`
+	EmployerID      int        `json:"employer_id"`
+	Name            string     `json:"name"`
+	AddressLine1    string     `json:"address_line1"`
+	AddressLine2    string     `json:"address_line2"`
+	City            string     `json:"city"`
+	Latitude        float64    `json:"addr_lat"`
+	Longitude       float64    `json:"addr_long"`
+	GeofenceRadiusM *int       `json:"geofence_radius_m"`
+	GeofencePolygon []GeoPoint `json:"geofence_polygon"`
+	ContactName     string     `json:"contact_name"`
+	ContactNumber   string     `json:"contact_number"`
+	ContactEmail    string     `json:"contact_email"`
+	// Trainees is how many trainees are placed at the site
+	Trainees int `json:"trainees"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// SiteToken is a signed code proving presence at a workplace. Method is qr
+// or nfc for printed codes and kiosk for the rotating code shown on a kiosk
+// page, which should be fetched again at RefreshAt. A code with a SiteID is
+// only accepted from trainees placed at that site.
+type SiteToken struct {
+	Token      string     `json:"token"`
+	EmployerID int        `json:"employer_id"`
+	SiteID     *int       `json:"site_id,omitempty"`
+	Method     string     `json:"method"`
+	NotBefore  time.Time  `json:"not_before"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	RefreshAt  *time.Time `json:"refresh_at,omitempty"`
+}
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// StaffAccount is a dashboard user: an admin, a supervisor (job coach) or an
+// employer contact
+type StaffAccount struct {
+	ID           int        `json:"id"`
+	Email        string     `json:"email"`
+	DisplayName  string     `json:"display_name"`
+	Role         string     `json:"role"`
+	SupervisorID *int       `json:"supervisor_id,omitempty"`
+	EmployerID   *int       `json:"employer_id,omitempty"`
+	IsActive     bool       `json:"is_active"`
+	LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// StaffAccountInput is used to create or update a staff account
+type StaffAccountInput struct {
+	Email        string `json:"email"`
+	DisplayName  string `json:"display_name"`
+	Role         string `json:"role"`
+	SupervisorID *int   `json:"supervisor_id"`
+	EmployerID   *int   `json:"employer_id"`
+	Password     string `json:"password,omitempty"`
+	IsActive     *bool  `json:"is_active,omitempty"`
+}
+
+// StaffLoginRequest is used for password login
+type StaffLoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// StaffCodeRequest asks for a login code to be emailed
+type StaffCodeRequest struct {
+	Email string `json:"email"`
+}
+
+// StaffCodeLoginRequest completes an email-code login
+type StaffCodeLoginRequest struct {
+	Email string `json:"email"`
+	Code  string `json:"code"`
+}
+
+// StaffLoginResponse is returned after a successful staff login
+type StaffLoginResponse struct {
+	Staff StaffAccount `json:"staff"`
+	*SessionTokens
+}
+
+// PasswordChangeRequest changes the caller's own password
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
@@ -20,6 +20,11 @@ type Student struct {
 	HomeLong              float64   `json:"home_long"`
 	HomeLat               float64   `json:"home_lat"`
 	EmployerID            *uint     `json:"employer_id"`
+	SiteID                *uint     `json:"site_id"`
 	CheckInTime           string    `json:"check_in_time"`
 	CheckOutTime          string    `json:"check_out_time"`
+	// Timezone overrides the employer/organisation timezone, e.g. "Asia/Colombo"
+	Timezone *string `json:"timezone"`
+	// Geocoding is filled in by the server from the address
+	Geocoding Geocoding `json:"geocoding"`
 }
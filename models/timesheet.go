@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Timesheet is one trainee's attendance for a calendar month, one row per
+// local day. Minutes are whole minutes.
+type Timesheet struct {
+	StudentID    int             `json:"student_id"`
+	FirstName    string          `json:"first_name"`
+	LastName     string          `json:"last_name"`
+	EmployerID   *int            `json:"employer_id"`
+	EmployerName string          `json:"employer_name"`
+	Month        string          `json:"month"`
+	Timezone     string          `json:"timezone"`
+	Days         []TimesheetDay  `json:"days"`
+	Totals       TimesheetTotals `json:"totals"`
+}
+
+// TimesheetDay is a single date. Status is worked, open (checked in but
+// never out), absent, excused, day_off or upcoming. CheckIn is the first
+// check-in and CheckOut the last check-out of the day. WorkedMinutes is net
+// of unpaid breaks; PaidBreakMinutes is the part of BreakMinutes included
+// in it. EmployerID is the employer of the placement on that date.
+type TimesheetDay struct {
+	Date              string     `json:"date"`
+	EmployerID        *int       `json:"employer_id,omitempty"`
+	EmployerName      string     `json:"employer_name,omitempty"`
+	Status            string     `json:"status"`
+	Excused           string     `json:"excused,omitempty"`
+	ExcusedReason     string     `json:"excused_reason,omitempty"`
+	ScheduledMinutes  int        `json:"scheduled_minutes"`
+	CheckIn           *time.Time `json:"check_in,omitempty"`
+	CheckOut          *time.Time `json:"check_out,omitempty"`
+	Sessions          int        `json:"sessions"`
+	WorkedMinutes     int        `json:"worked_minutes"`
+	BreakMinutes      int        `json:"break_minutes"`
+	PaidBreakMinutes  int        `json:"paid_break_minutes"`
+	LateMinutes       int        `json:"late_minutes"`
+	EarlyLeaveMinutes int        `json:"early_leave_minutes"`
+}
+
+// TimesheetTotals sums a timesheet's days
+type TimesheetTotals struct {
+	ScheduledMinutes  int `json:"scheduled_minutes"`
+	WorkedMinutes     int `json:"worked_minutes"`
+	BreakMinutes      int `json:"break_minutes"`
+	PaidBreakMinutes  int `json:"paid_break_minutes"`
+	LateMinutes       int `json:"late_minutes"`
+	LateDays          int `json:"late_days"`
+	EarlyLeaveMinutes int `json:"early_leave_minutes"`
+	DaysWorked        int `json:"days_worked"`
+	Absences          int `json:"absences"`
+	ExcusedDays       int `json:"excused_days"`
+}
@@ -1,51 +1,158 @@
 package routes
 
 import (
+	"net/http"
 	"server/controllers"
 
 	"github.com/gorilla/mux"
 )
 
+// staffOnly wraps a handler so only staff holding perm can reach it
+func staffOnly(perm controllers.Permission, h http.HandlerFunc) http.Handler {
+	return controllers.RequirePermission(perm)(h)
+}
+
 func RegisterStudentRoutes(router *mux.Router) {
-	router.HandleFunc("/get-students", controllers.GetStudents).Methods("GET")
+	// Trainee app routes. The student is identified by the session token
+	// issued from /validate-otp, never by a client supplied header.
+	trainee := router.NewRoute().Subrouter()
+	trainee.Use(controllers.RequireStudent)
+
+	trainee.HandleFunc("/attendance", controllers.PostAttendance).Methods("POST")
+	trainee.HandleFunc("/attendance/sync", controllers.SyncAttendance).Methods("POST")
+	trainee.HandleFunc("/commute/pings", controllers.PostCommutePing).Methods("POST")
+	trainee.HandleFunc("/post-mood", controllers.CreateMood).Methods("POST")
+	trainee.Handle("/validate-location", controllers.ValidateLocationHandler()).Methods("GET")
+	trainee.Handle("/validate-attendance", controllers.ValidateAttendanceHandler()).Methods("POST")
+
+	// Routes shared by trainees and staff. Trainees see their own data; staff
+	// pass a student-id header and are limited to the trainees they manage.
+	shared := router.NewRoute().Subrouter()
+	shared.Use(controllers.RequireAuth)
+
+	shared.HandleFunc("/get-student", controllers.GetStudent).Methods("GET")
+	shared.HandleFunc("/trainee-profile", controllers.GetTraineeProfile).Methods("GET")
+	shared.HandleFunc("/employee-summary", controllers.GetEmployeeSummary).Methods("GET")
+	shared.HandleFunc("/devices", controllers.ListDevices).Methods("GET")
+	shared.HandleFunc("/devices/{id}", controllers.RevokeDevice).Methods("DELETE")
+	shared.HandleFunc("/attendance-history", controllers.GetAttendanceHistory).Methods("GET")
+	shared.HandleFunc("/attendance-breaks", controllers.GetAttendanceBreaks).Methods("GET")
+	shared.HandleFunc("/attendance-corrections", controllers.GetCorrections).Methods("GET")
+	shared.HandleFunc("/attendance-corrections", controllers.CreateCorrection).Methods("POST")
+	shared.HandleFunc("/leave-requests", controllers.GetLeaveRequests).Methods("GET")
+	shared.HandleFunc("/leave-requests", controllers.CreateLeaveRequest).Methods("POST")
+	shared.HandleFunc("/holidays", controllers.GetHolidays).Methods("GET")
+	shared.HandleFunc("/schedules", controllers.GetSchedules).Methods("GET")
+	shared.HandleFunc("/schedules/day", controllers.GetDaySchedule).Methods("GET")
+	shared.HandleFunc("/schedule-overrides", controllers.GetScheduleOverrides).Methods("GET")
+	shared.HandleFunc("/commute", controllers.GetCommuteStatus).Methods("GET")
+	shared.HandleFunc("/commute/settings", controllers.UpdateCommuteSettings).Methods("PUT")
+	shared.HandleFunc("/placements", controllers.GetPlacements).Methods("GET")
+
+	// Staff login
+	router.HandleFunc("/staff/login", controllers.StaffLogin).Methods("POST")
+	router.HandleFunc("/staff/login/code", controllers.RequestStaffLoginCode).Methods("POST")
+	router.HandleFunc("/staff/login/verify", controllers.StaffCodeLogin).Methods("POST")
+	shared.HandleFunc("/staff/me", controllers.GetCurrentStaff).Methods("GET")
+	shared.HandleFunc("/staff/password", controllers.ChangeStaffPassword).Methods("PUT")
+
+	// Staff account management
+	router.Handle("/staff", staffOnly(controllers.PermManageStaff, controllers.GetStaffAccounts)).Methods("GET")
+	router.Handle("/staff", staffOnly(controllers.PermManageStaff, controllers.CreateStaffAccount)).Methods("POST")
+	router.Handle("/staff/{id}", staffOnly(controllers.PermManageStaff, controllers.UpdateStaffAccount)).Methods("PUT")
+	router.Handle("/staff/{id}", staffOnly(controllers.PermManageStaff, controllers.DeactivateStaffAccount)).Methods("DELETE")
+
+	router.Handle("/get-students", staffOnly(controllers.PermViewTrainees, controllers.GetStudents)).Methods("GET")
 	// router.HandleFunc("/post-student", controllers.CreateStudent).Methods("POST")
 	// RegisterEmployeeRoutes sets up the employee routes using Gorilla Mux
 
-	router.HandleFunc("/create-employee", controllers.CreateStudent).Methods("POST")
-	router.HandleFunc("/update-employee", controllers.UpdateStudent).Methods("PUT")
-	router.HandleFunc("/delete-employee", controllers.DeleteStudent).Methods("DELETE")
+	router.Handle("/create-employee", staffOnly(controllers.PermManageTrainees, controllers.CreateStudent)).Methods("POST")
+	router.Handle("/update-employee", staffOnly(controllers.PermManageTrainees, controllers.UpdateStudent)).Methods("PUT")
+	router.Handle("/delete-employee", staffOnly(controllers.PermDeleteTrainees, controllers.DeleteStudent)).Methods("DELETE")
+
+	// Placements with an employer, site and supervisor over time
+	router.Handle("/placements", staffOnly(controllers.PermManageTrainees, controllers.StartPlacement)).Methods("POST")
+	router.Handle("/placements/{id}", staffOnly(controllers.PermManageTrainees, controllers.UpdatePlacement)).Methods("PUT")
+	router.Handle("/placements/{id}/transfer", staffOnly(controllers.PermManageTrainees, controllers.TransferPlacement)).Methods("POST")
+	router.Handle("/placements/{id}/end", staffOnly(controllers.PermManageTrainees, controllers.EndPlacement)).Methods("POST")
 
-	router.HandleFunc("/get-student", controllers.GetStudent).Methods("GET") // set to student
+	// Work schedules
+	router.Handle("/schedules", staffOnly(controllers.PermManageTrainees, controllers.CreateSchedule)).Methods("POST")
+	router.Handle("/schedules/{id}", staffOnly(controllers.PermManageTrainees, controllers.UpdateSchedule)).Methods("PUT")
+	router.Handle("/schedules/{id}", staffOnly(controllers.PermManageTrainees, controllers.DeleteSchedule)).Methods("DELETE")
+	router.Handle("/schedule-overrides", staffOnly(controllers.PermManageTrainees, controllers.SaveScheduleOverride)).Methods("PUT")
+	router.Handle("/schedule-overrides/{id}", staffOnly(controllers.PermManageTrainees, controllers.DeleteScheduleOverride)).Methods("DELETE")
 
 	//supervisor routes
-	router.HandleFunc("/get-supervisors", controllers.GetSupervisors).Methods("GET")
-	router.HandleFunc("/get-supervisor", controllers.GetSupervisor).Methods("GET")
-	router.HandleFunc("/create-supervisor", controllers.CreateSupervisor).Methods("POST")
-	router.HandleFunc("/update-supervisor", controllers.UpdateSupervisor).Methods("PUT")
-	router.HandleFunc("/delete-supervisor", controllers.DeleteSupervisor).Methods("DELETE")
+	router.Handle("/get-supervisors", staffOnly(controllers.PermViewDirectory, controllers.GetSupervisors)).Methods("GET")
+	router.Handle("/get-supervisor", staffOnly(controllers.PermManageSupervisors, controllers.GetSupervisor)).Methods("GET")
+	router.Handle("/create-supervisor", staffOnly(controllers.PermManageSupervisors, controllers.CreateSupervisor)).Methods("POST")
+	router.Handle("/update-supervisor", staffOnly(controllers.PermManageSupervisors, controllers.UpdateSupervisor)).Methods("PUT")
+	router.Handle("/delete-supervisor", staffOnly(controllers.PermManageSupervisors, controllers.DeleteSupervisor)).Methods("DELETE")
 
 	// employer routes
-	// TODO
-	// router.HandleFunc("/get-employers", controllers.GetEmployers).Methods("GET")
-	// router.HandleFunc("/get-employer", controllers.GetEmployer).Methods("GET")
-	// router.HandleFunc("/create-employer", controllers.CreateEmployer).Methods("POST")
-	// router.HandleFunc("/update-employer", controllers.UpdateEmployer).Methods("PUT")
-	// router.HandleFunc("/delete-employer", controllers.DeleteEmployer).Methods("DELETE")
+	router.Handle("/get-employers", staffOnly(controllers.PermViewDirectory, controllers.GetEmployers)).Methods("GET")
+	router.Handle("/get-employer", staffOnly(controllers.PermViewTrainees, controllers.GetEmployer)).Methods("GET")
+	router.Handle("/create-employer", staffOnly(controllers.PermManageEmployers, controllers.CreateEmployer)).Methods("POST")
+	router.Handle("/update-employer", staffOnly(controllers.PermManageEmployers, controllers.UpdateEmployer)).Methods("PUT")
+	router.Handle("/delete-employer", staffOnly(controllers.PermManageEmployers, controllers.DeleteEmployer)).Methods("DELETE")
 
-	// Add attendance routes
-	router.HandleFunc("/attendance", controllers.PostAttendance).Methods("POST")
+	// Geocoded locations awaiting a check, and confirming them
+	router.Handle("/location-reviews", staffOnly(controllers.PermViewTrainees, controllers.GetLocationReviews)).Methods("GET")
+	router.Handle("/employer-location", staffOnly(controllers.PermManageEmployers, controllers.ConfirmEmployerLocation)).Methods("PUT")
+	router.Handle("/employee-location", staffOnly(controllers.PermManageTrainees, controllers.ConfirmStudentLocation)).Methods("PUT")
 
 	// Add mood routes
-	router.HandleFunc("/post-mood", controllers.CreateMood).Methods("POST")
-	router.HandleFunc("/get-mood", controllers.GetMoods).Methods("GET")
+	router.Handle("/get-mood", staffOnly(controllers.PermViewTrainees, controllers.GetMoods)).Methods("GET")
 
 	// Add card routes
-	router.HandleFunc("/dashboard", controllers.GetStudentDetails).Methods("GET")
+	router.Handle("/dashboard", staffOnly(controllers.PermViewTrainees, controllers.GetStudentDetails)).Methods("GET")
+
+	// Correction requests are decided by staff who manage the trainee
+	router.Handle("/attendance-corrections/{id}/approve", staffOnly(controllers.PermManageTrainees, controllers.ApproveCorrection)).Methods("PUT")
+	router.Handle("/attendance-corrections/{id}/reject", staffOnly(controllers.PermManageTrainees, controllers.RejectCorrection)).Methods("PUT")
+
+	router.Handle("/leave-requests/{id}/approve", staffOnly(controllers.PermManageTrainees, controllers.ApproveLeaveRequest)).Methods("PUT")
+	router.Handle("/leave-requests/{id}/reject", staffOnly(controllers.PermManageTrainees, controllers.RejectLeaveRequest)).Methods("PUT")
+
+	// Holiday calendar and employer closures
+	router.Handle("/holidays", staffOnly(controllers.PermManageCalendar, controllers.CreateHoliday)).Methods("POST")
+	router.Handle("/holidays/import", staffOnly(controllers.PermManageCalendar, controllers.ImportHolidays)).Methods("POST")
+	router.Handle("/holidays/{id}", staffOnly(controllers.PermManageCalendar, controllers.DeleteHoliday)).Methods("DELETE")
+	router.Handle("/employer-closures", staffOnly(controllers.PermViewTrainees, controllers.GetEmployerClosures)).Methods("GET")
+	router.Handle("/employer-closures", staffOnly(controllers.PermManageClosures, controllers.CreateEmployerClosure)).Methods("POST")
+	router.Handle("/employer-closures/{id}", staffOnly(controllers.PermManageClosures, controllers.DeleteEmployerClosure)).Methods("DELETE")
+
+	// Branches of an employer that trainees can be placed at
+	router.Handle("/employer-sites", staffOnly(controllers.PermViewTrainees, controllers.GetEmployerSites)).Methods("GET")
+	router.Handle("/employer-sites", staffOnly(controllers.PermManageSites, controllers.CreateEmployerSite)).Methods("POST")
+	router.Handle("/employer-sites/{id}", staffOnly(controllers.PermManageSites, controllers.UpdateEmployerSite)).Methods("PUT")
+	router.Handle("/employer-sites/{id}", staffOnly(controllers.PermManageSites, controllers.DeleteEmployerSite)).Methods("DELETE")
+
+	// Workplace codes for QR, NFC and kiosk check-in
+	router.Handle("/site-tokens", staffOnly(controllers.PermIssueSiteTokens, controllers.IssueSiteToken)).Methods("POST")
+	router.Handle("/site-tokens/kiosk", staffOnly(controllers.PermIssueSiteTokens, controllers.GetKioskToken)).Methods("GET")
+	router.Handle("/site-tokens/rotate", staffOnly(controllers.PermIssueSiteTokens, controllers.RotateSiteTokens)).Methods("POST")
+
+	// Absences, auto-closed sessions, break overruns and overdue commutes raised by the background jobs
+	router.Handle("/job-actions", staffOnly(controllers.PermViewTrainees, controllers.GetJobActions)).Methods("GET")
+	router.Handle("/job-actions/{id}/review", staffOnly(controllers.PermManageTrainees, controllers.ReviewJobAction)).Methods("PUT")
+
+	// Events that looked spoofed, queued for a supervisor to review
+	router.Handle("/attendance-anomalies", staffOnly(controllers.PermViewTrainees, controllers.GetAttendanceAnomalies)).Methods("GET")
+	router.Handle("/attendance-anomalies/{id}/review", staffOnly(controllers.PermManageTrainees, controllers.ReviewAttendanceAnomaly)).Methods("PUT")
+
+	// Monthly timesheets
+	router.Handle("/timesheets/export", staffOnly(controllers.PermViewTrainees, controllers.ExportTimesheets)).Methods("GET")
+
+	router.Handle("/employees", staffOnly(controllers.PermViewTrainees, controllers.GetEmployeeData)).Methods("GET")
+	router.Handle("/management", staffOnly(controllers.PermViewTrainees, controllers.GetManagementTable)).Methods("GET")
 
-	router.HandleFunc("/employees", controllers.GetEmployeeData).Methods("GET")
-	router.HandleFunc("/management", controllers.GetManagementTable).Methods("GET")
-	router.HandleFunc("/trainee-profile", controllers.GetTraineeProfile).Methods("GET")
+	// Messages captured by the fake SMS/email gateway, for local testing only
+	if controllers.FakeDeliveryEnabled() {
+		router.Handle("/dev/outbox", staffOnly(controllers.PermManageStaff, controllers.GetFakeOutbox)).Methods("GET")
+	}
 
-	router.HandleFunc("/get-supervisor-ids", controllers.GetAllSupervisorIDsAndNames).Methods("GET")
-	router.HandleFunc("/get-employer-ids", controllers.GetAllEmployerIDsAndNames).Methods("GET")
+	router.Handle("/get-supervisor-ids", staffOnly(controllers.PermViewDirectory, controllers.GetAllSupervisorIDsAndNames)).Methods("GET")
+	router.Handle("/get-employer-ids", staffOnly(controllers.PermViewDirectory, controllers.GetAllEmployerIDsAndNames)).Methods("GET")
 }